@@ -7,11 +7,20 @@ type Buffer interface {
 	// Returns an error if the position is invalid.
 	Insert(line, col int, r rune) error
 
+	// InsertString inserts s at a given (line, col) position in one operation.
+	// Returns an error if the position is invalid.
+	InsertString(line, col int, s string) error
+
 	// Deletes a rune at a given (line, col) position.
 	// Deleting "at" (line, col) means deleting the char *before* it (like backspace).
 	// Returns an error if the position is invalid or at the start of the document.
 	Delete(line, col int) error
 
+	// DeleteRange deletes the text from (startLine, startCol) up to, but not
+	// including, (endLine, endCol). Columns are clamped to their line.
+	// Returns an error if either line is invalid or the end is before the start.
+	DeleteRange(startLine, startCol, endLine, endCol int) error
+
 	// GetLine returns the content of a single line.
 	// Returns an empty string if the line is out of bounds.
 	GetLine(line int) string
@@ -19,7 +28,18 @@ type Buffer interface {
 	// LineCount returns the total number of lines in the buffer.
 	LineCount() int
 
+	// Length returns the total number of runes in the buffer, newlines included.
+	Length() int
+
+	// Version returns a counter that increases monotonically on every mutation.
+	// It does not change on reads.
+	Version() int
+
 	// WriteTo writes the entire contents of the buffer to an io.Writer.
 	// Returns the number of bytes written and any error encountered.
 	WriteTo(w io.Writer) (int64, error)
+
+	// NewReader returns a reader over the same bytes WriteTo writes.
+	// The buffer must not be modified while the reader is in use.
+	NewReader() io.Reader
 }
@@ -8,6 +8,7 @@ import (
 	"io"
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 // Constants for node size, controlling performance and tree balance.
@@ -24,9 +25,16 @@ const (
 // and deletions. The rope maintains a line index for fast line-based operations.
 type Rope struct {
 	root       *node
-	lineStarts []int // Stores the rune-offset (index) of the *start* of each line.
+	lineStarts []int  // Stores the rune-offset (index) of the *start* of each line.
+	version    int    // Bumped on every successful mutation.
+	owner      *owner // Tags the nodes this rope may change in place.
 }
 
+// owner marks which rope a node belongs to. A rope changes its own nodes in
+// place and copies any other node before changing it, so ropes that share
+// nodes after Snapshot never see each other's edits.
+type owner struct{ _ byte }
+
 // node is a node in the rope's binary tree.
 // Internal nodes have nil data and store the weight (length) of the left subtree.
 // Leaf nodes have non-nil data containing the actual text runes.
@@ -34,6 +42,7 @@ type node struct {
 	left, right *node
 	weight      int    // Length (in runes) of the *left* subtree
 	data        []rune // nil for internal nodes, non-nil for leaves
+	owner       *owner // The rope allowed to change this node in place
 }
 
 // Statically check that *Rope implements the Buffer interface.
@@ -45,6 +54,20 @@ func (n *node) isLeaf() bool {
 	return n.data != nil
 }
 
+// writable returns n if o may change it in place, or else a copy of n, with
+// its own copy of the leaf data, that o owns.
+func (n *node) writable(o *owner) *node {
+	if n.owner == o {
+		return n
+	}
+	c := *n
+	c.owner = o
+	if n.data != nil {
+		c.data = append(make([]rune, 0, len(n.data)), n.data...)
+	}
+	return &c
+}
+
 func (n *node) length() int {
 	if n.isLeaf() {
 		return len(n.data)
@@ -62,13 +85,32 @@ func (n *node) length() int {
 // If the text is empty, an empty rope is created.
 // The line index is automatically built during initialization.
 func NewRope(initialText string) *Rope {
+	o := &owner{}
 	r := &Rope{
-		root: &node{data: []rune(initialText)},
+		root:  buildNode([]rune(initialText), o),
+		owner: o,
 	}
 	r.rebuildLineIndex()
 	return r
 }
 
+// buildNode builds a perfectly balanced subtree whose leaves hold at most
+// maxLeafSize runes each. The runes are copied, so the caller keeps ownership.
+func buildNode(runes []rune, o *owner) *node {
+	if len(runes) <= maxLeafSize {
+		data := make([]rune, len(runes))
+		copy(data, runes)
+		return &node{data: data, owner: o}
+	}
+	mid := len(runes) / 2
+	return &node{
+		left:   buildNode(runes[:mid], o),
+		right:  buildNode(runes[mid:], o),
+		weight: mid,
+		owner:  o,
+	}
+}
+
 // rebuildLineIndex scans the entire rope and rebuilds the line index.
 // This is O(N) and should only be called during initialization.
 // It uses an efficient in-order traversal to find all newline characters.
@@ -89,14 +131,15 @@ func (r *Rope) rebuildLineIndex() {
 // if it becomes too unbalanced. Time complexity: O(log N).
 func (r *Rope) Insert(line, col int, ru rune) error {
 	if r.root == nil {
-		r.root = &node{data: []rune{}}
+		r.root = &node{data: []rune{}, owner: r.owner}
 	}
 	index, err := r.getIndex(line, col)
 	if err != nil {
 		return fmt.Errorf("invalid position (line %d, col %d): %w", line, col, err)
 	}
-	r.root = r.root.insert(index, ru)
+	r.root = r.root.insert(index, ru, r.owner)
 	r.updateLineIndexOnInsert(index, ru)
+	r.version++
 
 	// Periodically rebalance if tree becomes too unbalanced
 	if r.shouldRebalance() {
@@ -105,6 +148,32 @@ func (r *Rope) Insert(line, col int, ru rune) error {
 	return nil
 }
 
+// InsertString inserts s at a given (line, col) position. The runes are
+// spliced in with a single walk of the tree, and the line index is rebuilt
+// only for the inserted text. Time complexity: O(log N + K + L), where K
+// is the length of s and L the number of lines after the insertion point.
+func (r *Rope) InsertString(line, col int, s string) error {
+	if r.root == nil {
+		r.root = &node{data: []rune{}, owner: r.owner}
+	}
+	index, err := r.getIndex(line, col)
+	if err != nil {
+		return fmt.Errorf("invalid position (line %d, col %d): %w", line, col, err)
+	}
+	runes := []rune(s)
+	if len(runes) == 0 {
+		return nil
+	}
+	r.root = r.root.insertRunes(index, runes, r.owner)
+	r.rebuildLineIndexRange(index, index, index+len(runes))
+	r.version++
+
+	if r.shouldRebalance() {
+		r.rebalance()
+	}
+	return nil
+}
+
 // Delete deletes a rune at a given (line, col) position.
 // Deleting "at" (line, col) means deleting the char *before* it (like backspace).
 // Returns an error if the position is invalid or at the start of the document.
@@ -135,8 +204,9 @@ func (r *Rope) Delete(line, col int) error {
 		return fmt.Errorf("failed to get rune at delete position: %w", err)
 	}
 
-	r.root = r.root.delete(deleteIndex)
+	r.root = r.root.delete(deleteIndex, r.owner)
 	r.updateLineIndexOnDelete(deleteIndex, ru)
+	r.version++
 
 	// Periodically rebalance if tree becomes too unbalanced
 	if r.shouldRebalance() {
@@ -145,6 +215,39 @@ func (r *Rope) Delete(line, col int) error {
 	return nil
 }
 
+// DeleteRange deletes the runes from (startLine, startCol) up to, but not
+// including, (endLine, endCol) in a single walk of the tree, then fixes up
+// the line index once. Columns are clamped to their line, so a range ending
+// past the end of a line stops before its newline.
+// Time complexity: O(log N + K + L), where K is the number of leaves touched
+// and L the number of lines after the range.
+func (r *Rope) DeleteRange(startLine, startCol, endLine, endCol int) error {
+	start, err := r.getIndex(startLine, startCol)
+	if err != nil {
+		return fmt.Errorf("invalid start (line %d, col %d): %w", startLine, startCol, err)
+	}
+	end, err := r.getIndex(endLine, endCol)
+	if err != nil {
+		return fmt.Errorf("invalid end (line %d, col %d): %w", endLine, endCol, err)
+	}
+	if end < start {
+		return fmt.Errorf("range end (line %d, col %d) is before its start (line %d, col %d)",
+			endLine, endCol, startLine, startCol)
+	}
+	if start == end {
+		return nil
+	}
+
+	r.root = r.root.deleteRange(start, end, r.owner)
+	r.rebuildLineIndexRange(start, end, start)
+	r.version++
+
+	if r.shouldRebalance() {
+		r.rebalance()
+	}
+	return nil
+}
+
 // GetLine returns the content of a single line as a string.
 // The line number is 0-indexed. Returns an empty string if the line is out of bounds.
 // This method is optimized to O(log N + K) where K is the line length, using efficient
@@ -192,6 +295,15 @@ func (r *Rope) LineCount() int {
 	return len(r.lineStarts)
 }
 
+// Length returns the total number of runes in the buffer, newlines included.
+// Time complexity: O(log N), the depth of the tree's right spine.
+func (r *Rope) Length() int {
+	if r.root == nil {
+		return 0
+	}
+	return r.root.length()
+}
+
 // WriteTo writes the entire contents of the buffer to an io.Writer.
 // This is optimized to write directly during tree traversal, avoiding
 // large string allocations. Time complexity: O(N).
@@ -202,6 +314,37 @@ func (r *Rope) WriteTo(w io.Writer) (int64, error) {
 	return r.root.writeTo(w)
 }
 
+// NewReader returns a reader that yields the buffer's contents as UTF-8, the
+// same bytes WriteTo writes. It walks the leaves in order as it is read, so the
+// whole text is never held as one string. The rope must not be modified while
+// the reader is in use. Time complexity: O(N) over all reads, O(log N) space.
+func (r *Rope) NewReader() io.Reader {
+	rd := &ropeReader{}
+	rd.pushLeft(r.root)
+	return rd
+}
+
+// Snapshot returns a copy of the rope that later edits to either rope do not
+// affect. The two ropes share the whole tree; only the line index is copied,
+// and a node is copied the first time either rope changes it, so taking a
+// snapshot is O(L) for L lines and an edit copies at most one path.
+func (r *Rope) Snapshot() *Rope {
+	r.owner = &owner{}
+	return &Rope{
+		root:       r.root,
+		lineStarts: append([]int(nil), r.lineStarts...),
+		version:    r.version,
+		owner:      &owner{},
+	}
+}
+
+// Version returns a counter that increases with every successful Insert or Delete.
+// Reads never change it, so callers can cache derived data and compare versions
+// to know when it is stale. Time complexity: O(1).
+func (r *Rope) Version() int {
+	return r.version
+}
+
 // --- Rope-Specific Public Methods ---
 
 // RuneAt finds the rune at a specific *global* rune offset (index).
@@ -218,6 +361,84 @@ func (r *Rope) RuneAt(index int) (rune, error) {
 	return r.root.runeAt(index)
 }
 
+// ForEachRune calls fn with the global index and value of every rune from
+// start to the end of the buffer, in order, until fn returns false. It walks
+// the leaves directly, so reading the whole buffer allocates nothing. A
+// negative start begins at 0. Time complexity: O(log N + K) for K runes visited.
+func (r *Rope) ForEachRune(start int, fn func(index int, r rune) bool) {
+	if r.root == nil {
+		return
+	}
+	r.root.forEachRune(max(start, 0), 0, fn)
+}
+
+// IndexToLineCol converts a *global* rune offset (index) to a 0-indexed (line, col) pair.
+// It is the inverse of the (line, col) to index conversion used by Insert and Delete.
+// An index on a newline rune maps to the end of the line it terminates, and the index
+// one past the last rune maps to the end of the last line. Out-of-range indexes are
+// clamped to the document bounds. Time complexity: O(log L) where L is the line count.
+func (r *Rope) IndexToLineCol(index int) (line, col int) {
+	if r.root == nil || len(r.lineStarts) == 0 {
+		return 0, 0
+	}
+	if index < 0 {
+		index = 0
+	}
+	if length := r.root.length(); index > length {
+		index = length
+	}
+	line = r.findLine(index)
+	return line, index - r.lineStarts[line]
+}
+
+// OffsetToLineCol converts a *byte* offset into the UTF-8 text, as written by
+// WriteTo, to a 0-indexed (line, col) pair with col counted in runes. An offset
+// inside a multi-byte rune maps to that rune, and out-of-range offsets are
+// clamped like IndexToLineCol. Time complexity: O(K) for the K runes before offset.
+func (r *Rope) OffsetToLineCol(offset int) (line, col int) {
+	index := 0
+	bytes := 0
+	r.ForEachRune(0, func(i int, ru rune) bool {
+		size := runeLen(ru)
+		if bytes+size > offset {
+			return false
+		}
+		bytes += size
+		index = i + 1
+		return true
+	})
+	return r.IndexToLineCol(index)
+}
+
+// LineColToOffset converts a 0-indexed (line, col) pair to a *byte* offset into
+// the UTF-8 text, as written by WriteTo. The column is clamped to its line, as
+// in Insert. Returns an error if the line is out of bounds.
+// Time complexity: O(K) for the K runes before the position.
+func (r *Rope) LineColToOffset(line, col int) (int, error) {
+	index, err := r.getIndex(line, col)
+	if err != nil {
+		return 0, fmt.Errorf("invalid position (line %d, col %d): %w", line, col, err)
+	}
+	bytes := 0
+	r.ForEachRune(0, func(i int, ru rune) bool {
+		if i >= index {
+			return false
+		}
+		bytes += runeLen(ru)
+		return true
+	})
+	return bytes, nil
+}
+
+// runeLen is the number of bytes ru takes in the text WriteTo produces. A rune
+// that is not valid UTF-8 is written as utf8.RuneError.
+func runeLen(ru rune) int {
+	if size := utf8.RuneLen(ru); size > 0 {
+		return size
+	}
+	return utf8.RuneLen(utf8.RuneError)
+}
+
 // --- Internal Helper Methods ---
 
 // getIndex converts a (line, col) pair to a *global* rune offset (index).
@@ -276,7 +497,10 @@ func (n *node) runeAt(index int) (rune, error) {
 	}
 }
 
-func (n *node) insert(index int, ru rune) *node {
+// insert is the recursive helper for Insert. Like the other mutation helpers
+// it changes only nodes owned by o, copying shared ones on the way down.
+func (n *node) insert(index int, ru rune, o *owner) *node {
+	n = n.writable(o)
 	if n.isLeaf() {
 		n.data = append(n.data[:index], append([]rune{ru}, n.data[index:]...)...)
 		if len(n.data) > maxLeafSize {
@@ -286,38 +510,66 @@ func (n *node) insert(index int, ru rune) *node {
 			copy(leftData, n.data[:mid])
 			rightData := make([]rune, len(n.data)-mid)
 			copy(rightData, n.data[mid:])
-			newLeftLeaf := &node{data: leftData}
-			newRightLeaf := &node{data: rightData}
+			newLeftLeaf := &node{data: leftData, owner: o}
+			newRightLeaf := &node{data: rightData, owner: o}
 			return &node{
 				left:   newLeftLeaf,
 				right:  newRightLeaf,
 				weight: len(newLeftLeaf.data),
+				owner:  o,
 			}
 		}
 		return n
 	}
 
 	if index < n.weight {
-		n.left = n.left.insert(index, ru)
+		n.left = n.left.insert(index, ru, o)
 		n.weight++
 	} else {
-		n.right = n.right.insert(index-n.weight, ru)
+		n.right = n.right.insert(index-n.weight, ru, o)
 	}
-	return n
+	return n.balance(o)
+}
+
+// insertRunes is the recursive helper for InsertString. A leaf that would
+// outgrow maxLeafSize is replaced by a balanced subtree of its new content.
+func (n *node) insertRunes(index int, runes []rune, o *owner) *node {
+	if n.isLeaf() {
+		if len(n.data)+len(runes) <= maxLeafSize {
+			n = n.writable(o)
+			n.data = append(n.data[:index], append(append([]rune{}, runes...), n.data[index:]...)...)
+			return n
+		}
+		combined := make([]rune, 0, len(n.data)+len(runes))
+		combined = append(combined, n.data[:index]...)
+		combined = append(combined, runes...)
+		combined = append(combined, n.data[index:]...)
+		return buildNode(combined, o)
+	}
+
+	n = n.writable(o)
+	if index < n.weight {
+		n.left = n.left.insertRunes(index, runes, o)
+		n.weight += len(runes)
+	} else {
+		n.right = n.right.insertRunes(index-n.weight, runes, o)
+	}
+	return n.balance(o)
 }
 
 // delete is the recursive helper for node deletion.
-func (n *node) delete(index int) *node {
+func (n *node) delete(index int, o *owner) *node {
+	n = n.writable(o)
 	if n.isLeaf() {
 		n.data = append(n.data[:index], n.data[index+1:]...)
-		return n // Node merging logic would go here
+		return n // The parent merges it with a sibling if it got too small
 	}
 
 	if index < n.weight {
-		n.left = n.left.delete(index)
+		n.left = n.left.delete(index, o)
 		n.weight--
 	} else {
-		n.right = n.right.delete(index - n.weight)
+		n.right = n.right.delete(index-n.weight, o)
 	}
 
 	// Optional: Add logic to merge nodes if children become too small or empty
@@ -330,9 +582,76 @@ func (n *node) delete(index int) *node {
 		return n.left
 	}
 
+	return n.mergeLeaves(o).balance(o)
+}
+
+// deleteRange is the recursive helper for DeleteRange. It removes the runes
+// in [start, end), relative to this node, and skips subtrees outside it.
+func (n *node) deleteRange(start, end int, o *owner) *node {
+	n = n.writable(o)
+	if n.isLeaf() {
+		n.data = append(n.data[:start], n.data[end:]...)
+		return n
+	}
+
+	if start < n.weight && n.left != nil {
+		leftEnd := min(end, n.weight)
+		n.left = n.left.deleteRange(start, leftEnd, o)
+		end -= leftEnd - start
+		n.weight -= leftEnd - start
+	}
+	if end > n.weight && n.right != nil {
+		n.right = n.right.deleteRange(max(start-n.weight, 0), end-n.weight, o)
+	}
+
+	if n.left != nil && n.left.length() == 0 {
+		return n.right
+	}
+	if n.right != nil && n.right.length() == 0 {
+		return n.left
+	}
+	return n.mergeLeaves(o).balance(o)
+}
+
+// mergeLeaves folds a leaf that fell below minLeafSize into the leaf next to
+// it, so deletions do not leave the tree full of tiny leaves. Two sibling
+// leaves collapse into their parent; a leaf beside a subtree joins that
+// subtree's nearest leaf, and the subtree takes the parent's place. Nothing
+// is merged if the result would exceed maxLeafSize. n must be owned by o.
+func (n *node) mergeLeaves(o *owner) *node {
+	if n.isLeaf() || n.left == nil || n.right == nil {
+		return n
+	}
+	l, rt := n.left, n.right
+	switch {
+	case l.isLeaf() && rt.isLeaf():
+		if (len(l.data) < minLeafSize || len(rt.data) < minLeafSize) && len(l.data)+len(rt.data) <= maxLeafSize {
+			return &node{data: joinRunes(l.data, rt.data), owner: o}
+		}
+	case l.isLeaf() && len(l.data) < minLeafSize:
+		if rt.left != nil && rt.left.isLeaf() && len(l.data)+len(rt.left.data) <= maxLeafSize {
+			rt = rt.writable(o)
+			rt.left = &node{data: joinRunes(l.data, rt.left.data), owner: o}
+			rt.weight += len(l.data)
+			return rt
+		}
+	case rt.isLeaf() && len(rt.data) < minLeafSize:
+		if l.right != nil && l.right.isLeaf() && len(l.right.data)+len(rt.data) <= maxLeafSize {
+			l = l.writable(o)
+			l.right = &node{data: joinRunes(l.right.data, rt.data), owner: o}
+			return l
+		}
+	}
 	return n
 }
 
+// joinRunes returns a new slice holding a followed by b.
+func joinRunes(a, b []rune) []rune {
+	data := make([]rune, 0, len(a)+len(b))
+	data = append(data, a...)
+	return append(data, b...)
+}
+
 // toString is a recursive helper to convert the rope to a string.
 func (n *node) toString() string {
 	if n.isLeaf() {
@@ -403,6 +722,34 @@ func (r *Rope) updateLineIndexOnDelete(index int, ru rune) {
 	}
 }
 
+// rebuildLineIndexRange fixes up the lineStarts array after the runes that
+// were in [start, oldEnd) were replaced by the ones now in [start, newEnd).
+// The line starts inside the old runes are dropped, the ones after them
+// shift, and only the new runes are scanned for newlines, so a bulk edit
+// costs O(log N + K + L) for K new runes and L later lines instead of a full
+// rebuild.
+func (r *Rope) rebuildLineIndexRange(start, oldEnd, newEnd int) {
+	first := sort.SearchInts(r.lineStarts, start+1)
+	last := sort.SearchInts(r.lineStarts, oldEnd+1)
+	var added []int
+	if r.root != nil && newEnd > start {
+		r.root.forEachRune(start, 0, func(i int, ru rune) bool {
+			if i >= newEnd {
+				return false
+			}
+			if ru == '\n' {
+				added = append(added, i+1)
+			}
+			return true
+		})
+	}
+	rest := append(added, r.lineStarts[last:]...)
+	for i := len(added); i < len(rest); i++ {
+		rest[i] += newEnd - oldEnd
+	}
+	r.lineStarts = append(r.lineStarts[:first], rest...)
+}
+
 // --- Optimization Methods ---
 
 // slice extracts a substring from startIndex to endIndex (exclusive) efficiently.
@@ -476,6 +823,29 @@ func (n *node) rebuildLineIndexHelper(offset int, lineStarts *[]int) {
 	}
 }
 
+// forEachRune is the recursive helper for ForEachRune. offset is the global
+// index of the node's first rune; it reports whether fn asked to go on.
+func (n *node) forEachRune(start, offset int, fn func(int, rune) bool) bool {
+	if n.isLeaf() {
+		for i := max(start-offset, 0); i < len(n.data); i++ {
+			if !fn(offset+i, n.data[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if n.left != nil && start < offset+n.weight {
+		if !n.left.forEachRune(start, offset, fn) {
+			return false
+		}
+	}
+	if n.right != nil {
+		return n.right.forEachRune(start, offset+n.weight, fn)
+	}
+	return true
+}
+
 // writeTo writes the rope contents directly to an io.Writer during tree traversal.
 // This avoids creating large intermediate strings.
 func (n *node) writeTo(w io.Writer) (int64, error) {
@@ -502,6 +872,73 @@ func (n *node) writeTo(w io.Writer) (int64, error) {
 	return total, nil
 }
 
+// ropeReader is the io.Reader returned by NewReader. stack holds the nodes
+// still to visit, with the next leaf on top; a rune that did not fit in the
+// caller's slice is kept in pending for the next Read.
+type ropeReader struct {
+	stack   []*node
+	leaf    []rune // Runes of the current leaf not yet read
+	pending []byte // Tail of a rune split across two Reads
+	buf     [utf8.UTFMax]byte
+}
+
+// pushLeft pushes n and its chain of left children, so the leftmost leaf
+// below n ends up on top of the stack.
+func (rd *ropeReader) pushLeft(n *node) {
+	for n != nil {
+		rd.stack = append(rd.stack, n)
+		if n.isLeaf() {
+			return
+		}
+		n = n.left
+	}
+}
+
+// nextLeaf moves to the next leaf in order that has runes, reporting false
+// at the end.
+func (rd *ropeReader) nextLeaf() bool {
+	for len(rd.stack) > 0 {
+		n := rd.stack[len(rd.stack)-1]
+		rd.stack = rd.stack[:len(rd.stack)-1]
+		if n.isLeaf() {
+			if len(n.data) > 0 {
+				rd.leaf = n.data
+				return true
+			}
+			continue
+		}
+		rd.pushLeft(n.right)
+	}
+	return false
+}
+
+func (rd *ropeReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	n := copy(p, rd.pending)
+	rd.pending = rd.pending[n:]
+	for n < len(p) {
+		if len(rd.leaf) == 0 && !rd.nextLeaf() {
+			break
+		}
+		ru := rd.leaf[0]
+		rd.leaf = rd.leaf[1:]
+		if runeLen(ru) <= len(p)-n {
+			n += utf8.EncodeRune(p[n:], ru)
+			continue
+		}
+		size := utf8.EncodeRune(rd.buf[:], ru)
+		copied := copy(p[n:], rd.buf[:size])
+		rd.pending = rd.buf[copied:size]
+		n += copied
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
 // shouldRebalance checks if the rope tree is unbalanced and needs rebalancing.
 // A tree is considered unbalanced if the ratio of left/right subtree sizes
 // exceeds the rebalanceThreshold.
@@ -521,22 +958,66 @@ func (r *Rope) shouldRebalance() bool {
 	return ratio > rebalanceThreshold
 }
 
-// rebalance rebuilds the rope tree to ensure better balance.
-// This is done by converting the tree to a flat string and rebuilding it.
-// While this is O(N), it's only called when the tree becomes significantly unbalanced.
+// rebalance restores balance at the root using rotations.
+// Insert and delete already rebalance every node on their path, so this only
+// touches the top of the tree and never flattens it: O(log N) instead of O(N).
+// Rotations keep rune offsets intact, so lineStarts stays valid as-is and the
+// line index is deliberately not rebuilt here.
 func (r *Rope) rebalance() {
 	if r.root == nil {
 		return
 	}
+	r.root = r.root.balance(r.owner)
+}
 
-	// Convert to string and rebuild
-	var buf strings.Builder
-	r.root.writeTo(&buf)
-	content := buf.String()
+// balance performs a single or double rotation at n if one subtree outweighs
+// the other by more than rebalanceThreshold. Rune order, and therefore every
+// global offset, is unchanged by the rotation. Nodes that are not owned by o
+// are copied before they are rotated.
+func (n *node) balance(o *owner) *node {
+	if n.isLeaf() || n.left == nil || n.right == nil {
+		return n
+	}
+	leftLen := n.weight
+	rightLen := n.right.length()
+
+	if float64(leftLen) > rebalanceThreshold*float64(rightLen) && !n.left.isLeaf() {
+		n = n.writable(o)
+		l := n.left
+		if l.right.length() > l.weight && !l.right.isLeaf() {
+			n.left = l.rotateLeft(o)
+		}
+		return n.rotateRight(o)
+	}
+	if float64(rightLen) > rebalanceThreshold*float64(leftLen) && !n.right.isLeaf() {
+		n = n.writable(o)
+		rt := n.right
+		if rt.weight > rt.right.length() && !rt.left.isLeaf() {
+			n.right = rt.rotateRight(o)
+		}
+		return n.rotateLeft(o)
+	}
+	return n
+}
 
-	// Rebuild the tree
-	r.root = &node{data: []rune(content)}
-	r.rebuildLineIndex()
+// rotateLeft makes n's right child the new subtree root.
+func (n *node) rotateLeft(o *owner) *node {
+	n = n.writable(o)
+	pivot := n.right.writable(o)
+	n.right = pivot.left
+	pivot.left = n
+	pivot.weight += n.weight
+	return pivot
+}
+
+// rotateRight makes n's left child the new subtree root.
+func (n *node) rotateRight(o *owner) *node {
+	n = n.writable(o)
+	pivot := n.left.writable(o)
+	n.left = pivot.right
+	n.weight -= pivot.weight
+	pivot.right = n
+	return pivot
 }
 
 // Helper functions for min/max
@@ -2,8 +2,12 @@ package buffer
 
 import (
 	"bytes"
+	"io"
+	"slices"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestNewRope(t *testing.T) {
@@ -68,6 +72,77 @@ func TestRope_Insert(t *testing.T) {
 	}
 }
 
+func TestRope_InsertString(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  string
+		line     int
+		col      int
+		s        string
+		expected string
+	}{
+		{"into empty", "", 0, 0, "hello", "hello"},
+		{"at start", "world", 0, 0, "hello ", "hello world"},
+		{"middle", "held", 0, 2, "llo wor", "hello world"},
+		{"with newlines", "ad", 0, 1, "b\nc\n", "ab\nc\nd"},
+		{"at line start", "one\nthree", 1, 0, "two\n", "one\ntwo\nthree"},
+		{"at end", "one", 0, 3, "\ntwo\n", "one\ntwo\n"},
+		{"empty string", "one", 0, 1, "", "one"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRope(tt.initial)
+			if err := r.InsertString(tt.line, tt.col, tt.s); err != nil {
+				t.Fatalf("InsertString failed: %v", err)
+			}
+			var buf bytes.Buffer
+			r.WriteTo(&buf)
+			if buf.String() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, buf.String())
+			}
+			want := NewRope(tt.expected)
+			if r.LineCount() != want.LineCount() {
+				t.Fatalf("expected %d lines, got %d", want.LineCount(), r.LineCount())
+			}
+			for i := 0; i < want.LineCount(); i++ {
+				if r.GetLine(i) != want.GetLine(i) {
+					t.Errorf("line %d: expected %q, got %q", i, want.GetLine(i), r.GetLine(i))
+				}
+			}
+		})
+	}
+}
+
+func TestRope_InsertStringLarge(t *testing.T) {
+	base := strings.Repeat("0123456789\n", maxLeafSize/4)
+	paste := strings.Repeat("pasted line\n", maxLeafSize)
+	r := NewRope(base)
+	if err := r.InsertString(7, 3, paste); err != nil {
+		t.Fatalf("InsertString failed: %v", err)
+	}
+
+	expected := base[:7*11+3] + paste + base[7*11+3:]
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	if buf.String() != expected {
+		t.Fatal("content mismatch after a large insert")
+	}
+	got := append([]int(nil), r.lineStarts...)
+	r.rebuildLineIndex()
+	if len(got) != len(r.lineStarts) {
+		t.Fatalf("line index has %d entries, a rebuild has %d", len(got), len(r.lineStarts))
+	}
+	for i := range got {
+		if got[i] != r.lineStarts[i] {
+			t.Fatalf("line %d starts at %d, a rebuild says %d", i, got[i], r.lineStarts[i])
+		}
+	}
+	if d := depth(r.root); d > 20 {
+		t.Errorf("tree depth %d after a large insert, expected a balanced tree", d)
+	}
+}
+
 func TestRope_Delete(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -97,6 +172,134 @@ func TestRope_Delete(t *testing.T) {
 	}
 }
 
+func TestRope_DeleteRange(t *testing.T) {
+	tests := []struct {
+		name                                 string
+		initial                              string
+		startLine, startCol, endLine, endCol int
+		expected                             string
+	}{
+		{"same line", "hello world", 0, 2, 0, 7, "heorld"},
+		{"empty range", "hello", 0, 2, 0, 2, "hello"},
+		{"multi line", "line1\nline2\nline3", 0, 3, 2, 2, "linne3"},
+		{"whole lines", "a\nb\nc\nd", 1, 0, 3, 0, "a\nd"},
+		{"to EOF", "line1\nline2", 0, 4, 1, 5, "line"},
+		{"clamped end col", "line1\nline2", 1, 2, 1, 99, "line1\nli"},
+		{"whole buffer", "a\nb\nc", 0, 0, 2, 1, ""},
+		{"across CRLF", "ab\r\ncd\r\nef", 0, 2, 1, 0, "abcd\r\nef"},
+		{"into CRLF line", "ab\r\ncd\r\nef", 0, 1, 1, 1, "ad\r\nef"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRope(tt.initial)
+			if err := r.DeleteRange(tt.startLine, tt.startCol, tt.endLine, tt.endCol); err != nil {
+				t.Fatalf("DeleteRange failed: %v", err)
+			}
+			var buf bytes.Buffer
+			r.WriteTo(&buf)
+			if buf.String() != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, buf.String())
+			}
+			want := NewRope(tt.expected)
+			if r.LineCount() != want.LineCount() {
+				t.Fatalf("expected %d lines, got %d", want.LineCount(), r.LineCount())
+			}
+			for i := 0; i < want.LineCount(); i++ {
+				if r.GetLine(i) != want.GetLine(i) {
+					t.Errorf("line %d: expected %q, got %q", i, want.GetLine(i), r.GetLine(i))
+				}
+			}
+		})
+	}
+}
+
+func TestRope_RebuildLineIndexRange(t *testing.T) {
+	r := NewRope("alpha\nbeta\r\ngamma\ndelta")
+	text := "alpha\nbeta\r\ngamma\ndelta"
+	check := func(step string) {
+		t.Helper()
+		want := NewRope(text)
+		if r.LineCount() != want.LineCount() {
+			t.Fatalf("%s: %d lines, want %d", step, r.LineCount(), want.LineCount())
+		}
+		for i := 0; i < want.LineCount(); i++ {
+			if r.GetLine(i) != want.GetLine(i) {
+				t.Errorf("%s: line %d is %q, want %q", step, i, r.GetLine(i), want.GetLine(i))
+			}
+		}
+		if !slices.Equal(r.lineStarts, want.lineStarts) {
+			t.Errorf("%s: line starts %v, a rebuild gives %v", step, r.lineStarts, want.lineStarts)
+		}
+	}
+
+	r.InsertString(1, 2, "one\ntwo\r\n\nthree")
+	text = "alpha\nbeone\ntwo\r\n\nthreeta\r\ngamma\ndelta"
+	check("multi-line insert")
+
+	r.InsertString(6, 5, "\nend\n")
+	text += "\nend\n"
+	check("insert at the end")
+
+	r.DeleteRange(0, 3, 4, 2)
+	text = "alpreeta\r\ngamma\ndelta\nend\n"
+	check("multi-line delete")
+
+	r.DeleteRange(1, 0, 4, 0)
+	text = "alpreeta\r\n"
+	check("delete to the end")
+
+	r.DeleteRange(0, 0, 1, 0)
+	text = ""
+	check("delete everything")
+}
+
+func TestRope_DeleteRangeErrors(t *testing.T) {
+	r := NewRope("one\ntwo")
+	if err := r.DeleteRange(1, 0, 0, 1); err == nil {
+		t.Error("expected an error for a range ending before its start")
+	}
+	if err := r.DeleteRange(0, 0, 5, 0); err == nil {
+		t.Error("expected an error for an end line out of bounds")
+	}
+	if v := r.Version(); v != 0 {
+		t.Errorf("failed DeleteRange bumped the version to %d", v)
+	}
+}
+
+func TestRope_DeleteRangeAcrossLeaves(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; sb.Len() < maxLeafSize*8; i++ {
+		sb.WriteString(strings.Repeat(string(rune('a'+i%26)), i%70))
+		sb.WriteByte('\n')
+	}
+	text := sb.String()
+	r := NewRope(text)
+
+	startLine, startCol := r.IndexToLineCol(maxLeafSize / 2)
+	endLine, endCol := r.IndexToLineCol(maxLeafSize * 5)
+	if err := r.DeleteRange(startLine, startCol, endLine, endCol); err != nil {
+		t.Fatalf("DeleteRange failed: %v", err)
+	}
+
+	expected := text[:maxLeafSize/2] + text[maxLeafSize*5:]
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	if buf.String() != expected {
+		t.Fatal("content mismatch after deleting across leaves")
+	}
+	got := append([]int(nil), r.lineStarts...)
+	r.rebuildLineIndex()
+	if len(got) != len(r.lineStarts) {
+		t.Fatalf("line index has %d entries, a rebuild has %d", len(got), len(r.lineStarts))
+	}
+	for i := range got {
+		if got[i] != r.lineStarts[i] {
+			t.Fatalf("line %d starts at %d, a rebuild says %d", i, got[i], r.lineStarts[i])
+		}
+	}
+}
+
 func TestRope_GetLine(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -151,6 +354,42 @@ func TestRope_LineCount(t *testing.T) {
 	}
 }
 
+func TestRope_Length(t *testing.T) {
+	tests := []struct {
+		name     string
+		initial  string
+		expected int
+	}{
+		{"empty", "", 0},
+		{"single line", "hello", 5},
+		{"multiple lines", "line1\nline2\nline3", 17},
+		{"trailing newline", "line1\nline2\n", 12},
+		{"crlf", "a\r\nb", 4},
+		{"multi-byte runes", "héllo\n世界", 8},
+		{"spans leaves", strings.Repeat("abc\n", maxLeafSize), 4 * maxLeafSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRope(tt.initial)
+			if got := r.Length(); got != tt.expected {
+				t.Errorf("expected %d, got %d", tt.expected, got)
+			}
+		})
+	}
+
+	r := NewRope("ab\ncd")
+	r.InsertString(1, 2, "ef\ng")
+	r.Delete(0, 1)
+	r.DeleteRange(1, 0, 1, 1)
+	if got := r.Length(); got != 7 {
+		t.Errorf("after edits: expected 7, got %d", got)
+	}
+	if got := (&Rope{}).Length(); got != 0 {
+		t.Errorf("zero Rope: expected 0, got %d", got)
+	}
+}
+
 func TestRope_WriteTo(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -219,6 +458,262 @@ func TestRope_RuneAt(t *testing.T) {
 	}
 }
 
+func TestRope_ForEachRune(t *testing.T) {
+	text := strings.Repeat("héllo, 世界\n", maxLeafSize/4)
+	runes := []rune(text)
+	r := NewRope(text)
+
+	for _, start := range []int{0, 1, maxLeafSize - 1, maxLeafSize + 7, len(runes) - 1} {
+		next := start
+		r.ForEachRune(start, func(i int, ru rune) bool {
+			if i != next {
+				t.Fatalf("start %d: expected index %d, got %d", start, next, i)
+			}
+			if ru != runes[i] {
+				t.Fatalf("start %d: index %d: expected %q, got %q", start, i, runes[i], ru)
+			}
+			next++
+			return true
+		})
+		if next != len(runes) {
+			t.Errorf("start %d: stopped at %d, expected %d", start, next, len(runes))
+		}
+	}
+
+	calls := 0
+	r.ForEachRune(3, func(i int, ru rune) bool {
+		calls++
+		return ru != '\n'
+	})
+	if calls != 7 { // Runes 3 through 9, the first newline
+		t.Errorf("early stop: expected 7 calls, got %d", calls)
+	}
+
+	for _, start := range []int{len(runes), len(runes) + 10} {
+		r.ForEachRune(start, func(int, rune) bool {
+			t.Fatalf("start %d: fn called past the end", start)
+			return false
+		})
+	}
+	first := -1
+	r.ForEachRune(-5, func(i int, _ rune) bool {
+		first = i
+		return false
+	})
+	if first != 0 {
+		t.Errorf("negative start: expected to begin at 0, got %d", first)
+	}
+	NewRope("").ForEachRune(0, func(int, rune) bool {
+		t.Fatal("fn called on an empty rope")
+		return false
+	})
+}
+
+func TestRope_IndexToLineCol(t *testing.T) {
+	text := "ab\ncd\n\nef"
+	tests := []struct {
+		name     string
+		index    int
+		wantLine int
+		wantCol  int
+	}{
+		{"document start", 0, 0, 0},
+		{"middle of first line", 1, 0, 1},
+		{"newline rune", 2, 0, 2},
+		{"start of second line", 3, 1, 0},
+		{"second newline rune", 5, 1, 2},
+		{"empty line", 6, 2, 0},
+		{"start of last line", 7, 3, 0},
+		{"final position", 9, 3, 2},
+		{"past the end", 42, 3, 2},
+		{"negative index", -3, 0, 0},
+	}
+
+	r := NewRope(text)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line, col := r.IndexToLineCol(tt.index)
+			if line != tt.wantLine || col != tt.wantCol {
+				t.Errorf("IndexToLineCol(%d) = (%d, %d), expected (%d, %d)", tt.index, line, col, tt.wantLine, tt.wantCol)
+			}
+			if tt.index < 0 || tt.index > len(text) {
+				return
+			}
+			// Round-trip through getIndex
+			if index, err := r.getIndex(line, col); err != nil || index != tt.index {
+				t.Errorf("getIndex(%d, %d) = %d, %v; expected %d", line, col, index, err, tt.index)
+			}
+		})
+	}
+}
+
+func TestRope_ByteOffsets(t *testing.T) {
+	text := "aこb\nんにちは\r\n\nx😀y"
+	r := NewRope(text)
+
+	tests := []struct {
+		offset    int
+		line, col int
+	}{
+		{0, 0, 0},
+		{1, 0, 1},  // こ
+		{2, 0, 1},  // Inside こ
+		{4, 0, 2},  // b
+		{5, 0, 3},  // \n
+		{6, 1, 0},  // ん
+		{9, 1, 1},  // に
+		{13, 1, 2}, // Inside ち
+		{18, 1, 4}, // \r
+		{19, 1, 5}, // \n, after the line's last column
+		{20, 2, 0}, // Empty line
+		{21, 3, 0}, // x
+		{22, 3, 1}, // 😀
+		{24, 3, 1}, // Inside 😀
+		{26, 3, 2}, // y
+		{27, 3, 3}, // End of text
+		{99, 3, 3}, // Past the end, clamped
+		{-1, 0, 0}, // Before the start, clamped
+	}
+	for _, tt := range tests {
+		line, col := r.OffsetToLineCol(tt.offset)
+		if line != tt.line || col != tt.col {
+			t.Errorf("OffsetToLineCol(%d): expected (%d, %d), got (%d, %d)", tt.offset, tt.line, tt.col, line, col)
+		}
+	}
+
+	// Every rune start must round-trip, and agree with the string's own offsets.
+	for offset := range text {
+		line, col := r.OffsetToLineCol(offset)
+		got, err := r.LineColToOffset(line, col)
+		if err != nil {
+			t.Fatalf("LineColToOffset(%d, %d): %v", line, col, err)
+		}
+		if got != offset {
+			t.Errorf("byte %d maps to (%d, %d), which maps back to %d", offset, line, col, got)
+		}
+	}
+
+	if got, err := r.LineColToOffset(1, 99); err != nil || got != 19 {
+		t.Errorf("LineColToOffset clamps the column: expected 19, got %d (%v)", got, err)
+	}
+	if _, err := r.LineColToOffset(9, 0); err == nil {
+		t.Error("expected an error for a line out of bounds")
+	}
+}
+
+func TestRope_NewReader(t *testing.T) {
+	// Several leaves of multi-byte text, with edits so the tree is not just
+	// what NewRope built.
+	r := NewRope(strings.Repeat("aこ😀b\n", 600))
+	r.InsertString(0, 0, "start ")
+	r.InsertString(300, 2, "middle ñ\n")
+	r.Delete(450, 1)
+	var want bytes.Buffer
+	r.WriteTo(&want)
+
+	for _, size := range []int{1, 2, 3, 5, 7, 4096} {
+		rd := r.NewReader()
+		var got []byte
+		p := make([]byte, size)
+		for {
+			n, err := rd.Read(p)
+			got = append(got, p[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Read with %d-byte chunks: %v", size, err)
+			}
+			if n == 0 {
+				t.Fatalf("Read with %d-byte chunks returned 0 bytes and no error", size)
+			}
+		}
+		if !bytes.Equal(got, want.Bytes()) {
+			t.Errorf("%d-byte chunks: read %d bytes that differ from WriteTo's %d", size, len(got), want.Len())
+		}
+	}
+
+	if err := iotest.TestReader(r.NewReader(), want.Bytes()); err != nil {
+		t.Error(err)
+	}
+	if err := iotest.TestReader(NewRope("").NewReader(), nil); err != nil {
+		t.Errorf("empty rope: %v", err)
+	}
+}
+
+func TestRope_Snapshot(t *testing.T) {
+	text := strings.Repeat("line of text\n", 400)
+	r := NewRope(text)
+	snap := r.Snapshot()
+
+	// Edits that touch single leaves, split them, merge them and rebalance.
+	r.Insert(0, 0, 'x')
+	r.InsertString(200, 4, strings.Repeat("new\n", 300))
+	r.Delete(100, 1)
+	r.DeleteRange(10, 0, 350, 0)
+	var edited strings.Builder
+	r.WriteTo(&edited)
+
+	var got strings.Builder
+	snap.WriteTo(&got)
+	if got.String() != text {
+		t.Fatalf("snapshot changed when the rope was edited")
+	}
+	if snap.LineCount() != 401 || snap.GetLine(200) != "line of text" {
+		t.Errorf("snapshot line index changed: %d lines, line 200 %q", snap.LineCount(), snap.GetLine(200))
+	}
+
+	// And the other way round: editing the snapshot leaves the rope alone.
+	snap.DeleteRange(0, 0, 300, 0)
+	snap.InsertString(50, 2, "snapshot edit\n")
+	var after strings.Builder
+	r.WriteTo(&after)
+	if after.String() != edited.String() {
+		t.Errorf("rope changed when its snapshot was edited")
+	}
+	if r.GetLine(0) != "xline of text" {
+		t.Errorf("rope line 0 = %q, want %q", r.GetLine(0), "xline of text")
+	}
+}
+
+func TestRope_Version(t *testing.T) {
+	r := NewRope("hello\nworld")
+	v := r.Version()
+
+	// Reads leave the version alone.
+	r.GetLine(1)
+	r.LineCount()
+	r.RuneAt(3)
+	r.IndexToLineCol(4)
+	r.WriteTo(&bytes.Buffer{})
+	if r.Version() != v {
+		t.Fatalf("version changed on reads: %d -> %d", v, r.Version())
+	}
+
+	if err := r.Insert(0, 5, '!'); err != nil {
+		t.Fatal(err)
+	}
+	if r.Version() <= v {
+		t.Errorf("version did not increase on Insert: %d -> %d", v, r.Version())
+	}
+	v = r.Version()
+
+	if err := r.Delete(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if r.Version() <= v {
+		t.Errorf("version did not increase on Delete: %d -> %d", v, r.Version())
+	}
+	v = r.Version()
+
+	// Failed mutations are not changes.
+	r.Delete(0, 0)
+	r.Insert(99, 0, 'x')
+	if r.Version() != v {
+		t.Errorf("version changed on failed mutations: %d -> %d", v, r.Version())
+	}
+}
+
 func TestRope_InsertDeleteSequence(t *testing.T) {
 	r := NewRope("")
 	
@@ -300,6 +795,164 @@ func TestRope_MultipleLines(t *testing.T) {
 	}
 }
 
+func TestRope_StaysBalanced(t *testing.T) {
+	r := NewRope("")
+	var expected strings.Builder
+	for i := 0; i < maxLeafSize*64; i++ {
+		c := rune('a' + i%26)
+		if i%50 == 49 {
+			c = '\n'
+		}
+		r.Insert(r.LineCount()-1, 1<<30, c)
+		expected.WriteRune(c)
+	}
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	if buf.String() != expected.String() {
+		t.Fatal("content mismatch after sequential appends")
+	}
+	if r.LineCount() != strings.Count(expected.String(), "\n")+1 {
+		t.Errorf("expected %d lines, got %d", strings.Count(expected.String(), "\n")+1, r.LineCount())
+	}
+	if got := r.GetLine(3); got != expected.String()[150:199] {
+		t.Errorf("line 3: expected %q, got %q", expected.String()[150:199], got)
+	}
+
+	// A degenerate (list-like) tree would be ~128 levels deep here.
+	if d := depth(r.root); d > 20 {
+		t.Errorf("tree depth %d after sequential appends, expected a balanced tree", d)
+	}
+}
+
+func TestRope_MergesSmallLeaves(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; sb.Len() < maxLeafSize*200; i++ {
+		sb.WriteString(strings.Repeat(string(rune('a'+i%26)), i%70))
+		sb.WriteByte('\n')
+	}
+	expected := []rune(sb.String())
+	r := NewRope(sb.String())
+
+	// Chop a small piece out of every stretch of the buffer until little is
+	// left, then backspace through part of what remains.
+	for len(expected) > maxLeafSize*4 {
+		for at := 0; at+200 < len(expected); at += 300 {
+			startLine, startCol := r.IndexToLineCol(at)
+			endLine, endCol := r.IndexToLineCol(at + 100)
+			if err := r.DeleteRange(startLine, startCol, endLine, endCol); err != nil {
+				t.Fatalf("DeleteRange failed: %v", err)
+			}
+			expected = append(expected[:at], expected[at+100:]...)
+		}
+	}
+	for i := 0; i < maxLeafSize; i++ {
+		at := (i * 7) % len(expected)
+		line, col := r.IndexToLineCol(at + 1)
+		if err := r.Delete(line, col); err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		expected = append(expected[:at], expected[at+1:]...)
+	}
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	if buf.String() != string(expected) {
+		t.Fatal("content mismatch after deletions")
+	}
+	got := append([]int(nil), r.lineStarts...)
+	r.rebuildLineIndex()
+	for i := range r.lineStarts {
+		if i >= len(got) || got[i] != r.lineStarts[i] {
+			t.Fatalf("line index differs from a rebuild at line %d", i)
+		}
+	}
+	if !weightsValid(r.root) {
+		t.Error("a node's weight does not match the length of its left subtree")
+	}
+
+	// Unmerged, the buffer would still be spread over the ~270 leaves it
+	// started with. Merged, no small leaf is left next to another leaf it fits in.
+	sizes := leafSizes(r.root, nil)
+	if limit := 2*len(expected)/minLeafSize + 2; len(sizes) > limit {
+		t.Errorf("%d runes are spread over %d leaves, expected at most %d", len(expected), len(sizes), limit)
+	}
+}
+
+func TestRope_RebalancePreservesLineIndex(t *testing.T) {
+	// Build a left-leaning chain of small leaves so the root is unbalanced.
+	lines := []string{"alpha\n", "beta\n\n", "gamma\n", "delta", "\nepsilon\n", "zeta"}
+	root := &node{data: []rune(lines[0])}
+	for _, l := range lines[1:] {
+		root = &node{left: root, right: &node{data: []rune(l)}, weight: root.length()}
+	}
+	r := &Rope{root: root}
+	r.rebuildLineIndex()
+
+	if !r.shouldRebalance() {
+		t.Fatal("test tree should be unbalanced")
+	}
+	before := append([]int(nil), r.lineStarts...)
+	var content bytes.Buffer
+	r.WriteTo(&content)
+
+	r.rebalance()
+
+	if r.shouldRebalance() {
+		t.Error("tree is still unbalanced after rebalance")
+	}
+	if len(before) != len(r.lineStarts) {
+		t.Fatalf("lineStarts changed length: %v -> %v", before, r.lineStarts)
+	}
+	for i := range before {
+		if before[i] != r.lineStarts[i] {
+			t.Fatalf("lineStarts changed: %v -> %v", before, r.lineStarts)
+		}
+	}
+
+	// The preserved index must still match a full rescan of the new tree.
+	preserved := r.lineStarts
+	r.rebuildLineIndex()
+	for i := range preserved {
+		if preserved[i] != r.lineStarts[i] {
+			t.Fatalf("preserved lineStarts %v differ from rescan %v", preserved, r.lineStarts)
+		}
+	}
+	var after bytes.Buffer
+	r.WriteTo(&after)
+	if after.String() != content.String() {
+		t.Errorf("content changed by rebalance: %q -> %q", content.String(), after.String())
+	}
+}
+
+func depth(n *node) int {
+	if n == nil || n.isLeaf() {
+		return 1
+	}
+	return 1 + max(depth(n.left), depth(n.right))
+}
+
+func leafSizes(n *node, sizes []int) []int {
+	if n == nil {
+		return sizes
+	}
+	if n.isLeaf() {
+		return append(sizes, len(n.data))
+	}
+	return leafSizes(n.right, leafSizes(n.left, sizes))
+}
+
+func weightsValid(n *node) bool {
+	if n == nil || n.isLeaf() {
+		return true
+	}
+	leftLen := 0
+	if n.left != nil {
+		leftLen = n.left.length()
+	}
+	return n.weight == leftLen && weightsValid(n.left) && weightsValid(n.right)
+}
+
 func BenchmarkRope_Insert(b *testing.B) {
 	r := NewRope("")
 	b.ResetTimer()
@@ -308,6 +961,33 @@ func BenchmarkRope_Insert(b *testing.B) {
 	}
 }
 
+// benchPaste is a 64 KiB block used to compare a bulk insert with the
+// per-rune loop it replaces.
+var benchPaste = strings.Repeat("some pasted text with a newline\n", 2048)
+
+func BenchmarkRope_InsertString(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		r := NewRope("line with some text\n")
+		r.InsertString(0, 5, benchPaste)
+	}
+}
+
+func BenchmarkRope_InsertRuneLoop(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		r := NewRope("line with some text\n")
+		line, col := 0, 5
+		for _, c := range benchPaste {
+			r.Insert(line, col, c)
+			if c == '\n' {
+				line++
+				col = 0
+			} else {
+				col++
+			}
+		}
+	}
+}
+
 func BenchmarkRope_GetLine(b *testing.B) {
 	text := strings.Repeat("line with some text\n", 100)
 	r := NewRope(text)
@@ -328,3 +1008,19 @@ func BenchmarkRope_WriteTo(b *testing.B) {
 	}
 }
 
+
+func BenchmarkRope_AppendLarge(b *testing.B) {
+	text := strings.Repeat("line with some text\n", 50000)
+	r := NewRope(text)
+	var worst time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// Columns are clamped to the line length, so this always appends.
+		start := time.Now()
+		r.Insert(r.LineCount()-1, 1<<30, 'a')
+		if d := time.Since(start); d > worst {
+			worst = d
+		}
+	}
+	b.ReportMetric(float64(worst.Nanoseconds()), "max-ns")
+}
@@ -4,25 +4,124 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
 
 	"github.com/bulga138/panka/toml" // Usando tu paquete TOML
 )
 
+// Values accepted for Config.CtrlCAction.
+const (
+	CtrlCActionNone   = "none"   // Ctrl+C without a selection does nothing
+	CtrlCActionCancel = "cancel" // Ctrl+C without a selection cancels the current mode, like Esc
+)
+
+// Values accepted for Config.BlankLineWhitespace.
+const (
+	BlankLineWhitespaceKeep = "keep" // Save whitespace-only lines as they are
+	BlankLineWhitespaceTrim = "trim" // Empty whitespace-only lines on save
+)
+
+// Values accepted for UserCommand.Input.
+const (
+	CommandInputSelection = "selection" // The selection, or the whole buffer when nothing is selected
+	CommandInputBuffer    = "buffer"    // Always the whole buffer
+	CommandInputNone      = "none"      // Nothing; stdin is empty
+)
+
+// Values accepted for UserCommand.Output.
+const (
+	CommandOutputReplace = "replace" // stdout replaces the text sent on stdin
+	CommandOutputStatus  = "status"  // The first line of stdout is shown in the status bar
+)
+
+// UserCommand is an external program run by name from the editor, declared
+// as a [commands.<name>] table.
+type UserCommand struct {
+	Run    string // Shell command line
+	Input  string // What the program gets on stdin
+	Output string // What happens to its stdout
+}
+
 // Config holds all user-configurable settings for the editor.
 type Config struct {
-	TabSize          int
-	ShowLineNumbers  bool
-	ShowNonPrintable bool // <-- ADD THIS
-	EnableLogger     bool
+	IndentSize          int  // Columns one indent level takes when indenting with spaces
+	TabWidth            int  // Display columns a '\t' occupies
+	IndentWithTabs      bool // Auto-indent adds a '\t' per level instead of IndentSize spaces
+	UseSoftTabs         bool // Tab inserts spaces up to the next multiple of IndentSize instead of a '\t'
+	AutoIndentBrackets  bool // Enter after an opening bracket indents one level more
+	ReindentOnPaste     bool // A pasted block of lines takes the indentation of the cursor's line
+	ShowLineNumbers     bool
+	ShowNonPrintable    bool // <-- ADD THIS
+	ShowScrollbar       bool // A position indicator in the rightmost column, which it takes from the text
+	EnableLogger        bool
+	AutoWrapColumn      int    // 0 = off
+	ScrollOff           int    // Rows kept in view above and below the cursor, at most half the screen
+	RulerColumn         int    // Draw a guide after this many columns; 0 = off
+	CtrlCAction         string // What Ctrl+C does when nothing is selected
+	UseAltScreen        bool   // false renders inline, keeping the output in the scrollback
+	EnableMouse         bool   // Clicks move the cursor, drags select and the wheel scrolls
+	MaxFileSize         int64  // Files larger than this many bytes open read-only in pager mode (0 = no limit)
+	UndoLimit           int    // Undo steps kept per buffer, oldest dropped first (0 = no limit)
+	AutoSaveSeconds     int    // Save a modified, named buffer after this many idle seconds (0 = off)
+	HighlightTodos      bool
+	TodoKeywords        []string // Whole words highlighted when HighlightTodos is on
+	KeepHighlights      bool     // Esc after Enter in Find closes it at the match, leaving the matches highlighted
+	CenterFindMatch     bool     // Find scrolls a match that is off screen to the middle, not the nearest edge
+	BlankLineWhitespace string   // What saving does to lines holding only spaces and tabs
+	EnsureFinalNewline  bool     // Saving adds a newline to text that does not end with one
+	TrimFinalNewlines   bool     // Saving drops empty lines at the end, leaving at most one newline
+	CreateBackup        bool     // Saving over a file first copies it to the file name plus BackupSuffix
+	BackupSuffix        string   // Appended to the file name to name its backup
+	FormatCommand       string   // Shell command the buffer is piped through before saving ("" = off)
+	ShowEndOfBuffer     bool     // Mark rows past the end of the buffer in the gutter
+	EndOfBufferChar     string   // The single character used for that mark
+	CommentPrefix       string   // Inserted after the indentation by Ctrl+/ to comment a line out
+	StatusFormat        string   // Status bar layout, with {tokens} filled in; {=} starts the right-hand part
+	Commands            map[string]UserCommand
+	Keybindings         map[string]string // Action name to key spec, such as "toggle_case" = "ctrl+j"; checked by the editor
 }
 
+// DefaultStatusFormat is the status bar layout the editor has always drawn.
+const DefaultStatusFormat = " {filename}{buffers}{dirty}{mode}{=}Ln {line}, Col {col}  {eol}{encoding}  v{version}"
+
 // DefaultConfig returns the default editor settings.
 func DefaultConfig() Config {
 	return Config{
-		TabSize:          4,
-		ShowLineNumbers:  true,
-		ShowNonPrintable: false, // Default off
-		EnableLogger:     false,
+		IndentSize:          4,
+		TabWidth:            4,
+		IndentWithTabs:      false,
+		UseSoftTabs:         false,
+		AutoIndentBrackets:  false,
+		ReindentOnPaste:     false,
+		ShowLineNumbers:     true,
+		ShowNonPrintable:    false, // Default off
+		ShowScrollbar:       false,
+		EnableLogger:        false,
+		AutoWrapColumn:      0,
+		ScrollOff:           0,
+		RulerColumn:         0,
+		CtrlCAction:         CtrlCActionNone,
+		UseAltScreen:        true,
+		EnableMouse:         true,
+		MaxFileSize:         64 << 20,
+		UndoLimit:           1000,
+		AutoSaveSeconds:     0,
+		HighlightTodos:      false,
+		KeepHighlights:      false,
+		CenterFindMatch:     false,
+		TodoKeywords:        []string{"TODO", "FIXME", "XXX", "NOTE", "HACK"},
+		BlankLineWhitespace: BlankLineWhitespaceKeep,
+		EnsureFinalNewline:  false,
+		TrimFinalNewlines:   false,
+		CreateBackup:        false,
+		BackupSuffix:        "~",
+		FormatCommand:       "",
+		ShowEndOfBuffer:     true,
+		EndOfBufferChar:     "~",
+		CommentPrefix:       "// ",
+		StatusFormat:        DefaultStatusFormat,
 	}
 }
 
@@ -55,21 +154,62 @@ func LoadConfig() Config {
 		return cfg
 	}
 
-	f, err := os.ReadFile(configPath)
-	if err != nil {
+	if _, err := os.Stat(configPath); err != nil {
 		return cfg // No config file, use defaults
 	}
 
+	loaded, err := LoadConfigFile(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v. Using default config.\n", err)
+		return cfg // Error parsing, use defaults
+	}
+	return loaded
+}
+
+// LoadConfigFile loads the config at path, which must exist. Keys missing
+// from the file keep their default values.
+func LoadConfigFile(path string) (Config, error) {
+	cfg := DefaultConfig()
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("could not read config file: %w", err)
+	}
+
 	// Usar tu parser TOML
 	data, err := toml.ParseNative(string(f))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error parsing %s: %v\n", configPath, err)
-		return cfg // Error parsing, use defaults
+		return cfg, fmt.Errorf("error parsing %s: %w", path, err)
 	}
 
 	// Mapear manualmente del mapa a la estructura
-	if tabSize, ok := data["tabSize"].(int64); ok { // TOML parsea números como int64
-		cfg.TabSize = int(tabSize)
+	// tabSize predates the split into indentSize and tabWidth and sets both.
+	if tabSize, ok := data["tabSize"].(int); ok {
+		cfg.IndentSize = tabSize
+		cfg.TabWidth = tabSize
+	}
+
+	if indentSize, ok := data["indentSize"].(int); ok {
+		cfg.IndentSize = indentSize
+	}
+
+	if tabWidth, ok := data["tabWidth"].(int); ok {
+		cfg.TabWidth = tabWidth
+	}
+
+	if indentWithTabs, ok := data["indentWithTabs"].(bool); ok {
+		cfg.IndentWithTabs = indentWithTabs
+	}
+
+	if useSoftTabs, ok := data["useSoftTabs"].(bool); ok {
+		cfg.UseSoftTabs = useSoftTabs
+	}
+
+	if autoIndentBrackets, ok := data["autoIndentBrackets"].(bool); ok {
+		cfg.AutoIndentBrackets = autoIndentBrackets
+	}
+
+	if reindentOnPaste, ok := data["reindentOnPaste"].(bool); ok {
+		cfg.ReindentOnPaste = reindentOnPaste
 	}
 
 	if showLineNumbers, ok := data["showLineNumbers"].(bool); ok {
@@ -80,16 +220,267 @@ func LoadConfig() Config {
 		cfg.ShowNonPrintable = showNonPrintable
 	}
 
+	if showScrollbar, ok := data["showScrollbar"].(bool); ok {
+		cfg.ShowScrollbar = showScrollbar
+	}
+
 	if enableLogger, ok := data["enableLogger"].(bool); ok {
 		cfg.EnableLogger = enableLogger
 	}
 
+	if autoWrapColumn, ok := data["autoWrapColumn"].(int); ok {
+		cfg.AutoWrapColumn = autoWrapColumn
+	}
+
+	if scrollOff, ok := data["scrollOff"].(int); ok {
+		cfg.ScrollOff = scrollOff
+	}
+
+	if rulerColumn, ok := data["rulerColumn"].(int); ok {
+		cfg.RulerColumn = rulerColumn
+	}
+
+	if ctrlCAction, ok := data["ctrlCAction"].(string); ok {
+		cfg.CtrlCAction = ctrlCAction
+	}
+
+	if useAltScreen, ok := data["useAltScreen"].(bool); ok {
+		cfg.UseAltScreen = useAltScreen
+	}
+
+	if enableMouse, ok := data["enableMouse"].(bool); ok {
+		cfg.EnableMouse = enableMouse
+	}
+
+	if maxFileSize, ok := data["maxFileSize"].(int); ok {
+		cfg.MaxFileSize = int64(maxFileSize)
+	}
+
+	if undoLimit, ok := data["undoLimit"].(int); ok {
+		cfg.UndoLimit = undoLimit
+	}
+
+	if keepHighlights, ok := data["keepHighlights"].(bool); ok {
+		cfg.KeepHighlights = keepHighlights
+	}
+
+	if centerFindMatch, ok := data["centerFindMatch"].(bool); ok {
+		cfg.CenterFindMatch = centerFindMatch
+	}
+
+	if autoSaveSeconds, ok := data["autoSaveSeconds"].(int); ok {
+		cfg.AutoSaveSeconds = autoSaveSeconds
+	}
+
+	if highlightTodos, ok := data["highlightTodos"].(bool); ok {
+		cfg.HighlightTodos = highlightTodos
+	}
+
+	if todoKeywords, ok := data["todoKeywords"].([]any); ok {
+		cfg.TodoKeywords = nil
+		for _, k := range todoKeywords {
+			if k, ok := k.(string); ok && k != "" {
+				cfg.TodoKeywords = append(cfg.TodoKeywords, k)
+			}
+		}
+	}
+
+	if blankLineWhitespace, ok := data["blankLineWhitespace"].(string); ok {
+		cfg.BlankLineWhitespace = blankLineWhitespace
+	}
+
+	if ensureFinalNewline, ok := data["ensureFinalNewline"].(bool); ok {
+		cfg.EnsureFinalNewline = ensureFinalNewline
+	}
+
+	if trimFinalNewlines, ok := data["trimFinalNewlines"].(bool); ok {
+		cfg.TrimFinalNewlines = trimFinalNewlines
+	}
+
+	if createBackup, ok := data["createBackup"].(bool); ok {
+		cfg.CreateBackup = createBackup
+	}
+
+	if backupSuffix, ok := data["backupSuffix"].(string); ok {
+		cfg.BackupSuffix = backupSuffix
+	}
+
+	if formatCommand, ok := data["formatCommand"].(string); ok {
+		cfg.FormatCommand = strings.TrimSpace(formatCommand)
+	}
+
+	if showEndOfBuffer, ok := data["showEndOfBuffer"].(bool); ok {
+		cfg.ShowEndOfBuffer = showEndOfBuffer
+	}
+
+	if endOfBufferChar, ok := data["endOfBufferChar"].(string); ok {
+		cfg.EndOfBufferChar = endOfBufferChar
+	}
+
+	if commentPrefix, ok := data["commentPrefix"].(string); ok {
+		cfg.CommentPrefix = commentPrefix
+	}
+
+	if statusFormat, ok := data["statusFormat"].(string); ok {
+		cfg.StatusFormat = statusFormat
+	}
+
+	if commands, ok := data["commands"].(map[string]any); ok {
+		cfg.Commands = make(map[string]UserCommand, len(commands))
+		for name, v := range commands {
+			table, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			cmd := UserCommand{Input: CommandInputSelection, Output: CommandOutputReplace}
+			cmd.Run, _ = table["run"].(string)
+			if input, ok := table["input"].(string); ok {
+				cmd.Input = input
+			}
+			if output, ok := table["output"].(string); ok {
+				cmd.Output = output
+			}
+			if cmd.Run == "" {
+				return cfg, fmt.Errorf("command %q in %s has no run line", name, path)
+			}
+			if cmd.Input != CommandInputSelection && cmd.Input != CommandInputBuffer && cmd.Input != CommandInputNone {
+				return cfg, fmt.Errorf("command %q in %s: unknown input %q", name, path, cmd.Input)
+			}
+			if cmd.Output != CommandOutputReplace && cmd.Output != CommandOutputStatus {
+				return cfg, fmt.Errorf("command %q in %s: unknown output %q", name, path, cmd.Output)
+			}
+			cfg.Commands[name] = cmd
+		}
+	}
+
+	if keybindings, ok := data["keybindings"].(map[string]any); ok {
+		cfg.Keybindings = make(map[string]string, len(keybindings))
+		for action, v := range keybindings {
+			spec, ok := v.(string)
+			if !ok {
+				return cfg, fmt.Errorf("keybinding %q in %s is not a string", action, path)
+			}
+			cfg.Keybindings[action] = spec
+		}
+	}
+
 	// Asegurar que los valores sean lógicos
-	if cfg.TabSize <= 0 {
-		cfg.TabSize = DefaultConfig().TabSize
+	if cfg.IndentSize <= 0 {
+		cfg.IndentSize = DefaultConfig().IndentSize
+	}
+	if cfg.TabWidth <= 0 {
+		cfg.TabWidth = DefaultConfig().TabWidth
+	}
+	if cfg.AutoWrapColumn < 0 {
+		cfg.AutoWrapColumn = 0
+	}
+	if cfg.ScrollOff < 0 {
+		cfg.ScrollOff = 0
+	}
+	if cfg.RulerColumn < 0 {
+		cfg.RulerColumn = 0
+	}
+	if cfg.CtrlCAction != CtrlCActionNone && cfg.CtrlCAction != CtrlCActionCancel {
+		cfg.CtrlCAction = DefaultConfig().CtrlCAction
+	}
+	if cfg.BlankLineWhitespace != BlankLineWhitespaceKeep && cfg.BlankLineWhitespace != BlankLineWhitespaceTrim {
+		cfg.BlankLineWhitespace = DefaultConfig().BlankLineWhitespace
+	}
+	if cfg.BackupSuffix == "" || strings.ContainsAny(cfg.BackupSuffix, `/\`) {
+		cfg.BackupSuffix = DefaultConfig().BackupSuffix
+	}
+	if utf8.RuneCountInString(cfg.EndOfBufferChar) != 1 {
+		cfg.EndOfBufferChar = DefaultConfig().EndOfBufferChar
+	}
+	if strings.TrimSpace(cfg.StatusFormat) == "" {
+		cfg.StatusFormat = DefaultConfig().StatusFormat
+	}
+	if cfg.MaxFileSize < 0 {
+		cfg.MaxFileSize = 0
+	}
+	if cfg.UndoLimit < 0 {
+		cfg.UndoLimit = 0
+	}
+	if cfg.AutoSaveSeconds < 0 {
+		cfg.AutoSaveSeconds = 0
+	}
+	if strings.TrimSpace(cfg.CommentPrefix) == "" || strings.ContainsAny(cfg.CommentPrefix, "\r\n") {
+		cfg.CommentPrefix = DefaultConfig().CommentPrefix
+	}
+
+	return cfg, nil
+}
+
+// Encode renders cfg as TOML, one key per line in a fixed order, with no
+// comments. It describes the settings in effect, not the file they came from.
+func Encode(cfg Config) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "indentSize = %d\n", cfg.IndentSize)
+	fmt.Fprintf(&b, "tabWidth = %d\n", cfg.TabWidth)
+	fmt.Fprintf(&b, "indentWithTabs = %t\n", cfg.IndentWithTabs)
+	fmt.Fprintf(&b, "useSoftTabs = %t\n", cfg.UseSoftTabs)
+	fmt.Fprintf(&b, "autoIndentBrackets = %t\n", cfg.AutoIndentBrackets)
+	fmt.Fprintf(&b, "reindentOnPaste = %t\n", cfg.ReindentOnPaste)
+	fmt.Fprintf(&b, "showLineNumbers = %t\n", cfg.ShowLineNumbers)
+	fmt.Fprintf(&b, "showNonPrintable = %t\n", cfg.ShowNonPrintable)
+	fmt.Fprintf(&b, "showScrollbar = %t\n", cfg.ShowScrollbar)
+	fmt.Fprintf(&b, "enableLogger = %t\n", cfg.EnableLogger)
+	fmt.Fprintf(&b, "autoWrapColumn = %d\n", cfg.AutoWrapColumn)
+	fmt.Fprintf(&b, "scrollOff = %d\n", cfg.ScrollOff)
+	fmt.Fprintf(&b, "rulerColumn = %d\n", cfg.RulerColumn)
+	fmt.Fprintf(&b, "ctrlCAction = %s\n", toml.QuoteString(cfg.CtrlCAction))
+	fmt.Fprintf(&b, "useAltScreen = %t\n", cfg.UseAltScreen)
+	fmt.Fprintf(&b, "enableMouse = %t\n", cfg.EnableMouse)
+	fmt.Fprintf(&b, "maxFileSize = %d\n", cfg.MaxFileSize)
+	fmt.Fprintf(&b, "undoLimit = %d\n", cfg.UndoLimit)
+	fmt.Fprintf(&b, "autoSaveSeconds = %d\n", cfg.AutoSaveSeconds)
+	fmt.Fprintf(&b, "highlightTodos = %t\n", cfg.HighlightTodos)
+	fmt.Fprintf(&b, "todoKeywords = %s\n", encodeStrings(cfg.TodoKeywords))
+	fmt.Fprintf(&b, "keepHighlights = %t\n", cfg.KeepHighlights)
+	fmt.Fprintf(&b, "centerFindMatch = %t\n", cfg.CenterFindMatch)
+	fmt.Fprintf(&b, "blankLineWhitespace = %s\n", toml.QuoteString(cfg.BlankLineWhitespace))
+	fmt.Fprintf(&b, "ensureFinalNewline = %t\n", cfg.EnsureFinalNewline)
+	fmt.Fprintf(&b, "trimFinalNewlines = %t\n", cfg.TrimFinalNewlines)
+	fmt.Fprintf(&b, "createBackup = %t\n", cfg.CreateBackup)
+	fmt.Fprintf(&b, "backupSuffix = %s\n", toml.QuoteString(cfg.BackupSuffix))
+	fmt.Fprintf(&b, "formatCommand = %s\n", toml.QuoteString(cfg.FormatCommand))
+	fmt.Fprintf(&b, "showEndOfBuffer = %t\n", cfg.ShowEndOfBuffer)
+	fmt.Fprintf(&b, "endOfBufferChar = %s\n", toml.QuoteString(cfg.EndOfBufferChar))
+	fmt.Fprintf(&b, "commentPrefix = %s\n", toml.QuoteString(cfg.CommentPrefix))
+	fmt.Fprintf(&b, "statusFormat = %s\n", toml.QuoteString(cfg.StatusFormat))
+	if len(cfg.Keybindings) > 0 {
+		actions := make([]string, 0, len(cfg.Keybindings))
+		for action := range cfg.Keybindings {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+		b.WriteString("\n[keybindings]\n")
+		for _, action := range actions {
+			fmt.Fprintf(&b, "%s = %s\n", toml.EncodeKey(action), toml.QuoteString(cfg.Keybindings[action]))
+		}
+	}
+	names := make([]string, 0, len(cfg.Commands))
+	for name := range cfg.Commands {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := cfg.Commands[name]
+		fmt.Fprintf(&b, "\n[commands.%s]\n", toml.EncodeKey(name))
+		fmt.Fprintf(&b, "run = %s\n", toml.QuoteString(cmd.Run))
+		fmt.Fprintf(&b, "input = %s\n", toml.QuoteString(cmd.Input))
+		fmt.Fprintf(&b, "output = %s\n", toml.QuoteString(cmd.Output))
+	}
+	return b.String()
+}
 
-	return cfg
+// encodeStrings renders a TOML array of strings.
+func encodeStrings(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = toml.QuoteString(v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
 }
 
 func SaveConfig(cfg Config) error {
@@ -97,14 +488,37 @@ func SaveConfig(cfg Config) error {
 	if err != nil {
 		return err
 	}
+	return SaveConfigFile(cfg, configPath)
+}
 
+// SaveConfigFile writes cfg as a commented config file at configPath.
+func SaveConfigFile(cfg Config, configPath string) error {
 	// Manually format the TOML content.
 	content := fmt.Sprintf(
 		`# panka editor configuration
 # This file was generated by panka. You can edit it manually.
 
-# Number of spaces for a tab.
-tabSize = %d
+# Number of spaces one indent level takes when indenting with spaces.
+indentSize = %d
+
+# Number of columns a tab character is displayed as.
+tabWidth = %d
+
+# Indent with a tab character per level instead of indentSize spaces.
+indentWithTabs = %t
+
+# Pressing Tab inserts spaces up to the next multiple of indentSize instead of
+# a tab character, and Backspace in the indentation removes them in one go.
+useSoftTabs = %t
+
+# Pressing Enter after {, ( or [ indents the new line one level more, and
+# typing the closing bracket first on a line takes that level off again.
+autoIndentBrackets = %t
+
+# Pasting several lines moves them as a block to the indentation of the
+# cursor's line, keeping their indentation relative to each other. Set to
+# false to paste text exactly as it was copied.
+reindentOnPaste = %t
 
 # Whether to show line numbers on startup (toggled with Ctrl+L).
 showLineNumbers = %t
@@ -112,9 +526,132 @@ showLineNumbers = %t
 # Whether to show non-printable characters like spaces, tabs, and newlines (toggled with Ctrl+O).
 showNonPrintable = %t
 
+# Show where the screen is in the file with a scrollbar in the rightmost
+# column. The column is taken from the text only while this is on.
+showScrollbar = %t
+
 # Set to true to enable debug logging to 'panka.log'.
 enableLogger = %t
-`, cfg.TabSize, cfg.ShowLineNumbers, cfg.ShowNonPrintable, cfg.EnableLogger)
+
+# Break lines at the last word boundary when typing past this column (0 = off).
+autoWrapColumn = %d
+
+# Keep this many rows in view above and below the cursor, scrolling before it
+# reaches the edge of the screen (0 = off). Capped at half the screen height.
+scrollOff = %d
+
+# Draw a faint vertical guide just after this column, on rows whose text
+# stops short of it, to help keep lines short (0 = off).
+rulerColumn = %d
+
+# What Ctrl+C does when nothing is selected: "none" or "cancel" (acts like Esc).
+# With a selection, Ctrl+C always copies.
+ctrlCAction = "%s"
+
+# Use the terminal's alternate screen. Set to false to render inline and keep
+# the editor's output in the scrollback (same as --no-alt-screen).
+useAltScreen = %t
+
+# Use the mouse: click to place the cursor, drag or Shift+click to select,
+# and scroll with the wheel. Set to false to keep the terminal's own mouse
+# selection.
+enableMouse = %t
+
+# Files larger than this many bytes open read-only in a pager that loads the
+# file a window at a time (0 = no limit).
+maxFileSize = %d
+
+# How many undo steps each buffer keeps. Past this the oldest are dropped, so
+# a long session doesn't grow without bound (0 = no limit).
+undoLimit = %d
+
+# Save a modified buffer that has a file name after this many seconds without
+# a key press, unless a prompt is open (0 = off).
+autoSaveSeconds = %d
+
+# Highlight annotation keywords such as TODO and FIXME wherever they appear
+# as whole words.
+highlightTodos = %t
+todoKeywords = %s
+
+# After Enter in Find, Esc closes the prompt at the current match and leaves
+# the matches highlighted; Alt+N and Alt+P step through them. An edit or a
+# second Esc clears them.
+keepHighlights = %t
+
+# When Find jumps to a match that is off screen, scroll it to the middle of
+# the screen instead of just into view at the top or bottom edge.
+centerFindMatch = %t
+
+# What saving does to lines that hold only spaces and tabs: "keep" or "trim"
+# (trim leaves them empty).
+blankLineWhitespace = "%s"
+
+# Saving ends text that does not end with a newline with one. With
+# trimFinalNewlines, saving also drops the empty lines at the end, so the
+# file ends with exactly one newline when both are on.
+ensureFinalNewline = %t
+trimFinalNewlines = %t
+
+# Before saving over a file, copy what is on disk to the file name plus
+# backupSuffix, so the last saved version survives one more save.
+createBackup = %t
+backupSuffix = %s
+
+# Pipe the buffer through this shell command before each save, for example
+# "gofmt", and save its output instead when it exits 0. On failure the text
+# is saved as it is and the command's stderr is shown. PANKA_FILE is set as
+# for user commands ("" = off).
+formatCommand = %s
+
+# Mark rows past the end of the file in the line-number gutter, and the
+# character to mark them with.
+showEndOfBuffer = %t
+endOfBufferChar = %s
+
+# What Ctrl+/ puts after a line's indentation to comment it out, for example
+# "# " for shell or Python files. Lines that all start with it are uncommented.
+commentPrefix = %s
+
+# The status bar. Each {token} is replaced as it is drawn: {filename},
+# {buffers} ([2/3] with several files open), {dirty} ("(modified)" when
+# there are unsaved changes), {mode} (the pager, [RO] and regex markers),
+# {line}, {col}, {lines} (the line count; in the pager, the last line read
+# so far followed by "+"), {eol} (LF or CRLF), {encoding} (empty for UTF-8)
+# and {version}. {buffers}, {dirty}, {mode} and {encoding} come with a
+# leading space when they are not empty. What follows {=} is drawn against
+# the right edge; when the bar is too narrow, the left part is cut.
+# Unknown tokens are shown as written.
+statusFormat = %s
+
+# Move main-editor commands to other control keys, as action = "ctrl+key".
+# The key is a letter, /, ] or \; Ctrl+C, Ctrl+I and Ctrl+M can't be used.
+# A moved command's old key does nothing unless another command takes it.
+# Unknown actions and keys bound twice are reported in the log and ignored.
+# Actions: save, save_as, quit, undo, redo, cut, paste, select_all, find,
+# replace, goto_line, toggle_line_numbers, toggle_non_printable,
+# duplicate_line, line_endings, toggle_case, clear_search, run_command,
+# doc_stats, toggle_comment, matching_bracket, delete_word_left,
+# command_palette.
+#
+# [keybindings]
+# toggle_case = "ctrl+j"
+
+# Named external commands, run with Ctrl+R. Each one is a shell command line
+# (cmd /C on Windows, sh -c elsewhere) that gets text on stdin and the
+# environment variables PANKA_FILE, PANKA_LINE and PANKA_COL (1-based).
+#   input  = "selection" (default; the whole buffer when nothing is selected),
+#            "buffer" or "none"
+#   output = "replace" (default; stdout replaces the input text, or is
+#            inserted at the cursor when input is "none") or "status" (the
+#            first line of stdout is shown in the status bar)
+# A command that exits non-zero changes nothing and its stderr is shown.
+#
+# [commands.sort]
+# run = "sort"
+# input = "selection"
+# output = "replace"
+`, cfg.IndentSize, cfg.TabWidth, cfg.IndentWithTabs, cfg.UseSoftTabs, cfg.AutoIndentBrackets, cfg.ReindentOnPaste, cfg.ShowLineNumbers, cfg.ShowNonPrintable, cfg.ShowScrollbar, cfg.EnableLogger, cfg.AutoWrapColumn, cfg.ScrollOff, cfg.RulerColumn, cfg.CtrlCAction, cfg.UseAltScreen, cfg.EnableMouse, cfg.MaxFileSize, cfg.UndoLimit, cfg.AutoSaveSeconds, cfg.HighlightTodos, encodeStrings(cfg.TodoKeywords), cfg.KeepHighlights, cfg.CenterFindMatch, cfg.BlankLineWhitespace, cfg.EnsureFinalNewline, cfg.TrimFinalNewlines, cfg.CreateBackup, toml.QuoteString(cfg.BackupSuffix), toml.QuoteString(cfg.FormatCommand), cfg.ShowEndOfBuffer, toml.QuoteString(cfg.EndOfBufferChar), toml.QuoteString(cfg.CommentPrefix), toml.QuoteString(cfg.StatusFormat))
 
 	// Write the file
 	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
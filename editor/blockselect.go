@@ -0,0 +1,192 @@
+package editor
+
+import "strings"
+
+// blockRect is the rectangle of a block selection: lines top to bottom and
+// the screen columns from left up to, but not including, right.
+type blockRect struct {
+	top, bottom int
+	left, right int
+}
+
+// contains reports whether the rune drawn from screen column visX on line y
+// is inside the block. A block with no width marks the column itself, the
+// way the cursors of a column block are shown.
+func (b blockRect) contains(y, visX int) bool {
+	if y < b.top || y > b.bottom {
+		return false
+	}
+	if b.left == b.right {
+		return visX == b.left
+	}
+	return visX >= b.left && visX < b.right
+}
+
+// blockRect returns the rectangle between the block anchor and the cursor.
+func (e *Editor) blockRect() blockRect {
+	return blockRect{
+		top:    min(e.blockAnchorY, e.cursorY),
+		bottom: max(e.blockAnchorY, e.cursorY),
+		left:   min(e.blockAnchorVisX, e.blockCursorVisX),
+		right:  max(e.blockAnchorVisX, e.blockCursorVisX),
+	}
+}
+
+// getBlockText returns the block's columns on each of its lines, joined with
+// "\n". A line that ends before the block gives an empty line, and a block
+// with no width gives no text.
+func (e *Editor) getBlockText() string {
+	b := e.blockRect()
+	if b.left == b.right {
+		return ""
+	}
+	var sb strings.Builder
+	for y := b.top; y <= b.bottom; y++ {
+		if y > b.top {
+			sb.WriteByte('\n')
+		}
+		runes := []rune(e.buffer.GetLine(y))
+		start := e.runeXForVisualX(y, b.left)
+		end := e.runeXForVisualX(y, b.right)
+		sb.WriteString(string(runes[start:end]))
+	}
+	return sb.String()
+}
+
+// extendBlockSelection (Alt+Shift+arrows) starts a block selection at the
+// cursor, or moves its cursor corner one line or column. The column is kept
+// apart from cursorX so the block can reach past the end of a short line.
+func (e *Editor) extendBlockSelection(direction byte) {
+	e.flushEditGroups()
+	if !e.blockActive {
+		e.blockActive = true
+		e.blockAnchorY = e.cursorY
+		e.blockAnchorVisX = e.getVisualX(e.cursorY, e.cursorX)
+		e.blockCursorVisX = e.blockAnchorVisX
+		e.selectionActive = false
+		e.extraCursorHeight = 0
+	}
+	switch direction {
+	case 'A': // Up
+		if e.cursorY > 0 {
+			e.cursorY--
+		}
+	case 'B': // Down
+		if e.cursorY < e.buffer.LineCount()-1 {
+			e.cursorY++
+		}
+	case 'C': // Right
+		e.blockCursorVisX++
+	case 'D': // Left
+		if e.blockCursorVisX > 0 {
+			e.blockCursorVisX--
+		}
+	}
+	e.cursorX = e.runeXForVisualX(e.cursorY, e.blockCursorVisX)
+}
+
+// handleBlockKey acts on a key pressed while a block selection is active.
+// Typing replaces the block on every line, Backspace deletes it, Ctrl+X cuts
+// it, and any other key ends the block and is handled as usual; it reports
+// whether the key was used up.
+func (e *Editor) handleBlockKey(r rune) bool {
+	switch {
+	case r == '\x7f': // Backspace
+		if !e.readOnlyBlocked() {
+			e.deleteBlock()
+		}
+		return true
+	case r == '\x18': // Ctrl+X
+		if !e.readOnlyBlocked() {
+			e.cutBlock()
+		}
+		return true
+	case r >= ' ' || r == '\t':
+		if !e.readOnlyBlocked() {
+			e.typeIntoBlock(r)
+		}
+		return true
+	}
+	e.blockActive = false
+	return false
+}
+
+// deleteBlock deletes the block's columns on each of its lines as one undo
+// step and leaves a column of cursors at its left edge. Lines that end
+// before the left edge are left alone.
+func (e *Editor) deleteBlock() {
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	e.replaceBlock("")
+}
+
+// cutBlock puts the block's text on the clipboard, then deletes the block
+// as deleteBlock does. A block with no width has nothing to cut and stays.
+func (e *Editor) cutBlock() {
+	text := e.getBlockText()
+	if text == "" {
+		e.setStatusMessage("Nothing to cut")
+		return
+	}
+	if err := e.setClipboardText(text); err != nil {
+		e.setStatusMessage("Cut failed: %v", err)
+		return
+	}
+	e.deleteBlock()
+	e.setStatusMessage("Cut to clipboard")
+}
+
+// typeIntoBlock replaces the block's columns on each of its lines with r as
+// one undo step, then carries on as a column of cursors just after it. Lines
+// that end before the left edge are padded with spaces so the text lines up.
+func (e *Editor) typeIntoBlock(r rune) {
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	text := string(r)
+	if r == '\t' && e.config.UseSoftTabs {
+		left := e.blockRect().left
+		text = strings.Repeat(" ", e.config.IndentSize-left%e.config.IndentSize)
+	}
+	e.replaceBlock(text)
+}
+
+// replaceBlock puts text in place of the block's columns on each line. Lines
+// too short to reach the block get spaces up to its left edge before a
+// non-empty text. The block then becomes a column of cursors after text.
+func (e *Editor) replaceBlock(text string) {
+	b := e.blockRect()
+	n := len([]rune(text))
+	for y := b.top; y <= b.bottom; y++ {
+		start := e.runeXForVisualX(y, b.left)
+		end := e.runeXForVisualX(y, b.right)
+		if end > start {
+			runes := []rune(e.buffer.GetLine(y))
+			entries := make([]opEntry, 0, end-start)
+			for x := start; x < end; x++ {
+				entries = append(entries, opEntry{insertLine: y, insertCol: x, r: runes[x]})
+			}
+			if err := e.buffer.DeleteRange(y, start, y, end); err != nil {
+				continue
+			}
+			e.pushUndoDeleteBlock(entries, false)
+			e.dirty = true
+		}
+		if n == 0 {
+			continue
+		}
+		insert := text
+		if width := e.getVisualX(y, start); width < b.left && start == len([]rune(e.buffer.GetLine(y))) {
+			insert = strings.Repeat(" ", b.left-width) + text
+		}
+		if err := e.buffer.InsertString(y, start, insert); err != nil {
+			continue
+		}
+		e.pushUndoInsertText(y, start, insert)
+		e.dirty = true
+	}
+
+	e.blockActive = false
+	e.extraCursorHeight = e.blockAnchorY - e.cursorY
+	e.cursorX = e.runeXForVisualX(e.cursorY, b.left) + n
+	e.clampCursorX()
+}
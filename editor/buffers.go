@@ -0,0 +1,180 @@
+package editor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bulga138/panka/buffer"
+)
+
+// bufferState is everything that belongs to one open file. The editor works
+// on its own fields; a buffer's state is copied out when another buffer is
+// switched in, and copied back when it returns.
+type bufferState struct {
+	filename      string
+	buffer        buffer.Buffer
+	pager         *pager
+	lineEnding    string
+	hasBOM        bool
+	encoding      textEncoding
+	invalidUTF8   bool
+	dirty         bool
+	initialHash   string
+	initialLength int
+	diskModTime   time.Time
+	diskSize      int64
+	undoStack     []undoAction
+	redoStack     []undoAction
+
+	cursorX, cursorY   int
+	viewportY          int
+	viewportWrapOffset int
+}
+
+// storeBufferState copies the current buffer's state into slot i.
+func (e *Editor) storeBufferState(i int) {
+	e.buffers[i] = bufferState{
+		filename:           e.filename,
+		buffer:             e.buffer,
+		pager:              e.pager,
+		lineEnding:         e.lineEnding,
+		hasBOM:             e.hasBOM,
+		encoding:           e.encoding,
+		invalidUTF8:        e.invalidUTF8,
+		dirty:              e.dirty,
+		initialHash:        e.initialHash,
+		initialLength:      e.initialLength,
+		diskModTime:        e.diskModTime,
+		diskSize:           e.diskSize,
+		undoStack:          e.undoStack,
+		redoStack:          e.redoStack,
+		cursorX:            e.cursorX,
+		cursorY:            e.cursorY,
+		viewportY:          e.viewportY,
+		viewportWrapOffset: e.viewportWrapOffset,
+	}
+}
+
+// restoreBufferState makes slot i the current buffer.
+func (e *Editor) restoreBufferState(i int) {
+	b := e.buffers[i]
+	e.currentBuffer = i
+	e.filename = b.filename
+	e.buffer = b.buffer
+	e.pager = b.pager
+	e.lineEnding = b.lineEnding
+	e.hasBOM = b.hasBOM
+	e.encoding = b.encoding
+	e.invalidUTF8 = b.invalidUTF8
+	e.dirty = b.dirty
+	e.initialHash = b.initialHash
+	e.initialLength = b.initialLength
+	e.diskModTime = b.diskModTime
+	e.diskSize = b.diskSize
+	e.undoStack = b.undoStack
+	e.redoStack = b.redoStack
+	e.cursorX = b.cursorX
+	e.cursorY = b.cursorY
+	e.viewportY = b.viewportY
+	e.viewportWrapOffset = b.viewportWrapOffset
+}
+
+// switchBuffer shows buffer i, keeping the cursor and scroll position each
+// buffer had when it was left. Selections, block cursors and find matches
+// belong to the buffer being left and are dropped.
+func (e *Editor) switchBuffer(i int) {
+	if i == e.currentBuffer || i < 0 || i >= len(e.buffers) {
+		return
+	}
+	e.flushEditGroups()
+	e.storeBufferState(e.currentBuffer)
+	e.restoreBufferState(i)
+	e.selectionActive = false
+	e.extraCursorHeight = 0
+	e.extraCursors = nil
+	e.blockActive = false
+	e.clearHighlights()
+	e.updateLineNumWidth()
+	if !e.showLineNumbers {
+		e.lineNumWidth = 0
+	}
+}
+
+// cycleBuffer moves delta buffers through the list, wrapping around at
+// either end, and names the buffer it lands on.
+func (e *Editor) cycleBuffer(delta int) {
+	if len(e.buffers) < 2 {
+		e.setStatusMessage("No other buffers open")
+		return
+	}
+	n := len(e.buffers)
+	e.switchBuffer(((e.currentBuffer+delta)%n + n) % n)
+	e.setStatusMessage("Buffer %d/%d: %s", e.currentBuffer+1, n, e.displayName())
+}
+
+// displayName is the file name shown for the current buffer.
+func (e *Editor) displayName() string {
+	if e.filename == "" {
+		return "[No Name]"
+	}
+	return e.filename
+}
+
+// bufferListStatus is the status bar marker for the buffer's place in the
+// list, shown once more than one file is open.
+func (e *Editor) bufferListStatus() string {
+	if len(e.buffers) < 2 {
+		return ""
+	}
+	return fmt.Sprintf(" [%d/%d]", e.currentBuffer+1, len(e.buffers))
+}
+
+// isModified reports whether the current buffer differs from its file.
+func (e *Editor) isModified() bool {
+	return e.dirty && !e.isContentUnchanged()
+}
+
+// quitOrAsk walks the buffers from quitNext on and switches to the first one
+// with unsaved changes to ask whether to save it. Once every buffer has been
+// dealt with, the editor quits.
+func (e *Editor) quitOrAsk() {
+	for e.quitNext < len(e.buffers) {
+		i := e.quitNext
+		e.quitNext++
+		e.switchBuffer(i)
+		if e.isModified() {
+			e.isQuitting = true
+			if len(e.buffers) > 1 {
+				e.setStatusMessage("Save modified buffer %s (Y/N)?", e.displayName())
+			} else {
+				e.setStatusMessage("Save modified buffer (Y/N)?")
+			}
+			return
+		}
+	}
+	e.quit = true
+}
+
+// resumeQuit goes on with a quit that was waiting on a save the quit prompt
+// started, once that save is done. A cancelled or failed save stops the quit.
+func (e *Editor) resumeQuit(saved bool) {
+	if !e.quitAfterSave {
+		return
+	}
+	e.quitAfterSave = false
+	if saved {
+		e.quitOrAsk()
+	}
+}
+
+// closeBuffers releases the files held open by pager-mode buffers.
+func (e *Editor) closeBuffers() {
+	if e.pager != nil {
+		e.pager.close()
+	}
+	for _, b := range e.buffers {
+		if b.pager != nil {
+			b.pager.close()
+		}
+	}
+}
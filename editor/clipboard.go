@@ -1,15 +1,17 @@
 package editor
 
-import (
-	"fmt"
-	"strings"
-	"unsafe"
-
-	"golang.org/x/sys/windows"
-)
+import "strings"
 
 // ---------- Clipboard / Paste / Cut ----------
 
+// clipboard reads and writes the system clipboard. Each platform provides
+// its implementation through systemClipboard. Text crosses this interface
+// with "\n" line endings; implementations convert as their platform needs.
+type clipboard interface {
+	GetText() (string, error)
+	SetText(text string) error
+}
+
 func (e *Editor) pasteFromClipboard() error {
 	text, err := e.getClipboardText()
 	if err != nil {
@@ -20,96 +22,100 @@ func (e *Editor) pasteFromClipboard() error {
 		e.setStatusMessage("Clipboard is empty")
 		return nil
 	}
+	if err := e.pasteText(e.reindentPaste(text)); err != nil {
+		return err
+	}
+	e.setStatusMessage("Pasted from clipboard")
+	return nil
+}
+
+// pasteText inserts text at the cursor as a single undo action. Unlike typing,
+// pasted text is never auto-wrapped.
+func (e *Editor) pasteText(text string) error {
 	text = strings.ReplaceAll(text, "\r\n", "\n")
 	text = strings.ReplaceAll(text, "\r", "\n")
 	e.flushTypingAndBackspaceIfNeeded()
-	
-	// Always group paste operations as a single undo action
-	e.beginUndoGroup()
-	defer e.endUndoGroup()
-	
-	entries := make([]opEntry, 0, len([]rune(text)))
-	for _, r := range []rune(text) {
-		insertLine := e.cursorY
-		insertCol := e.cursorX
-		if r == '\n' {
-			if err := e.buffer.Insert(e.cursorY, e.cursorX, '\n'); err != nil {
-				e.setStatusMessage("Paste error: %v", err)
-				return err
-			}
-			e.cursorY++
-			e.cursorX = 0
-		} else {
-			if err := e.buffer.Insert(e.cursorY, e.cursorX, r); err != nil {
-				e.setStatusMessage("Paste error: %v", err)
-				return err
-			}
-			e.cursorX++
-		}
-		delLine := e.cursorY
-		delCol := e.cursorX
-		entries = append(entries, opEntry{
-			insertLine: insertLine, insertCol: insertCol,
-			delLine: delLine, delCol: delCol,
-			r: r,
-		})
-	}
-	// Push all entries as a single grouped undo action
-	e.pushUndoInsertBlock(entries)
+
+	// Always group paste operations as a single undo action, joining the
+	// caller's group if one is open
+	if !e.undoGrouping {
+		e.beginUndoGroup()
+		defer e.endUndoGroup()
+	}
+
+	if err := e.insertTextAtCursor(text); err != nil {
+		e.setStatusMessage("Paste error: %v", err)
+		return err
+	}
 	e.dirty = true
-	e.setStatusMessage("Pasted from clipboard")
 	return nil
 }
 
-func (e *Editor) getClipboardText() (string, error) {
-	return getClipboardTextWindows()
-}
+// reindentPaste moves the lines of a multi-line paste as a block to the
+// indentation of the cursor's line when config.ReindentOnPaste is set. The
+// leading whitespace the pasted lines share is swapped for that indentation,
+// so they keep their indentation relative to each other. The first line lands
+// at the cursor and only loses its indentation when the cursor is in the
+// line's indentation. Blank lines come out empty.
+func (e *Editor) reindentPaste(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+	if !e.config.ReindentOnPaste || !strings.Contains(text, "\n") {
+		return text
+	}
+	lines := strings.Split(text, "\n")
 
-// Windows clipboard implementation for getting text
-func getClipboardTextWindows() (string, error) {
-	user32 := windows.NewLazyDLL("user32.dll")
-	kernel32 := windows.NewLazyDLL("kernel32.dll")
-
-	// Get required functions
-	openClipboard := user32.NewProc("OpenClipboard")
-	closeClipboard := user32.NewProc("CloseClipboard")
-	getClipboardData := user32.NewProc("GetClipboardData")
-	globalLock := kernel32.NewProc("GlobalLock")
-	globalUnlock := kernel32.NewProc("GlobalUnlock")
-
-	// Open clipboard
-	hwnd := uintptr(0) // NULL
-	ret, _, _ := openClipboard.Call(hwnd)
-	if ret == 0 {
-		return "", fmt.Errorf("failed to open clipboard")
-	}
-	defer closeClipboard.Call()
-
-	// Get clipboard data (CF_UNICODETEXT = 13)
-	cfUnicodeText := uintptr(13)
-	hMem, _, _ := getClipboardData.Call(cfUnicodeText)
-	if hMem == 0 {
-		return "", fmt.Errorf("failed to get clipboard data")
-	}
-
-	// Lock memory
-	ptr, _, _ := globalLock.Call(hMem)
-	if ptr == 0 {
-		return "", fmt.Errorf("failed to lock global memory")
-	}
-	defer globalUnlock.Call(hMem)
-
-	// Convert UTF-16 to Go string
-	var result []uint16
-	for i := 0; ; i++ {
-		c := *(*uint16)(unsafe.Pointer(ptr + uintptr(i*2)))
-		if c == 0 {
-			break
+	common, found := "", false
+	for _, line := range lines {
+		rest := strings.TrimLeft(line, " \t")
+		if rest == "" {
+			continue
+		}
+		indent := line[:len(line)-len(rest)]
+		if !found {
+			common, found = indent, true
+		}
+		for !strings.HasPrefix(indent, common) {
+			common = common[:len(common)-1]
 		}
-		result = append(result, c)
 	}
 
-	return windows.UTF16ToString(result), nil
+	runes := []rune(e.buffer.GetLine(e.cursorY))
+	line := string(runes)
+	target := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+	before := string(runes[:min(e.cursorX, len(runes))])
+	inIndent := strings.TrimLeft(before, " \t") == ""
+	if inIndent {
+		target = before
+	}
+
+	for i, l := range lines {
+		switch {
+		case i == 0:
+			if inIndent {
+				lines[i] = strings.TrimPrefix(l, common)
+			}
+		case strings.TrimLeft(l, " \t") == "":
+			lines[i] = ""
+		default:
+			lines[i] = target + strings.TrimPrefix(l, common)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// pasteIntoPrompt inserts the first line of the clipboard into the active prompt.
+func (e *Editor) pasteIntoPrompt() {
+	text, err := e.getClipboardText()
+	if err != nil {
+		// The message bar holds the prompt itself, so there is nowhere to report this.
+		return
+	}
+	e.insertPromptText(text)
+}
+
+func (e *Editor) getClipboardText() (string, error) {
+	return e.clipboard.GetText()
 }
 
 func (e *Editor) selectAll() error {
@@ -128,77 +134,35 @@ func (e *Editor) selectAll() error {
 }
 
 func (e *Editor) setClipboardText(text string) error {
-	return setClipboardTextWindows(text)
+	return e.clipboard.SetText(text)
 }
 
-// Windows clipboard implementation using Windows API
-func setClipboardTextWindows(text string) error {
-	kernel32 := windows.NewLazyDLL("kernel32.dll")
-	user32 := windows.NewLazyDLL("user32.dll")
-
-	// Get required functions
-	globalAlloc := kernel32.NewProc("GlobalAlloc")
-	globalLock := kernel32.NewProc("GlobalLock")
-	globalUnlock := kernel32.NewProc("GlobalUnlock")
-	openClipboard := user32.NewProc("OpenClipboard")
-	emptyClipboard := user32.NewProc("EmptyClipboard")
-	setClipboardData := user32.NewProc("SetClipboardData")
-	closeClipboard := user32.NewProc("CloseClipboard")
-
-	// Convert string to Windows UTF-16
-	utf16Text, err := windows.UTF16FromString(text)
-	if err != nil {
-		return err
-	}
-
-	// Allocate global memory
-	GMEM_MOVEABLE := uintptr(0x0002)
-	size := uintptr((len(utf16Text) + 1) * 2) // +1 for null terminator, *2 for UTF-16
-	hMem, _, _ := globalAlloc.Call(GMEM_MOVEABLE, size)
-	if hMem == 0 {
-		return fmt.Errorf("failed to allocate global memory")
-	}
-
-	// Lock memory
-	ptr, _, _ := globalLock.Call(hMem)
-	if ptr == 0 {
-		return fmt.Errorf("failed to lock global memory")
-	}
-	defer globalUnlock.Call(hMem)
-
-	// Copy text to memory
-	dst := (*[1 << 30]byte)(unsafe.Pointer(ptr))[:size:size]
-	for i, v := range utf16Text {
-		dst[i*2] = byte(v)
-		dst[i*2+1] = byte(v >> 8)
-	}
+// crlfText gives text the CRLF line endings Windows programs expect on the
+// clipboard. Endings that are already CRLF are left as they are.
+func crlfText(text string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\n", "\r\n")
+}
 
-	// Open clipboard
-	hwnd := uintptr(0) // NULL
-	ret, _, _ := openClipboard.Call(hwnd)
-	if ret == 0 {
-		return fmt.Errorf("failed to open clipboard")
+// clipboardText returns what copy and cut act on: the selection when there
+// is one, or else the cursor's line with its newline, so that pasting it
+// makes a new line; wholeLine reports that case. A block selection is cut by
+// handleBlockKey and copied as getBlockText.
+func (e *Editor) clipboardText() (text string, wholeLine bool) {
+	if e.selectionActive {
+		return e.getSelectedText(), false
 	}
-	defer closeClipboard.Call()
-
-	// Empty clipboard
-	emptyClipboard.Call()
-
-	// Set clipboard data (CF_UNICODETEXT = 13)
-	cfUnicodeText := uintptr(13)
-	setClipboardData.Call(cfUnicodeText, hMem)
-
-	return nil
+	return e.buffer.GetLine(e.cursorY) + "\n", true
 }
 
 func (e *Editor) copyToClipboard() error {
-	content := e.getSelectedText()
+	content, _ := e.clipboardText()
+	if e.blockActive {
+		content = e.getBlockText()
+	}
 	if content == "" {
-		// When copying a single line, include the newline character
-		// so that pasting it will create a new line
-		content = e.buffer.GetLine(e.cursorY) + "\n"
+		e.setStatusMessage("Nothing to copy")
+		return nil
 	}
-	content = strings.ReplaceAll(content, "\n", "\r\n")
 	err := e.setClipboardText(content)
 	if err != nil {
 		e.setStatusMessage("Copy failed: %v", err)
@@ -210,20 +174,18 @@ func (e *Editor) copyToClipboard() error {
 
 func (e *Editor) cutToClipboard() error {
 	e.flushTypingAndBackspaceIfNeeded()
-	content := e.getSelectedText()
+	content, wholeLine := e.clipboardText()
 	if content == "" {
-		// When cutting a single line, include the newline character
-		// so that pasting it will create a new line
-		content = e.buffer.GetLine(e.cursorY) + "\n"
-		e.beginUndoGroup()
+		e.setStatusMessage("Nothing to cut")
+		return nil
+	}
+	e.beginUndoGroup()
+	if wholeLine {
 		e.deleteCurrentLine()
-		e.endUndoGroup()
-	} else if e.selectionActive {
-		e.beginUndoGroup()
+	} else {
 		e.deleteSelectedText()
-		e.endUndoGroup()
 	}
-	content = strings.ReplaceAll(content, "\n", "\r\n")
+	e.endUndoGroup()
 	err := e.setClipboardText(content)
 	if err != nil {
 		e.setStatusMessage("Cut failed: %v", err)
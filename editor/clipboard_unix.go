@@ -0,0 +1,83 @@
+//go:build !windows
+
+package editor
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// commandClipboard runs helper programs such as xclip or pbcopy.
+type commandClipboard struct {
+	get []string // Prints the clipboard on stdout
+	set []string // Reads the new clipboard contents on stdin
+}
+
+// clipboardHelpers lists the helpers to try for goos, best first.
+func clipboardHelpers(goos string) []commandClipboard {
+	if goos == "darwin" {
+		return []commandClipboard{{get: []string{"pbpaste"}, set: []string{"pbcopy"}}}
+	}
+	var helpers []commandClipboard
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		helpers = append(helpers, commandClipboard{get: []string{"wl-paste", "--no-newline"}, set: []string{"wl-copy"}})
+	}
+	return append(helpers,
+		commandClipboard{get: []string{"xclip", "-selection", "clipboard", "-o"}, set: []string{"xclip", "-selection", "clipboard", "-i"}},
+		commandClipboard{get: []string{"xsel", "--clipboard", "--output"}, set: []string{"xsel", "--clipboard", "--input"}},
+	)
+}
+
+// systemClipboard picks the first helper installed on this machine. Without
+// one, copying still works through OSC 52, which most terminal emulators
+// forward to the system clipboard, but pasting is left to the terminal.
+func systemClipboard() clipboard {
+	for _, h := range clipboardHelpers(runtime.GOOS) {
+		if _, err := exec.LookPath(h.get[0]); err != nil {
+			continue
+		}
+		if _, err := exec.LookPath(h.set[0]); err != nil {
+			continue
+		}
+		return h
+	}
+	return osc52Clipboard{w: os.Stdout}
+}
+
+func (c commandClipboard) GetText() (string, error) {
+	out, err := exec.Command(c.get[0], c.get[1:]...).Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", c.get[0], err)
+	}
+	return string(out), nil
+}
+
+func (c commandClipboard) SetText(text string) error {
+	cmd := exec.Command(c.set[0], c.set[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", c.set[0], err)
+	}
+	return nil
+}
+
+// osc52Clipboard sets the clipboard with the OSC 52 escape sequence. Terminals
+// do not reliably answer OSC 52 queries, so it cannot read the clipboard.
+type osc52Clipboard struct {
+	w io.Writer
+}
+
+func (c osc52Clipboard) GetText() (string, error) {
+	return "", errors.New("no clipboard helper found (install xclip, xsel or wl-clipboard), use the terminal's paste instead")
+}
+
+func (c osc52Clipboard) SetText(text string) error {
+	_, err := fmt.Fprintf(c.w, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString([]byte(text)))
+	return err
+}
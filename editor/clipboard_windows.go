@@ -0,0 +1,133 @@
+//go:build windows
+
+package editor
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// windowsClipboard uses the Win32 clipboard API.
+type windowsClipboard struct{}
+
+func systemClipboard() clipboard {
+	return windowsClipboard{}
+}
+
+func (windowsClipboard) GetText() (string, error) {
+	return getClipboardTextWindows()
+}
+
+// SetText stores text with CRLF line endings, as Windows programs expect.
+func (windowsClipboard) SetText(text string) error {
+	return setClipboardTextWindows(crlfText(text))
+}
+
+// Windows clipboard implementation for getting text
+func getClipboardTextWindows() (string, error) {
+	user32 := windows.NewLazyDLL("user32.dll")
+	kernel32 := windows.NewLazyDLL("kernel32.dll")
+
+	// Get required functions
+	openClipboard := user32.NewProc("OpenClipboard")
+	closeClipboard := user32.NewProc("CloseClipboard")
+	getClipboardData := user32.NewProc("GetClipboardData")
+	globalLock := kernel32.NewProc("GlobalLock")
+	globalUnlock := kernel32.NewProc("GlobalUnlock")
+
+	// Open clipboard
+	hwnd := uintptr(0) // NULL
+	ret, _, _ := openClipboard.Call(hwnd)
+	if ret == 0 {
+		return "", fmt.Errorf("failed to open clipboard")
+	}
+	defer closeClipboard.Call()
+
+	// Get clipboard data (CF_UNICODETEXT = 13)
+	cfUnicodeText := uintptr(13)
+	hMem, _, _ := getClipboardData.Call(cfUnicodeText)
+	if hMem == 0 {
+		return "", fmt.Errorf("failed to get clipboard data")
+	}
+
+	// Lock memory
+	ptr, _, _ := globalLock.Call(hMem)
+	if ptr == 0 {
+		return "", fmt.Errorf("failed to lock global memory")
+	}
+	defer globalUnlock.Call(hMem)
+
+	// Convert UTF-16 to Go string
+	var result []uint16
+	for i := 0; ; i++ {
+		c := *(*uint16)(unsafe.Pointer(ptr + uintptr(i*2)))
+		if c == 0 {
+			break
+		}
+		result = append(result, c)
+	}
+
+	return windows.UTF16ToString(result), nil
+}
+
+// Windows clipboard implementation using Windows API
+func setClipboardTextWindows(text string) error {
+	kernel32 := windows.NewLazyDLL("kernel32.dll")
+	user32 := windows.NewLazyDLL("user32.dll")
+
+	// Get required functions
+	globalAlloc := kernel32.NewProc("GlobalAlloc")
+	globalLock := kernel32.NewProc("GlobalLock")
+	globalUnlock := kernel32.NewProc("GlobalUnlock")
+	openClipboard := user32.NewProc("OpenClipboard")
+	emptyClipboard := user32.NewProc("EmptyClipboard")
+	setClipboardData := user32.NewProc("SetClipboardData")
+	closeClipboard := user32.NewProc("CloseClipboard")
+
+	// Convert string to Windows UTF-16
+	utf16Text, err := windows.UTF16FromString(text)
+	if err != nil {
+		return err
+	}
+
+	// Allocate global memory
+	GMEM_MOVEABLE := uintptr(0x0002)
+	size := uintptr((len(utf16Text) + 1) * 2) // +1 for null terminator, *2 for UTF-16
+	hMem, _, _ := globalAlloc.Call(GMEM_MOVEABLE, size)
+	if hMem == 0 {
+		return fmt.Errorf("failed to allocate global memory")
+	}
+
+	// Lock memory
+	ptr, _, _ := globalLock.Call(hMem)
+	if ptr == 0 {
+		return fmt.Errorf("failed to lock global memory")
+	}
+	defer globalUnlock.Call(hMem)
+
+	// Copy text to memory
+	dst := (*[1 << 30]byte)(unsafe.Pointer(ptr))[:size:size]
+	for i, v := range utf16Text {
+		dst[i*2] = byte(v)
+		dst[i*2+1] = byte(v >> 8)
+	}
+
+	// Open clipboard
+	hwnd := uintptr(0) // NULL
+	ret, _, _ := openClipboard.Call(hwnd)
+	if ret == 0 {
+		return fmt.Errorf("failed to open clipboard")
+	}
+	defer closeClipboard.Call()
+
+	// Empty clipboard
+	emptyClipboard.Call()
+
+	// Set clipboard data (CF_UNICODETEXT = 13)
+	cfUnicodeText := uintptr(13)
+	setClipboardData.Call(cfUnicodeText, hMem)
+
+	return nil
+}
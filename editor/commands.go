@@ -0,0 +1,208 @@
+package editor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bulga138/panka/config"
+)
+
+// userCommandTimeout bounds how long a user command may run before it is
+// killed, along with any process it started. It is a variable for the tests.
+var userCommandTimeout = 10 * time.Second
+
+// userCommandWaitDelay bounds how long to wait for a command's output to be
+// closed once it has exited or been killed: a process it left running in
+// the background may hold on to it.
+const userCommandWaitDelay = time.Second
+
+// User commands are external programs declared in the config under
+// [commands.<name>] and run by name from the Ctrl+R prompt. The contract
+// with the program is:
+//
+//   - The command line runs through the shell: cmd /C on Windows, sh -c
+//     elsewhere.
+//   - stdin gets the selection, or the whole buffer when nothing is selected
+//     (input = "selection"); always the whole buffer (input = "buffer"); or
+//     nothing (input = "none"). Lines end in "\n".
+//   - The environment adds PANKA_FILE (may be empty), PANKA_LINE and
+//     PANKA_COL (1-based cursor position).
+//   - With output = "replace", stdout replaces the text sent on stdin as a
+//     single undo step, or is inserted at the cursor when input is "none".
+//     With output = "status", the first line of stdout goes to the status bar.
+//   - A non-zero exit, or running longer than userCommandTimeout, changes
+//     nothing and shows the first line of stderr.
+
+// runUserCommand runs the configured command called name.
+func (e *Editor) runUserCommand(name string) {
+	cmd, ok := e.config.Commands[name]
+	if !ok {
+		e.setStatusMessage("No such command: %s", name)
+		return
+	}
+	if cmd.Output == config.CommandOutputReplace && e.readOnlyBlocked() {
+		return
+	}
+	e.flushEditGroups()
+
+	// Pick the input and remember whether it is a selection to replace.
+	var input string
+	replaceAll := false
+	switch {
+	case cmd.Input == config.CommandInputNone:
+	case cmd.Input == config.CommandInputSelection && e.selectionActive:
+		input = e.getSelectedText()
+	default:
+		var sb strings.Builder
+		e.buffer.WriteTo(&sb)
+		input = strings.ReplaceAll(sb.String(), "\r\n", "\n")
+		replaceAll = true
+	}
+
+	out, err := e.execUserCommand(cmd.Run, strings.NewReader(input))
+	if err != nil {
+		e.setStatusMessage("%s: %v", name, err)
+		return
+	}
+
+	if cmd.Output == config.CommandOutputStatus {
+		first, _, _ := strings.Cut(strings.TrimRight(out, "\r\n"), "\n")
+		e.setStatusMessage("%s", strings.TrimRight(first, "\r"))
+		return
+	}
+
+	// Output that matches its input, like a formatter run on tidy code,
+	// leaves the buffer unmodified.
+	if strings.ReplaceAll(out, "\r\n", "\n") == input {
+		e.setStatusMessage("Ran %s: no changes", name)
+		return
+	}
+
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	if replaceAll {
+		e.selectAll()
+	}
+	if cmd.Input != config.CommandInputNone && e.selectionActive {
+		e.deleteSelectedText()
+	}
+	e.selectionActive = false
+	e.extraCursorHeight = 0
+	e.extraCursors = nil
+	if out != "" {
+		e.pasteText(out)
+	}
+	e.dirty = true
+	e.setStatusMessage("Ran %s", name)
+}
+
+// execUserCommand runs line through the shell with input on stdin and
+// returns its stdout.
+func (e *Editor) execUserCommand(line string, input io.Reader) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), userCommandTimeout)
+	defer cancel()
+
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.CommandContext(ctx, "cmd", "/C", line)
+	} else {
+		c = exec.CommandContext(ctx, "sh", "-c", line)
+	}
+	startOwnProcessGroup(c)
+	c.WaitDelay = userCommandWaitDelay
+	c.Stdin = input
+	c.Env = append(os.Environ(),
+		"PANKA_FILE="+e.filename,
+		fmt.Sprintf("PANKA_LINE=%d", e.lineBase()+e.cursorY+1),
+		fmt.Sprintf("PANKA_COL=%d", e.cursorX+1),
+	)
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+
+	err := c.Run()
+	if ctx.Err() != nil || errors.Is(err, exec.ErrWaitDelay) {
+		killProcessGroup(c)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("timed out after %v", userCommandTimeout)
+		}
+		if errors.Is(err, exec.ErrWaitDelay) {
+			return "", fmt.Errorf("a process it left running kept its output open")
+		}
+		if msg, _, _ := strings.Cut(strings.TrimSpace(stderr.String()), "\n"); msg != "" {
+			return "", fmt.Errorf("%s", strings.TrimSpace(msg))
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
+
+// userCommandNames lists the configured commands in a stable order.
+func (e *Editor) userCommandNames() []string {
+	names := make([]string, 0, len(e.config.Commands))
+	for name := range e.config.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (e *Editor) handleRunCommandInput(r rune) error {
+	switch r {
+	case '\r': // Enter
+		e.isRunCommand = false
+		name := strings.TrimSpace(e.promptBuffer)
+		e.promptBuffer = ""
+		e.promptCursorX = 0
+		if name == "" {
+			e.setStatusMessage("Run command cancelled.")
+			return nil
+		}
+		e.runUserCommand(name)
+		return nil
+
+	case '\t': // Complete the command name
+		for _, name := range e.userCommandNames() {
+			if strings.HasPrefix(name, e.promptBuffer) {
+				e.promptBuffer = name
+				e.promptCursorX = len([]rune(name))
+				break
+			}
+		}
+
+	case '\x16': // Ctrl+V (Paste)
+		e.pasteIntoPrompt()
+
+	case '\x7f', '\b': // Backspace
+		e.backspacePromptRune()
+
+	default:
+		if r >= 32 {
+			e.insertPromptRune(r)
+		}
+	}
+	return nil
+}
+
+// openRunCommandPrompt starts the Ctrl+R prompt for a user command name.
+func (e *Editor) openRunCommandPrompt() {
+	if len(e.config.Commands) == 0 {
+		e.setStatusMessage("No commands configured; add [commands.<name>] tables to the config.")
+		return
+	}
+	e.isRunCommand = true
+	e.promptBuffer = ""
+	e.promptCursorX = 0
+	e.statusMessage = fmt.Sprintf("Run command (%s): ", strings.Join(e.userCommandNames(), ", "))
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package editor
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// startOwnProcessGroup puts c in a process group of its own, and makes the
+// timeout kill that whole group rather than just the shell, so programs the
+// command started cannot keep running with its output open.
+func startOwnProcessGroup(c *exec.Cmd) {
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error { return killProcessGroup(c) }
+}
+
+// killProcessGroup kills every process left in c's group.
+func killProcessGroup(c *exec.Cmd) error {
+	if c.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
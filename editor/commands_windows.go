@@ -0,0 +1,14 @@
+//go:build windows
+
+package editor
+
+import "os/exec"
+
+// startOwnProcessGroup leaves c as it is: on Windows the timeout kills the
+// shell, and WaitDelay stops the wait for anything it left running.
+func startOwnProcessGroup(c *exec.Cmd) {}
+
+// killProcessGroup does nothing on Windows; see startOwnProcessGroup.
+func killProcessGroup(c *exec.Cmd) error {
+	return nil
+}
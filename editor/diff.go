@@ -0,0 +1,202 @@
+package editor
+
+import "strings"
+
+// lineDiff counts how two versions of a text differ, line by line. Within a
+// run of lines that differ, removed and added lines are paired off as
+// changed lines; the ones left over count as removed or added.
+type lineDiff struct {
+	added, removed, changed int
+}
+
+// diffLines compares the lines a and b with Myers' algorithm, which finds a
+// shortest edit script in O((N+M)D) time for D differing lines, in the
+// linear-space form that splits the texts at the middle of the edit path.
+func diffLines(a, b []string) lineDiff {
+	var d lineDiff
+	removed, added := 0, 0
+	flush := func() {
+		paired := min(removed, added)
+		d.changed += paired
+		d.removed += removed - paired
+		d.added += added - paired
+		removed, added = 0, 0
+	}
+	for _, op := range editScript(a, b) {
+		switch op {
+		case '=':
+			flush()
+		case '-':
+			removed++
+		case '+':
+			added++
+		}
+	}
+	flush()
+	return d
+}
+
+// diffMaxRounds bounds the search for the middle of an edit path. Past it,
+// the two parts are counted as removed and added whole, which pairs them off
+// as changed lines: the count is then an estimate, but two very different
+// texts cannot take quadratic time.
+const diffMaxRounds = 1000
+
+// editScript returns a shortest list of steps that turns a into b: '=' keeps
+// a line, '-' removes one from a and '+' adds one from b.
+func editScript(a, b []string) []byte {
+	ops := make([]byte, 0, len(a)+len(b))
+	return appendEditScript(ops, a, b)
+}
+
+// appendEditScript appends the steps that turn a into b to ops. The lines
+// both ends have in common are set aside, as they usually make up most of a
+// file; the rest is split at a point on a shortest path and each half is
+// compared on its own.
+func appendEditScript(ops []byte, a, b []string) []byte {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	ops = appendOps(ops, '=', prefix)
+	if x, y, ok := middleSnake(a, b); ok {
+		ops = appendEditScript(ops, a[:x], b[:y])
+		ops = appendEditScript(ops, a[x:], b[y:])
+	} else {
+		ops = appendOps(ops, '-', len(a))
+		ops = appendOps(ops, '+', len(b))
+	}
+	return appendOps(ops, '=', suffix)
+}
+
+func appendOps(ops []byte, op byte, n int) []byte {
+	for range n {
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// middleSnake runs Myers' search from both ends of a and b at once until
+// the two paths meet, and returns the point (x, y) where they do, which lies
+// on a shortest path. vf[k+offset] holds the furthest x the forward search
+// has reached on diagonal k = x-y, and vb the same for the backward search,
+// counted from the ends. It reports false when a or b is empty, or when the
+// paths have not met after diffMaxRounds.
+func middleSnake(a, b []string) (x, y int, ok bool) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0, false
+	}
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	vf := make([]int, 2*maxD+2)
+	vb := make([]int, 2*maxD+2)
+	for i := range vf {
+		vf[i], vb[i] = -1, -1
+	}
+	vf[offset+1], vb[offset+1] = 0, 0
+	delta := n - m
+	front := delta%2 != 0 // Which search can meet the other first
+	// Diagonals that ran off the edit graph are trimmed from the next rounds.
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for d := 0; d < min(maxD, diffMaxRounds); d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && vf[i-1] < vf[i+1]) {
+				x = vf[i+1]
+			} else {
+				x = vf[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			vf[i] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case front:
+				if j := offset + delta - k; j >= 0 && j < len(vb) && vb[j] != -1 && x >= n-vb[j] {
+					return x, y, true
+				}
+			}
+		}
+		for k := -d + bStart; k <= d-bEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && vb[i-1] < vb[i+1]) {
+				x = vb[i+1]
+			} else {
+				x = vb[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x, y = x+1, y+1
+			}
+			vb[i] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !front:
+				if j := offset + delta - k; j >= 0 && j < len(vf) && vf[j] != -1 {
+					fx := vf[j]
+					if fx >= n-x {
+						return fx, fx - (j - offset), true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// splitLines splits text into lines the way Buffer.GetLine returns them,
+// without their "\n" or "\r\n".
+func splitLines(text string) []string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// showDiffSummary reports in the status bar how the buffer differs from the
+// file on disk, counted in added, removed and changed lines.
+func (e *Editor) showDiffSummary() {
+	if e.filename == "" {
+		e.setStatusMessage("Nothing to diff: the buffer has no file")
+		return
+	}
+	if e.pager != nil {
+		e.setStatusMessage("Nothing to diff: the file is open in pager mode and cannot change")
+		return
+	}
+	text, _, _, err := e.readFileText(e.filename)
+	if err != nil {
+		e.setStatusMessage("Diff error: %v", err)
+		return
+	}
+	lines := make([]string, e.buffer.LineCount())
+	for y := range lines {
+		lines[y] = e.buffer.GetLine(y)
+	}
+	d := diffLines(splitLines(text), lines)
+	if d == (lineDiff{}) {
+		e.setStatusMessage("No changes from %s on disk", e.filename)
+		return
+	}
+	e.setStatusMessage("Changes from %s on disk: %d added, %d removed, %d changed lines",
+		e.filename, d.added, d.removed, d.changed)
+}
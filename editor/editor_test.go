@@ -2,11 +2,23 @@ package editor
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 
+	"github.com/bulga138/panka/buffer"
 	"github.com/bulga138/panka/config"
+	"github.com/bulga138/panka/runewidth"
+	"github.com/bulga138/panka/version"
 )
 
 // mockTerminal is a test implementation of the Terminal interface
@@ -20,9 +32,14 @@ func (m *mockTerminal) DisableRawMode() error  { return nil }
 func (m *mockTerminal) GetWindowSize() (int, int, error) {
 	return m.width, m.height, nil
 }
-func (m *mockTerminal) Stdin() io.Reader { return m.stdin }
+func (m *mockTerminal) Stdin() io.Reader { return mockInput{m.stdin} }
 func (m *mockTerminal) Close() error     { return nil }
 
+// mockInput never blocks, so its reads have nothing to time out.
+type mockInput struct{ *bytes.Buffer }
+
+func (mockInput) SetReadDeadline(time.Time) error { return nil }
+
 func newMockTerminal() *mockTerminal {
 	return &mockTerminal{
 		width:  80,
@@ -192,7 +209,7 @@ func TestEditor_LoadFileContent(t *testing.T) {
 	tmpfile.Close()
 	
 	// Load content
-	content, err := e.loadFileContent(tmpfile.Name())
+	content, _, err := e.loadFileContent(tmpfile.Name())
 	if err != nil {
 		t.Fatalf("loadFileContent() error = %v", err)
 	}
@@ -210,7 +227,7 @@ func TestEditor_LoadFileContent_Nonexistent(t *testing.T) {
 		t.Fatal(err)
 	}
 	
-	_, err = e.loadFileContent("nonexistent_file_12345.txt")
+	_, _, err = e.loadFileContent("nonexistent_file_12345.txt")
 	if err == nil {
 		t.Error("expected error for nonexistent file")
 	}
@@ -237,7 +254,7 @@ func TestEditor_LoadFileContent_LargeFile(t *testing.T) {
 	tmpfile.Close()
 	
 	// Load content (should use streaming)
-	content, err := e.loadFileContent(tmpfile.Name())
+	content, _, err := e.loadFileContent(tmpfile.Name())
 	if err != nil {
 		t.Fatalf("loadFileContent() error = %v", err)
 	}
@@ -263,7 +280,42 @@ func createTestEditor(content string) (*Editor, error) {
 	}
 	tmpfile.Close()
 	
-	return NewEditor(term, cfg, tmpfile.Name())
+	e, err := NewEditor(term, cfg, tmpfile.Name())
+	if err != nil {
+		return nil, err
+	}
+	e.clipboard = &memClipboard{}
+	return e, nil
+}
+
+// feedInput writes seq to the mock terminal and processes all of it, the
+// way Run does, including the pager's window slides.
+func feedInput(e *Editor, term *mockTerminal, seq string) {
+	term.stdin.WriteString(seq)
+	for term.stdin.Len() > 0 || e.inputReader.Buffered() > 0 {
+		if e.processInput() != nil {
+			return
+		}
+		e.pagerFollowCursor()
+	}
+}
+
+// bufferText is the whole buffer, with "\n" for every line break.
+func bufferText(e *Editor) string {
+	var sb strings.Builder
+	e.buffer.WriteTo(&sb)
+	return strings.ReplaceAll(sb.String(), "\r\n", "\n")
+}
+
+// memClipboard keeps the clipboard in memory so tests never touch the system one.
+type memClipboard struct {
+	text string
+}
+
+func (c *memClipboard) GetText() (string, error) { return c.text, nil }
+func (c *memClipboard) SetText(text string) error {
+	c.text = text
+	return nil
 }
 
 func TestEditor_FindReplace(t *testing.T) {
@@ -282,6 +334,86 @@ func TestEditor_FindReplace(t *testing.T) {
 	}
 }
 
+func TestEditor_ToggleNonPrintableStatus(t *testing.T) {
+	e, err := createTestEditor("a\tb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	for _, want := range []string{"Show non-printable: ON", "Show non-printable: OFF"} {
+		e.handleKey('\x0f') // Ctrl+O
+		if e.statusMessage != want {
+			t.Errorf("status %q, want %q", e.statusMessage, want)
+		}
+	}
+}
+
+func TestEditor_ColumnTypingUndo(t *testing.T) {
+	e, err := createTestEditor("abc\ndef\nghi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.cursorX = 1
+	e.extraCursorHeight = 1
+	e.handleKey('x')
+	e.handleKey('y')
+	var buf bytes.Buffer
+	e.buffer.WriteTo(&buf)
+	if got, want := buf.String(), "axybc\ndxyef\nghi"; got != want {
+		t.Fatalf("after typing: %q, want %q", got, want)
+	}
+
+	// Each undo takes out the last rune typed, not the one before it.
+	for _, want := range []string{"axbc\ndxef\nghi", "abc\ndef\nghi"} {
+		e.undo()
+		buf.Reset()
+		e.buffer.WriteTo(&buf)
+		if got := buf.String(); got != want {
+			t.Errorf("after undo: %q, want %q", got, want)
+		}
+	}
+}
+
+func TestEditor_FindAfterMultibyteText(t *testing.T) {
+	e, err := createTestEditor("naïve café, café\ncafé")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.findAllMatches("café")
+	want := []findResult{{0, 6, 4}, {0, 12, 4}, {1, 0, 4}}
+	if len(e.findMatches) != len(want) {
+		t.Fatalf("matches %v, want %v", e.findMatches, want)
+	}
+	for i, m := range e.findMatches {
+		if m != want[i] {
+			t.Errorf("match %d at %v, want %v", i, m, want[i])
+		}
+	}
+}
+
+func BenchmarkEditor_FindAsYouType(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(&sb, "line %d: the quick brown fox jumps over the lazy dog\n", i)
+	}
+	e, err := createTestEditor(sb.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	e.isFinding = true
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e.promptBuffer = ""
+		e.promptCursorX = 0
+		e.findCacheQuery = ""
+		for _, r := range "quick brow" {
+			e.handleFindInput(r)
+		}
+	}
+}
+
 func BenchmarkEditor_LoadFileContent_Small(b *testing.B) {
 	term := newMockTerminal()
 	cfg := config.DefaultConfig()
@@ -317,3 +449,4372 @@ func BenchmarkEditor_LoadFileContent_Large(b *testing.B) {
 	}
 }
 
+// The paste benchmarks compare the undo record of a 1 MiB paste kept as one
+// piece of text with the per-rune record typing uses; see allocs and B/op.
+func BenchmarkEditor_PasteUndo_Text(b *testing.B) {
+	benchmarkPasteUndo(b, func(e *Editor, text string) {
+		e.pushUndoInsertText(0, 0, text)
+	})
+}
+
+func BenchmarkEditor_PasteUndo_Runes(b *testing.B) {
+	benchmarkPasteUndo(b, func(e *Editor, text string) {
+		var entries []opEntry
+		y, x := 0, 0
+		for _, r := range text {
+			insertLine, insertCol := y, x
+			if r == '\n' {
+				y, x = y+1, 0
+			} else {
+				x++
+			}
+			entries = append(entries, opEntry{insertLine: insertLine, insertCol: insertCol, delLine: y, delCol: x, r: r})
+		}
+		e.pushUndoInsertBlock(entries)
+	})
+}
+
+func benchmarkPasteUndo(b *testing.B, record func(e *Editor, text string)) {
+	text := strings.Repeat("the quick brown fox jumps over the lazy dog\n", 1<<20/44)
+	e, err := createTestEditor("")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := e.buffer.InsertString(0, 0, text); err != nil {
+			b.Fatal(err)
+		}
+		record(e, text)
+		e.undo()
+		e.redoStack = nil
+	}
+}
+
+
+func TestEditor_AutoWrapColumn(t *testing.T) {
+	term := newMockTerminal()
+	cfg := config.DefaultConfig()
+	cfg.AutoWrapColumn = 20
+	e, err := NewEditor(term, cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e.buffer.Insert(0, 0, ' ')
+	e.buffer.Insert(0, 1, ' ')
+	e.cursorX = 2
+	for _, r := range "the quick brown fox jumps over the lazy dog" {
+		e.handleKey(r)
+	}
+
+	expected := []string{
+		"  the quick brown",
+		"  fox jumps over the",
+		"  lazy dog",
+	}
+	if e.buffer.LineCount() != len(expected) {
+		t.Fatalf("expected %d lines, got %d", len(expected), e.buffer.LineCount())
+	}
+	for i, want := range expected {
+		if got := e.buffer.GetLine(i); got != want {
+			t.Errorf("line %d: expected %q, got %q", i, want, got)
+		}
+	}
+	if e.cursorY != 2 || e.cursorX != len("  lazy dog") {
+		t.Errorf("cursor at (%d, %d), expected end of last line", e.cursorY, e.cursorX)
+	}
+
+	// Undo the keystrokes back to the one that triggered the last wrap;
+	// the break must go away together with it.
+	for i := 0; i < len("lazy dog"); i++ {
+		e.undo()
+	}
+	if e.buffer.LineCount() != 2 {
+		t.Fatalf("expected 2 lines after undo, got %d", e.buffer.LineCount())
+	}
+	if got := e.buffer.GetLine(1); got != "  fox jumps over the " {
+		t.Errorf("line 1 after undo: expected %q, got %q", "  fox jumps over the ", got)
+	}
+}
+
+func TestEditor_CtrlCWithoutSelection(t *testing.T) {
+	e, err := createTestEditor("one\ntwo\nthree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Default action: a no-op that leaves the buffer and modes alone.
+	e.extraCursorHeight = 1
+	if err := e.handleCtrlC(); err != nil {
+		t.Fatal(err)
+	}
+	if e.extraCursorHeight != 1 || e.dirty {
+		t.Error("Ctrl+C without a selection should do nothing by default")
+	}
+
+	// "cancel" behaves like Esc.
+	e.config.CtrlCAction = config.CtrlCActionCancel
+	e.handleCtrlC()
+	if e.extraCursorHeight != 0 {
+		t.Error("expected Ctrl+C to cancel multi-cursor mode")
+	}
+
+	e.isFinding = true
+	e.promptBuffer = "two"
+	e.findInitial()
+	e.handleCtrlC()
+	if e.isFinding || e.selectionActive {
+		t.Error("expected Ctrl+C to cancel find mode")
+	}
+	if e.cursorY != 0 || e.cursorX != 0 {
+		t.Errorf("expected cursor restored to (0, 0), got (%d, %d)", e.cursorY, e.cursorX)
+	}
+}
+
+func TestEditor_TinyTerminal(t *testing.T) {
+	sizes := []struct{ width, height int }{
+		{1, 1},
+		{0, 0},
+		{1, 24},
+		{80, 1},
+	}
+	for _, size := range sizes {
+		term := newMockTerminal()
+		term.width, term.height = size.width, size.height
+		e, err := NewEditor(term, config.DefaultConfig(), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range "a line that is much wider than the terminal\nand another" {
+			if r == '\n' {
+				e.handleKey('\r')
+			} else {
+				e.handleKey(r)
+			}
+		}
+
+		if !e.tooSmall {
+			t.Errorf("%dx%d: expected terminal to be flagged as too small", size.width, size.height)
+		}
+		if e.termWidth < 1 || e.termHeight < 1 || e.getTextWidth() < 1 {
+			t.Errorf("%dx%d: non-positive layout %dx%d", size.width, size.height, e.termWidth, e.termHeight)
+		}
+
+		var ab bytes.Buffer
+		e.scroll()
+		e.drawRows(&ab)
+		row, col := e.calculateCursorScreenPosition()
+		if row < 1 || col < 1 {
+			t.Errorf("%dx%d: cursor screen position (%d, %d) is not positive", size.width, size.height, row, col)
+		}
+
+		ab.Reset()
+		e.drawTooSmall(&ab)
+		notice := "terminal too small"[:min(e.termWidth, len("terminal too small"))]
+		if !bytes.Contains(ab.Bytes(), []byte(notice)) {
+			t.Errorf("%dx%d: expected too-small notice, got %q", size.width, size.height, ab.String())
+		}
+	}
+}
+
+func TestEditor_ToggleLineNumbersKeepsCursor(t *testing.T) {
+	long := strings.Repeat("word ", 60) // wraps over several rows at width 80
+	e, err := createTestEditor(strings.Repeat("short\n", 10) + long + "\nlast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.cursorY = 10
+	e.cursorX = 230
+	e.viewportY = 8 // Cursor sits mid-screen with the long line below it
+	e.scroll()
+
+	for i := 0; i < 2; i++ {
+		rowBefore, _ := e.calculateCursorScreenPosition()
+		e.toggleLineNumbers()
+		e.scroll()
+
+		row, col := e.calculateCursorScreenPosition()
+		if row != rowBefore {
+			t.Errorf("toggle %d: cursor moved from screen row %d to %d", i, rowBefore, row)
+		}
+		textWidth := e.getTextWidth()
+		wantCol := e.getVisualX(e.cursorY, e.cursorX)%textWidth + e.lineNumWidth + 1
+		if col != wantCol {
+			t.Errorf("toggle %d: cursor screen column %d, expected %d", i, col, wantCol)
+		}
+		visRow, _ := e.getVisualCursorPos()
+		if visRow != row {
+			t.Errorf("toggle %d: viewport math disagrees: %d vs %d", i, visRow, row)
+		}
+	}
+}
+
+func TestEditor_PasteIntoPrompt(t *testing.T) {
+	e, err := createTestEditor("naïve café\nplain text")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find prompt: multibyte text, only the first line is used.
+	e.isFinding = true
+	e.promptBuffer = "ca"
+	e.promptCursorX = 2
+	e.handlePaste("fé\r\nsecond line")
+	if e.promptBuffer != "café" {
+		t.Errorf("expected prompt %q, got %q", "café", e.promptBuffer)
+	}
+	if e.promptCursorX != 4 {
+		t.Errorf("expected prompt cursor at 4, got %d", e.promptCursorX)
+	}
+	if len(e.findMatches) != 1 || e.findMatches[0] != (findResult{0, 6, 4}) {
+		t.Errorf("expected a single match at (0, 6), got %v", e.findMatches)
+	}
+	if e.buffer.LineCount() != 2 || e.dirty {
+		t.Error("pasting into a prompt must not touch the buffer")
+	}
+
+	// Paste in the middle of the prompt.
+	e.promptCursorX = 0
+	e.insertPromptText("ï\tx")
+	if e.promptBuffer != "ïxcafé" || e.promptCursorX != 2 {
+		t.Errorf("expected %q with cursor 2, got %q with cursor %d", "ïxcafé", e.promptBuffer, e.promptCursorX)
+	}
+	e.isFinding = false
+
+	// Go-to-line prompt only keeps digits.
+	e.isGotoLine = true
+	e.promptBuffer = ""
+	e.promptCursorX = 0
+	e.handlePaste("line 12\n")
+	if e.promptBuffer != "12" {
+		t.Errorf("expected goto prompt %q, got %q", "12", e.promptBuffer)
+	}
+}
+
+func TestEditor_UndoReplaceInFindMode(t *testing.T) {
+	e, err := createTestEditor("foo bar foo\nfoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.isFinding = true
+	e.isReplacing = true
+	e.promptBuffer = "foo"
+	e.replaceBuffer = "bazz"
+	e.findInitial()
+	want := []findResult{{0, 0, 3}, {0, 8, 3}, {1, 0, 3}}
+
+	e.handleReplaceInput('\x12') // Ctrl+R
+	if got := e.buffer.GetLine(0); got != "bazz bar foo" {
+		t.Fatalf("expected first match replaced, got %q", got)
+	}
+
+	e.handleReplaceInput('\x15') // Ctrl+U
+	if got := e.buffer.GetLine(0); got != "foo bar foo" {
+		t.Errorf("expected replace to be undone, got %q", got)
+	}
+	if !e.isReplacing || !e.isFinding {
+		t.Error("undo should not leave replace mode")
+	}
+	if len(e.findMatches) != len(want) {
+		t.Fatalf("expected %d matches after undo, got %v", len(want), e.findMatches)
+	}
+	for i := range want {
+		if e.findMatches[i] != want[i] {
+			t.Errorf("match %d: expected %v, got %v", i, want[i], e.findMatches[i])
+		}
+	}
+	if e.findCurrentMatch != 0 {
+		t.Errorf("expected the restored match to be current, got %d", e.findCurrentMatch)
+	}
+
+	// Redo re-applies the replacement and the match list follows.
+	e.handleReplaceInput('\x19') // Ctrl+Y
+	if got := e.buffer.GetLine(0); got != "bazz bar foo" {
+		t.Errorf("expected replace to be redone, got %q", got)
+	}
+	if len(e.findMatches) != 2 {
+		t.Errorf("expected 2 matches after redo, got %v", e.findMatches)
+	}
+}
+
+func TestEditor_FindMatchLengths(t *testing.T) {
+	// Lowercasing İ yields two runes; matches after it must keep their columns.
+	e, err := createTestEditor("İx \u212AELVIN x\nΣίσυφος")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.isFinding = true
+	e.promptBuffer = "x"
+	e.findInitial()
+	want := []findResult{{0, 1, 1}, {0, 10, 1}}
+	if len(e.findMatches) != len(want) || e.findMatches[0] != want[0] || e.findMatches[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, e.findMatches)
+	}
+	if e.cursorX != 2 || e.selectionAnchorX != 1 {
+		t.Errorf("expected the match selected from 1 to 2, got %d to %d", e.selectionAnchorX, e.cursorX)
+	}
+
+	// Case-insensitive matches, including the Kelvin sign and final sigma.
+	for query, want := range map[string]findResult{"kelvin": {0, 3, 6}, "σίσυφοσ": {1, 0, 7}} {
+		e.promptBuffer = query
+		e.findInitial()
+		if len(e.findMatches) != 1 || e.findMatches[0] != want {
+			t.Errorf("%q: expected %v, got %v", query, want, e.findMatches)
+		}
+	}
+
+	e.isReplacing = true
+	e.promptBuffer = "kelvin"
+	e.replaceBuffer = "k"
+	e.findInitial()
+	e.replaceNext()
+	if got := e.buffer.GetLine(0); got != "İx k x" {
+		t.Errorf("expected the whole match replaced, got %q", got)
+	}
+}
+
+func TestEditor_IncrementalFind(t *testing.T) {
+	e, err := createTestEditor("foobar foo\nfood fob\nFOOBAR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.isFinding = true
+	for _, r := range "foob" {
+		e.handleFindInput(r)
+	}
+	want := []findResult{{0, 0, 4}, {2, 0, 4}}
+	if len(e.findMatches) != len(want) || e.findMatches[0] != want[0] || e.findMatches[1] != want[1] {
+		t.Fatalf("expected %v, got %v", want, e.findMatches)
+	}
+	if e.findCacheQuery != "foob" {
+		t.Errorf("expected the matches for %q to be cached, got %q", "foob", e.findCacheQuery)
+	}
+
+	// Shrinking the query rescans.
+	e.handleFindInput('\x7f')
+	e.handleFindInput('\x7f')
+	if len(e.findMatches) != 5 {
+		t.Errorf("expected 5 matches for %q, got %v", e.promptBuffer, e.findMatches)
+	}
+
+	// An edit invalidates the cache even when the query only grows.
+	e.buffer.InsertString(1, 0, "fo")
+	e.handleFindInput('o')
+	want = []findResult{{0, 0, 3}, {0, 7, 3}, {1, 2, 3}, {2, 0, 3}}
+	if len(e.findMatches) != len(want) {
+		t.Fatalf("expected %v after an edit, got %v", want, e.findMatches)
+	}
+	for i := range want {
+		if e.findMatches[i] != want[i] {
+			t.Errorf("match %d: expected %v, got %v", i, want[i], e.findMatches[i])
+		}
+	}
+}
+
+func TestEditor_DocStats(t *testing.T) {
+	e, err := createTestEditor("héllo, wörld\n\nsnake_case x2 -- 42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.handleKey('\x0e') // Ctrl+N
+	if want := "Document: 3 lines, 5 words, 33 characters"; e.statusMessage != want {
+		t.Errorf("expected %q, got %q", want, e.statusMessage)
+	}
+
+	e.selectionActive = true
+	e.selectionAnchorY, e.selectionAnchorX = 0, 7
+	e.cursorY, e.cursorX = 2, 5
+	e.handleKey('\x0e')
+	if want := "Selection: 3 lines, 2 words, 12 characters"; e.statusMessage != want {
+		t.Errorf("expected %q, got %q", want, e.statusMessage)
+	}
+	if !e.selectionActive {
+		t.Error("statistics should keep the selection")
+	}
+
+	// A rune split across writes is counted once.
+	stats := newDocStats()
+	b := []byte("aé b")
+	stats.Write(b[:2])
+	stats.Write(b[2:])
+	if stats.chars != 4 || stats.words != 2 {
+		t.Errorf("expected 4 characters and 2 words, got %d and %d", stats.chars, stats.words)
+	}
+
+	// A CRLF line break counts as one character, like LF.
+	e, err = createTestEditor("one\r\ntwo\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.handleKey('\x0e')
+	if want := "Document: 3 lines, 2 words, 8 characters"; e.statusMessage != want {
+		t.Errorf("expected %q, got %q", want, e.statusMessage)
+	}
+}
+
+func TestEditor_CRLFRoundTrip(t *testing.T) {
+	e, err := createTestEditor("one\r\ntwo\r\nthree\nfour\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	if e.lineEnding != "\r\n" || e.lineEndingName() != "CRLF" {
+		t.Fatalf("expected CRLF to be detected, got %q", e.lineEnding)
+	}
+
+	// Lines typed with Enter are saved with the file's ending, and the one
+	// stray LF is brought in line.
+	e.cursorY, e.cursorX = 1, 3
+	e.handleKey('\r')
+	for _, r := range "2.5" {
+		e.handleKey(r)
+	}
+	if err := e.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(e.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "one\r\ntwo\r\n2.5\r\nthree\r\nfour\r\n"; string(saved) != want {
+		t.Errorf("saved %q, want %q", saved, want)
+	}
+
+	for content, want := range map[string]string{
+		"":              "\n",
+		"no newline":    "\n",
+		"a\nb\r\nc\n":   "\n",
+		"a\r\nb\nc\r\n": "\r\n",
+		"a\r\n\r\n\n":   "\r\n",
+		"\nx\r\n":       "\n",
+	} {
+		if got := detectLineEnding(content); got != want {
+			t.Errorf("detectLineEnding(%q) = %q, want %q", content, got, want)
+		}
+	}
+}
+
+func TestEditor_PreservesBOM(t *testing.T) {
+	e, err := createTestEditor("\uFEFFfirst\r\nsecond\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	if !e.hasBOM {
+		t.Fatal("expected the BOM to be detected")
+	}
+	if got := e.buffer.GetLine(0); got != "first" {
+		t.Errorf("expected the BOM kept out of the buffer, got %q", got)
+	}
+	if e.dirty || !e.isContentUnchanged() {
+		t.Error("a freshly opened BOM file should not count as modified")
+	}
+
+	if err := e.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(e.filename)
+	if want := "\uFEFFfirst\r\nsecond\r\n"; string(saved) != want {
+		t.Errorf("saved %q, want %q", saved, want)
+	}
+	if !strings.Contains(e.statusMessage, fmt.Sprintf("%d bytes", len(saved))) {
+		t.Errorf("expected the byte count to include the BOM, got %q", e.statusMessage)
+	}
+
+	// Typing and deleting a character leaves the content unchanged again.
+	e.handleKey('x')
+	e.handleKey('\x7f')
+	if !e.isContentUnchanged() {
+		t.Error("expected the content to match the saved file")
+	}
+
+	plain, err := createTestEditor("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(plain.filename)
+	plain.save()
+	if saved, _ := os.ReadFile(plain.filename); string(saved) != "plain" {
+		t.Errorf("a file without a BOM must not gain one, got %q", saved)
+	}
+}
+
+func TestEditor_ConvertIndentation(t *testing.T) {
+	e, err := createTestEditor("\tif x {\n\t\ts := \"a\tb\"\n  \t}\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.config.TabWidth = 4
+	original := bufferText(e)
+
+	e.cursorY, e.cursorX = 1, 2 // On 's'
+	e.feedEscape('\x1b')
+	e.feedEscape('t') // Alt+T
+	if want := "    if x {\n        s := \"a\tb\"\n      }\n"; bufferText(e) != want {
+		t.Fatalf("tabs to spaces: got %q, want %q", bufferText(e), want)
+	}
+	if e.cursorY != 1 || e.cursorX != 8 {
+		t.Errorf("expected the cursor to stay on 's' at column 8, got %d", e.cursorX)
+	}
+	if !strings.Contains(e.statusMessage, "3 line(s)") {
+		t.Errorf("unexpected status %q", e.statusMessage)
+	}
+
+	e.handleConvertIndentation(true)
+	if want := "\tif x {\n\t\ts := \"a\tb\"\n\t  }\n"; bufferText(e) != want {
+		t.Fatalf("spaces to tabs: got %q, want %q", bufferText(e), want)
+	}
+	if e.cursorX != 2 {
+		t.Errorf("expected the cursor back on 's' at column 2, got %d", e.cursorX)
+	}
+
+	// Each conversion is a single undo step.
+	e.undo()
+	e.undo()
+	if bufferText(e) != original {
+		t.Errorf("undo: got %q, want %q", bufferText(e), original)
+	}
+
+	// With a selection only the selected lines change.
+	e.selectionActive = true
+	e.selectionAnchorY, e.selectionAnchorX = 1, 0
+	e.cursorY, e.cursorX = 2, 1
+	e.handleConvertIndentation(false)
+	if want := "\tif x {\n        s := \"a\tb\"\n      }\n"; bufferText(e) != want {
+		t.Errorf("selection: got %q, want %q", bufferText(e), want)
+	}
+}
+
+func TestEditor_ToggleComment(t *testing.T) {
+	e, err := createTestEditor("func f() {\n\tx := 1\n\n\t// y := 2\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := bufferText(e)
+
+	// A selection with one uncommented line comments them all, after the
+	// indentation, and skips the blank line.
+	e.selectionActive = true
+	e.selectionAnchorY, e.selectionAnchorX = 1, 2
+	e.cursorY, e.cursorX = 4, 0
+	e.handleKey('\x1f') // Ctrl+/
+	if want := "func f() {\n\t// x := 1\n\n\t// // y := 2\n}"; bufferText(e) != want {
+		t.Fatalf("comment: got %q, want %q", bufferText(e), want)
+	}
+	if !e.selectionActive || e.selectionAnchorX != 5 {
+		t.Errorf("expected the selection kept and its anchor shifted to 5, got %v, %d", e.selectionActive, e.selectionAnchorX)
+	}
+
+	// Now every line is commented, so the same key uncomments.
+	e.handleKey('\x1f')
+	if bufferText(e) != original {
+		t.Fatalf("uncomment: got %q, want %q", bufferText(e), original)
+	}
+
+	e.handleKey('\x1f')
+	e.undo()
+	if bufferText(e) != original {
+		t.Errorf("expected a single undo step, got %q", bufferText(e))
+	}
+
+	// Without a selection only the cursor line changes; a prefix without its
+	// trailing space is still recognized.
+	e.selectionActive = false
+	e.config.CommentPrefix = "# "
+	e.buffer = buffer.NewRope("  #a\nb")
+	e.cursorY, e.cursorX = 0, 4
+	e.handleKey('\x1f')
+	if got := e.buffer.GetLine(0); got != "  a" || e.cursorX != 3 {
+		t.Errorf("expected %q with the cursor at 3, got %q at %d", "  a", got, e.cursorX)
+	}
+}
+
+func TestEditor_JumpToMatchingBracket(t *testing.T) {
+	e, err := createTestEditor("f(a[0], {b: (c)}) {\n\tif (x) {\n\t}\n}\n)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := e.buffer.Version()
+	undoLen := len(e.undoStack)
+
+	tests := []struct {
+		name         string
+		y, x         int
+		wantY, wantX int
+	}{
+		{"open paren, nested", 0, 1, 0, 16},
+		{"close paren, backward", 0, 16, 0, 1},
+		{"square", 0, 3, 0, 5},
+		{"after a bracket", 0, 6, 0, 3},
+		{"across lines", 0, 18, 3, 0},
+		{"backward across lines", 3, 0, 0, 18},
+		{"inner block", 1, 8, 2, 1},
+	}
+	for _, tt := range tests {
+		e.cursorY, e.cursorX = tt.y, tt.x
+		e.handleKey('\x1d') // Ctrl+]
+		if e.cursorY != tt.wantY || e.cursorX != tt.wantX {
+			t.Errorf("%s: expected (%d, %d), got (%d, %d)", tt.name, tt.wantY, tt.wantX, e.cursorY, e.cursorX)
+		}
+	}
+
+	e.cursorY, e.cursorX = 4, 0
+	e.handleKey('\x1d')
+	if e.cursorY != 4 || e.cursorX != 0 || !strings.Contains(e.statusMessage, "No matching (") {
+		t.Errorf("unbalanced: expected to stay put with a message, got (%d, %d) %q", e.cursorY, e.cursorX, e.statusMessage)
+	}
+	e.cursorY, e.cursorX = 1, 2
+	e.handleKey('\x1d')
+	if !strings.Contains(e.statusMessage, "No bracket") {
+		t.Errorf("expected a message when not on a bracket, got %q", e.statusMessage)
+	}
+	if e.buffer.Version() != version || len(e.undoStack) != undoLen {
+		t.Error("jumping to a bracket must not touch the buffer or the undo stack")
+	}
+}
+
+func TestEditor_MatchingBracketHighlight(t *testing.T) {
+	// The closing paren lands on a wrapped row at the default width of 80.
+	e, err := createTestEditor("x = (" + strings.Repeat("a", 100) + ")\nnone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func() string {
+		var ab bytes.Buffer
+		e.scroll()
+		e.drawRows(&ab)
+		return ab.String()
+	}
+
+	e.cursorY, e.cursorX = 0, 4
+	out := render()
+	if !strings.Contains(out, ansiBracket+"(") || !strings.Contains(out, ansiBracket+")") {
+		t.Errorf("expected both parens highlighted, got %q", out)
+	}
+
+	e.cursorY, e.cursorX = 1, 0
+	if out := render(); strings.Contains(out, ansiBracket) {
+		t.Errorf("expected no highlight away from brackets, got %q", out)
+	}
+
+	e.cursorY, e.cursorX = 0, 4
+	e.selectionActive = true
+	e.selectionAnchorY, e.selectionAnchorX = 0, 0
+	if out := render(); strings.Contains(out, ansiBracket) {
+		t.Errorf("expected no bracket highlight with a selection, got %q", out)
+	}
+}
+
+func TestEditor_ReplaceAllOverlapping(t *testing.T) {
+	tests := []struct {
+		name, content, query, replacement, want string
+		count                                    int
+	}{
+		{"replacement contains the query", "aaa", "a", "aa", "aaaaaa", 3},
+		{"replacement extends the query", "foo foofoo\nfoo", "foo", "foobar", "foobar foobarfoobar\nfoobar", 4},
+		{"overlapping matches", "aaaa aaa", "aa", "b", "bb ba", 3},
+		{"shrinks the line", "xyxyxy", "xy", "", "", 3},
+		{"spans lines", "a,b,c", ",", "\n", "a\nb\nc", 2},
+	}
+	for _, tt := range tests {
+		e, err := createTestEditor(tt.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.isFinding = true
+		e.isReplacing = true
+		e.promptBuffer = tt.query
+		e.replaceBuffer = tt.replacement
+		e.replaceAll()
+
+		var buf bytes.Buffer
+		e.buffer.WriteTo(&buf)
+		if buf.String() != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, buf.String())
+		}
+		if want := fmt.Sprintf("Replaced %d instance(s).", tt.count); e.statusMessage != want {
+			t.Errorf("%s: expected %q, got %q", tt.name, want, e.statusMessage)
+		}
+		e.undo()
+		buf.Reset()
+		e.buffer.WriteTo(&buf)
+		if buf.String() != tt.content {
+			t.Errorf("%s: undo should restore %q, got %q", tt.name, tt.content, buf.String())
+		}
+	}
+}
+
+func TestEditor_BufferList(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{filepath.Join(dir, "one.txt"), filepath.Join(dir, "two.txt"), filepath.Join(dir, "new.txt")}
+	os.WriteFile(names[0], []byte("first\nfile"), 0644)
+	os.WriteFile(names[1], []byte("second file\r\n"), 0644)
+	e, err := NewEditor(newMockTerminal(), config.DefaultConfig(), names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.clipboard = &memClipboard{}
+
+	if e.filename != names[0] || e.buffer.GetLine(1) != "file" {
+		t.Fatalf("expected the first file shown, got %q", e.filename)
+	}
+	e.cursorY, e.cursorX = 1, 2
+	e.handleKey('X')
+	e.handleCSI('~', "6;5") // Ctrl+PageDown
+	if e.filename != names[1] || e.buffer.GetLine(0) != "second file" || e.lineEnding != "\r\n" {
+		t.Fatalf("expected the second file, got %q %q", e.filename, e.buffer.GetLine(0))
+	}
+	if e.cursorY != 0 || e.cursorX != 0 || e.dirty || len(e.undoStack) != 0 {
+		t.Errorf("expected the second buffer's own state, got cursor (%d, %d) dirty=%v", e.cursorY, e.cursorX, e.dirty)
+	}
+	var ab bytes.Buffer
+	e.drawStatusBar(&ab)
+	if !strings.Contains(ab.String(), "[2/3]") {
+		t.Errorf("expected [2/3] in the status bar, got %q", ab.String())
+	}
+
+	e.handleCSI('~', "6;5")
+	e.handleCSI('~', "6;5") // Wraps around to the first buffer
+	if e.filename != names[0] || e.buffer.GetLine(1) != "fiXle" || e.cursorY != 1 || e.cursorX != 3 || !e.dirty {
+		t.Fatalf("expected the first buffer as left, got %q %q at (%d, %d)", e.filename, e.buffer.GetLine(1), e.cursorY, e.cursorX)
+	}
+	e.undo()
+	if e.buffer.GetLine(1) != "file" {
+		t.Errorf("expected undo to stay with its buffer, got %q", e.buffer.GetLine(1))
+	}
+	e.redo()
+	e.handleCSI('~', "5;5") // Ctrl+PageUp wraps back to the new file
+	if e.filename != names[2] || e.buffer.LineCount() != 1 {
+		t.Fatalf("expected the new file, got %q", e.filename)
+	}
+	e.handleKey('Y')
+
+	// Quitting asks about each modified buffer in turn.
+	e.handleKey('\x11') // Ctrl+Q
+	if !e.isQuitting || e.filename != names[0] || !strings.Contains(e.statusMessage, "one.txt") {
+		t.Fatalf("expected to be asked about the first file, got %q", e.statusMessage)
+	}
+	e.handleRune('n')
+	if e.quit || !e.isQuitting || e.filename != names[2] {
+		t.Fatalf("expected to be asked about the new file next, got %q", e.statusMessage)
+	}
+	e.handleRune('y')
+	if !e.quit {
+		t.Error("expected to quit once every buffer was answered")
+	}
+	if got, _ := os.ReadFile(names[2]); string(got) != "Y" {
+		t.Errorf("expected the new file saved, got %q", got)
+	}
+	if got, _ := os.ReadFile(names[0]); string(got) != "first\nfile" {
+		t.Errorf("expected the first file left alone, got %q", got)
+	}
+}
+
+func TestEditor_ReloadFile(t *testing.T) {
+	e, err := createTestEditor("one\ntwo\nthree three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	altR := func() {
+		e.handleRune('\x1b')
+		e.handleRune('r')
+	}
+
+	e.cursorY, e.cursorX = 2, 8
+	os.WriteFile(e.filename, []byte("one\nchanged"), 0644)
+	altR()
+	if got := e.buffer.GetLine(1); got != "changed" || e.buffer.LineCount() != 2 {
+		t.Fatalf("expected the new content, got %q", got)
+	}
+	if e.cursorY != 1 || e.cursorX != 7 {
+		t.Errorf("expected the cursor clamped to (1, 7), got (%d, %d)", e.cursorY, e.cursorX)
+	}
+
+	e.handleKey('!')
+	os.WriteFile(e.filename, []byte("again"), 0644)
+	altR()
+	if !e.isConfirmingReload {
+		t.Fatal("expected a prompt before discarding changes")
+	}
+	e.handleRune('n')
+	if e.isConfirmingReload || e.buffer.GetLine(1) != "changed!" {
+		t.Fatalf("expected the edit kept after declining, got %q", e.buffer.GetLine(1))
+	}
+	altR()
+	e.handleRune('y')
+	if e.buffer.GetLine(0) != "again" || e.dirty || len(e.undoStack) != 0 {
+		t.Errorf("expected a clean reload, got %q dirty=%v", e.buffer.GetLine(0), e.dirty)
+	}
+
+	os.Remove(e.filename)
+	altR()
+	if e.buffer.GetLine(0) != "again" || !strings.Contains(e.statusMessage, "no longer exists") {
+		t.Errorf("expected the buffer kept for a deleted file, got %q, %q", e.buffer.GetLine(0), e.statusMessage)
+	}
+	if !e.isModified() {
+		t.Error("a buffer whose file was deleted should count as modified")
+	}
+}
+
+func TestEditor_SaveWarnsWhenChangedOnDisk(t *testing.T) {
+	e, err := createTestEditor("mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.cursorX = 4
+	e.handleKey('!')
+
+	// Something else writes the file; a different mtime is enough to notice.
+	os.WriteFile(e.filename, []byte("theirs"), 0644)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(e.filename, later, later)
+
+	e.handleKey('\x13') // Ctrl+S
+	if !e.isConfirmingOverwrite {
+		t.Fatal("expected a prompt before overwriting a file changed on disk")
+	}
+	e.handleRune('n')
+	if got, _ := os.ReadFile(e.filename); string(got) != "theirs" || !e.dirty {
+		t.Fatalf("expected the file left alone after declining, got %q", got)
+	}
+
+	// Quitting and saving stops at the same question, and quits once it is
+	// answered and the file written.
+	e.handleKey('\x11') // Ctrl+Q
+	e.handleRune('y')
+	if e.quit || !e.isConfirmingOverwrite {
+		t.Fatalf("expected the overwrite prompt instead of quitting, got %q", e.statusMessage)
+	}
+	e.handleRune('y')
+	if got, _ := os.ReadFile(e.filename); string(got) != "mine!" || e.dirty {
+		t.Fatalf("expected the buffer written after confirming, got %q", got)
+	}
+	if !e.quit {
+		t.Fatal("expected to quit once the save went through")
+	}
+	e.quit = false
+
+	e.handleKey('?')
+	e.handleKey('\x13')
+	if e.isConfirmingOverwrite {
+		t.Error("expected no prompt once our own save was recorded")
+	}
+	if got, _ := os.ReadFile(e.filename); string(got) != "mine!?" {
+		t.Errorf("expected a plain save, got %q", got)
+	}
+}
+
+func TestEditor_QuitSaveAs(t *testing.T) {
+	e, err := createTestEditor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(e.filename)
+	e.filename = ""
+	e.handleKey('x')
+
+	// A buffer without a name asks for one before the quit goes on.
+	e.handleKey('\x11') // Ctrl+Q
+	e.handleRune('y')
+	if e.quit || !e.isSaveAs {
+		t.Fatalf("expected the Save As prompt instead of quitting, got %q", e.statusMessage)
+	}
+	e.handleRune('\x1b')
+	e.escapeTimedOut()
+	if e.quit || e.isSaveAs {
+		t.Fatalf("expected cancelling Save As to cancel the quit, got %q", e.statusMessage)
+	}
+
+	name := filepath.Join(t.TempDir(), "new.txt")
+	e.handleKey('\x11')
+	e.handleRune('y')
+	for _, r := range name + "\r" {
+		e.handleRune(r)
+	}
+	if got, _ := os.ReadFile(name); string(got) != "x" {
+		t.Errorf("expected the buffer saved, got %q", got)
+	}
+	if !e.quit {
+		t.Errorf("expected to quit once the buffer was saved, got %q", e.statusMessage)
+	}
+}
+
+func TestEditor_AutoIndentBrackets(t *testing.T) {
+	e, err := createTestEditor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	typeText := func(text string) {
+		for _, r := range text {
+			e.handleKey(r)
+		}
+	}
+
+	// Off by default: Enter only copies the indentation.
+	typeText("\tif x {\r")
+	if got := bufferText(e); got != "\tif x {\n\t" {
+		t.Fatalf("expected plain indentation with the option off, got %q", got)
+	}
+
+	e.buffer = buffer.NewRope("")
+	e.cursorY, e.cursorX = 0, 0
+	e.config.AutoIndentBrackets = true
+	typeText("func f() {\rreturn g(\rx,\r)\r}")
+	want := "func f() {\n    return g(\n        x,\n    )\n}"
+	if got := bufferText(e); got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	// Enter and its indentation are undone together, as is the dedent with
+	// the bracket typed after it.
+	e.undo()
+	if got := bufferText(e); got != "func f() {\n    return g(\n        x,\n    )\n    " {
+		t.Errorf("undoing the bracket should restore the indentation, got %q", got)
+	}
+	e.undo()
+	if got := bufferText(e); got != "func f() {\n    return g(\n        x,\n    )" {
+		t.Errorf("undoing Enter should remove the new line, got %q", got)
+	}
+
+	e.buffer = buffer.NewRope("")
+	e.cursorY, e.cursorX = 0, 0
+	e.config.IndentWithTabs = true
+	typeText("a := [\r1\r]")
+	if got := bufferText(e); got != "a := [\n\t1\n]" {
+		t.Errorf("expected tab indentation, got %q", got)
+	}
+	typeText(" )")
+	if got := bufferText(e); got != "a := [\n\t1\n] )" {
+		t.Errorf("a bracket after other text must not dedent, got %q", got)
+	}
+}
+
+func TestEditor_InlineRegion(t *testing.T) {
+	for _, tc := range []struct {
+		reply string
+		row   int
+		ok    bool
+	}{
+		{"\x1b[7;1R", 7, true},
+		{"\x1b[24;80R", 24, true},
+		{"\x1b[7R", 0, false},
+		{"\x1b[0;1R", 0, false},
+		{"x\x1b[7;1R", 0, false},
+	} {
+		if row, ok := parseCursorReport(tc.reply); row != tc.row || ok != tc.ok {
+			t.Errorf("parseCursorReport(%q) = %d, %v, want %d, %v", tc.reply, row, ok, tc.row, tc.ok)
+		}
+	}
+	for _, tc := range []struct{ row, h, want int }{
+		{1, 24, 0},
+		{5, 24, 4},
+		{24, 24, 12},
+	} {
+		if got := inlineRegionTop(tc.row, tc.h); got != tc.want {
+			t.Errorf("inlineRegionTop(%d, %d) = %d, want %d", tc.row, tc.h, got, tc.want)
+		}
+	}
+
+	var lines []string
+	for i := 0; i < 40; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	e, err := createTestEditor(strings.Join(lines, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	term := e.term.(*mockTerminal)
+	_, h, _ := term.GetWindowSize()
+
+	// The shell prompt is on row 7: the editor keeps the six rows above it.
+	term.stdin.WriteString("\x1b[7;1R")
+	e.reserveInlineRegion()
+	if e.screenTop != 6 || e.termHeight != h-6-3 {
+		t.Errorf("region: screenTop %d, termHeight %d, want 6, %d", e.screenTop, e.termHeight, h-6-3)
+	}
+	feedInput(e, term, "\x1b[<0;8;9M\x1b[<0;8;9m")
+	if e.cursorY != 2 || e.cursorX != 2 {
+		t.Errorf("click on screen row 9: cursor (%d,%d), want (2,2)", e.cursorY, e.cursorX)
+	}
+	e.setWindowSize(80, 10)
+	if e.screenTop != 5 || e.termHeight != 2 {
+		t.Errorf("after shrinking: screenTop %d, termHeight %d, want 5, 2", e.screenTop, e.termHeight)
+	}
+}
+
+func TestEditor_Mouse(t *testing.T) {
+	var lines []string
+	for i := 0; i < 40; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	e, err := createTestEditor(strings.Join(lines, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := e.term.(*mockTerminal)
+	// The gutter is 5 columns wide, so text starts at screen column 6.
+
+	feedInput(e, term, "\x1b[<0;8;3M\x1b[<0;8;3m")
+	if e.cursorY != 2 || e.cursorX != 2 || e.selectionActive {
+		t.Errorf("click: cursor (%d,%d) selection %v, want (2,2) and no selection", e.cursorY, e.cursorX, e.selectionActive)
+	}
+	feedInput(e, term, "\x1b[<0;2;1M\x1b[<0;2;1m")
+	if e.cursorY != 0 || e.cursorX != 0 {
+		t.Errorf("click in the gutter: cursor (%d,%d), want (0,0)", e.cursorY, e.cursorX)
+	}
+	feedInput(e, term, "\x1b[<0;70;2M\x1b[<0;70;2m")
+	if e.cursorY != 1 || e.cursorX != 6 {
+		t.Errorf("click past the end of a line: cursor (%d,%d), want (1,6)", e.cursorY, e.cursorX)
+	}
+
+	// Drag from the start of line 0 to column 3 of line 1.
+	feedInput(e, term, "\x1b[<0;6;1M\x1b[<32;7;1M\x1b[<32;9;2M\x1b[<0;9;2m")
+	if got := e.getSelectedText(); got != "line 0\nlin" {
+		t.Errorf("drag selected %q, want %q", got, "line 0\nlin")
+	}
+	feedInput(e, term, "\x1b[<32;12;4M")
+	if e.cursorY != 1 || e.cursorX != 3 {
+		t.Errorf("motion after the release moved the cursor to (%d,%d)", e.cursorY, e.cursorX)
+	}
+
+	// Shift+click extends from the cursor; a plain click drops the selection.
+	feedInput(e, term, "\x1b[<0;6;1M\x1b[<0;6;1m\x1b[<4;7;3M\x1b[<4;7;3m")
+	if got := e.getSelectedText(); got != "line 0\nline 1\nl" {
+		t.Errorf("shift+click selected %q", got)
+	}
+	feedInput(e, term, "\x1b[<0;6;5M\x1b[<0;6;5m")
+	if e.selectionActive {
+		t.Error("a plain click should drop the selection")
+	}
+
+	// The wheel scrolls three rows, taking the cursor along only when it
+	// would leave the screen.
+	feedInput(e, term, "\x1b[<0;8;10M\x1b[<0;8;10m\x1b[<65;1;1M")
+	if e.viewportY != 3 || e.cursorY != 9 || e.cursorX != 2 {
+		t.Errorf("wheel down: viewport %d cursor (%d,%d), want 3 and (9,2)", e.viewportY, e.cursorY, e.cursorX)
+	}
+	feedInput(e, term, "\x1b[<65;1;1M\x1b[<65;1;1M\x1b[<65;1;1M")
+	if e.viewportY != 12 || e.cursorY != 12 || e.cursorX != 2 {
+		t.Errorf("wheel down past the cursor: viewport %d cursor (%d,%d), want 12 and (12,2)", e.viewportY, e.cursorY, e.cursorX)
+	}
+	feedInput(e, term, "\x1b[<64;1;1M")
+	if e.viewportY != 9 || e.cursorY != 12 {
+		t.Errorf("wheel up: viewport %d cursor line %d, want 9 and 12", e.viewportY, e.cursorY)
+	}
+	e.scroll()
+	if e.viewportY != 9 {
+		t.Errorf("scroll moved the scrolled viewport to %d", e.viewportY)
+	}
+
+	// Clicks are ignored while a prompt has the keyboard.
+	e.isGotoLine = true
+	feedInput(e, term, "\x1b[<0;6;1M\x1b[<0;6;1m")
+	if e.cursorY != 12 {
+		t.Errorf("click in a prompt moved the cursor to line %d", e.cursorY)
+	}
+	e.isGotoLine = false
+
+	// Wrapped lines and the rows below the text.
+	e, err = createTestEditor(strings.Repeat("x", 80) + "yz\nend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	term = e.term.(*mockTerminal)
+	feedInput(e, term, "\x1b[<0;7;2M")
+	if e.cursorY != 0 || e.cursorX != 76 {
+		t.Errorf("click on a wrapped row: cursor (%d,%d), want (0,76)", e.cursorY, e.cursorX)
+	}
+	feedInput(e, term, "\x1b[<0;7;10M")
+	if e.cursorY != 1 || e.cursorX != 3 {
+		t.Errorf("click below the text: cursor (%d,%d), want (1,3)", e.cursorY, e.cursorX)
+	}
+	feedInput(e, term, "\x1b[<0;7;23M")
+	if e.cursorY != 1 || e.cursorX != 3 {
+		t.Errorf("click on the status bar moved the cursor to (%d,%d)", e.cursorY, e.cursorX)
+	}
+}
+
+func TestEditor_MultiCursorOccurrences(t *testing.T) {
+	e, err := createTestEditor("foo = foo + 1\nfood\nbar(foo)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	altD := func() {
+		e.handleRune('\x1b')
+		e.handleRune('d')
+	}
+
+	e.cursorX = 3 // End of the first foo
+	altD()
+	altD()
+	if len(e.extraCursors) != 2 {
+		t.Fatalf("expected 2 extra cursors, got %v", e.extraCursors)
+	}
+	altD() // Wraps around to the first foo, which already has a cursor
+	if len(e.extraCursors) != 2 || !strings.Contains(e.statusMessage, "No more occurrences") {
+		t.Errorf("expected no more occurrences, got %v and %q", e.extraCursors, e.statusMessage)
+	}
+
+	for _, r := range "Bar" {
+		e.handleKey(r)
+	}
+	if got, want := bufferText(e), "fooBar = fooBar + 1\nfood\nbar(fooBar)"; got != want {
+		t.Errorf("after typing: %q, want %q", got, want)
+	}
+	if e.cursorY != 0 || e.cursorX != 6 {
+		t.Errorf("main cursor at (%d,%d), want (0,6)", e.cursorY, e.cursorX)
+	}
+	if want := []cursorPos{{0, 15}, {2, 10}}; !slices.Equal(e.extraCursors, want) {
+		t.Errorf("extra cursors %v, want %v", e.extraCursors, want)
+	}
+
+	e.handleKey('\x7f')
+	e.handleKey('\x7f')
+	if got, want := bufferText(e), "fooB = fooB + 1\nfood\nbar(fooB)"; got != want {
+		t.Errorf("after backspace: %q, want %q", got, want)
+	}
+
+	// Every edit made at the cursors undoes one keystroke at a time.
+	e.handleKey('\x15')
+	if got, want := bufferText(e), "fooBa = fooBa + 1\nfood\nbar(fooBa)"; got != want {
+		t.Errorf("after undo: %q, want %q", got, want)
+	}
+	if e.extraCursors != nil {
+		t.Errorf("undo should drop the extra cursors, got %v", e.extraCursors)
+	}
+	e.handleKey('\x19')
+	if got, want := bufferText(e), "fooB = fooB + 1\nfood\nbar(fooB)"; got != want {
+		t.Errorf("after redo: %q, want %q", got, want)
+	}
+
+	// Cursors that run into each other merge.
+	e, err = createTestEditor("a a a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.cursorX = 1
+	altD()
+	altD()
+	e.handleKey('\x7f')
+	if got := e.buffer.GetLine(0); got != "  " {
+		t.Errorf("after backspace at three cursors: %q", got)
+	}
+	e.handleKey('x')
+	if got := e.buffer.GetLine(0); got != "x x x" {
+		t.Errorf("after typing: %q", got)
+	}
+	for i := 0; i < 3; i++ {
+		e.handleKey('\x7f')
+	}
+	if got := e.buffer.GetLine(0); got != "" || len(e.extraCursors) != 0 || e.cursorX != 0 {
+		t.Errorf("after backspacing into each other: %q, cursor %d, extra cursors %v", got, e.cursorX, e.extraCursors)
+	}
+	e.buffer = buffer.NewRope("a a")
+	e.cursorX = 1
+
+	// Esc and cursor movement drop the extra cursors.
+	altD()
+	if len(e.extraCursors) == 0 {
+		t.Fatal("expected an extra cursor")
+	}
+	e.cancelMode()
+	if e.extraCursors != nil {
+		t.Errorf("Esc should drop the extra cursors, got %v", e.extraCursors)
+	}
+	altD()
+	e.handleCSI('C', "")
+	if e.extraCursors != nil {
+		t.Errorf("Right should drop the extra cursors, got %v", e.extraCursors)
+	}
+
+	e.buffer = buffer.NewRope(" ")
+	e.cursorX = 0
+	altD()
+	if e.extraCursors != nil || e.statusMessage != "No word at the cursor" {
+		t.Errorf("expected no word at the cursor, got %v and %q", e.extraCursors, e.statusMessage)
+	}
+}
+
+func TestEditor_IndentSelection(t *testing.T) {
+	e, err := createTestEditor("\tfoo\n  bar\nbaz\n\nqux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Select from the middle of foo down to the start of qux, which leaves
+	// qux out.
+	e.selectionActive = true
+	e.selectionAnchorY, e.selectionAnchorX = 0, 2
+	e.cursorY, e.cursorX = 4, 0
+
+	e.handleKey('\t')
+	if got, want := bufferText(e), "    \tfoo\n      bar\n    baz\n\nqux"; got != want {
+		t.Errorf("after Tab: %q, want %q", got, want)
+	}
+	if !e.selectionActive || e.selectionAnchorX != 6 || e.cursorX != 0 {
+		t.Errorf("selection not kept: active %v anchor x %d cursor x %d", e.selectionActive, e.selectionAnchorX, e.cursorX)
+	}
+
+	e.handleKey('\t')
+	e.handleCSI('Z', "")
+	e.handleCSI('Z', "")
+	if got, want := bufferText(e), "\tfoo\n  bar\nbaz\n\nqux"; got != want {
+		t.Errorf("after Tab and two Shift+Tabs: %q, want %q", got, want)
+	}
+	e.handleCSI('Z', "")
+	e.handleCSI('Z', "")
+	if got, want := bufferText(e), "foo\nbar\nbaz\n\nqux"; got != want {
+		t.Errorf("after unindenting past the indentation: %q, want %q", got, want)
+	}
+	if !e.selectionActive || e.selectionAnchorX != 1 {
+		t.Errorf("selection not kept: active %v anchor x %d, want 1", e.selectionActive, e.selectionAnchorX)
+	}
+
+	// Each press undoes as a whole; the last one changed nothing.
+	e.handleKey('\x15')
+	if got, want := bufferText(e), "\tfoo\n  bar\nbaz\n\nqux"; got != want {
+		t.Errorf("after undo: %q, want %q", got, want)
+	}
+
+	e.config.IndentWithTabs = true
+	e.selectionActive = true
+	e.selectionAnchorY, e.selectionAnchorX = 1, 0
+	e.cursorY, e.cursorX = 2, 1
+	e.handleKey('\t')
+	if got, want := bufferText(e), "\tfoo\n\t  bar\n\tbaz\n\nqux"; got != want {
+		t.Errorf("after Tab with indentWithTabs: %q, want %q", got, want)
+	}
+	if e.selectionAnchorX != 0 || e.cursorX != 2 {
+		t.Errorf("selection after Tab: anchor x %d cursor x %d, want 0 and 2", e.selectionAnchorX, e.cursorX)
+	}
+
+	// Within one line, Tab replaces nothing and inserts a tab as usual.
+	e.selectionActive = true
+	e.selectionAnchorY, e.selectionAnchorX = 4, 0
+	e.cursorY, e.cursorX = 4, 2
+	e.handleKey('\t')
+	if got := e.buffer.GetLine(4); got != "qu\tx" || e.selectionActive {
+		t.Errorf("Tab in a one-line selection: %q, selection %v", got, e.selectionActive)
+	}
+}
+
+func TestEditor_SoftTabs(t *testing.T) {
+	e, err := createTestEditor("ab\nx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.config.UseSoftTabs = true
+	e.config.IndentSize = 4
+
+	// From column 2, Tab goes to the stop at 4.
+	e.cursorY, e.cursorX = 0, 2
+	e.handleKey('\t')
+	if got := e.buffer.GetLine(0); got != "ab  " || e.cursorX != 4 {
+		t.Errorf("after Tab at column 2: %q cursor %d, want %q cursor 4", got, e.cursorX, "ab  ")
+	}
+	e.undo()
+	if got := e.buffer.GetLine(0); got != "ab" {
+		t.Errorf("undo should remove the soft tab in one step, got %q", got)
+	}
+
+	// At the start of a line, Tab inserts a whole stop and Backspace takes
+	// the indentation back a stop at a time.
+	e.cursorY, e.cursorX = 1, 0
+	e.handleKey('\t')
+	e.handleKey('\t')
+	e.handleKey(' ')
+	if got := e.buffer.GetLine(1); got != "         x" {
+		t.Fatalf("after two Tabs and a space: %q", got)
+	}
+	e.handleKey(127)
+	e.handleKey(127)
+	if got := e.buffer.GetLine(1); got != "    x" || e.cursorX != 4 {
+		t.Errorf("after two Backspaces: %q cursor %d, want %q cursor 4", got, e.cursorX, "    x")
+	}
+
+	// After text, Backspace removes a single space.
+	e.cursorX = 5
+	e.handleKey('\t')
+	e.handleKey(127)
+	if got := e.buffer.GetLine(1); got != "    x  " {
+		t.Errorf("Backspace after text: %q, want %q", got, "    x  ")
+	}
+}
+
+func TestEditor_UndoLimit(t *testing.T) {
+	e, err := createTestEditor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.config.UndoLimit = 3
+	e.lastGroupID = 1
+
+	// Each step inserts its runes at the end of the line as one group, one
+	// action per rune.
+	step := func(text string) {
+		e.beginUndoGroup()
+		defer e.endUndoGroup()
+		for _, r := range text {
+			x := len([]rune(e.buffer.GetLine(0)))
+			if err := e.buffer.Insert(0, x, r); err != nil {
+				t.Fatal(err)
+			}
+			e.pushUndoInsertBlock([]opEntry{{insertLine: 0, insertCol: x, delLine: 0, delCol: x + 1, r: r}})
+		}
+	}
+	for _, text := range []string{"a", "bb", "cc", "dd", "ee"} {
+		step(text)
+	}
+	if len(e.undoStack) != 6 {
+		t.Fatalf("undo stack holds %d actions, want the 6 of the last 3 steps", len(e.undoStack))
+	}
+	if e.undoStack[0].groupID != e.undoStack[1].groupID {
+		t.Errorf("oldest step kept only in part: group IDs %d and %d", e.undoStack[0].groupID, e.undoStack[1].groupID)
+	}
+
+	for i := 0; i < 4; i++ {
+		e.undo()
+	}
+	if got := e.buffer.GetLine(0); got != "abb" {
+		t.Errorf("after undoing everything kept: %q, want %q", got, "abb")
+	}
+	for i := 0; i < 3; i++ {
+		e.redo()
+	}
+	if got := e.buffer.GetLine(0); got != "abbccddee" {
+		t.Errorf("after redoing: %q, want %q", got, "abbccddee")
+	}
+
+	// A new step still pushes the oldest out.
+	step("f")
+	e.undo()
+	e.undo()
+	e.undo()
+	e.undo()
+	if got := e.buffer.GetLine(0); got != "abbcc" {
+		t.Errorf("after undoing past the limit again: %q, want %q", got, "abbcc")
+	}
+
+	// A step bigger than the limit is kept whole once its group ends, and
+	// the oldest steps make room for it.
+	step("h")
+	step("i")
+	step("j")
+	step(strings.Repeat("g", 10))
+	steps := 1
+	for i := 1; i < len(e.undoStack); i++ {
+		if !sameUndoGroup(e.undoStack[i-1], e.undoStack[i]) {
+			steps++
+		}
+	}
+	if last := e.undoStack[len(e.undoStack)-10:]; steps != 3 || len(e.undoStack) != 12 || last[0].groupID != last[9].groupID {
+		t.Errorf("after a big step: %d steps on the stack, want 3 ending with the whole step", steps)
+	}
+}
+
+func TestEditor_PasteUndoIsCompact(t *testing.T) {
+	e, err := createTestEditor("ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.cursorX = 1
+	if err := e.pasteText("x\nyé\nz"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := e.buffer.GetLine(2), "zb"; got != want || e.cursorY != 2 || e.cursorX != 1 {
+		t.Fatalf("after paste: line 2 %q cursor (%d, %d), want %q cursor (2, 1)", got, e.cursorY, e.cursorX, want)
+	}
+	if len(e.undoStack) != 1 || len(e.undoStack[0].ops) != 0 || e.undoStack[0].text != "x\nyé\nz" {
+		t.Fatalf("paste should be one text action, got %+v", e.undoStack)
+	}
+
+	e.undo()
+	if got := e.buffer.GetLine(0); got != "ab" || e.buffer.LineCount() != 1 || e.cursorX != 1 {
+		t.Errorf("after undo: %q (%d lines) cursor x %d, want %q cursor x 1", got, e.buffer.LineCount(), e.cursorX, "ab")
+	}
+	e.redo()
+	if got := e.buffer.GetLine(1); got != "yé" || e.cursorY != 2 || e.cursorX != 1 {
+		t.Errorf("after redo: line 1 %q cursor (%d, %d), want %q cursor (2, 1)", got, e.cursorY, e.cursorX, "yé")
+	}
+
+	// Pasting on one line ends the cursor past the text, counted in runes.
+	e.cursorY, e.cursorX = 1, 0
+	e.pasteText("éé")
+	e.undo()
+	e.redo()
+	if got := e.buffer.GetLine(1); got != "ééyé" || e.cursorX != 2 {
+		t.Errorf("after one-line paste, undo and redo: %q cursor x %d, want %q cursor x 2", got, e.cursorX, "ééyé")
+	}
+}
+
+func TestEditor_FindWrapMessage(t *testing.T) {
+	e, err := createTestEditor("foo\nfoo\nfoo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.isFinding = true
+	e.statusMessage = "Find: "
+	e.promptBuffer = "foo"
+	e.findInitial()
+	messageBar := func() string {
+		var ab bytes.Buffer
+		e.drawMessageBar(&ab)
+		return ab.String()
+	}
+
+	e.findNext()
+	e.findNext()
+	if e.findCurrentMatch != 2 || e.findWrapNote() != "" {
+		t.Fatalf("at match %d with note %q, want the last match and no note", e.findCurrentMatch, e.findWrapNote())
+	}
+	e.findNext()
+	if got := messageBar(); !strings.Contains(got, "Search wrapped to top (1 of 3)") {
+		t.Errorf("message bar after wrapping forward: %q", got)
+	}
+	if !strings.HasPrefix(messageBar(), ansiClearLine+"Find: foo") {
+		t.Errorf("wrap note should leave the prompt alone: %q", messageBar())
+	}
+
+	e.findNext()
+	if strings.Contains(messageBar(), "wrapped") {
+		t.Errorf("note should go with the next match: %q", messageBar())
+	}
+
+	e.findPrevious()
+	e.findPrevious()
+	if got := messageBar(); !strings.Contains(got, "Search wrapped to bottom (3 of 3)") {
+		t.Errorf("message bar after wrapping back: %q", got)
+	}
+
+	// The note is as transient as a status message.
+	e.statusTime = time.Now().Add(-10 * time.Second)
+	if strings.Contains(messageBar(), "wrapped") {
+		t.Errorf("note should expire: %q", messageBar())
+	}
+}
+
+func TestEditor_GotoLineColumn(t *testing.T) {
+	e, err := createTestEditor("first\nsecond line\nthird")
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := e.term.(*mockTerminal)
+	gotoPosition := func(input string) {
+		feedInput(e, term, "\x14"+input+"\r") // Ctrl+T
+	}
+	tests := []struct {
+		input  string
+		y, x   int
+		status string
+	}{
+		{"2", 1, 0, "Moved to line 2"},
+		{"2:5", 1, 4, "Moved to line 2, column 5"},
+		{"3:99", 2, 5, "Moved to line 3, column 6"},
+		{"1:1", 0, 0, "Moved to line 1, column 1"},
+		{"2:", 0, 0, "Invalid position: 2:"},
+		{":5", 0, 0, "Invalid position: :5"},
+		{"1:2:3", 0, 0, "Invalid position: 1:2:3"},
+		{"0", 0, 0, "Invalid position: 0"},
+		{"2:0", 0, 0, "Invalid position: 2:0"},
+		{"9", 0, 0, "Invalid line number: 9"},
+	}
+	for _, tt := range tests {
+		gotoPosition(tt.input)
+		if e.cursorY != tt.y || e.cursorX != tt.x || e.statusMessage != tt.status {
+			t.Errorf("%q: cursor (%d, %d) status %q, want (%d, %d) %q", tt.input, e.cursorY, e.cursorX, e.statusMessage, tt.y, tt.x, tt.status)
+		}
+	}
+}
+
+func TestEditor_StickyColumn(t *testing.T) {
+	e, err := createTestEditor("a long line\nab\n\tanother one\nshort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.cursorY, e.cursorX = 0, 8
+	steps := []struct {
+		key  byte
+		y, x int
+	}{
+		{'B', 1, 2}, // clamped to the short line
+		{'B', 2, 5}, // visual column 8, past the tab
+		{'A', 1, 2},
+		{'A', 0, 8}, // back where it started
+		{'B', 1, 2},
+		{'D', 1, 1}, // a horizontal move sets a new column
+		{'B', 2, 0}, // column 1 is inside the tab
+		{'B', 3, 1},
+	}
+	for i, step := range steps {
+		e.handleArrowKey(step.key, false)
+		if e.cursorY != step.y || e.cursorX != step.x {
+			t.Errorf("step %d: cursor at (%d, %d), want (%d, %d)", i, e.cursorY, e.cursorX, step.y, step.x)
+		}
+	}
+
+	// An edit where a vertical move left the cursor also sets a new column.
+	e.cursorY, e.cursorX = 0, 8
+	e.handleArrowKey('B', false)
+	e.handleKey('c')
+	e.handleArrowKey('A', false)
+	if e.cursorY != 0 || e.cursorX != 3 {
+		t.Errorf("after typing on the short line: cursor at (%d, %d), want (0, 3)", e.cursorY, e.cursorX)
+	}
+}
+
+func TestEditor_SmartHome(t *testing.T) {
+	e, err := createTestEditor("\t  indented\nplain\n   ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		y, x  int
+		wantX []int // After each press of Home
+	}{
+		{0, 6, []int{3, 0, 3}},
+		{0, 0, []int{3, 0}},
+		{1, 3, []int{0, 0}},
+		{2, 1, []int{3, 0, 3}},
+	}
+	for _, tt := range tests {
+		e.cursorY, e.cursorX = tt.y, tt.x
+		for i, want := range tt.wantX {
+			e.handleCSI('H', "")
+			if e.cursorX != want {
+				t.Errorf("line %d from column %d, press %d: cursor x %d, want %d", tt.y, tt.x, i+1, e.cursorX, want)
+			}
+		}
+	}
+
+	// Shift+Home selects from where the cursor was.
+	e.cursorY, e.cursorX = 0, 6
+	e.handleCSI('~', "1;2")
+	if !e.selectionActive || e.selectionAnchorX != 6 || e.cursorX != 3 {
+		t.Errorf("Shift+Home: active %v anchor %d cursor %d, want anchor 6 cursor 3", e.selectionActive, e.selectionAnchorX, e.cursorX)
+	}
+	e.handleCSI('~', "1;2")
+	if !e.selectionActive || e.selectionAnchorX != 6 || e.cursorX != 0 {
+		t.Errorf("second Shift+Home: active %v anchor %d cursor %d, want anchor 6 cursor 0", e.selectionActive, e.selectionAnchorX, e.cursorX)
+	}
+}
+
+func TestEditor_SaveCreatesBackup(t *testing.T) {
+	e, err := createTestEditor("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.config.CreateBackup = true
+	backup := e.filename + "~"
+	defer os.Remove(backup)
+
+	e.cursorX = 5
+	e.handleKey('!')
+	e.handleKey('\x13') // Ctrl+S
+	if got, err := os.ReadFile(backup); err != nil || string(got) != "first" {
+		t.Fatalf("backup after the first save: %q, %v; want %q", got, err, "first")
+	}
+	if got, _ := os.ReadFile(e.filename); string(got) != "first!" {
+		t.Fatalf("file after the first save: %q", got)
+	}
+
+	// The backup is the file as last saved, not the buffer at any other time.
+	e.handleKey('?')
+	e.handleKey('\x13')
+	if got, _ := os.ReadFile(backup); string(got) != "first!" {
+		t.Errorf("backup after the second save: %q, want %q", got, "first!")
+	}
+
+	// A file that isn't on disk yet gets no backup, and the suffix is
+	// configurable.
+	dir := t.TempDir()
+	e.config.BackupSuffix = ".bak"
+	e.filename = filepath.Join(dir, "new.txt")
+	e.handleKey('\x13')
+	if _, err := os.Stat(e.filename + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("expected no backup of a new file, got %v", err)
+	}
+	e.handleKey('\x13')
+	if got, _ := os.ReadFile(e.filename + ".bak"); string(got) != "first!?" {
+		t.Errorf("backup with .bak suffix: %q, want %q", got, "first!?")
+	}
+}
+
+func TestEditor_ReadOnly(t *testing.T) {
+	e, err := createTestEditor("one\ntwo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.SetReadOnly(true)
+	term := e.term.(*mockTerminal)
+
+	// Typing, Tab, Enter, Backspace, Delete, Ctrl+D, Ctrl+K, Alt+Up and
+	// a bracketed paste.
+	feedInput(e, term, "abc\t\r\x7f\x1b[3~\x04\x0b\x1b[1;3A\x1b[200~pasted\x1b[201~")
+	if got := bufferText(e); got != "one\ntwo" || e.dirty {
+		t.Fatalf("buffer changed to %q (dirty %v)", got, e.dirty)
+	}
+	if e.statusMessage != "Buffer is read-only" {
+		t.Errorf("status %q, want the read-only notice", e.statusMessage)
+	}
+
+	// Moving, selecting and copying still work; cutting doesn't.
+	feedInput(e, term, "\x1b[B\x1b[1;2C\x1b[1;2C\x03")
+	if e.cursorY != 1 || e.cursorX != 2 {
+		t.Errorf("cursor at (%d, %d), want (1, 2)", e.cursorY, e.cursorX)
+	}
+	if got := e.clipboard.(*memClipboard).text; got != "tw" {
+		t.Errorf("copied %q, want %q", got, "tw")
+	}
+	feedInput(e, term, "\x18")
+	if got := bufferText(e); got != "one\ntwo" {
+		t.Errorf("cut changed the buffer to %q", got)
+	}
+
+	var ab bytes.Buffer
+	e.drawStatusBar(&ab)
+	if !strings.Contains(ab.String(), "[RO]") {
+		t.Errorf("status bar %q, want the [RO] marker", ab.String())
+	}
+}
+
+func TestEditor_EmojiWidth(t *testing.T) {
+	line := "a😀b☀\uFE0Fc✓d"
+	e, err := createTestEditor(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runes := []rune(line)
+	if got, want := e.getVisualX(0, len(runes)), runewidth.StringWidth(line); got != want {
+		t.Errorf("line width %d, StringWidth %d", got, want)
+	}
+	// a 😀 b ☀+VS16 c ✓ d start at these columns.
+	wantCols := []int{0, 1, 3, 4, 6, 6, 7, 8}
+	for x, want := range wantCols {
+		if got := e.getVisualX(0, x); got != want {
+			t.Errorf("getVisualX(0, %d) = %d, want %d", x, got, want)
+		}
+	}
+	if got := e.runeXForVisualX(0, 5); got != 3 {
+		t.Errorf("runeXForVisualX(0, 5) = %d, want 3, the sun", got)
+	}
+
+	// The cursor after the emoji is drawn where the terminal puts c.
+	e.cursorX = 5
+	e.scroll()
+	if _, col := e.calculateCursorScreenPosition(); col != e.lineNumWidth+1+6 {
+		t.Errorf("cursor drawn at column %d, want %d", col, e.lineNumWidth+1+6)
+	}
+}
+
+func TestEditor_GraphemeClusters(t *testing.T) {
+	// e + combining acute, a family emoji joined with ZWJs, a thumbs up with
+	// a skin tone, and a keycap.
+	family := "\U0001F468\u200D\U0001F469\u200D\U0001F467"
+	line := "ae\u0301b" + family + "c\U0001F44D\U0001F3FDd1\uFE0F\u20E3"
+	e, err := createTestEditor(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stops := []int{0, 1, 3, 4, 9, 10, 12, 13, 16}
+	for i, want := range stops[1:] {
+		e.handleArrowKey('C', false)
+		if e.cursorX != want {
+			t.Errorf("Right %d: cursor x %d, want %d", i+1, e.cursorX, want)
+		}
+	}
+	for i := len(stops) - 2; i >= 0; i-- {
+		e.handleArrowKey('D', false)
+		if e.cursorX != stops[i] {
+			t.Errorf("Left back to stop %d: cursor x %d, want %d", i, e.cursorX, stops[i])
+		}
+	}
+
+	// Delete and Backspace take the whole character.
+	e.cursorX = 1
+	e.handleCSI('~', "3") // Delete
+	if got, want := e.buffer.GetLine(0), "ab"+family+"c\U0001F44D\U0001F3FDd1\uFE0F\u20E3"; got != want {
+		t.Errorf("after Delete: %q, want %q", got, want)
+	}
+	e.cursorX = 7
+	e.handleKey(127)
+	if got, want := e.buffer.GetLine(0), "abc\U0001F44D\U0001F3FDd1\uFE0F\u20E3"; got != want || e.cursorX != 2 {
+		t.Errorf("after Backspace: %q cursor %d, want %q cursor 2", got, e.cursorX, want)
+	}
+	e.handleKey(127)
+	if got := e.buffer.GetLine(0); got != "ac\U0001F44D\U0001F3FDd1\uFE0F\u20E3" {
+		t.Errorf("Backspace over a plain letter: %q", got)
+	}
+
+	// Undo puts each back whole.
+	e.undo()
+	e.undo()
+	e.undo()
+	if got := e.buffer.GetLine(0); got != line {
+		t.Errorf("after undo: %q, want %q", got, line)
+	}
+}
+
+func TestEditor_WordHighlight(t *testing.T) {
+	e, err := createTestEditor("foo bar foo\nfood foo\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := e.term.(*mockTerminal)
+
+	e.cursorY, e.cursorX = 0, 9
+	feedInput(e, term, "\x1bw")
+	if !e.highlightMatches || len(e.findMatches) != 3 || e.findCurrentMatch != 1 {
+		t.Fatalf("Alt+W: highlight %v, %d matches, current %d; want true, 3, 1", e.highlightMatches, len(e.findMatches), e.findCurrentMatch)
+	}
+	if e.lastSearchQuery != "foo" {
+		t.Errorf("lastSearchQuery = %q, want %q", e.lastSearchQuery, "foo")
+	}
+	if want := (findResult{y: 1, x: 5, length: 3}); e.findMatches[2] != want {
+		t.Errorf("last match = %+v, want %+v (food is not a whole-word match)", e.findMatches[2], want)
+	}
+
+	feedInput(e, term, "\x1bn")
+	if e.cursorY != 1 || e.cursorX != 8 || e.findCurrentMatch != 2 {
+		t.Errorf("Alt+N: cursor (%d,%d) match %d, want (1,8) match 2", e.cursorY, e.cursorX, e.findCurrentMatch)
+	}
+	feedInput(e, term, "\x1bn")
+	if e.cursorY != 0 || e.cursorX != 3 || !e.highlightMatches {
+		t.Errorf("Alt+N wrap: cursor (%d,%d), highlight %v; want (0,3), true", e.cursorY, e.cursorX, e.highlightMatches)
+	}
+	feedInput(e, term, "\x1bp")
+	if e.cursorY != 1 || e.cursorX != 8 {
+		t.Errorf("Alt+P: cursor (%d,%d), want (1,8)", e.cursorY, e.cursorX)
+	}
+
+	feedInput(e, term, "\x1b[D") // Left stays on the word
+	if !e.highlightMatches {
+		t.Fatal("highlight dropped while the cursor is still on an occurrence")
+	}
+	feedInput(e, term, "\x1b[A") // Up moves off it
+	if e.highlightMatches || e.findMatches != nil {
+		t.Errorf("highlight kept after moving off: %v, %d matches", e.highlightMatches, len(e.findMatches))
+	}
+
+	e.cursorY, e.cursorX = 0, 1
+	feedInput(e, term, "\x1bw")
+	feedInput(e, term, "x")
+	if e.highlightMatches || e.findMatches != nil {
+		t.Errorf("highlight kept after an edit: %v, %d matches", e.highlightMatches, len(e.findMatches))
+	}
+
+	e.cursorY, e.cursorX = 1, 6
+	feedInput(e, term, "\x1bw")
+	var ab bytes.Buffer
+	e.scroll()
+	e.drawRows(&ab)
+	if !strings.Contains(ab.String(), ansiMatch+"f") {
+		t.Error("highlighted occurrence not drawn")
+	}
+}
+
+func TestEditor_KillLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		x        int
+		seq      string
+		want     string
+		wantX    int
+		wantLine int
+	}{
+		{"end from start", 0, "\x1bk", "\nsecond\n", 0, 0},
+		{"end from middle", 3, "\x1bk", "one\nsecond\n", 3, 0},
+		{"end at end joins", 7, "\x1bk", "one twosecond\n", 7, 0},
+		{"start from start", 0, "\x1bK", "one two\nsecond\n", 0, 0},
+		{"start from middle", 3, "\x1bK", " two\nsecond\n", 0, 0},
+		{"start from end", 7, "\x1bK", "\nsecond\n", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := createTestEditor("one two\nsecond\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			e.cursorX = tt.x
+			term := e.term.(*mockTerminal)
+			feedInput(e, term, tt.seq)
+			if got := bufferText(e); got != tt.want {
+				t.Errorf("text = %q, want %q", got, tt.want)
+			}
+			if e.cursorY != tt.wantLine || e.cursorX != tt.wantX || e.selectionActive {
+				t.Errorf("cursor (%d,%d) selection %v, want (%d,%d) and no selection", e.cursorY, e.cursorX, e.selectionActive, tt.wantLine, tt.wantX)
+			}
+			e.undo()
+			if got := bufferText(e); got != "one two\nsecond\n" {
+				t.Errorf("after one undo text = %q", got)
+			}
+		})
+	}
+}
+
+func TestEditor_BlockSelection(t *testing.T) {
+	e, err := createTestEditor("alpha one\nbeta two\nxy\ngamma three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := e.term.(*mockTerminal)
+
+	// A block over columns 2-3 of the first three lines; the third line
+	// is only two columns long.
+	e.cursorY, e.cursorX = 0, 2
+	feedInput(e, term, "\x1b[1;4B\x1b[1;4B\x1b[1;4C\x1b[1;4C")
+	if !e.blockActive {
+		t.Fatal("Alt+Shift+arrows did not start a block selection")
+	}
+	if got, want := e.blockRect(), (blockRect{top: 0, bottom: 2, left: 2, right: 4}); got != want {
+		t.Fatalf("block = %+v, want %+v", got, want)
+	}
+	var ab bytes.Buffer
+	e.scroll()
+	e.drawRows(&ab)
+	if out := ab.String(); !strings.Contains(out, ansiInvert+"p") || !strings.Contains(out, ansiInvert+"t") {
+		t.Errorf("block not drawn inverted: %q", out)
+	}
+
+	feedInput(e, term, "X")
+	want := "alXa one\nbeX two\nxyX\ngamma three"
+	if got := bufferText(e); got != want {
+		t.Fatalf("after typing into the block: %q, want %q", got, want)
+	}
+	if e.blockActive || e.extraCursorHeight != -2 || e.cursorY != 2 || e.cursorX != 3 {
+		t.Errorf("block %v height %d cursor (%d,%d); want a column of cursors after the X", e.blockActive, e.extraCursorHeight, e.cursorY, e.cursorX)
+	}
+	feedInput(e, term, "Y")
+	if got, want := bufferText(e), "alXYa one\nbeXY two\nxyXY\ngamma three"; got != want {
+		t.Errorf("typing on: %q, want %q", got, want)
+	}
+
+	e.undo()
+	if got := bufferText(e); got != want {
+		t.Errorf("undo of Y: %q, want %q", got, want)
+	}
+	e.undo()
+	if got, want := bufferText(e), "alpha one\nbeta two\nxy\ngamma three"; got != want {
+		t.Errorf("one undo should take back the whole block edit: %q, want %q", got, want)
+	}
+
+	// A block past the end of the short line: Delete leaves it alone.
+	e.extraCursorHeight = 0
+	e.cursorY, e.cursorX = 1, 2
+	feedInput(e, term, "\x1b[1;4B\x1b[1;4C\x1b[1;4C\x1b[1;4C\x1b[3~")
+	if got, want := bufferText(e), "alpha one\nbetwo\nxy\ngamma three"; got != want {
+		t.Errorf("Delete: %q, want %q", got, want)
+	}
+
+	// Typing pads a line that ends before the block so the text lines up.
+	e.extraCursorHeight = 0
+	e.cursorY, e.cursorX = 0, 7
+	feedInput(e, term, "\x1b[1;4B\x1b[1;4B\x1b[1;4C|")
+	if got, want := bufferText(e), "alpha o|e\nbetwo  |\nxy     |\ngamma three"; got != want {
+		t.Errorf("padding: %q, want %q", got, want)
+	}
+}
+
+func TestEditor_KeepHighlights(t *testing.T) {
+	e, err := createTestEditor("cat dog\ncat\nbird cat\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.config.KeepHighlights = true
+	term := e.term.(*mockTerminal)
+	// A lone Esc is only taken as a key once the read times out.
+	esc := func() {
+		e.handleRune('\x1b')
+		e.escapeTimedOut()
+		e.dropStaleHighlight()
+	}
+
+	// Without Enter, Esc cancels as before.
+	feedInput(e, term, "\x06cat")
+	esc()
+	if e.highlightMatches || e.findMatches != nil || e.cursorY != 0 || e.cursorX != 0 {
+		t.Fatalf("Esc before Enter: highlight %v, %d matches, cursor (%d,%d)", e.highlightMatches, len(e.findMatches), e.cursorY, e.cursorX)
+	}
+
+	feedInput(e, term, "\x06\r")
+	esc()
+	if e.isFinding || !e.highlightMatches || len(e.findMatches) != 3 {
+		t.Fatalf("Esc after Enter: finding %v, highlight %v, %d matches", e.isFinding, e.highlightMatches, len(e.findMatches))
+	}
+	if e.cursorY != 0 || e.cursorX != 3 {
+		t.Errorf("cursor (%d,%d), want it left at the match (0,3)", e.cursorY, e.cursorX)
+	}
+
+	feedInput(e, term, "\x1bn")
+	if e.cursorY != 1 || e.cursorX != 3 || e.statusMessage != "Match 2 of 3" {
+		t.Errorf("Alt+N: cursor (%d,%d) status %q, want (1,3) and Match 2 of 3", e.cursorY, e.cursorX, e.statusMessage)
+	}
+	feedInput(e, term, "\x1b[H") // Moving the cursor keeps them
+	feedInput(e, term, "\x1bp")
+	if !e.highlightMatches || e.cursorY != 0 || e.statusMessage != "Match 1 of 3" {
+		t.Errorf("Alt+P after Home: highlight %v cursor (%d,%d) status %q", e.highlightMatches, e.cursorY, e.cursorX, e.statusMessage)
+	}
+
+	esc()
+	if e.highlightMatches || e.findMatches != nil {
+		t.Error("second Esc left the highlights")
+	}
+
+	feedInput(e, term, "\x06\r")
+	esc()
+	feedInput(e, term, "\x1b[Bx") // Any edit clears them
+	if e.highlightMatches || e.findMatches != nil {
+		t.Error("edit left the highlights")
+	}
+}
+
+func TestEditor_AutoSave(t *testing.T) {
+	e, err := createTestEditor("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.config.AutoSaveSeconds = 2
+	onDisk := func() string {
+		data, err := os.ReadFile(e.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	e.handleKey('!')
+	e.lastInputTime = time.Now()
+	if !e.autoSavePending() {
+		t.Fatal("no auto-save pending after an edit")
+	}
+	e.autoSave()
+	if got := onDisk(); got != "hello" {
+		t.Fatalf("saved before the idle time was up: %q", got)
+	}
+
+	// A prompt holds the save back.
+	e.lastInputTime = time.Now().Add(-3 * time.Second)
+	e.isFinding = true
+	e.autoSave()
+	if got := onDisk(); got != "hello" {
+		t.Fatalf("saved while the find prompt was open: %q", got)
+	}
+	e.isFinding = false
+
+	e.autoSave()
+	if got := onDisk(); got != "!hello" || e.dirty {
+		t.Fatalf("after idling: file %q, dirty %v", got, e.dirty)
+	}
+	if e.statusMessage != "Auto-saved" {
+		t.Errorf("status = %q, want %q", e.statusMessage, "Auto-saved")
+	}
+	if e.autoSavePending() {
+		t.Error("auto-save still pending after saving")
+	}
+
+	// A file changed on disk is not overwritten, and not tried again until
+	// the next edit.
+	if err := os.WriteFile(e.filename, []byte("changed elsewhere"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e.handleKey('?')
+	e.lastInputTime = time.Now().Add(-3 * time.Second)
+	e.autoSave()
+	if got := onDisk(); got != "changed elsewhere" || !e.dirty || e.autoSavePending() {
+		t.Errorf("file changed on disk: file %q, dirty %v, pending %v", got, e.dirty, e.autoSavePending())
+	}
+}
+
+func TestEditor_AutoSaveWithoutReadDeadlines(t *testing.T) {
+	// An io.Pipe, like the Windows console, cannot take a read deadline.
+	r, w := io.Pipe()
+	defer w.Close()
+	name := filepath.Join(t.TempDir(), "idle.txt")
+	if err := os.WriteFile(name, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DefaultConfig()
+	cfg.AutoSaveSeconds = 1
+	e, err := NewEditor(&pipeTerminal{newMockTerminal(), r}, cfg, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.handleKey('!')
+	e.lastInputTime = time.Now()
+
+	done := make(chan error, 1)
+	go func() { done <- e.processInput() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read never gave up to auto-save")
+	}
+	if got, _ := os.ReadFile(name); string(got) != "!hello" || e.dirty {
+		t.Errorf("after idling: file %q, dirty %v", got, e.dirty)
+	}
+
+	// Input still arrives through the goroutine reading the pipe.
+	go w.Write([]byte("x"))
+	if err := e.processInput(); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.buffer.GetLine(0); got != "!xhello" {
+		t.Errorf("after typing: %q", got)
+	}
+}
+
+func TestEditor_MoveParagraph(t *testing.T) {
+	e, err := createTestEditor("\n\none\ntwo\n  \nthree\n\n\nfour\nfive\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lines: 0-1 blank, 2-3 paragraph, 4 spaces only, 5 paragraph, 6-7
+	// blank, 8-9 paragraph, 10 the empty last line.
+	type pos struct{ y, x int }
+	down := []pos{{4, 0}, {6, 0}, {10, 0}, {10, 0}}
+	e.cursorY, e.cursorX = 0, 0
+	for i, want := range down {
+		e.handleCSI('B', "1;5")
+		if got := (pos{e.cursorY, e.cursorX}); got != want {
+			t.Errorf("Ctrl+Down #%d: cursor %v, want %v", i+1, got, want)
+		}
+	}
+	up := []pos{{7, 0}, {4, 0}, {1, 0}, {0, 0}}
+	for i, want := range up {
+		e.handleCSI('A', "1;5")
+		if got := (pos{e.cursorY, e.cursorX}); got != want {
+			t.Errorf("Ctrl+Up #%d: cursor %v, want %v", i+1, got, want)
+		}
+	}
+
+	// From the middle of a line; Shift extends the selection.
+	e.cursorY, e.cursorX = 2, 1
+	e.handleCSI('B', "1;6")
+	if !e.selectionActive || e.selectionAnchorY != 2 || e.selectionAnchorX != 1 || e.cursorY != 4 {
+		t.Errorf("Ctrl+Shift+Down: selection %v from (%d,%d) to (%d,%d)", e.selectionActive, e.selectionAnchorY, e.selectionAnchorX, e.cursorY, e.cursorX)
+	}
+	e.handleCSI('B', "1;6")
+	if got := e.getSelectedText(); got != "ne\ntwo\n  \nthree\n" {
+		t.Errorf("selected %q", got)
+	}
+	e.handleCSI('A', "1;5")
+	if e.selectionActive || e.cursorY != 4 {
+		t.Errorf("Ctrl+Up: selection %v, cursor line %d; want none and line 4", e.selectionActive, e.cursorY)
+	}
+
+	// No trailing blank line: the last paragraph runs to the end of the buffer.
+	e, err = createTestEditor("a\nb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.handleCSI('B', "1;5")
+	if e.cursorY != 1 || e.cursorX != 1 {
+		t.Errorf("Ctrl+Down to end: cursor (%d,%d), want (1,1)", e.cursorY, e.cursorX)
+	}
+}
+
+func TestEditor_UTF16(t *testing.T) {
+	// encode builds a UTF-16 fixture with its byte order mark.
+	encode := func(s string, bigEndian bool) []byte {
+		var b []byte
+		for _, u := range utf16.Encode([]rune("\uFEFF" + s)) {
+			if bigEndian {
+				b = append(b, byte(u>>8), byte(u))
+			} else {
+				b = append(b, byte(u), byte(u>>8))
+			}
+		}
+		return b
+	}
+
+	for _, tt := range []struct {
+		name      string
+		bigEndian bool
+		want      textEncoding
+	}{
+		{"LE", false, encodingUTF16LE},
+		{"BE", true, encodingUTF16BE},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "utf16.txt")
+			if err := os.WriteFile(path, encode("héllo\n😀 wörld\n", tt.bigEndian), 0644); err != nil {
+				t.Fatal(err)
+			}
+			e, err := NewEditor(newMockTerminal(), config.DefaultConfig(), path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.encoding != tt.want || !e.hasBOM {
+				t.Fatalf("encoding = %v, hasBOM = %v; want %v with a BOM", e.encoding, e.hasBOM, tt.want)
+			}
+			if got := bufferText(e); got != "héllo\n😀 wörld\n" {
+				t.Fatalf("decoded %q", got)
+			}
+			var ab bytes.Buffer
+			e.drawStatusBar(&ab)
+			if !strings.Contains(ab.String(), tt.want.String()) {
+				t.Errorf("status bar %q does not show %s", ab.String(), tt.want)
+			}
+
+			// Edits are saved back in the same encoding, BOM first.
+			e.cursorY, e.cursorX = 0, 5
+			for _, r := range "!😀" {
+				e.handleKey(r)
+			}
+			if err := e.save(); err != nil {
+				t.Fatal(err)
+			}
+			saved, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := encode("héllo!😀\n😀 wörld\n", tt.bigEndian); !bytes.Equal(saved, want) {
+				t.Errorf("saved % x\nwant  % x", saved, want)
+			}
+			if want := fmt.Sprintf("%d bytes written", len(saved)); !strings.HasPrefix(e.statusMessage, want) {
+				t.Errorf("status %q, want it to start with %q", e.statusMessage, want)
+			}
+		})
+	}
+
+	// Files over the streaming threshold are decoded while they are read.
+	e, err := NewEditor(newMockTerminal(), config.DefaultConfig(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "large.txt")
+	large := strings.Repeat("ab😀\n", 200*1024)
+	if err := os.WriteFile(path, encode(large, true), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, enc, err := e.loadFileContent(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc != encodingUTF16BE || got != "\uFEFF"+large {
+		t.Errorf("streamed load gave %v and %d bytes, want UTF-16BE and %d", enc, len(got), len("\uFEFF"+large))
+	}
+
+	// Code units and surrogate pairs split across reads come out whole.
+	fixture := encode("a😀b", false)
+	d := utf16Decoder{}
+	var out []byte
+	for i := range fixture {
+		out = d.decode(out, fixture[i:i+1])
+	}
+	if got := string(d.flush(out)); got != "\uFEFFa😀b" {
+		t.Errorf("byte-at-a-time decode = %q", got)
+	}
+	d = utf16Decoder{}
+	if got := string(d.flush(d.decode(nil, fixture[:len(fixture)-4]))); got != "\uFEFFa\uFFFD" {
+		t.Errorf("truncated decode = %q, want a replacement for the lone surrogate", got)
+	}
+
+	// Without a BOM the file is UTF-8.
+	if enc := detectEncoding([]byte("\xff\x00plain")); enc != encodingUTF8 {
+		t.Errorf("detectEncoding without a BOM = %v", enc)
+	}
+}
+
+func TestEditor_InvalidUTF8(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "binary.dat")
+	fixture := []byte("ok\xff\xfe line\n\x80\xc3(end\n")
+	if err := os.WriteFile(binary, fixture, 0644); err != nil {
+		t.Fatal(err)
+	}
+	text := filepath.Join(dir, "text.txt")
+	if err := os.WriteFile(text, []byte("plain\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.DefaultConfig()
+	cfg.AutoSaveSeconds = 1
+	e, err := NewEditor(newMockTerminal(), cfg, binary, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.invalidUTF8 {
+		t.Fatal("invalid UTF-8 was not detected")
+	}
+	if !strings.Contains(e.statusMessage, "not valid UTF-8") {
+		t.Errorf("status %q, want the UTF-8 warning", e.statusMessage)
+	}
+	term := e.term.(*mockTerminal)
+
+	// Typing, Backspace, a paste, Save (Ctrl+S) and Save As (Ctrl+E) are all
+	// refused, so the bytes on disk are never rewritten.
+	feedInput(e, term, "abc\x7f\x1b[200~pasted\x1b[201~\x13\x05")
+	if e.dirty || e.isSaveAs || e.autoSavePending() {
+		t.Fatalf("dirty %v, isSaveAs %v, autoSavePending %v; want the buffer left alone", e.dirty, e.isSaveAs, e.autoSavePending())
+	}
+	if want := "Read-only: file is not valid UTF-8 and saving would corrupt it"; e.statusMessage != want {
+		t.Errorf("status %q, want %q", e.statusMessage, want)
+	}
+	if saved, err := os.ReadFile(binary); err != nil || !bytes.Equal(saved, fixture) {
+		t.Errorf("file on disk is % x (%v), want % x", saved, err, fixture)
+	}
+	var ab bytes.Buffer
+	e.drawStatusBar(&ab)
+	if !strings.Contains(ab.String(), "[RO]") {
+		t.Errorf("status bar %q, want the [RO] marker", ab.String())
+	}
+
+	// The flag belongs to the buffer: the valid file next to it is editable.
+	e.switchBuffer(1)
+	feedInput(e, term, "x")
+	if got := e.buffer.GetLine(0); got != "xplain" || e.invalidUTF8 {
+		t.Errorf("second buffer is %q (invalidUTF8 %v), want it edited", got, e.invalidUTF8)
+	}
+	e.switchBuffer(0)
+	if !e.invalidUTF8 {
+		t.Error("switching back lost the invalid UTF-8 flag")
+	}
+}
+
+func TestEditor_ScrollOff(t *testing.T) {
+	lines := make([]string, 100)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d", i)
+	}
+	e, err := createTestEditor(strings.Join(lines, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.config.ScrollOff = 3
+	e.setWindowSize(80, 23) // 20 text rows
+	row := func() int {
+		r, _ := e.getVisualCursorPos()
+		return r - 1
+	}
+
+	// Going down, the view scrolls once the cursor is 3 rows from the bottom.
+	for e.cursorY < 16 {
+		e.cursorY++
+		e.scroll()
+	}
+	if e.viewportY != 0 {
+		t.Fatalf("viewport scrolled to %d before the margin was reached", e.viewportY)
+	}
+	e.cursorY++
+	e.scroll()
+	if e.viewportY != 1 || row() != 16 {
+		t.Errorf("viewport %d, cursor row %d; want 1 and 16", e.viewportY, row())
+	}
+
+	// Going up, it keeps 3 rows above the cursor.
+	e.viewportY, e.cursorY = 40, 43
+	e.scroll()
+	e.cursorY--
+	e.scroll()
+	if e.viewportY != 39 || row() != 3 {
+		t.Errorf("viewport %d, cursor row %d; want 39 and 3", e.viewportY, row())
+	}
+
+	// A jump lands with the margin on the side the view moved.
+	e.cursorY = 80
+	e.scroll()
+	if row() != 16 {
+		t.Errorf("after a jump down the cursor is on row %d, want 16", row())
+	}
+
+	// At the ends of the buffer the cursor may reach the edge of the screen.
+	e.cursorY = 99
+	e.scroll()
+	if e.viewportY != 80 || row() != 19 {
+		t.Errorf("last line: viewport %d, cursor row %d; want 80 and 19", e.viewportY, row())
+	}
+	e.cursorY = 0
+	e.scroll()
+	if e.viewportY != 0 || row() != 0 {
+		t.Errorf("first line: viewport %d, cursor row %d; want 0 and 0", e.viewportY, row())
+	}
+
+	// Wrapped lines count as the rows they take up: at the start of a last
+	// line three rows long, the two rows below it are all the margin left.
+	e.buffer.InsertString(99, 0, strings.Repeat("x", e.getTextWidth()*2))
+	e.cursorY, e.cursorX = 99, 0
+	e.scroll()
+	if e.viewportY != 82 || e.viewportWrapOffset != 0 || row() != 17 {
+		t.Errorf("wrapped last line: viewport %d+%d, cursor row %d; want 82+0 and 17", e.viewportY, e.viewportWrapOffset, row())
+	}
+
+	// The margin is capped at half the screen, so the cursor stays mid-screen.
+	e.config.ScrollOff = 100
+	e.viewportY, e.viewportWrapOffset, e.cursorY = 50, 0, 60
+	e.scroll()
+	for _, y := range []int{61, 62, 59} {
+		e.cursorY = y
+		e.scroll()
+		if r := row(); r != 9 && r != 10 {
+			t.Errorf("cursor on line %d is on row %d, want the middle of the screen", y, r)
+		}
+	}
+
+	// The wheel takes the cursor along to the edge of the margin.
+	e.config.ScrollOff = 3
+	e.viewportY, e.viewportWrapOffset, e.cursorY, e.cursorX = 40, 0, 45, 0
+	e.scrollLines(3)
+	e.scroll()
+	if e.viewportY != 43 || e.cursorY != 46 || row() != 3 {
+		t.Errorf("wheel down: viewport %d, cursor line %d on row %d; want 43, 46 and 3", e.viewportY, e.cursorY, row())
+	}
+}
+
+func TestEditor_TabAcrossWrap(t *testing.T) {
+	rows := func(e *Editor) []string {
+		var ab bytes.Buffer
+		e.scroll()
+		e.drawRows(&ab)
+		return strings.Split(ab.String(), ansiClearLine+"\r\n")
+	}
+
+	for _, tt := range []struct {
+		name       string
+		line       string
+		row0, row1 string
+	}{
+		// The tab runs from column 16 to 20 and the rows are 18 wide: two
+		// columns on each row.
+		{"plain", strings.Repeat("a", 16) + "\tX", strings.Repeat("a", 16) + "  ", "  X"},
+		// A combining mark takes no column, so it doesn't shorten the tab.
+		{"combining mark", "e\u0301" + strings.Repeat("a", 15) + "\tX", "e\u0301" + strings.Repeat("a", 15) + "  ", "  X"},
+		// A wide rune takes two.
+		{"wide rune", "中" + strings.Repeat("a", 14) + "\tX", "中" + strings.Repeat("a", 14) + "  ", "  X"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := createTestEditor(tt.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(e.filename)
+			e.showLineNumbers = false
+			e.updateLineNumWidth()
+			e.config.TabWidth = 4
+			e.setWindowSize(18, 10)
+
+			got := rows(e)
+			if got[0] != tt.row0 || got[1] != tt.row1 {
+				t.Errorf("rows %q and %q, want %q and %q", got[0], got[1], tt.row0, tt.row1)
+			}
+			// The cursor after the tab is drawn where X is.
+			e.cursorX = len([]rune(tt.line)) - 1
+			if row, col := e.calculateCursorScreenPosition(); row != 2 || col != 3 {
+				t.Errorf("cursor on X at (%d, %d), want (2, 3)", row, col)
+			}
+		})
+	}
+
+	// With non-printables shown, the arrow starts the tab and the rest of it,
+	// on the next row, is blank.
+	e, err := createTestEditor(strings.Repeat("a", 16) + "\tX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.showLineNumbers = false
+	e.updateLineNumWidth()
+	e.showNonPrintable = true
+	e.config.TabWidth = 4
+	e.setWindowSize(18, 10)
+	got := rows(e)
+	if want := strings.Repeat("a", 16) + ansiDim + "→" + ansiReset + " "; got[0] != want {
+		t.Errorf("first row %q, want %q", got[0], want)
+	}
+	if want := "  X" + ansiDim + "¶" + ansiReset; got[1] != want {
+		t.Errorf("second row %q, want %q", got[1], want)
+	}
+}
+
+func TestEditor_FormatOnSave(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses tr and sh")
+	}
+	e, err := createTestEditor("banana\nsalsa\nlast line here")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	saved := func() string {
+		b, err := os.ReadFile(e.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// The formatted text is saved and replaces the buffer; the cursor stays
+	// put, clamped to the new text.
+	e.config.FormatCommand = "tr a b | head -n 2"
+	e.cursorY, e.cursorX = 2, 9
+	e.dirty = true
+	if err := e.save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := saved(); got != "bbnbnb\nsblsb\n" {
+		t.Errorf("saved %q, want the formatted text", got)
+	}
+	if got := e.buffer.GetLine(0) + "|" + e.buffer.GetLine(1); got != "bbnbnb|sblsb" || e.dirty {
+		t.Errorf("buffer %q (dirty %v), want the formatted text, saved", got, e.dirty)
+	}
+	if e.cursorY != 2 || e.cursorX != 0 {
+		t.Errorf("cursor at (%d, %d), want it clamped to (2, 0)", e.cursorY, e.cursorX)
+	}
+	if !strings.HasPrefix(e.statusMessage, "13 bytes written") {
+		t.Errorf("status %q", e.statusMessage)
+	}
+
+	// Formatting is one undo step.
+	e.undo()
+	if got := e.buffer.GetLine(2); got != "last line here" {
+		t.Errorf("undo left line 2 as %q", got)
+	}
+
+	// A failing formatter leaves the text alone and says why.
+	e.config.FormatCommand = "echo bad input 1>&2; exit 3"
+	if err := e.save(); err != nil {
+		t.Fatal(err)
+	}
+	if got := saved(); got != "banana\nsalsa\nlast line here" {
+		t.Errorf("saved %q, want the unformatted text", got)
+	}
+	if want := "(not formatted: bad input)"; !strings.HasSuffix(e.statusMessage, want) {
+		t.Errorf("status %q, want it to end with %q", e.statusMessage, want)
+	}
+	if e.dirty {
+		t.Error("the unformatted text should still count as saved")
+	}
+}
+
+func TestEditor_CommandPalette(t *testing.T) {
+	e, err := createTestEditor("pear  \nfig\napple\t\nkiwi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	term := e.term.(*mockTerminal)
+	messageBar := func() string {
+		var ab bytes.Buffer
+		e.drawMessageBar(&ab)
+		return ab.String()
+	}
+
+	// The commands starting with what is typed are listed, and Tab completes
+	// a unique one.
+	feedInput(e, term, "\x10tr")
+	if !e.isCommandMode {
+		t.Fatal("Ctrl+P should open the command palette")
+	}
+	if bar := messageBar(); !strings.Contains(bar, "Command: tr") || !strings.Contains(bar, "trim_whitespace") || strings.Contains(bar, "sort_lines") {
+		t.Errorf("message bar %q, want the commands starting with tr", bar)
+	}
+	feedInput(e, term, "\t")
+	if e.promptBuffer != "trim_whitespace " {
+		t.Errorf("Tab completed to %q", e.promptBuffer)
+	}
+	feedInput(e, term, "\r")
+	if got := bufferText(e); got != "pear\nfig\napple\nkiwi" || e.isCommandMode {
+		t.Fatalf("trim_whitespace left %q (palette open %v)", got, e.isCommandMode)
+	}
+
+	// A unique prefix is enough, "-" stands for "_", and the lines are
+	// sorted as one undo step.
+	feedInput(e, term, "\x10Sort-L\r")
+	if got := bufferText(e); got != "apple\nfig\nkiwi\npear" {
+		t.Errorf("sort_lines gave %q", got)
+	}
+	e.undo()
+	if got := bufferText(e); got != "pear\nfig\napple\nkiwi" {
+		t.Errorf("undo of sort_lines gave %q", got)
+	}
+
+	// goto_line takes a position; the actions that have keys run like them.
+	feedInput(e, term, "\x10goto 3:2\r")
+	if e.cursorY != 2 || e.cursorX != 1 {
+		t.Errorf("goto_line 3:2 put the cursor at (%d, %d)", e.cursorY, e.cursorX)
+	}
+	lineNumbers := e.showLineNumbers
+	feedInput(e, term, "\x10toggle_line\r")
+	if e.showLineNumbers == lineNumbers {
+		t.Error("toggle_line_numbers did not run")
+	}
+
+	for _, tt := range []struct{ line, status string }{
+		{"frobnicate", "Unknown command: frobnicate"},
+		{"to", "Ambiguous command to: to_spaces, to_tabs, toggle_"},
+		{"reload now", "reload takes no argument"},
+		{"", "Command cancelled."},
+	} {
+		feedInput(e, term, "\x10" + tt.line + "\r")
+		if !strings.HasPrefix(e.statusMessage, tt.status) {
+			t.Errorf("%q: status %q, want %q", tt.line, e.statusMessage, tt.status)
+		}
+	}
+
+	// Esc closes the palette without running anything.
+	feedInput(e, term, "\x10sort")
+	e.handleRune('\x1b')
+	e.escapeTimedOut()
+	if e.isCommandMode || e.statusMessage != "Command cancelled." {
+		t.Errorf("Esc left the palette open %v, status %q", e.isCommandMode, e.statusMessage)
+	}
+
+	// Commands that edit are refused in read-only mode.
+	e.SetReadOnly(true)
+	feedInput(e, term, "\x10sort_lines\r")
+	if got := bufferText(e); got != "pear\nfig\napple\nkiwi" || e.statusMessage != "Buffer is read-only" {
+		t.Errorf("read-only sort_lines gave %q, status %q", got, e.statusMessage)
+	}
+}
+
+func TestEditor_SortLinesFinalNewline(t *testing.T) {
+	e, err := createTestEditor("b\na\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.sortLines()
+	var sb strings.Builder
+	e.buffer.WriteTo(&sb)
+	if got, want := sb.String(), "a\nb\n"; got != want {
+		t.Errorf("sorted %q, want %q", got, want)
+	}
+}
+
+func TestEditor_GroupedUndoCursor(t *testing.T) {
+	e, err := createTestEditor("alpha\nbeta\ngamma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	insert := func(y, x int, text string) {
+		if err := e.buffer.InsertString(y, x, text); err != nil {
+			t.Fatal(err)
+		}
+		e.pushUndoInsertText(y, x, text)
+	}
+	backspace := func(y, x int) {
+		r := e.getRuneAt(y, x-1)
+		if err := e.buffer.Delete(y, x); err != nil {
+			t.Fatal(err)
+		}
+		e.pushUndoDeleteBlock([]opEntry{{insertLine: y, insertCol: x - 1, r: r}}, true)
+	}
+
+	// One group edited bottom-up: the cursor goes back to the earliest edit
+	// in the text, not to the first one made.
+	e.beginUndoGroup()
+	insert(2, 5, "!")
+	insert(0, 2, "XY")
+	insert(1, 0, "> ")
+	e.endUndoGroup()
+	e.cursorY, e.cursorX = 1, 2
+	e.undo()
+	if got := bufferText(e); got != "alpha\nbeta\ngamma" {
+		t.Fatalf("undo left %q", got)
+	}
+	if e.cursorY != 0 || e.cursorX != 2 {
+		t.Errorf("cursor at (%d, %d) after undo, want the earliest edit at (0, 2)", e.cursorY, e.cursorX)
+	}
+
+	// Redo and undo again land in the same place.
+	e.redo()
+	e.cursorY, e.cursorX = 2, 0
+	e.undo()
+	if e.cursorY != 0 || e.cursorX != 2 {
+		t.Errorf("cursor at (%d, %d) after the second undo, want (0, 2)", e.cursorY, e.cursorX)
+	}
+
+	// Undone backspaces leave the cursor after the earliest rune put back.
+	e.beginUndoGroup()
+	backspace(2, 5)
+	backspace(1, 3)
+	e.endUndoGroup()
+	e.undo()
+	if got := bufferText(e); got != "alpha\nbeta\ngamma" {
+		t.Fatalf("undo left %q", got)
+	}
+	if e.cursorY != 1 || e.cursorX != 3 {
+		t.Errorf("cursor at (%d, %d) after undoing the backspaces, want (1, 3)", e.cursorY, e.cursorX)
+	}
+}
+
+func TestEditor_BackspaceJoinUndo(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		line    int
+	}{
+		{"different indents", "  one\n    two\nthree", 1},
+		{"empty previous line", "one\n\n  three", 2},
+		{"empty current line", "  one\n\nthree", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := createTestEditor(tt.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(e.filename)
+
+			e.cursorY, e.cursorX = tt.line, 0
+			e.handleKey('\x7f')
+			e.flushEditGroups()
+
+			lines := strings.Split(tt.content, "\n")
+			joined := lines[tt.line-1] + lines[tt.line]
+			if got := e.buffer.GetLine(tt.line - 1); got != joined {
+				t.Fatalf("after backspace line %d = %q, want %q", tt.line-1, got, joined)
+			}
+			if want := len([]rune(lines[tt.line-1])); e.cursorY != tt.line-1 || e.cursorX != want {
+				t.Errorf("after backspace cursor = (%d,%d), want (%d,%d)", e.cursorY, e.cursorX, tt.line-1, want)
+			}
+
+			e.undo()
+			var sb strings.Builder
+			e.buffer.WriteTo(&sb)
+			if got := sb.String(); got != tt.content {
+				t.Errorf("after undo text = %q, want %q", got, tt.content)
+			}
+			if e.cursorY != tt.line || e.cursorX != 0 {
+				t.Errorf("after undo cursor = (%d,%d), want (%d,0)", e.cursorY, e.cursorX, tt.line)
+			}
+
+			e.redo()
+			if got := e.buffer.GetLine(tt.line - 1); got != joined {
+				t.Errorf("after redo line %d = %q, want %q", tt.line-1, got, joined)
+			}
+		})
+	}
+}
+
+func TestEditor_CopyShapes(t *testing.T) {
+	e, err := createTestEditor("alpha one\nbeta two\nxy\ngamma three")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	term := e.term.(*mockTerminal)
+	copied := func() string { return e.clipboard.(*memClipboard).text }
+
+	// No selection: copyToClipboard takes the whole line and its newline.
+	e.cursorY, e.cursorX = 1, 3
+	e.copyToClipboard()
+	if got := copied(); got != "beta two\n" {
+		t.Errorf("line copy = %q, want %q", got, "beta two\n")
+	}
+
+	// A linear selection across lines.
+	e.cursorY, e.cursorX = 0, 6
+	feedInput(e, term, "\x1b[1;2B\x1b[1;2B\x03")
+	if got, want := copied(), "one\nbeta two\nxy"; got != want {
+		t.Errorf("selection copy = %q, want %q", got, want)
+	}
+	if !e.selectionActive {
+		t.Error("copying ended the selection")
+	}
+	feedInput(e, term, "\x1b[C")
+
+	// A block over columns 2-5 of three lines; the third ends before it.
+	e.cursorY, e.cursorX = 0, 2
+	feedInput(e, term, "\x1b[1;4B\x1b[1;4B\x1b[1;4C\x1b[1;4C\x1b[1;4C\x03")
+	if got, want := copied(), "pha\nta \n"; got != want {
+		t.Errorf("block copy = %q, want %q", got, want)
+	}
+	if !e.blockActive {
+		t.Error("copying ended the block selection")
+	}
+
+	// A block with no width has nothing to copy.
+	feedInput(e, term, "\x1b[1;4D\x1b[1;4D\x1b[1;4D\x03")
+	if got, want := copied(), "pha\nta \n"; got != want {
+		t.Errorf("empty block replaced the clipboard with %q", got)
+	}
+	if e.statusMessage != "Nothing to copy" {
+		t.Errorf("status %q, want %q", e.statusMessage, "Nothing to copy")
+	}
+
+	// Windows gets CRLF endings, never doubled.
+	for in, want := range map[string]string{
+		"pha\nta \n": "pha\r\nta \r\n",
+		"a\r\nb\nc":  "a\r\nb\r\nc",
+		"one":        "one",
+	} {
+		if got := crlfText(in); got != want {
+			t.Errorf("crlfText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestEditor_BlockCut(t *testing.T) {
+	e, err := createTestEditor("abcdef\nghijkl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	term := e.term.(*mockTerminal)
+
+	// Block "bc" over "hi", cut with Ctrl+X.
+	e.cursorY, e.cursorX = 0, 1
+	feedInput(e, term, "\x1b[1;4B\x1b[1;4C\x1b[1;4C\x18")
+	if got, want := e.clipboard.(*memClipboard).text, "bc\nhi"; got != want {
+		t.Errorf("clipboard = %q, want %q", got, want)
+	}
+	if got, want := bufferText(e), "adef\ngjkl"; got != want {
+		t.Errorf("buffer = %q, want %q", got, want)
+	}
+	if e.blockActive {
+		t.Error("the block is still active after the cut")
+	}
+
+	e.undo()
+	if got, want := bufferText(e), "abcdef\nghijkl"; got != want {
+		t.Errorf("after undo buffer = %q, want %q", got, want)
+	}
+}
+
+func TestEditor_ReindentOnPaste(t *testing.T) {
+	const context = "    if a {\n        \n    }"
+	const block = "    x := 1\n    if x {\n        y()\n\n    }\n"
+
+	e, err := createTestEditor(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.config.ReindentOnPaste = true
+	e.clipboard.SetText(block)
+
+	// Into an 8-space indentation: the 4-space block gains 4 spaces a line.
+	e.cursorY, e.cursorX = 1, 8
+	e.handleKey('\x16') // Ctrl+V
+	want := "    if a {\n        x := 1\n        if x {\n            y()\n\n        }\n\n    }"
+	if got := bufferText(e); got != want {
+		t.Errorf("reindented paste = %q, want %q", got, want)
+	}
+	if e.cursorY != 6 || e.cursorX != 0 {
+		t.Errorf("cursor at (%d,%d), want (6,0)", e.cursorY, e.cursorX)
+	}
+	e.undo()
+	if got := bufferText(e); got != context {
+		t.Errorf("one undo should take back the paste: %q", got)
+	}
+
+	// After text on the line, the first line stays where it lands and the
+	// rest take the line's indentation.
+	e.cursorY, e.cursorX = 0, 10
+	e.handleKey('\x16')
+	want = "    if a {    x := 1\n    if x {\n        y()\n\n    }\n\n        \n    }"
+	if got := bufferText(e); got != want {
+		t.Errorf("paste after text = %q, want %q", got, want)
+	}
+	e.undo()
+
+	// With the option off a bracketed paste goes in exactly as copied.
+	e.config.ReindentOnPaste = false
+	e.cursorY, e.cursorX = 1, 8
+	e.handlePaste(block)
+	want = "    if a {\n            x := 1\n    if x {\n        y()\n\n    }\n\n    }"
+	if got := bufferText(e); got != want {
+		t.Errorf("literal paste = %q, want %q", got, want)
+	}
+}
+
+func TestEditor_DuplicateSelection(t *testing.T) {
+	e, err := createTestEditor("one two\nthree\nfour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	term := e.term.(*mockTerminal)
+
+	// Part of a line is copied inline, and pressing again stacks copies.
+	e.cursorY, e.cursorX = 0, 4
+	feedInput(e, term, "\x1b[1;2C\x1b[1;2C\x1b[1;2C\x04")
+	if got, want := bufferText(e), "one twotwo\nthree\nfour"; got != want {
+		t.Fatalf("inline duplicate = %q, want %q", got, want)
+	}
+	if got := e.getSelectedText(); got != "two" || e.cursorY != 0 || e.cursorX != 10 {
+		t.Errorf("selection %q cursor (%d,%d), want the copy selected up to (0,10)", got, e.cursorY, e.cursorX)
+	}
+	feedInput(e, term, "\x04")
+	if got, want := bufferText(e), "one twotwotwo\nthree\nfour"; got != want {
+		t.Errorf("second duplicate = %q, want %q", got, want)
+	}
+	e.undo()
+	e.undo()
+	if got, want := bufferText(e), "one two\nthree\nfour"; got != want {
+		t.Fatalf("two undos = %q, want %q", got, want)
+	}
+
+	// Whole lines selected with Shift+Down are copied as lines below.
+	e.selectionActive = false
+	e.cursorY, e.cursorX = 0, 0
+	feedInput(e, term, "\x1b[1;2B\x1b[1;2B\x04")
+	if got, want := bufferText(e), "one two\nthree\none two\nthree\nfour"; got != want {
+		t.Errorf("line duplicate = %q, want %q", got, want)
+	}
+	if got := e.getSelectedText(); got != "one two\nthree\n" {
+		t.Errorf("selection %q, want the copied lines", got)
+	}
+	e.undo()
+
+	// So are whole lines ending at the end of the last one.
+	e.selectionActive = false
+	e.cursorY, e.cursorX = 1, 0
+	feedInput(e, term, "\x1b[1;2B\x1b[1;2F\x04")
+	if got, want := bufferText(e), "one two\nthree\nfour\nthree\nfour"; got != want {
+		t.Errorf("duplicate to the end = %q, want %q", got, want)
+	}
+	if got := e.getSelectedText(); got != "three\nfour" || e.cursorY != 4 || e.cursorX != 4 {
+		t.Errorf("selection %q cursor (%d,%d), want the copy selected up to (4,4)", got, e.cursorY, e.cursorX)
+	}
+}
+
+func TestEditor_RulerColumn(t *testing.T) {
+	// guideCols returns the screen column of the guide on each text row,
+	// or -1 where there is none.
+	guideCols := func(e *Editor) []int {
+		var ab bytes.Buffer
+		e.drawRows(&ab)
+		var cols []int
+		for _, row := range strings.Split(ab.String(), "\r\n") {
+			col, plain := -1, row
+			for {
+				i := strings.Index(plain, "\x1b[")
+				if i < 0 {
+					break
+				}
+				j := strings.IndexFunc(plain[i+2:], func(r rune) bool { return r >= 'A' && r <= 'z' && r != '[' })
+				plain = plain[:i] + plain[i+2+j+1:]
+			}
+			if i := strings.Index(plain, "│"); i >= 0 {
+				col = runewidth.StringWidth(plain[:i])
+			}
+			cols = append(cols, col)
+		}
+		return cols[:e.termHeight]
+	}
+
+	// Lines of 5, 22 and 3 columns.
+	const text = "short\nxxxxxxxxxxxxxxxxxxxxxx\nmid"
+	for _, tt := range []struct {
+		name        string
+		width       int
+		ruler       int
+		lineNumbers bool
+		want        []int
+	}{
+		{"wide", 40, 10, false, []int{10, -1, 10, -1}},
+		{"gutter", 40, 10, true, []int{15, -1, 15, -1}},
+		// At 20 columns the long line wraps after 20 and its second row
+		// holds 2; the ruler at 10 falls on the first, which is full.
+		{"wrapped", 20, 10, false, []int{10, -1, -1, 10}},
+		// A ruler past the text width shows on the wrapped row that
+		// reaches it, at its column within that row.
+		{"on a wrapped row", 20, 25, false, []int{-1, -1, 5, -1}},
+		{"with gutter, wrapped", 25, 25, true, []int{-1, -1, 10, -1}},
+		{"off", 40, 0, false, []int{-1, -1, -1, -1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := createTestEditor(text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(e.filename)
+			e.showLineNumbers = tt.lineNumbers
+			e.updateLineNumWidth()
+			e.config.RulerColumn = tt.ruler
+			e.setWindowSize(tt.width, 7) // 4 text rows
+
+			if got := guideCols(e); !slices.Equal(got, tt.want) {
+				t.Errorf("guide columns %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// The guide goes after the pilcrow and leaves the text alone.
+	e, err := createTestEditor("short")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.showLineNumbers = false
+	e.updateLineNumWidth()
+	e.showNonPrintable = true
+	e.config.RulerColumn = 8
+	e.setWindowSize(40, 7)
+	var ab bytes.Buffer
+	e.drawRows(&ab)
+	row := strings.Split(ab.String(), "\r\n")[0]
+	if want := "short" + ansiDim + "¶" + ansiReset + "  " + ansiDim + "│" + ansiReset; !strings.HasPrefix(row, want) {
+		t.Errorf("row %q, want it to start %q", row, want)
+	}
+}
+
+func TestScrollbarThumb(t *testing.T) {
+	tests := []struct {
+		name                            string
+		lineCount, top, visible, height int
+		wantStart, wantEnd              int
+	}{
+		{"whole file fits", 10, 0, 10, 20, 0, 20},
+		{"empty screen", 10, 0, 0, 0, 0, 0},
+		{"top", 100, 0, 20, 20, 0, 4},
+		{"middle", 100, 40, 20, 20, 8, 12},
+		{"bottom", 100, 80, 20, 20, 16, 20},
+		// Past the first screen the thumb leaves the top of the track, and
+		// short of the last it stays off the bottom.
+		{"just past the top", 100, 1, 20, 20, 1, 5},
+		{"just short of the bottom", 100, 79, 20, 20, 15, 19},
+		// A huge file still gets a one-row thumb.
+		{"huge file", 100000, 50000, 20, 20, 10, 11},
+		{"huge file, bottom", 100000, 99980, 20, 20, 19, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := scrollbarThumb(tt.lineCount, tt.top, tt.visible, tt.height)
+			if start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("scrollbarThumb(%d, %d, %d, %d) = %d, %d; want %d, %d",
+					tt.lineCount, tt.top, tt.visible, tt.height, start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
+
+func TestEditor_Scrollbar(t *testing.T) {
+	var lines []string
+	for i := range 40 {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	e, err := createTestEditor(strings.Join(lines, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.setWindowSize(30, 13) // 10 text rows
+	width := e.getTextWidth()
+
+	e.config.ShowScrollbar = true
+	if got := e.getTextWidth(); got != width-1 {
+		t.Errorf("text width %d with the scrollbar, want %d", got, width-1)
+	}
+	rows := func() []string {
+		var ab bytes.Buffer
+		e.drawRows(&ab)
+		return strings.Split(ab.String(), "\r\n")[:e.termHeight]
+	}
+	thumb := "\x1b[30G█"
+	track := "\x1b[30G" + ansiDim + "│" + ansiReset
+
+	// The first screen of four: the thumb is the top quarter, rounded down.
+	for i, row := range rows() {
+		if want := i < 2; strings.HasSuffix(row, thumb) != want || strings.HasSuffix(row, track) == want {
+			t.Errorf("top: row %d %q, want thumb %v", i, row, want)
+		}
+	}
+
+	// Scrolling to the end moves it to the bottom.
+	e.cursorY = 39
+	e.scroll()
+	for i, row := range rows() {
+		if want := i >= 8; strings.HasSuffix(row, thumb) != want {
+			t.Errorf("bottom: row %d %q, want thumb %v", i, row, want)
+		}
+	}
+
+	// Off, no row draws it.
+	e.config.ShowScrollbar = false
+	for i, row := range rows() {
+		if strings.Contains(row, "\x1b[30G") {
+			t.Errorf("row %d drew the scrollbar while it is off: %q", i, row)
+		}
+	}
+}
+
+func TestEditor_FinalNewline(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		ensure, trim  bool
+		cursorY       int
+		want          string
+		wantCursorY   int
+		wantLineCount int
+	}{
+		{"none added", "one\ntwo", true, false, 1, "one\ntwo\n", 1, 3},
+		{"one kept", "one\ntwo\n", true, true, 2, "one\ntwo\n", 2, 3},
+		{"several trimmed", "one\ntwo\n\n\n", true, true, 4, "one\ntwo\n", 2, 3},
+		{"several kept without trim", "one\ntwo\n\n\n", true, false, 4, "one\ntwo\n\n\n", 4, 5},
+		{"trim alone adds none", "one\ntwo", false, true, 1, "one\ntwo", 1, 2},
+		{"blank lines inside kept", "one\n\ntwo", true, true, 0, "one\n\ntwo\n", 0, 4},
+		{"empty file left empty", "", true, true, 0, "", 0, 1},
+		{"only newlines", "\n\n\n", true, true, 3, "\n", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := createTestEditor(tt.content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(e.filename)
+			e.config.EnsureFinalNewline = tt.ensure
+			e.config.TrimFinalNewlines = tt.trim
+			e.cursorY, e.cursorX = tt.cursorY, 0
+			e.dirty = true
+			if err := e.save(); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(e.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b); got != tt.want {
+				t.Errorf("saved %q, want %q", got, tt.want)
+			}
+			var sb strings.Builder
+			e.buffer.WriteTo(&sb)
+			if got := sb.String(); got != tt.want || e.dirty {
+				t.Errorf("buffer %q (dirty %v), want %q, saved", got, e.dirty, tt.want)
+			}
+			if e.buffer.LineCount() != tt.wantLineCount || e.cursorY != tt.wantCursorY {
+				t.Errorf("%d lines, cursor on line %d; want %d lines, cursor on line %d",
+					e.buffer.LineCount(), e.cursorY, tt.wantLineCount, tt.wantCursorY)
+			}
+
+			// The fix is one undo step.
+			if tt.want != tt.content {
+				e.undo()
+				sb.Reset()
+				e.buffer.WriteTo(&sb)
+				if got := sb.String(); got != tt.content {
+					t.Errorf("after undo %q, want %q", got, tt.content)
+				}
+			}
+		})
+	}
+}
+
+func TestEditor_TrailingWhitespace(t *testing.T) {
+	e, err := createTestEditor("\ta b \t\n  \nc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.showLineNumbers = false
+	e.updateLineNumWidth()
+	e.showNonPrintable = true
+	e.config.TabWidth = 2
+	e.setWindowSize(40, 7)
+
+	var ab bytes.Buffer
+	e.drawRows(&ab)
+	rows := strings.Split(ab.String(), "\r\n")
+	dim := func(s string) string { return ansiDim + s + ansiReset }
+	trailing := func(s string) string { return ansiTrailing + s + ansiReset }
+
+	// The leading tab and the space between words are dim; the space and
+	// tab at the end are marked as trailing.
+	if want := dim("→") + " a" + dim("·") + "b" + trailing("·") + trailing("→") + " " + dim("¶"); !strings.HasPrefix(rows[0], want) {
+		t.Errorf("row %q, want it to start %q", rows[0], want)
+	}
+	// A line of only whitespace is all trailing.
+	if want := trailing("·") + trailing("·") + dim("¶"); !strings.HasPrefix(rows[1], want) {
+		t.Errorf("blank row %q, want it to start %q", rows[1], want)
+	}
+	// Without non-printables nothing is marked.
+	e.showNonPrintable = false
+	ab.Reset()
+	e.drawRows(&ab)
+	if strings.Contains(ab.String(), ansiTrailing) {
+		t.Errorf("trailing whitespace marked with non-printables off: %q", ab.String())
+	}
+}
+
+func TestEditor_FindTab(t *testing.T) {
+	e, err := createTestEditor("one\tone\ntwo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	term := e.term.(*mockTerminal)
+
+	// Tab in Find leaves the query alone and moves on to the replace field.
+	feedInput(e, term, "\x06one\t")
+	if e.promptBuffer != "one" {
+		t.Errorf("query %q after Tab, want %q", e.promptBuffer, "one")
+	}
+	if !e.isReplacing || e.promptFocus != 1 {
+		t.Errorf("replacing %v focus %d, want the replace field focused", e.isReplacing, e.promptFocus)
+	}
+	var ab bytes.Buffer
+	feedInput(e, term, "\x1b")
+	e.escapeTimedOut()
+
+	// The command bar says so while Find is open.
+	feedInput(e, term, "\x06")
+	e.drawCommandBar(&ab)
+	if !strings.Contains(ab.String(), "TAB/^H Replace") {
+		t.Errorf("command bar %q does not mention Tab", ab.String())
+	}
+
+	// In a read-only buffer Tab does nothing to the query either.
+	feedInput(e, term, "\x1b")
+	e.escapeTimedOut()
+	e.readOnly = true
+	feedInput(e, term, "\x06one\t")
+	if e.promptBuffer != "one" || e.isReplacing {
+		t.Errorf("read-only: query %q replacing %v, want %q and no replace field", e.promptBuffer, e.isReplacing, "one")
+	}
+}
+
+func TestEditor_FindHistory(t *testing.T) {
+	e, err := createTestEditor("alpha beta gamma\nbeta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	term := e.term.(*mockTerminal)
+	closeFind := func() {
+		feedInput(e, term, "\x1b")
+		e.escapeTimedOut()
+	}
+	// search runs one query from an empty find prompt and commits it.
+	search := func(query string) {
+		feedInput(e, term, "\x06")
+		e.promptBuffer, e.promptCursorX = "", 0
+		feedInput(e, term, query + "\r")
+		closeFind()
+	}
+	search("alpha")
+	search("beta")
+	search("gamma")
+	search("beta") // Searched again: moves up, not in twice
+
+	if want := []string{"alpha", "gamma", "beta"}; !slices.Equal(e.findHistory, want) {
+		t.Fatalf("history %q, want %q", e.findHistory, want)
+	}
+
+	// Ctrl+F offers the last query; Up skips it and goes on to the older
+	// ones, stopping at the oldest.
+	feedInput(e, term, "\x06")
+	if e.promptBuffer != "beta" {
+		t.Fatalf("find opened with %q, want the last query", e.promptBuffer)
+	}
+	feedInput(e, term, "\x1b[A")
+	if e.promptBuffer != "gamma" || e.promptCursorX != len("gamma") || e.findCurrentMatch == -1 {
+		t.Errorf("Up gave %q cursor %d match %d, want %q searched with the cursor at its end",
+			e.promptBuffer, e.promptCursorX, e.findCurrentMatch, "gamma")
+	}
+	got := []string{e.promptBuffer}
+	for range 3 {
+		feedInput(e, term, "\x1b[A")
+		got = append(got, e.promptBuffer)
+	}
+	if want := []string{"gamma", "alpha", "alpha", "alpha"}; !slices.Equal(got, want) {
+		t.Errorf("Up recalled %q, want %q", got, want)
+	}
+
+	// Down comes back and ends at what was in the prompt.
+	got = nil
+	for range 4 {
+		feedInput(e, term, "\x1b[B")
+		got = append(got, e.promptBuffer)
+	}
+	if want := []string{"gamma", "beta", "beta", "beta"}; !slices.Equal(got, want) {
+		t.Errorf("Down recalled %q, want %q", got, want)
+	}
+	closeFind()
+
+	// In the replace prompt Up recalls in the find field, and Down past the
+	// newest still moves to the replace field.
+	feedInput(e, term, "\x08")
+	feedInput(e, term, "\x1b[A")
+	if e.promptBuffer != "gamma" || e.promptFocus != 0 {
+		t.Errorf("replace: Up gave %q focus %d, want %q in the find field", e.promptBuffer, e.promptFocus, "gamma")
+	}
+	feedInput(e, term, "\x1b[B\x1b[B\x1b[B")
+	if e.promptBuffer != "beta" || e.promptFocus != 1 {
+		t.Errorf("replace: Down gave %q focus %d, want %q and the replace field", e.promptBuffer, e.promptFocus, "beta")
+	}
+}
+
+func TestEditor_CenterFindMatch(t *testing.T) {
+	newEditor := func(needleLine int) *Editor {
+		var lines []string
+		for i := range 100 {
+			lines = append(lines, fmt.Sprintf("line %d", i))
+		}
+		lines[needleLine] = "a needle here"
+		e, err := createTestEditor(strings.Join(lines, "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Remove(e.filename) })
+		e.setWindowSize(40, 13) // 10 text rows
+		return e
+	}
+	find := func(e *Editor, query string) {
+		e.handleKey('\x06') // Ctrl+F
+		for _, r := range query {
+			e.handleFindInput(r)
+		}
+		e.scroll()
+	}
+
+	// Off: the match is scrolled just into view at the bottom edge.
+	e := newEditor(70)
+	find(e, "needle")
+	if row, _ := e.getVisualCursorPos(); e.cursorY != 70 || row != 10 {
+		t.Errorf("off: match on line %d at row %d, want line 70 at row 10", e.cursorY, row)
+	}
+
+	// On: it lands on the middle row, and scroll leaves it there.
+	e = newEditor(70)
+	e.config.CenterFindMatch = true
+	find(e, "needle")
+	if row, _ := e.getVisualCursorPos(); e.viewportY != 66 || row != 5 {
+		t.Errorf("on: viewport %d match at row %d, want viewport 66 and row 5", e.viewportY, row)
+	}
+
+	// A match already on screen does not scroll.
+	e = newEditor(6)
+	e.config.CenterFindMatch = true
+	find(e, "needle")
+	if e.viewportY != 0 {
+		t.Errorf("visible match scrolled the viewport to %d", e.viewportY)
+	}
+
+	// Near the end the last line stays at the bottom.
+	e = newEditor(98)
+	e.config.CenterFindMatch = true
+	find(e, "needle")
+	if row, _ := e.getVisualCursorPos(); e.viewportY != 90 || row != 9 {
+		t.Errorf("end: viewport %d match at row %d, want viewport 90 and row 9", e.viewportY, row)
+	}
+
+	// Wrapped lines count by the rows they take: the two lines above the
+	// match each take three rows here, so the viewport starts on the last
+	// row of the first of them.
+	var lines []string
+	for i := range 40 {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	lines[23] = strings.Repeat("w", 100)
+	lines[24] = strings.Repeat("w", 100)
+	lines[25] = "needle"
+	e, err := createTestEditor(strings.Join(lines, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.setWindowSize(40, 13)
+	e.config.CenterFindMatch = true
+	find(e, "needle")
+	if row, _ := e.getVisualCursorPos(); row != 5 || e.viewportY != 23 || e.viewportWrapOffset != 2 {
+		t.Errorf("wrapped: viewport %d+%d match at row %d, want 23+2 and row 5", e.viewportY, e.viewportWrapOffset, row)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		old, new string
+		want     lineDiff
+	}{
+		{"no change", "a\nb\nc", "a\nb\nc", lineDiff{}},
+		{"both empty", "", "", lineDiff{}},
+		{"insertion", "a\nb\nc", "a\nx\ny\nb\nc", lineDiff{added: 2}},
+		{"insertion at the end", "a\nb", "a\nb\nc", lineDiff{added: 1}},
+		{"deletion", "a\nb\nc\nd", "a\nd", lineDiff{removed: 2}},
+		{"deletion at the start", "a\nb\nc", "c", lineDiff{removed: 2}},
+		{"modification", "a\nb\nc", "a\nB\nc", lineDiff{changed: 1}},
+		{"modification and insertion", "a\nb\nc", "a\nB\nx\nc", lineDiff{added: 1, changed: 1}},
+		{"separate hunks", "a\nb\nc\nd\ne", "b\nc\nx\nd\ne\nf", lineDiff{added: 2, removed: 1}},
+		{"everything", "a\nb", "x\ny\nz", lineDiff{added: 1, changed: 2}},
+		{"repeated lines", "a\na\nb\na", "a\nb\na\na", lineDiff{added: 1, removed: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffLines(splitLines(tt.old), splitLines(tt.new)); got != tt.want {
+				t.Errorf("diffLines(%q, %q) = %+v, want %+v", tt.old, tt.new, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	const n = 20000
+	a := make([]string, n)
+	changed := make([]string, n)
+	for i := range a {
+		a[i] = "    line " + strconv.Itoa(i)
+		changed[i] = "\tline " + strconv.Itoa(i)
+	}
+	// A few scattered edits are found exactly.
+	scattered := slices.Clone(a)
+	scattered[10] = "edited"
+	scattered = slices.Insert(scattered, 5000, "new")
+	scattered = slices.Delete(scattered, 15000, 15002)
+
+	for _, tt := range []struct {
+		name string
+		b    []string
+		want lineDiff
+	}{
+		{"scattered edits", scattered, lineDiff{added: 1, removed: 2, changed: 1}},
+		{"every line changed", changed, lineDiff{changed: n}},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		got := diffLines(a, tt.b)
+		runtime.ReadMemStats(&after)
+		if got != tt.want {
+			t.Errorf("%s: diffLines = %+v, want %+v", tt.name, got, tt.want)
+		}
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 64<<20 {
+			t.Errorf("%s: allocated %d MB, want space linear in the input", tt.name, alloc>>20)
+		}
+	}
+}
+
+func TestEditor_DiffSummary(t *testing.T) {
+	e, err := createTestEditor("one\r\ntwo\r\nthree\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+
+	e.runPaletteLine("diff")
+	if !strings.HasPrefix(e.statusMessage, "No changes") {
+		t.Errorf("unchanged buffer: status %q", e.statusMessage)
+	}
+
+	e.buffer.InsertString(1, 0, "2 ")
+	e.buffer.InsertString(3, 0, "four\nfive\n")
+	e.runPaletteLine("diff")
+	if !strings.HasSuffix(e.statusMessage, "2 added, 0 removed, 1 changed lines") {
+		t.Errorf("edited buffer: status %q", e.statusMessage)
+	}
+
+	e.filename = ""
+	e.runPaletteLine("diff")
+	if e.statusMessage != "Nothing to diff: the buffer has no file" {
+		t.Errorf("no file: status %q", e.statusMessage)
+	}
+
+	// The byte order mark is not part of the first line.
+	utf16LE := []byte{0xff, 0xfe}
+	for _, u := range utf16.Encode([]rune("hello\nworld\n")) {
+		utf16LE = append(utf16LE, byte(u), byte(u>>8))
+	}
+	for name, data := range map[string][]byte{
+		"UTF-8 BOM": []byte("\ufeffhello\nworld\n"),
+		"UTF-16":    utf16LE,
+	} {
+		file := filepath.Join(t.TempDir(), "bom.txt")
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		e, err := NewEditor(newMockTerminal(), config.DefaultConfig(), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.runPaletteLine("diff")
+		if !strings.HasPrefix(e.statusMessage, "No changes") {
+			t.Errorf("%s: unchanged buffer: status %q", name, e.statusMessage)
+		}
+	}
+}
+
+func TestFormatStatus(t *testing.T) {
+	tokens := map[string]string{"line": "12", "col": "3", "empty": ""}
+	tests := []struct {
+		format, want string
+	}{
+		{"Ln {line}, Col {col}", "Ln 12, Col 3"},
+		{"{line}{col}", "123"},
+		{"[{empty}]", "[]"},
+		{"{unknown} {line}", "{unknown} 12"},
+		{"{{line}}", "{12}"},
+		{"{line", "{line"},
+		{"}{line}{", "}12{"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := formatStatus(tt.format, tokens); got != tt.want {
+			t.Errorf("formatStatus(%q) = %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestEditor_StatusFormat(t *testing.T) {
+	e, err := createTestEditor("one\r\ntwo\r\nthree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	e.setWindowSize(80, 24)
+	e.cursorY, e.cursorX = 1, 2
+	e.dirty = true
+
+	tokens := e.statusTokens()
+	for format, want := range map[string]string{
+		"{filename}": fmt.Sprintf("%.20s", e.filename),
+		"{buffers}":  "",
+		"{dirty}":    " (modified)",
+		"{mode}":     "",
+		"{line}":     "2",
+		"{col}":      "3",
+		"{lines}":    "3",
+		"{eol}":      "CRLF",
+		"{encoding}": "",
+		"{version}":  version.GetVersion(),
+	} {
+		if got := formatStatus(format, tokens); got != want {
+			t.Errorf("%s = %q, want %q", format, got, want)
+		}
+	}
+
+	bar := func() string {
+		var ab bytes.Buffer
+		e.drawStatusBar(&ab)
+		s := strings.TrimSuffix(ab.String(), ansiReset+"\r\n")
+		return strings.TrimPrefix(s, ansiInvert)
+	}
+	e.config.StatusFormat = "{line}:{col}{dirty}{=}{eol}"
+	if got, want := bar(), "2:3 (modified)"+strings.Repeat(" ", 80-18)+"CRLF"; got != want {
+		t.Errorf("bar = %q, want %q", got, want)
+	}
+
+	// Too narrow: the left part is cut and the right part kept whole.
+	e.config.StatusFormat = strings.Repeat("L", 50) + "{=}" + strings.Repeat("R", 40)
+	if got, want := bar(), strings.Repeat("L", 40)+strings.Repeat("R", 40); got != want {
+		t.Errorf("narrow bar = %q, want %q", got, want)
+	}
+	e.config.StatusFormat = "left{=}" + strings.Repeat("R", 90)
+	if got, want := bar(), strings.Repeat("R", 80); got != want {
+		t.Errorf("overfull bar = %q, want %q", got, want)
+	}
+}
+
+func TestEditor_RegexFindReplace(t *testing.T) {
+	e, err := createTestEditor("id=12 name=bob\nid=7 name=alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.isFinding = true
+	e.isReplacing = true
+	e.handleReplaceInput('\x05') // Ctrl+E
+	if !e.searchRegex {
+		t.Fatal("expected Ctrl+E to turn on regex search")
+	}
+
+	for _, r := range `(\w+)=(\d+)` {
+		e.handleReplaceInput(r)
+	}
+	want := []findResult{{0, 0, 5}, {1, 0, 4}}
+	if len(e.findMatches) != len(want) {
+		t.Fatalf("expected %v, got %v", want, e.findMatches)
+	}
+	for i := range want {
+		if e.findMatches[i] != want[i] {
+			t.Errorf("match %d: expected %v, got %v", i, want[i], e.findMatches[i])
+		}
+	}
+	if e.cursorX != 5 || !e.selectionActive {
+		t.Errorf("expected the first match selected up to column 5, got cursor %d", e.cursorX)
+	}
+
+	e.replaceBuffer = "$2:${1}"
+	e.handleReplaceInput('\x12') // Ctrl+R
+	if got := e.buffer.GetLine(0); got != "12:id name=bob" {
+		t.Errorf("expected capture groups expanded, got %q", got)
+	}
+	e.replaceAll()
+	if got := e.buffer.GetLine(1); got != "7:id name=alice" {
+		t.Errorf("expected replace all to expand per match, got %q", got)
+	}
+
+	// A query that does not compile clears the matches and reports why.
+	e.isFinding = true
+	e.promptBuffer = "name=("
+	e.findInitial()
+	if len(e.findMatches) != 0 || e.searchErr == nil {
+		t.Errorf("expected no matches and a compile error, got %v, %v", e.findMatches, e.searchErr)
+	}
+	if status := e.searchStatus(); !strings.Contains(status, "regex:") {
+		t.Errorf("expected the status bar to show the error, got %q", status)
+	}
+
+	// Empty matches are skipped rather than selected.
+	e.promptBuffer = "x*"
+	e.findInitial()
+	if len(e.findMatches) != 0 {
+		t.Errorf("expected empty matches to be skipped, got %v", e.findMatches)
+	}
+}
+
+func TestEditor_ConvertLineEndings(t *testing.T) {
+	original := "one\r\ntwo\nthree\r\n\nfive"
+	e, err := createTestEditor(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	// The raw text, since what is being checked is the CRLFs themselves.
+	raw := func() string {
+		var sb strings.Builder
+		e.buffer.WriteTo(&sb)
+		return sb.String()
+	}
+	lines := []string{"one", "two", "three", "", "five"}
+	checkLines := func(stage string) {
+		t.Helper()
+		if e.buffer.LineCount() != len(lines) {
+			t.Fatalf("%s: expected %d lines, got %d", stage, len(lines), e.buffer.LineCount())
+		}
+		for i, want := range lines {
+			if got := e.buffer.GetLine(i); got != want {
+				t.Errorf("%s: line %d: expected %q, got %q", stage, i, want, got)
+			}
+		}
+	}
+
+	if n := e.convertLineEndings(false); n != 2 {
+		t.Errorf("expected 2 lines converted to LF, got %d", n)
+	}
+	if got := raw(); got != "one\ntwo\nthree\n\nfive" {
+		t.Errorf("LF conversion: got %q", got)
+	}
+	checkLines("LF")
+
+	e.undo()
+	if got := raw(); got != original {
+		t.Errorf("undo: expected %q, got %q", original, got)
+	}
+	checkLines("undo")
+
+	if n := e.convertLineEndings(true); n != 2 {
+		t.Errorf("expected 2 lines converted to CRLF, got %d", n)
+	}
+	if got := raw(); got != "one\r\ntwo\r\nthree\r\n\r\nfive" {
+		t.Errorf("CRLF conversion: got %q", got)
+	}
+	checkLines("CRLF")
+
+	// Lines typed after the conversion are saved with the chosen ending too.
+	e.cursorY, e.cursorX = 4, 4
+	e.handleKey('\r')
+	e.handleKey('x')
+	if err := e.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(e.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != "one\r\ntwo\r\nthree\r\n\r\nfive\r\nx" {
+		t.Errorf("saved content: got %q", saved)
+	}
+}
+
+func TestEditor_PageUpDownWrapped(t *testing.T) {
+	term := newMockTerminal()
+	term.width, term.height = 20, 8 // 5 text rows, 15 columns next to the gutter
+	e, err := NewEditor(term, config.DefaultConfig(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "a\n" + strings.Repeat("b", 40) + "\nc\n" + strings.Repeat("d", 35) + "\ne\nf\ng\nh"
+	for _, r := range content {
+		if r == '\n' {
+			r = '\r'
+		}
+		e.handleKey(r)
+	}
+
+	steps := []struct {
+		down         bool
+		wantY, wantX int
+	}{
+		// Start at (1, 17): second visual row of line 1, screen row 3.
+		{true, 3, 32},  // b row 3, c, d rows 1-3: lands on d's third row
+		{true, 7, 1},   // e, f, g, h, then stops at the end of the document
+		{false, 3, 17}, // five rows up, back at column 2 from before h clamped it
+		{false, 1, 2},
+		{false, 0, 1}, // the top of the document stops the page early
+	}
+
+	e.cursorY, e.cursorX = 1, 17
+	e.viewportY, e.viewportWrapOffset = 0, 0
+	e.scroll()
+	for i, step := range steps {
+		rowBefore, _ := e.calculateCursorScreenPosition()
+		if step.down {
+			e.movePageDown()
+		} else {
+			e.movePageUp()
+		}
+		e.scroll()
+		if e.cursorY != step.wantY || e.cursorX != step.wantX {
+			t.Errorf("step %d: cursor at (%d, %d), expected (%d, %d)", i, e.cursorY, e.cursorX, step.wantY, step.wantX)
+		}
+		if row, _ := e.calculateCursorScreenPosition(); i == 0 && row != rowBefore {
+			t.Errorf("step %d: cursor moved from screen row %d to %d", i, rowBefore, row)
+		}
+	}
+}
+
+func TestEditor_PagerMode(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "panka_pager_*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	const total = 300000
+	for i := 1; i <= total; i++ {
+		fmt.Fprintf(tmpfile, "line %d\n", i)
+	}
+	tmpfile.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.MaxFileSize = 1 << 20
+	term := newMockTerminal()
+	e, err := NewEditor(term, cfg, tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.pager == nil {
+		t.Fatal("expected pager mode for a file larger than MaxFileSize")
+	}
+	defer e.pager.close()
+	if e.buffer.LineCount() >= total {
+		t.Fatalf("pager loaded %d lines, want only a window", e.buffer.LineCount())
+	}
+	if got, want := e.statusTokens()["lines"], strconv.Itoa(e.buffer.LineCount())+"+"; got != want {
+		t.Errorf("{lines} before the end of the file = %q, want %q", got, want)
+	}
+
+	atCursor := func() string {
+		return e.buffer.GetLine(e.cursorY)
+	}
+
+	// Scrolling off the bottom of the window slides it forward.
+	e.cursorY = e.buffer.LineCount() - 1
+	want := atCursor()
+	e.pagerFollowCursor()
+	if e.lineBase() == 0 || atCursor() != want {
+		t.Errorf("after slide: base %d, cursor on %q, want %q", e.lineBase(), atCursor(), want)
+	}
+	if got := fmt.Sprintf("line %d", e.lineBase()+e.cursorY+1); got != want {
+		t.Errorf("absolute line %q, want %q", got, want)
+	}
+
+	// Go to Line reaches lines outside the window, forward and back.
+	for _, n := range []int{250000, 10} {
+		feedInput(e, term, "\x14" + strconv.Itoa(n) + "\r")
+		if got, want := atCursor(), fmt.Sprintf("line %d", n); got != want {
+			t.Errorf("goto %d: cursor on %q", n, got)
+		}
+	}
+
+	// Find runs forward past the window.
+	feedInput(e, term, "\x06line 299999\r")
+	if got := atCursor(); got != "line 299999" {
+		t.Errorf("find: cursor on %q", got)
+	}
+	if got := e.statusTokens()["lines"]; strings.HasSuffix(got, "+") {
+		t.Errorf("{lines} at the end of the file = %q, want the total", got)
+	}
+
+	// Edits are refused.
+	feedInput(e, term, "\x1b") // Leave find
+	e.escapeTimedOut()
+	want = atCursor()
+	feedInput(e, term, "x\x04")
+	if e.dirty || atCursor() != want {
+		t.Errorf("pager buffer was modified: %q, want %q", atCursor(), want)
+	}
+}
+
+func TestEditor_PagerLongLine(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "panka_pager_*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmpfile.Name())
+	// A line three windows long, of three-byte characters that do not
+	// line up with the window size.
+	fmt.Fprintf(tmpfile, "head\n%s\ntail\n", strings.Repeat("€", pagerWindowSize))
+	tmpfile.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.MaxFileSize = 1 << 20
+	term := newMockTerminal()
+	e, err := NewEditor(term, cfg, tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.pager == nil {
+		t.Fatal("expected pager mode for a file larger than MaxFileSize")
+	}
+	defer e.pager.close()
+
+	at := func() (int, string) {
+		return e.lineBase() + e.cursorY, e.buffer.GetLine(e.cursorY)
+	}
+
+	// End keeps sliding along the long line until its end is loaded.
+	for i := 0; i < 20 && !e.pager.atEOF(); i++ {
+		feedInput(e, term, "\x1b[F")
+		if !utf8.ValidString(e.pager.text) {
+			t.Fatalf("window at %d cuts a character", e.pager.window.start)
+		}
+		if line, _ := at(); line != 1 && e.pager.window.start > 0 {
+			t.Fatalf("slid onto line %d, want line 1", line)
+		}
+	}
+	if !e.pager.atEOF() {
+		t.Fatal("End never reached the end of the long line")
+	}
+	feedInput(e, term, "\x1b[F\x1b[B")
+	if line, text := at(); line != 2 || text != "tail" {
+		t.Errorf("after the long line: line %d %q, want line 2 \"tail\"", line, text)
+	}
+
+	// Home slides back along it, a half window at a time, to the line before.
+	feedInput(e, term, "\x1b[A")
+	for i := 0; i < 20 && e.pager.window.start > 0; i++ {
+		feedInput(e, term, "\x1b[H")
+		if !utf8.ValidString(e.pager.text) {
+			t.Fatalf("window at %d cuts a character", e.pager.window.start)
+		}
+		if e.pager.window.start > 0 && e.cursorX == 0 {
+			t.Fatalf("cursor lost its place in the window at %d", e.pager.window.start)
+		}
+	}
+	if line, text := at(); line != 0 || text != "head" {
+		t.Errorf("before the long line: line %d %q, want line 0 \"head\"", line, text)
+	}
+}
+
+func TestEditor_ClearSearch(t *testing.T) {
+	e, err := createTestEditor("foo bar\nbar foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.handleKey('\x06') // Ctrl+F
+	for _, r := range "foo" {
+		e.handleFindInput(r)
+	}
+	e.handleFindInput('\r')
+	e.isFinding = false
+	if !e.selectionActive || len(e.findMatches) != 2 {
+		t.Fatalf("expected an active match, got %v", e.findMatches)
+	}
+	x, y := e.cursorX, e.cursorY
+
+	e.handleKey('\x07') // Ctrl+G
+	if e.findMatches != nil || e.findCurrentMatch != -1 || e.selectionActive {
+		t.Errorf("search not cleared: matches %v, current %d, selection %v", e.findMatches, e.findCurrentMatch, e.selectionActive)
+	}
+	if e.cursorX != x || e.cursorY != y {
+		t.Errorf("cursor moved from (%d,%d) to (%d,%d)", x, y, e.cursorX, e.cursorY)
+	}
+	if e.lastSearchQuery != "foo" {
+		t.Errorf("expected lastSearchQuery to be kept, got %q", e.lastSearchQuery)
+	}
+}
+
+func TestEditor_TabWidthSeparateFromIndentSize(t *testing.T) {
+	cfg := config.DefaultConfig()
+	cfg.TabWidth = 2
+	cfg.IndentSize = 4
+	e, err := NewEditor(newMockTerminal(), cfg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.buffer = buffer.NewRope("\tx\ta\n      y")
+
+	// Display math follows TabWidth: "\t" -> col 2, "x" -> 3, "\t" -> 4, "a" -> 5.
+	for i, want := range []int{0, 2, 3, 4, 5} {
+		if got := e.getVisualX(0, i); got != want {
+			t.Errorf("getVisualX(0, %d) = %d, want %d", i, got, want)
+		}
+	}
+	if got := e.runeXForVisualX(0, 2); got != 1 {
+		t.Errorf("runeXForVisualX(0, 2) = %d, want 1", got)
+	}
+	if got := e.countVisualRows(0, 4); got != 2 {
+		t.Errorf("countVisualRows(0, 4) = %d, want 2", got)
+	}
+
+	// Unindenting removes IndentSize spaces, not TabWidth.
+	e.cursorY = 1
+	e.unindentLine()
+	if got := e.buffer.GetLine(1); got != "  y" {
+		t.Errorf("after unindent got %q, want %q", got, "  y")
+	}
+}
+
+func TestEditor_NewEditDiscardsRedo(t *testing.T) {
+	e, err := createTestEditor("one\ntwo\nthree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.handleKey('a')
+	e.handleKey('\x15') // Ctrl+U
+	if len(e.redoStack) == 0 {
+		t.Fatal("expected a redo entry after undo")
+	}
+
+	// Moving around and toggling the gutter is not an edit.
+	e.handleKey('\x0c') // Ctrl+L
+	if len(e.redoStack) == 0 {
+		t.Fatal("a non-editing key discarded the redo history")
+	}
+
+	// A different edit diverges from the undone one.
+	e.handleKey('b')
+	e.handleKey('\x19') // Ctrl+Y
+	if len(e.redoStack) != 0 {
+		t.Errorf("expected an empty redo stack, got %d entries", len(e.redoStack))
+	}
+	if got := e.buffer.GetLine(0); got != "bone" {
+		t.Errorf("expected %q, got %q", "bone", got)
+	}
+
+	// Grouped multi-cursor typing discards redo too.
+	e.handleKey('\x15') // Ctrl+U
+	if len(e.redoStack) == 0 {
+		t.Fatal("expected a redo entry after undo")
+	}
+	e.extraCursorHeight = 2
+	e.handleKey('c')
+	e.flushEditGroups()
+	if len(e.redoStack) != 0 {
+		t.Errorf("multi-cursor edit left %d redo entries", len(e.redoStack))
+	}
+	for i, want := range []string{"cone", "ctwo", "cthree"} {
+		if got := e.buffer.GetLine(i); got != want {
+			t.Errorf("line %d: expected %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestEditor_TodoHighlights(t *testing.T) {
+	e, err := createTestEditor("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []rune("// TODO: fix TODOS, FIXME_later and (NOTE) XXX")
+	if marks := e.todoHighlights(line); marks != nil {
+		t.Fatal("expected no highlights while the feature is off")
+	}
+
+	e.config.HighlightTodos = true
+	marks := e.todoHighlights(line)
+	var got []string
+	for i := 0; i < len(line); i++ {
+		if !marks[i] {
+			continue
+		}
+		start := i
+		for i < len(line) && marks[i] {
+			i++
+		}
+		got = append(got, string(line[start:i]))
+	}
+	want := []string{"TODO", "NOTE", "XXX"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected highlights %v, got %v", want, got)
+	}
+
+	e.config.TodoKeywords = []string{"fix"}
+	if marks := e.todoHighlights(line); marks == nil || !marks[9] || marks[8] {
+		t.Errorf("expected only the custom keyword to be marked, got %v", marks)
+	}
+}
+
+func TestEditor_TrimBlankLineWhitespaceOnSave(t *testing.T) {
+	tmpfile, err := os.CreateTemp("", "panka_blank_*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	cfg := config.DefaultConfig()
+	cfg.BlankLineWhitespace = config.BlankLineWhitespaceTrim
+	e, err := NewEditor(newMockTerminal(), cfg, tmpfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.buffer = buffer.NewRope("a  \n \t \nb\r\n  \r\n   ")
+	e.lineEnding = "" // Save the mixed endings as they are
+	e.cursorY, e.cursorX = 1, 3
+	if err := e.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "a  \n\nb\r\n\r\n"
+	got, _ := os.ReadFile(tmpfile.Name())
+	if string(got) != want {
+		t.Errorf("saved %q, want %q", got, want)
+	}
+	var sb strings.Builder
+	e.buffer.WriteTo(&sb)
+	if sb.String() != want {
+		t.Errorf("buffer holds %q, want %q", sb.String(), want)
+	}
+	if e.dirty || !e.isContentUnchanged() {
+		t.Error("buffer should be clean after saving")
+	}
+	if e.cursorX != 0 {
+		t.Errorf("cursor left at column %d of an emptied line", e.cursorX)
+	}
+
+	// The cleanup is a single undo step.
+	e.undo()
+	sb.Reset()
+	e.buffer.WriteTo(&sb)
+	if sb.String() != "a  \n \t \nb\r\n  \r\n   " {
+		t.Errorf("undo restored %q", sb.String())
+	}
+}
+
+func TestEditor_EndOfBufferRows(t *testing.T) {
+	e, err := createTestEditor("only line")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.drawTildeRow(); !strings.Contains(got, "   ~ ") {
+		t.Errorf("expected the default ~ marker in the gutter, got %q", got)
+	}
+
+	e.config.EndOfBufferChar = "·"
+	if got := e.drawTildeRow(); !strings.Contains(got, ansiInvert+"   · "+ansiReset) {
+		t.Errorf("expected a right-aligned · marker, got %q", got)
+	}
+
+	e.config.ShowEndOfBuffer = false
+	if got := e.drawTildeRow(); got != ansiInvert+"     "+ansiReset+ansiClearLine+"\r\n" {
+		t.Errorf("expected a blank gutter of the same width, got %q", got)
+	}
+}
+
+func TestEditor_SplitEscapeSequences(t *testing.T) {
+	e, err := createTestEditor("abc\ndef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := e.term.(*mockTerminal)
+	feed := func(bytes string) {
+		for i := 0; i < len(bytes); i++ {
+			term.stdin.WriteByte(bytes[i])
+			if err := e.processInput(); err != nil {
+				t.Fatalf("processInput: %v", err)
+			}
+		}
+	}
+
+	feed("\x1b[C") // Right, one byte per read
+	if e.cursorX != 1 || e.cursorY != 0 {
+		t.Errorf("after Right: cursor (%d,%d), want (1,0)", e.cursorX, e.cursorY)
+	}
+	feed("\x1b[1;2C") // Shift+Right
+	if !e.selectionActive || e.cursorX != 2 {
+		t.Errorf("after Shift+Right: cursorX %d, selection %v", e.cursorX, e.selectionActive)
+	}
+	feed("\x1b[B\x1bOD") // Down, then Left in SS3 form
+	if e.cursorX != 1 || e.cursorY != 1 {
+		t.Errorf("after Down, Left: cursor (%d,%d), want (1,1)", e.cursorX, e.cursorY)
+	}
+
+	// Whole sequences in one read behave the same.
+	feedInput(e, term, "\x1b[D\x1b[A")
+	if e.cursorX != 0 || e.cursorY != 0 {
+		t.Errorf("after Left, Up: cursor (%d,%d), want (0,0)", e.cursorX, e.cursorY)
+	}
+
+	// A runaway sequence is dropped without inserting anything.
+	feed("\x1b[" + strings.Repeat("1;", 40) + "A")
+	if got := e.buffer.GetLine(0) + "\n" + e.buffer.GetLine(1); got != "abc\ndef" {
+		t.Errorf("escape bytes leaked into the buffer: %q", got)
+	}
+	if e.escState != escNone {
+		t.Errorf("parser left in state %d", e.escState)
+	}
+
+	// A lone Esc is resolved when the rest of a sequence never arrives.
+	e.handleKey('\x06') // Ctrl+F
+	feed("\x1b")
+	if !e.isFinding {
+		t.Fatal("a pending ESC must not cancel find before it times out")
+	}
+	e.escapeTimedOut()
+	if e.isFinding || e.escState != escNone {
+		t.Error("expected the timed-out ESC to cancel find")
+	}
+}
+
+// pipeTerminal is a mockTerminal whose input is a pipe, so reads block the
+// way they do on a real terminal.
+type pipeTerminal struct {
+	*mockTerminal
+	r io.Reader
+}
+
+func (p *pipeTerminal) Stdin() io.Reader { return p.r }
+
+func TestEditor_BracketedPasteWithoutEnd(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	e, err := NewEditor(&pipeTerminal{newMockTerminal(), r}, config.DefaultConfig(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The paste holds an escape sequence that is not its end marker, and
+	// the end marker never comes.
+	w.WriteString("\x1b[200~a\x1bxb\x1b[Dc")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e.inputReader.Buffered() > 0 || e.escState != escNone || e.buffer.GetLine(0) == "" {
+			if err := e.processInput(); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		w.Close()
+		<-done
+		t.Fatal("bracketed paste without an end marker blocked")
+	}
+	if got, want := e.buffer.GetLine(0), "a\x1bxb\x1b[Dc"; got != want {
+		t.Errorf("pasted %q, want %q", got, want)
+	}
+}
+
+func TestEditor_FunctionKeys(t *testing.T) {
+	tests := []struct {
+		seq  string
+		want string // "" = not a function key
+	}{
+		{"\x1bOP", "F1"},
+		{"\x1bOS", "F4"},
+		{"\x1b[11~", "F1"},
+		{"\x1b[15~", "F5"},
+		{"\x1b[17~", "F6"},
+		{"\x1b[21~", "F10"},
+		{"\x1b[24~", "F12"},
+		{"\x1b[1;2P", "Shift+F1"},
+		{"\x1b[15;5~", "Ctrl+F5"},
+		{"\x1b[24;8~", "Ctrl+Alt+Shift+F12"},
+		{"\x1b[2~", "Insert"},
+		{"\x1b[2;2~", "Shift+Insert"},
+		{"\x1b[2;5~", "Ctrl+Insert"},
+		{"\x1b[3;2~", "Shift+Delete"},
+		{"\x1b[3~", ""},   // Delete is handled as an editing key
+		{"\x1b[A", ""},    // Arrows too
+		{"\x1b[99~", ""},  // Unknown
+		{"\x1b[1;5X", ""}, // Unknown
+	}
+	for _, tt := range tests {
+		cmd := tt.seq[len(tt.seq)-1]
+		params := ""
+		if strings.HasPrefix(tt.seq, "\x1b[") {
+			params = tt.seq[2 : len(tt.seq)-1]
+		}
+		got, ok := decodeFunctionKey(cmd, params)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("%q: got %q (%v), want %q", tt.seq, got, ok, tt.want)
+		}
+
+		// Fed through the input path, no sequence may leave text behind.
+		e, err := createTestEditor("text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		term := e.term.(*mockTerminal)
+		feedInput(e, term, tt.seq)
+		if strings.HasPrefix(tt.seq, "\x1b[3") {
+			continue // Delete forms edit the buffer
+		}
+		if line := e.buffer.GetLine(0); line != "text" || e.escState != escNone {
+			t.Errorf("%q: buffer %q, parser state %d", tt.seq, line, e.escState)
+		}
+	}
+}
+
+func TestParseKeySpec(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"ctrl+s", "ctrl+s", false},
+		{"Ctrl+K", "ctrl+k", false},
+		{" ctrl+a ", "ctrl+a", false},
+		{"ctrl+z", "ctrl+z", false},
+		{"ctrl+/", "ctrl+/", false},
+		{"ctrl+]", "ctrl+]", false},
+		{"ctrl+\\", "ctrl+\\", false},
+		{"F5", "f5", false},
+		{"f12", "f12", false},
+		{"Shift+F1", "shift+f1", false},
+		{"insert", "insert", false},
+		{"shift+ctrl+Insert", "ctrl+shift+insert", false},
+		{"shift+delete", "shift+delete", false},
+		{"ctrl+c", "", true}, // Copy
+		{"ctrl+i", "", true}, // Tab
+		{"ctrl+m", "", true}, // Enter
+		{"ctrl+", "", true},
+		{"ctrl+ab", "", true},
+		{"ctrl+1", "", true},
+		{"alt+s", "", true},
+		{"s", "", true},
+		{"", "", true},
+		{"f13", "", true},
+		{"f0", "", true},
+		{"delete", "", true}, // An editing key
+		{"ctrl+delete", "", true},
+		{"ctrl+ctrl+f1", "", true},
+		{"hyper+f1", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parseKeySpec(tt.spec)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseKeySpec(%q) = %q, %v; want %q, error %v", tt.spec, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestEditor_Keybindings(t *testing.T) {
+	keymap, errs := buildKeymap(map[string]string{
+		"toggle_case": "ctrl+j",
+		"save":        "ctrl+k", // Free once toggle_case moves
+		"bogus":       "ctrl+z",
+		"find":        "ctrl+q", // Taken by quit
+		"redo":        "hyper+r",
+	})
+	if len(errs) != 3 {
+		t.Errorf("got %d errors, want 3: %v", len(errs), errs)
+	}
+	for key, want := range map[string]rune{"ctrl+j": '\x0b', "ctrl+k": '\x13', "ctrl+q": '\x11', "ctrl+f": '\x06', "ctrl+y": '\x19', "f3": '\x06'} {
+		if got, ok := keymap[key]; !ok || got != want {
+			t.Errorf("keymap[%q] = %q (%v), want %q", key, got, ok, want)
+		}
+	}
+	for _, key := range []string{"ctrl+s", "f2"} {
+		if _, ok := keymap[key]; ok {
+			t.Errorf("%s still bound after save moved to Ctrl+K", key)
+		}
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.Keybindings = map[string]string{"toggle_case": "ctrl+j"}
+	dir := t.TempDir()
+	name := filepath.Join(dir, "keys.txt")
+	if err := os.WriteFile(name, []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEditor(newMockTerminal(), cfg, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := e.term.(*mockTerminal)
+	feedInput(e, term, "\x0b") // Ctrl+K no longer toggles case
+	if got := e.buffer.GetLine(0); got != "abc" {
+		t.Errorf("after Ctrl+K: %q, want it unchanged", got)
+	}
+	feedInput(e, term, "\n") // Ctrl+J does
+	if got := e.buffer.GetLine(0); got != "Abc" {
+		t.Errorf("after Ctrl+J: %q, want %q", got, "Abc")
+	}
+
+	// Bad bindings are reported in the status bar at startup.
+	cfg.Keybindings = map[string]string{"bogus": "ctrl+z", "redo": "hyper+r"}
+	e, err = NewEditor(newMockTerminal(), cfg, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `Config error: keybindings: unknown action "bogus" (and 1 more)`; e.statusMessage != want {
+		t.Errorf("status %q, want %q", e.statusMessage, want)
+	}
+}
+
+func TestEditor_FunctionKeyActions(t *testing.T) {
+	e, err := createTestEditor("hello world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	term := e.term.(*mockTerminal)
+
+	e.selectionActive = true
+	e.selectionAnchorX, e.selectionAnchorY = 0, 0
+	e.cursorX = 6
+	feedInput(e, term, "\x1b[3;2~") // Shift+Delete cuts
+	if got := e.buffer.GetLine(0); got != "world" {
+		t.Errorf("after Shift+Delete got %q", got)
+	}
+
+	feedInput(e, term, "\x1b[13~") // F3 opens find
+	if !e.isFinding {
+		t.Error("expected F3 to open the find prompt")
+	}
+
+	// Function keys can be bound to other actions, and a moved action
+	// leaves its default function key.
+	cfg := config.DefaultConfig()
+	cfg.Keybindings = map[string]string{"toggle_case": "F5", "find": "shift+f3", "save": "ctrl+insert"}
+	e, err = NewEditor(newMockTerminal(), cfg, e.filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(e.statusMessage, "ctrl+insert is bound to both copy and save") {
+		t.Errorf("status %q, want the clash with copy reported", e.statusMessage)
+	}
+	term = e.term.(*mockTerminal)
+	feedInput(e, term, "\x1b[15~") // F5
+	if got := e.buffer.GetLine(0); got != "Hello world" {
+		t.Errorf("after F5 got %q, want toggle_case to run", got)
+	}
+	feedInput(e, term, "\x1b[13~") // F3 no longer finds
+	if e.isFinding {
+		t.Error("F3 still opens find after find moved to Shift+F3")
+	}
+	feedInput(e, term, "\x1b[13;2~") // Shift+F3
+	if !e.isFinding {
+		t.Error("expected Shift+F3 to open the find prompt")
+	}
+}
+
+func TestEditor_UserCommands(t *testing.T) {
+	e, err := createTestEditor("c\nb\na\nz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lineVar, failing := "$PANKA_LINE", "echo oops 1>&2; exit 1"
+	if runtime.GOOS == "windows" {
+		lineVar, failing = "%PANKA_LINE%", "echo oops 1>&2 & exit 1"
+	}
+	e.config.Commands = map[string]config.UserCommand{
+		"sort": {Run: "sort", Input: config.CommandInputSelection, Output: config.CommandOutputReplace},
+		"line": {Run: "echo line " + lineVar, Input: config.CommandInputNone, Output: config.CommandOutputStatus},
+		"fail": {Run: failing, Input: config.CommandInputBuffer, Output: config.CommandOutputReplace},
+	}
+
+	// Replace the selection through the prompt, with Tab completion.
+	e.selectionActive = true
+	e.selectionAnchorX, e.selectionAnchorY = 0, 0
+	e.cursorX, e.cursorY = 0, 3
+	e.handleKey('\x12') // Ctrl+R
+	for _, r := range "so\t\r" {
+		e.handleRune(r)
+	}
+	if e.isRunCommand {
+		t.Error("the prompt should close after Enter")
+	}
+	if got := bufferText(e); got != "a\nb\nc\nz" {
+		t.Errorf("after sort got %q", got)
+	}
+	e.undo()
+	if got := bufferText(e); got != "c\nb\na\nz" {
+		t.Errorf("a single undo should restore the input, got %q", got)
+	}
+
+	// Output equal to the input leaves the buffer unmodified.
+	e.dirty = false
+	e.selectionActive = true
+	e.selectionAnchorX, e.selectionAnchorY = 0, 2
+	e.cursorX, e.cursorY = 0, 3
+	e.runUserCommand("sort")
+	if e.dirty || e.statusMessage != "Ran sort: no changes" {
+		t.Errorf("sorting sorted lines: dirty %v, status %q", e.dirty, e.statusMessage)
+	}
+	e.selectionActive = false
+
+	// Status output leaves the buffer alone.
+	e.cursorY = 1
+	e.runUserCommand("line")
+	if e.statusMessage != "line 2" {
+		t.Errorf("expected status %q, got %q", "line 2", e.statusMessage)
+	}
+
+	// The command palette lists and runs them too.
+	if matches := e.paletteMatches("li"); !slices.Contains(matches, "line") {
+		t.Errorf("palette matches for li = %v, want the line command", matches)
+	}
+	e.cursorY = 2
+	for _, r := range "\x10line\r" {
+		e.handleRune(r)
+	}
+	if e.statusMessage != "line 3" {
+		t.Errorf("palette line: expected status %q, got %q", "line 3", e.statusMessage)
+	}
+
+	// A failing command changes nothing and reports stderr.
+	e.runUserCommand("fail")
+	if got := bufferText(e); got != "c\nb\na\nz" {
+		t.Errorf("failed command changed the buffer to %q", got)
+	}
+	if !strings.Contains(e.statusMessage, "oops") {
+		t.Errorf("expected stderr in the status, got %q", e.statusMessage)
+	}
+}
+
+func TestEditor_UserCommandTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh and process groups")
+	}
+	e, err := createTestEditor("text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(e.filename)
+	defer func(d time.Duration) { userCommandTimeout = d }(userCommandTimeout)
+	userCommandTimeout = 300 * time.Millisecond
+
+	for _, line := range []string{
+		"sleep 5; echo", // Runs past the timeout in a child of the shell
+		"sleep 5 & echo", // Exits at once, leaving a child holding stdout
+	} {
+		start := time.Now()
+		if _, err := e.execUserCommand(line, strings.NewReader("")); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("%q: took %v, want it cut short", line, elapsed)
+		}
+	}
+}
+
+func TestEditor_ClipboardRoundTrip(t *testing.T) {
+	e, err := createTestEditor("one\ntwo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.handleKey('\x18') // Ctrl+X cuts the line
+	if got := e.clipboard.(*memClipboard).text; got != "one\n" {
+		t.Errorf("expected the cut line with an LF ending, got %q", got)
+	}
+	e.cursorY, e.cursorX = 0, 0
+	e.handleKey('\x16') // Ctrl+V
+	if got := e.buffer.GetLine(0) + "|" + e.buffer.GetLine(1); got != "one|two" {
+		t.Errorf("expected the line pasted back, got %q", got)
+	}
+}
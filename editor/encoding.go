@@ -0,0 +1,168 @@
+package editor
+
+import (
+	"io"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// textEncoding is how a file's text is stored on disk. The buffer always
+// holds UTF-8; a UTF-16 file is decoded on load and encoded again on save.
+type textEncoding int
+
+const (
+	encodingUTF8 textEncoding = iota
+	encodingUTF16LE
+	encodingUTF16BE
+)
+
+func (enc textEncoding) String() string {
+	switch enc {
+	case encodingUTF16LE:
+		return "UTF-16LE"
+	case encodingUTF16BE:
+		return "UTF-16BE"
+	}
+	return "UTF-8"
+}
+
+// detectEncoding looks for a UTF-16 byte order mark at the start of a file.
+// Without one the file is taken to be UTF-8.
+func detectEncoding(head []byte) textEncoding {
+	if len(head) >= 2 {
+		switch {
+		case head[0] == 0xFF && head[1] == 0xFE:
+			return encodingUTF16LE
+		case head[0] == 0xFE && head[1] == 0xFF:
+			return encodingUTF16BE
+		}
+	}
+	return encodingUTF8
+}
+
+// utf16Decoder turns UTF-16 bytes into UTF-8 a chunk at a time, so a file can
+// be decoded while it is streamed in. A byte or a high surrogate cut off at
+// the end of one chunk is held for the next. The BOM is decoded as U+FEFF
+// like any other character.
+type utf16Decoder struct {
+	bigEndian bool
+	odd       []byte // The first byte of a code unit split across chunks
+	high      rune   // A high surrogate waiting for its low half, or 0
+}
+
+// decode appends the UTF-8 text of p to dst.
+func (d *utf16Decoder) decode(dst, p []byte) []byte {
+	if len(d.odd) > 0 && len(p) > 0 {
+		unit := append(d.odd, p[0])
+		d.odd = d.odd[:0]
+		dst = d.decodeUnit(dst, unit)
+		p = p[1:]
+	}
+	for len(p) >= 2 {
+		dst = d.decodeUnit(dst, p[:2])
+		p = p[2:]
+	}
+	if len(p) == 1 {
+		d.odd = append(d.odd[:0], p[0])
+	}
+	return dst
+}
+
+func (d *utf16Decoder) decodeUnit(dst, unit []byte) []byte {
+	var u rune
+	if d.bigEndian {
+		u = rune(unit[0])<<8 | rune(unit[1])
+	} else {
+		u = rune(unit[1])<<8 | rune(unit[0])
+	}
+	if d.high != 0 {
+		high := d.high
+		d.high = 0
+		if r := utf16.DecodeRune(high, u); r != utf8.RuneError {
+			return utf8.AppendRune(dst, r)
+		}
+		dst = utf8.AppendRune(dst, utf8.RuneError)
+	}
+	if utf16.IsSurrogate(u) && u < 0xDC00 {
+		d.high = u
+		return dst
+	}
+	if utf16.IsSurrogate(u) {
+		u = utf8.RuneError // A low surrogate on its own
+	}
+	return utf8.AppendRune(dst, u)
+}
+
+// flush appends U+FFFD for a surrogate or byte left over at the end of the
+// input.
+func (d *utf16Decoder) flush(dst []byte) []byte {
+	if d.high != 0 {
+		d.high = 0
+		dst = utf8.AppendRune(dst, utf8.RuneError)
+	}
+	if len(d.odd) > 0 {
+		d.odd = d.odd[:0]
+		dst = utf8.AppendRune(dst, utf8.RuneError)
+	}
+	return dst
+}
+
+// utf16Writer encodes the UTF-8 written to it as UTF-16. A rune split across
+// writes is held until the rest of it arrives. Call Flush when done.
+type utf16Writer struct {
+	w         io.Writer
+	bigEndian bool
+	pending   []byte // The start of a UTF-8 sequence, not yet written
+	written   int64
+}
+
+func (uw *utf16Writer) Write(p []byte) (int, error) {
+	in := p
+	if len(uw.pending) > 0 {
+		in = append(uw.pending, p...)
+		uw.pending = nil
+	}
+	out := make([]byte, 0, 2*len(in))
+	for len(in) > 0 {
+		if !utf8.FullRune(in) {
+			uw.pending = append([]byte(nil), in...)
+			break
+		}
+		r, size := utf8.DecodeRune(in)
+		in = in[size:]
+		out = uw.appendRune(out, r)
+	}
+	n, err := uw.w.Write(out)
+	uw.written += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (uw *utf16Writer) appendRune(out []byte, r rune) []byte {
+	if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+		out = uw.appendUnit(out, r1)
+		return uw.appendUnit(out, r2)
+	}
+	return uw.appendUnit(out, r)
+}
+
+func (uw *utf16Writer) appendUnit(out []byte, u rune) []byte {
+	if uw.bigEndian {
+		return append(out, byte(u>>8), byte(u))
+	}
+	return append(out, byte(u), byte(u>>8))
+}
+
+// Flush writes U+FFFD for an incomplete UTF-8 sequence held back from the
+// last write.
+func (uw *utf16Writer) Flush() error {
+	if len(uw.pending) == 0 {
+		return nil
+	}
+	uw.pending = nil
+	n, err := uw.w.Write(uw.appendRune(nil, utf8.RuneError))
+	uw.written += int64(n)
+	return err
+}
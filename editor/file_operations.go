@@ -4,8 +4,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 	"time"
+
+	"github.com/bulga138/panka/config"
 )
 
 // ---------- Save / misc ----------
@@ -19,13 +23,7 @@ func (e *Editor) scroll() {
 		e.viewportWrapOffset = 0
 	} else if e.cursorY >= e.viewportY {
 		if e.cursorY == e.viewportY && visCursorScreenY < 0 {
-			if e.viewportWrapOffset > 0 {
-				e.viewportWrapOffset--
-			} else if e.viewportY > 0 {
-				e.viewportY--
-				numVisualRows := e.countVisualRows(e.viewportY, textWidth)
-				e.viewportWrapOffset = numVisualRows - 1
-			}
+			e.retreatViewport(textWidth)
 		} else if visCursorScreenY >= e.termHeight {
 			diff := visCursorScreenY - e.termHeight + 1
 			for i := 0; i < diff; i++ {
@@ -33,6 +31,64 @@ func (e *Editor) scroll() {
 			}
 		}
 	}
+	e.keepScrollOff(textWidth)
+}
+
+// scrollOffMargin is the number of rows scrollOff keeps in view on each side
+// of the cursor, capped so the two margins fit on the screen.
+func (e *Editor) scrollOffMargin() int {
+	return max(min(e.config.ScrollOff, (e.termHeight-1)/2), 0)
+}
+
+// keepScrollOff scrolls so the cursor has scrollOff rows of context above and
+// below it. Near the start or end of the buffer there is less to show, and
+// the cursor may come closer to the edge of the screen.
+func (e *Editor) keepScrollOff(textWidth int) {
+	margin := e.scrollOffMargin()
+	if margin == 0 {
+		return
+	}
+	row, _ := e.getVisualCursorPos()
+	row--
+	for ; row < margin && (e.viewportY > 0 || e.viewportWrapOffset > 0); row++ {
+		e.retreatViewport(textWidth)
+	}
+	below := e.visualRowsBelowCursor(textWidth, margin)
+	for ; row > e.termHeight-1-below; row-- {
+		e.advanceViewport(textWidth)
+	}
+}
+
+// visualRowsBelowCursor counts the visual rows after the cursor's row, up to
+// limit.
+func (e *Editor) visualRowsBelowCursor(textWidth, limit int) int {
+	wrapRow := e.getVisualX(e.cursorY, e.cursorX) / textWidth
+	n := max(e.countVisualRows(e.cursorY, textWidth)-1-wrapRow, 0)
+	for y := e.cursorY + 1; n < limit && y < e.buffer.LineCount(); y++ {
+		n += e.countVisualRows(y, textWidth)
+	}
+	return min(n, limit)
+}
+
+// centerCursorIfOffScreen scrolls a cursor that is off the screen to its
+// middle row. Near the end of the buffer it scrolls only as far as puts the
+// last line at the bottom, so the screen stays full.
+func (e *Editor) centerCursorIfOffScreen() {
+	// A line more than a screen below the viewport cannot be on screen, so
+	// don't count the rows up to it
+	if e.cursorY >= e.viewportY && e.cursorY <= e.viewportY+e.termHeight {
+		if row, _ := e.getVisualCursorPos(); row >= 1 && row <= e.termHeight {
+			return
+		}
+	}
+	textWidth := e.getTextWidth()
+	e.viewportY = e.cursorY
+	e.viewportWrapOffset = e.getVisualX(e.cursorY, e.cursorX) / textWidth
+	half := (e.termHeight - 1) / 2
+	below := e.visualRowsBelowCursor(textWidth, e.termHeight-1-half)
+	for i := 0; i < e.termHeight-1-below; i++ {
+		e.retreatViewport(textWidth)
+	}
 }
 
 func (e *Editor) advanceViewport(textWidth int) {
@@ -47,6 +103,17 @@ func (e *Editor) advanceViewport(textWidth int) {
 	}
 }
 
+// retreatViewport moves the viewport up one visual row, the reverse of
+// advanceViewport.
+func (e *Editor) retreatViewport(textWidth int) {
+	if e.viewportWrapOffset > 0 {
+		e.viewportWrapOffset--
+	} else if e.viewportY > 0 {
+		e.viewportY--
+		e.viewportWrapOffset = e.countVisualRows(e.viewportY, textWidth) - 1
+	}
+}
+
 func (e *Editor) save() error {
 	if e.filename == "" {
 		e.isSaveAs = true
@@ -54,6 +121,61 @@ func (e *Editor) save() error {
 		e.statusMessage = "Save As: "
 		return nil
 	}
+	if e.changedOnDisk() {
+		e.isConfirmingOverwrite = true
+		e.setStatusMessage("File changed on disk, overwrite (Y/N)?")
+		return nil
+	}
+	return e.writeFile()
+}
+
+// autoSavePending reports whether the buffer is waiting to be auto-saved:
+// autoSaveSeconds is set, the buffer has unsaved changes and a file name,
+// no prompt is open, and this version was not already tried.
+func (e *Editor) autoSavePending() bool {
+	return e.config.AutoSaveSeconds > 0 && e.dirty && e.filename != "" &&
+		e.pager == nil && !e.readOnly && !e.invalidUTF8 && !e.inPrompt() &&
+		(e.autoSaveBuffer != e.buffer || e.autoSaveVersion != e.buffer.Version())
+}
+
+// autoSaveDelay is how long the keyboard must be idle before an auto-save.
+func (e *Editor) autoSaveDelay() time.Duration {
+	return time.Duration(e.config.AutoSaveSeconds) * time.Second
+}
+
+// autoSave saves the buffer once no key has been pressed for autoSaveSeconds.
+// It never asks anything: a file changed on disk is left for an explicit
+// save. Each buffer version is tried once, so a failed save waits for the
+// next edit instead of being retried in a loop.
+func (e *Editor) autoSave() {
+	if !e.autoSavePending() || time.Since(e.lastInputTime) < e.autoSaveDelay() {
+		return
+	}
+	e.flushEditGroups()
+	e.autoSaveBuffer = e.buffer
+	e.autoSaveVersion = e.buffer.Version()
+	if e.changedOnDisk() {
+		e.setStatusMessage("Not auto-saved: %s changed on disk", e.filename)
+		return
+	}
+	if e.writeFile() == nil {
+		e.setStatusMessage("Auto-saved")
+	}
+}
+
+// writeFile writes the buffer to e.filename, first copying the file on disk
+// to its backup when createBackup is on.
+func (e *Editor) writeFile() error {
+	e.cleanupBeforeSave()
+	formatErr := e.formatBeforeSave()
+	e.fixFinalNewline()
+
+	if e.config.CreateBackup {
+		if err := copyFileIfExists(e.filename, e.filename+e.config.BackupSuffix); err != nil {
+			e.setStatusMessage("Backup error: %v", err)
+			return err
+		}
+	}
 
 	f, err := os.Create(e.filename)
 	if err != nil {
@@ -62,20 +184,369 @@ func (e *Editor) save() error {
 	}
 	defer f.Close()
 
-	n, err := e.buffer.WriteTo(f)
+	// A UTF-16 file is encoded on the way out, BOM included.
+	var out io.Writer = f
+	var uw *utf16Writer
+	if e.encoding != encodingUTF8 {
+		uw = &utf16Writer{w: f, bigEndian: e.encoding == encodingUTF16BE}
+		out = uw
+	}
+
+	var n int64
+	if e.hasBOM {
+		if _, err := io.WriteString(out, utf8BOM); err != nil {
+			e.setStatusMessage("Write error: %v", err)
+			return err
+		}
+		n = int64(len(utf8BOM))
+	}
+	var written int64
+	if e.lineEnding != "" {
+		lw := &lineEndingWriter{w: out, crlf: e.lineEnding == "\r\n"}
+		_, err = e.buffer.WriteTo(lw)
+		if err == nil {
+			err = lw.Flush()
+		}
+		written = lw.written
+	} else {
+		written, err = e.buffer.WriteTo(out)
+	}
+	n += written
+	if uw != nil {
+		if err == nil {
+			err = uw.Flush()
+		}
+		n = uw.written
+	}
+	if err == nil {
+		err = f.Close()
+	}
 	if err != nil {
 		e.setStatusMessage("Write error: %v", err)
 		return err
 	}
 
 	e.dirty = false
+	e.recordDiskState()
 	// Update the hash after a successful save
 	e.initialHash = e.calculateBufferHash()
+	e.initialLength = e.buffer.Length()
+
+	if formatErr != nil {
+		e.setStatusMessage("%d bytes written to %s (not formatted: %v)", n, e.filename, formatErr)
+	} else {
+		e.setStatusMessage("%d bytes written to %s", n, e.filename)
+	}
+	return nil
+}
+
+// copyFileIfExists copies src to dst with the same permissions, replacing
+// dst. A src that doesn't exist yet has nothing to copy.
+func copyFileIfExists(src, dst string) error {
+	in, err := os.Open(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// recordDiskState remembers the file's modification time and size, so a later
+// save can tell whether something else has written to it since.
+func (e *Editor) recordDiskState() {
+	e.diskModTime, e.diskSize = time.Time{}, 0
+	if info, err := os.Stat(e.filename); err == nil {
+		e.diskModTime, e.diskSize = info.ModTime(), info.Size()
+	}
+}
+
+// changedOnDisk reports whether the file was modified by something else after
+// it was loaded or last saved. A file that was not on disk then, or is not
+// now, has nothing to lose.
+func (e *Editor) changedOnDisk() bool {
+	if e.diskModTime.IsZero() {
+		return false
+	}
+	info, err := os.Stat(e.filename)
+	if err != nil {
+		return false
+	}
+	return !info.ModTime().Equal(e.diskModTime) || info.Size() != e.diskSize
+}
+
+// reloadFile re-reads the file from disk, asking first when the buffer has
+// unsaved changes. A file that has been deleted leaves the buffer alone.
+func (e *Editor) reloadFile() {
+	e.flushEditGroups()
+	if e.filename == "" {
+		e.setStatusMessage("Nothing to reload: the buffer has no file")
+		return
+	}
+	if _, err := os.Stat(e.filename); err != nil {
+		if !os.IsNotExist(err) {
+			e.setStatusMessage("Reload error: %v", err)
+			return
+		}
+		// Keep the text, and make sure quitting offers to save it.
+		e.dirty = true
+		e.initialHash = ""
+		e.setStatusMessage("%s no longer exists on disk; keeping the buffer (save to recreate it)", e.filename)
+		return
+	}
+	if e.isModified() {
+		e.isConfirmingReload = true
+		e.setStatusMessage("Discard changes and reload %s (Y/N)?", e.filename)
+		return
+	}
+	e.reloadFromDisk()
+}
+
+// reloadFromDisk replaces the buffer with the file's current content. The
+// cursor stays on the same line and column where the new text still has them.
+func (e *Editor) reloadFromDisk() {
+	old := e.pager
+	if err := e.openFile(e.filename); err != nil {
+		e.setStatusMessage("Reload error: %v", err)
+		return
+	}
+	if old != nil {
+		old.close()
+	}
+	e.selectionActive = false
+	e.extraCursorHeight = 0
+	e.extraCursors = nil
+	e.blockActive = false
+	e.clearHighlights()
+	e.cursorY = min(e.cursorY, e.buffer.LineCount()-1)
+	e.clampCursorX()
+	e.viewportY = min(e.viewportY, e.cursorY)
+	e.viewportWrapOffset = 0
+	e.updateLineNumWidth()
+	if !e.showLineNumbers {
+		e.lineNumWidth = 0
+	}
+	e.setStatusMessage("Reloaded %s from disk", e.filename)
+}
+
+// cleanupBeforeSave applies the save-time cleanups enabled in the config. It
+// edits the buffer itself, as a single undo step, so the saved file and the
+// buffer stay identical.
+func (e *Editor) cleanupBeforeSave() {
+	if e.config.BlankLineWhitespace != config.BlankLineWhitespaceTrim {
+		return
+	}
+	e.flushEditGroups()
+	grouped := false
+	for y := 0; y < e.buffer.LineCount(); y++ {
+		line := e.buffer.GetLine(y)
+		if line == "" || strings.Trim(line, " \t") != "" {
+			continue
+		}
+		if !grouped {
+			e.beginUndoGroup()
+			defer e.endUndoGroup()
+			grouped = true
+		}
+		runes := []rune(line)
+		ops := make([]opEntry, len(runes))
+		for x, r := range runes {
+			ops[x] = opEntry{insertLine: y, insertCol: x, r: r}
+		}
+		for x := len(runes); x > 0; x-- {
+			e.buffer.Delete(y, x)
+		}
+		e.pushUndoDeleteBlock(ops, false)
+		if y == e.cursorY {
+			e.clampCursorX()
+		}
+	}
+}
+
+// formatBeforeSave pipes the buffer through formatCommand, streaming it to
+// the command's stdin, and replaces the text with the output as one undo
+// step when the command exits 0. The cursor keeps its line and column,
+// clamped to the new text. A failing command changes nothing; its error is
+// returned so the save can report it.
+func (e *Editor) formatBeforeSave() error {
+	if e.config.FormatCommand == "" {
+		return nil
+	}
+	e.flushEditGroups()
+	out, err := e.execUserCommand(e.config.FormatCommand, e.buffer.NewReader())
+	if err != nil {
+		return err
+	}
+	var current strings.Builder
+	e.buffer.WriteTo(&current)
+	if strings.ReplaceAll(out, "\r\n", "\n") == strings.ReplaceAll(current.String(), "\r\n", "\n") {
+		return nil
+	}
 
-	e.setStatusMessage("%d bytes written to %s", n, e.filename)
+	cursorY, cursorX := e.cursorY, e.cursorX
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	e.selectAll()
+	e.deleteSelectedText()
+	e.selectionActive = false
+	e.extraCursorHeight = 0
+	e.extraCursors = nil
+	e.blockActive = false
+	if out != "" {
+		e.pasteText(out)
+	}
+	e.cursorY = min(cursorY, e.buffer.LineCount()-1)
+	e.cursorX = cursorX
+	e.clampCursorX()
 	return nil
 }
 
+// fixFinalNewline makes the text end the way ensureFinalNewline and
+// trimFinalNewlines ask, after any formatCommand has run. Text ending with a
+// newline has an empty last line, so trimming leaves exactly one empty line
+// at the end and moves a cursor that was below it up onto it. Empty text is
+// left alone.
+func (e *Editor) fixFinalNewline() {
+	last := e.buffer.LineCount() - 1
+	if e.config.TrimFinalNewlines && e.buffer.GetLine(last) == "" {
+		first := last
+		for first > 1 && e.buffer.GetLine(first-1) == "" {
+			first--
+		}
+		if first < last {
+			e.flushEditGroups()
+			ops := make([]opEntry, 0, last-first)
+			for y := first; y < last; y++ {
+				ops = append(ops, opEntry{insertLine: y, insertCol: 0, r: '\n'})
+			}
+			if err := e.buffer.DeleteRange(first, 0, last, 0); err != nil {
+				return
+			}
+			e.pushUndoDeleteBlock(ops, false)
+			e.cursorY = min(e.cursorY, first)
+			e.selectionAnchorY = min(e.selectionAnchorY, first)
+			e.clampCursorAndAnchor()
+			last = first
+		}
+	}
+	if line := e.buffer.GetLine(last); e.config.EnsureFinalNewline && line != "" {
+		e.flushEditGroups()
+		col := len([]rune(line))
+		if err := e.buffer.InsertString(last, col, "\n"); err != nil {
+			return
+		}
+		e.pushUndoInsertText(last, col, "\n")
+	}
+}
+
+// utf8BOM is the UTF-8 encoding of U+FEFF, the byte order mark.
+const utf8BOM = "\uFEFF"
+
+// lineEndingSampleLines is how many lines detectLineEnding looks at.
+const lineEndingSampleLines = 1000
+
+// detectLineEnding returns the line ending used by most of the first
+// lineEndingSampleLines lines of content: "\r\n" or "\n". Text without line
+// breaks gets "\n".
+func detectLineEnding(content string) string {
+	crlf, lf := 0, 0
+	for i := 0; i < lineEndingSampleLines; i++ {
+		nl := strings.IndexByte(content, '\n')
+		if nl == -1 {
+			break
+		}
+		if nl > 0 && content[nl-1] == '\r' {
+			crlf++
+		} else {
+			lf++
+		}
+		content = content[nl+1:]
+	}
+	if crlf > lf {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// lineEndingName is the status bar label for the line ending used on save.
+func (e *Editor) lineEndingName() string {
+	if e.lineEnding == "\r\n" {
+		return "CRLF"
+	}
+	return "LF"
+}
+
+// encodingStatus is the status bar marker for a file not stored as UTF-8.
+func (e *Editor) encodingStatus() string {
+	if e.encoding == encodingUTF8 {
+		return ""
+	}
+	return " " + e.encoding.String()
+}
+
+// lineEndingWriter rewrites line terminators to LF or CRLF on the fly so a
+// buffer with mixed endings is saved consistently. Call Flush when done.
+type lineEndingWriter struct {
+	w         io.Writer
+	crlf      bool
+	pendingCR bool // A '\r' at the end of the previous chunk, not yet written
+	written   int64
+}
+
+func (lw *lineEndingWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+len(p)/16)
+	for _, b := range p {
+		if lw.pendingCR {
+			lw.pendingCR = false
+			if b != '\n' {
+				out = append(out, '\r') // A lone '\r' is content, keep it
+			}
+		}
+		switch b {
+		case '\r':
+			lw.pendingCR = true
+		case '\n':
+			if lw.crlf {
+				out = append(out, '\r')
+			}
+			out = append(out, '\n')
+		default:
+			out = append(out, b)
+		}
+	}
+	n, err := lw.w.Write(out)
+	lw.written += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes a trailing '\r' held back from the last chunk.
+func (lw *lineEndingWriter) Flush() error {
+	if !lw.pendingCR {
+		return nil
+	}
+	lw.pendingCR = false
+	n, err := lw.w.Write([]byte{'\r'})
+	lw.written += int64(n)
+	return err
+}
+
 func (e *Editor) setStatusMessage(f string, a ...interface{}) {
 	e.statusMessage = fmt.Sprintf(f, a...)
 	e.statusTime = time.Now()
@@ -113,8 +584,12 @@ func (e *Editor) calculateBufferHash() string {
 }
 
 // isContentUnchanged checks if the current buffer content exactly matches
-// the content when the file was loaded or last saved.
+// the content when the file was loaded or last saved. A change in length
+// settles it without hashing the buffer.
 func (e *Editor) isContentUnchanged() bool {
+	if e.buffer.Length() != e.initialLength {
+		return false
+	}
 	currentHash := e.calculateBufferHash()
 	return currentHash == e.initialHash
 }
@@ -0,0 +1,107 @@
+package editor
+
+// Find matches can stay on screen outside the find prompt: Alt+W marks the
+// word under the cursor, and with keepHighlights a find closed after
+// Enter leaves its matches up. Either way Alt+N and Alt+P step through them,
+// and an edit or Esc takes them down; see dropStaleHighlight.
+
+// highlightWordOccurrences (Alt+W) marks every whole-word occurrence of the
+// word under the cursor without opening the find prompt. Ctrl+F then starts
+// out searching for the word. Unlike kept search matches, the marks also go
+// away once the cursor leaves the occurrences.
+func (e *Editor) highlightWordOccurrences() {
+	runes := []rune(e.buffer.GetLine(e.cursorY))
+	start, end, ok := wordBoundsAt(runes, e.cursorX)
+	if !ok {
+		e.setStatusMessage("No word at the cursor")
+		return
+	}
+	word := runes[start:end]
+
+	var matches []findResult
+	current := -1
+	for y := 0; y < e.buffer.LineCount(); y++ {
+		line := []rune(e.buffer.GetLine(y))
+		for x := 0; x+len(word) <= len(line); x++ {
+			if !isWholeWordAt(line, x, word) {
+				continue
+			}
+			if y == e.cursorY && x == start {
+				current = len(matches)
+			}
+			matches = append(matches, findResult{y: y, x: x, length: len(word)})
+			x += len(word) - 1
+		}
+	}
+
+	e.findMatches = matches
+	e.findCurrentMatch = current
+	e.findWrapMessage = ""
+	e.lastSearchQuery = string(word)
+	e.showHighlights(true)
+	e.setStatusMessage("%d occurrence(s) of %q (Alt+N:Next | Alt+P:Prev)", len(matches), e.lastSearchQuery)
+}
+
+// keepFindHighlights closes the find prompt at the current match, leaving
+// the matches on screen.
+func (e *Editor) keepFindHighlights() {
+	e.isFinding = false
+	e.promptBuffer = ""
+	e.showHighlights(false)
+	e.setStatusMessage("Match %d of %d (Alt+N:Next | Alt+P:Prev | Esc:Clear)", e.findCurrentMatch+1, len(e.findMatches))
+}
+
+// showHighlights marks findMatches as shown outside the prompt, as of the
+// current buffer version.
+func (e *Editor) showHighlights(followCursor bool) {
+	e.highlightMatches = true
+	e.highlightFollowsCursor = followCursor
+	e.highlightVersion = e.buffer.Version()
+}
+
+// stepHighlight (Alt+N, Alt+P) jumps to the next or previous highlighted
+// match and says which one it is.
+func (e *Editor) stepHighlight(forward bool) {
+	if forward {
+		e.findNext()
+	} else {
+		e.findPrevious()
+	}
+	e.setStatusMessage("%sMatch %d of %d", e.findWrapNote(), e.findCurrentMatch+1, len(e.findMatches))
+}
+
+// clearHighlights takes the highlighted matches down.
+func (e *Editor) clearHighlights() {
+	e.highlightMatches = false
+	e.findMatches = nil
+	e.findCurrentMatch = -1
+}
+
+// dropStaleHighlight clears the highlighted matches after a key that edited
+// the buffer, or for Alt+W, took the cursor off every occurrence. Opening
+// the find prompt hands findMatches over to the prompt, which keeps them up
+// to date itself.
+func (e *Editor) dropStaleHighlight() {
+	if !e.highlightMatches {
+		return
+	}
+	if e.isFinding || e.isReplacing {
+		e.highlightMatches = false
+		return
+	}
+	if e.buffer.Version() == e.highlightVersion && (!e.highlightFollowsCursor || e.cursorOnHighlight()) {
+		return
+	}
+	e.clearHighlights()
+}
+
+// cursorOnHighlight reports whether the cursor is inside one of the
+// highlighted matches or just past its end.
+func (e *Editor) cursorOnHighlight() bool {
+	for _, m := range e.findMatches {
+		if m.y == e.cursorY && e.cursorX >= m.x && e.cursorX <= m.x+m.length {
+			return true
+		}
+	}
+	return false
+}
@@ -1,9 +1,18 @@
 package editor
 
 import (
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/bulga138/panka/config"
 )
 
 // ---------- Undo grouping helpers ----------
@@ -16,6 +25,7 @@ func (e *Editor) beginUndoGroup() {
 
 func (e *Editor) endUndoGroup() {
 	e.undoGrouping = false
+	e.trimUndoStack()
 }
 
 func (e *Editor) flushTypingGroup() {
@@ -65,13 +75,134 @@ func (e *Editor) flushEditGroups() {
 // ---------- Input processing ----------
 
 func (e *Editor) processInput() error {
-	r, _, err := e.inputReader.ReadRune()
+	r, err := e.readInputRune()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if e.escState != escNone {
+			return e.escapeTimedOut()
+		}
+		e.autoSave()
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	if r == '\x1b' {
+	r, bound := e.boundKey(r)
+	if !bound {
+		return nil
+	}
+	err = e.handleRune(r)
+	e.dropStaleHighlight()
+	return err
+}
+
+// readInputRune reads the next rune of input. While an escape sequence or a
+// bracketed paste is pending and nothing else is buffered, the read gives up
+// after escTimeout so a lone Esc press is not held back until the next key,
+// and a paste whose end marker never comes does not hang. While an auto-save
+// is pending it gives up when the save is due.
+func (e *Editor) readInputRune() (rune, error) {
+	if e.inputReader.Buffered() == 0 {
+		var deadline time.Time
+		if e.escState != escNone || e.pasting {
+			deadline = time.Now().Add(escTimeout)
+		} else if e.autoSavePending() {
+			deadline = e.lastInputTime.Add(e.autoSaveDelay())
+		}
+		if !deadline.IsZero() {
+			if err := e.input.SetReadDeadline(deadline); err != nil {
+				e.setStatusMessage("Input cannot time out, so Esc and auto-save wait for the next key: %v", err)
+			} else {
+				defer e.input.SetReadDeadline(time.Time{})
+			}
+		}
+	}
+	r, _, err := e.inputReader.ReadRune()
+	if err == nil {
+		e.lastInputTime = time.Now()
+	}
+	return r, err
+}
+
+// inputSource is terminal input whose reads can give up at a deadline, with
+// os.ErrDeadlineExceeded, the way an *os.File's can.
+type inputSource interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// newInputSource returns r if reads from it can already time out. Other
+// input, such as the Windows console, which cannot take a read deadline, is
+// read on a goroutine of its own so that a read can stop waiting for it.
+func newInputSource(r io.Reader) inputSource {
+	if in, ok := r.(inputSource); ok && in.SetReadDeadline(time.Time{}) == nil {
+		return in
+	}
+	a := &asyncInput{chunks: make(chan asyncChunk)}
+	go a.readFrom(r)
+	return a
+}
+
+// asyncInput hands on what a goroutine reads from the terminal.
+type asyncInput struct {
+	chunks   chan asyncChunk
+	deadline time.Time
+	pending  []byte // The rest of the last chunk
+	err      error  // The error that ended the input
+}
+
+type asyncChunk struct {
+	data []byte
+	err  error
+}
+
+func (a *asyncInput) readFrom(r io.Reader) {
+	for {
+		buf := make([]byte, 4096)
+		n, err := r.Read(buf)
+		a.chunks <- asyncChunk{buf[:n], err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (a *asyncInput) Read(p []byte) (int, error) {
+	if len(a.pending) == 0 && a.err == nil {
+		var timeout <-chan time.Time
+		if !a.deadline.IsZero() {
+			t := time.NewTimer(time.Until(a.deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case c := <-a.chunks:
+			a.pending, a.err = c.data, c.err
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+	if len(a.pending) == 0 {
+		return 0, a.err
+	}
+	n := copy(p, a.pending)
+	a.pending = a.pending[n:]
+	return n, nil
+}
+
+func (a *asyncInput) SetReadDeadline(t time.Time) error {
+	a.deadline = t
+	return nil
+}
+
+// handleRune routes one rune of input to the escape sequence parser, the
+// active prompt, or the main editor.
+func (e *Editor) handleRune(r rune) error {
+	if e.escState != escNone || r == '\x1b' {
+		return e.feedEscape(r)
+	}
+	if r == '\x03' { // Ctrl+C is never inserted into a prompt or the buffer
 		e.flushEditGroups()
-		return e.handleEscape()
+		return e.handleCtrlC()
 	}
 	if e.isConfirmingReplace {
 		return e.handleReplaceConfirm(r)
@@ -79,27 +210,59 @@ func (e *Editor) processInput() error {
 	if e.isQuitting {
 		return e.handleQuitPrompt(r)
 	}
+	if e.isConfirmingReload {
+		return e.handleReloadPrompt(r)
+	}
+	if e.isConfirmingOverwrite {
+		return e.handleOverwritePrompt(r)
+	}
+	if e.isChoosingLineEnding {
+		return e.handleLineEndingPrompt(r)
+	}
 	if e.isGotoLine {
 		return e.handleGotoLineInput(r)
 	}
 	if e.isSaveAs {
 		return e.handleSaveAsInput(r)
 	}
+	if e.isRunCommand {
+		return e.handleRunCommandInput(r)
+	}
+	if e.isCommandMode {
+		return e.handleCommandInput(r)
+	}
 	if e.isReplacing {
 		return e.handleReplaceInput(r)
 	}
 	if e.isFinding {
 		return e.handleFindInput(r)
 	}
+	if e.pager != nil || e.readOnly || e.invalidUTF8 {
+		return e.handleReadOnlyKey(r)
+	}
 	return e.handleKey(r)
 }
 
+// handleReadOnlyKey, in pager or read-only mode, passes the keys that do not
+// modify the buffer on to handleKey and refuses the rest.
+func (e *Editor) handleReadOnlyKey(r rune) error {
+	switch r {
+	case '\x11', '\x06', '\x14', '\x0c', '\x0f', '\x01', '\x07', '\x12', '\x0e', '\x1d', '\x10': // Quit, Find, Go to, line numbers, non-printable, Select All, Clear search, Run command, Statistics, Matching bracket, Command palette
+		return e.handleKey(r)
+	}
+	e.readOnlyBlocked()
+	return nil
+}
+
 func (e *Editor) handleFindInput(r rune) error {
 	switch r {
 	case '\x1b': // Escape
 		return nil
 
-	case '\x08': // Ctrl+H
+	case '\x08', '\t': // Ctrl+H, or Tab as in the replace prompt: on to the replace field
+		if e.readOnlyBlocked() {
+			return nil
+		}
 		e.isReplacing = true
 		e.promptFocus = 1
 		e.replaceBuffer = ""
@@ -107,19 +270,41 @@ func (e *Editor) handleFindInput(r rune) error {
 		return nil
 
 	case '\r', '\x0e': // Enter or Ctrl+N (Find Next)
+		if r == '\r' {
+			e.addFindHistory(e.promptBuffer)
+		}
+		e.findAccepted = true
 		e.findNext()
 		return nil
 
 	case '\x10': // Ctrl+P (Find Previous)
+		e.findAccepted = true
 		e.findPrevious()
 		return nil
 
+	case '\x05': // Ctrl+E (Toggle regex)
+		e.toggleSearchRegex()
+		return nil
+
+	case '\x16': // Ctrl+V (Paste)
+		e.pasteIntoPrompt()
+		return nil
+
+	case '\x15': // Ctrl+U (Undo)
+		e.undoInFind(false)
+		return nil
+
+	case '\x19': // Ctrl+Y (Redo)
+		e.undoInFind(true)
+		return nil
+
 	case '\x7f': // Backspace
 		e.backspacePromptRune()
 		e.lastSearchQuery = e.promptBuffer
 		if e.promptBuffer == "" {
 			e.findMatches = nil
 			e.findCurrentMatch = -1
+			e.searchErr = nil
 			e.selectionActive = false
 		} else {
 			e.findInitial()
@@ -149,33 +334,179 @@ func (e *Editor) handleReplaceConfirm(r rune) error {
 
 func (e *Editor) findAllMatches(query string) {
 	e.findMatches = nil
-	if query == "" {
+	if !e.compileSearch(query) {
 		return
 	}
-	queryLower := strings.ToLower(query)
-	matches := make([]findResult, 0)
-	for y := 0; y < e.buffer.LineCount(); y++ {
-		line := e.buffer.GetLine(y)
-		lineLower := strings.ToLower(line)
-		lineRunes := []rune(lineLower)
-		offset := 0
-		for {
-			matchIndex := strings.Index(string(lineRunes[offset:]), queryLower)
-			if matchIndex == -1 {
-				break
-			}
-			matchX := offset + matchIndex
-			matches = append(matches, findResult{y, matchX})
-			offset = matchX + 1
-			if offset >= len(lineRunes) {
-				break
+	if e.searchRe == nil && e.findCacheQuery != "" && strings.HasPrefix(query, e.findCacheQuery) &&
+		e.findCacheBuffer == e.buffer && e.findCacheVersion == e.buffer.Version() {
+		e.filterFindCache(query)
+	} else {
+		e.findCache = e.findCache[:0]
+		matches := make([]findResult, 0)
+		for y := 0; y < e.buffer.LineCount(); y++ {
+			line := e.buffer.GetLine(y)
+			lineMatches := e.matchLine(y, line, query)
+			matches = append(matches, lineMatches...)
+			if e.searchRe == nil {
+				for _, m := range lineMatches {
+					e.findCache = append(e.findCache, findCacheEntry{match: m, line: line, byteX: runeToByteOffset(line, m.x)})
+				}
 			}
 		}
+		e.findMatches = matches
+	}
+
+	e.findCacheQuery = ""
+	if e.searchRe == nil {
+		e.findCacheQuery = query
+		e.findCacheBuffer = e.buffer
+		e.findCacheVersion = e.buffer.Version()
+	}
+}
+
+// findCacheEntry remembers where a cached match sits in its line's text, so
+// narrowing the search needs neither the buffer nor a rune conversion.
+type findCacheEntry struct {
+	match findResult
+	line  string
+	byteX int
+}
+
+// filterFindCache narrows the cached matches to those that still match query,
+// which extends the cached query. A literal match of the longer query starts
+// with a match of the shorter one, so only the cached positions need checking.
+func (e *Editor) filterFindCache(query string) {
+	queryRunes := []rune(query)
+	matches := make([]findResult, 0, len(e.findCache))
+	cache := e.findCache[:0]
+	for _, c := range e.findCache {
+		if stringHasPrefixFold(c.line[c.byteX:], queryRunes) {
+			c.match.length = len(queryRunes)
+			matches = append(matches, c.match)
+			cache = append(cache, c)
+		}
 	}
 	e.findMatches = matches
+	e.findCache = cache
+}
+
+// stringHasPrefixFold reports whether s starts with prefix under simple case
+// folding, rune for rune.
+func stringHasPrefixFold(s string, prefix []rune) bool {
+	for _, want := range prefix {
+		r, size := utf8.DecodeRuneInString(s)
+		if size == 0 || !runeEqualFold(r, want) {
+			return false
+		}
+		s = s[size:]
+	}
+	return true
+}
+
+// runeToByteOffset returns the byte offset of rune column x in s.
+func runeToByteOffset(s string, x int) int {
+	for i := range s {
+		if x == 0 {
+			return i
+		}
+		x--
+	}
+	return len(s)
+}
+
+// compileSearch prepares query for matchLine and reports whether there is
+// anything to search for. In regex mode a query that does not compile leaves
+// its error in searchErr, which the status bar shows.
+func (e *Editor) compileSearch(query string) bool {
+	e.searchRe = nil
+	e.searchErr = nil
+	if query == "" {
+		e.findCache = nil
+		e.findCacheQuery = ""
+		return false
+	}
+	if !e.searchRegex {
+		return true
+	}
+	// Match the literal search, which ignores case; (?-i) turns it back on.
+	re, err := regexp.Compile("(?i)" + query)
+	if err != nil {
+		e.searchErr = err
+		return false
+	}
+	e.searchRe = re
+	return true
+}
+
+// matchLine finds the matches for query on line y, whose text is line.
+// compileSearch must have succeeded first. Empty regex matches are skipped,
+// since there is nothing to select or replace.
+func (e *Editor) matchLine(y int, line, query string) []findResult {
+	var matches []findResult
+	if e.searchRe != nil {
+		for _, loc := range e.searchRe.FindAllStringIndex(line, -1) {
+			if loc[0] == loc[1] {
+				continue
+			}
+			matches = append(matches, findResult{
+				y:      y,
+				x:      utf8.RuneCountInString(line[:loc[0]]),
+				length: utf8.RuneCountInString(line[loc[0]:loc[1]]),
+			})
+		}
+		return matches
+	}
+
+	// Compare rune by rune with simple case folding rather than lowercasing
+	// the line: ToLower can change a line's rune count (İ becomes i̇), which
+	// would shift every column after it.
+	queryRunes := []rune(query)
+	lineRunes := []rune(line)
+	for x := 0; x+len(queryRunes) <= len(lineRunes); x++ {
+		if runesEqualFold(lineRunes[x:x+len(queryRunes)], queryRunes) {
+			matches = append(matches, findResult{y, x, len(queryRunes)})
+		}
+	}
+	return matches
+}
+
+// runesEqualFold reports whether a and b are equal under simple Unicode case
+// folding, rune for rune.
+func runesEqualFold(a, b []rune) bool {
+	for i := range a {
+		if !runeEqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// runeEqualFold reports whether a and b are the same rune under simple
+// Unicode case folding.
+func runeEqualFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	r := unicode.SimpleFold(a)
+	for r != a && r != b {
+		r = unicode.SimpleFold(r)
+	}
+	return r == b
+}
+
+// toggleSearchRegex switches the find prompt between literal and regex
+// search and re-runs the current query.
+func (e *Editor) toggleSearchRegex() {
+	e.searchRegex = !e.searchRegex
+	if e.promptBuffer == "" {
+		e.searchErr = nil
+		return
+	}
+	e.findInitial()
 }
 
 func (e *Editor) findInitial() {
+	e.findWrapMessage = ""
 	e.findAllMatches(e.promptBuffer)
 	if len(e.findMatches) == 0 {
 		e.findCurrentMatch = -1
@@ -197,14 +528,58 @@ func (e *Editor) findInitial() {
 	e.jumpToMatch(e.findCurrentMatch)
 }
 
+// undoInFind runs undo (or redo) without leaving find/replace mode, then
+// re-runs the search so findMatches reflects the restored buffer.
+func (e *Editor) undoInFind(redo bool) {
+	// In plain find mode the message bar shows statusMessage as the prompt label.
+	label := e.statusMessage
+	if redo {
+		e.redo()
+	} else {
+		e.undo()
+	}
+	if !e.isReplacing {
+		e.statusMessage = label
+	}
+	e.refreshFindMatches()
+}
+
+// refreshFindMatches recomputes findMatches and selects the first match at or
+// after the cursor, wrapping to the first match in the document.
+func (e *Editor) refreshFindMatches() {
+	e.findAllMatches(e.promptBuffer)
+	e.findCurrentMatch = -1
+	if len(e.findMatches) == 0 {
+		e.selectionActive = false
+		return
+	}
+	e.findCurrentMatch = 0
+	for i, match := range e.findMatches {
+		if match.y > e.cursorY || (match.y == e.cursorY && match.x >= e.cursorX) {
+			e.findCurrentMatch = i
+			break
+		}
+	}
+	e.jumpToMatch(e.findCurrentMatch)
+}
+
 func (e *Editor) findNext() {
+	// In pager mode, running past the last match in the window searches on
+	// through the rest of the file.
+	if e.pager != nil && e.findCurrentMatch >= len(e.findMatches)-1 && e.pagerFindForward() {
+		return
+	}
 	if len(e.findMatches) == 0 {
 		return
 	}
+	e.findWrapMessage = ""
 	if e.findCurrentMatch == -1 {
 		e.findCurrentMatch = 0
 	} else {
 		e.findCurrentMatch = (e.findCurrentMatch + 1) % len(e.findMatches)
+		if e.findCurrentMatch == 0 {
+			e.setFindWrapMessage("Search wrapped to top")
+		}
 	}
 	e.jumpToMatch(e.findCurrentMatch)
 }
@@ -213,13 +588,95 @@ func (e *Editor) findPrevious() {
 	if len(e.findMatches) == 0 {
 		return
 	}
+	e.findWrapMessage = ""
 	e.findCurrentMatch--
 	if e.findCurrentMatch < 0 {
 		e.findCurrentMatch = len(e.findMatches) - 1
+		e.setFindWrapMessage("Search wrapped to bottom")
 	}
 	e.jumpToMatch(e.findCurrentMatch)
 }
 
+// setFindWrapMessage notes that the search went round the end of the buffer.
+// The message bar holds the find prompt, so the note is shown next to the
+// match count instead, for as long as a status message would be.
+func (e *Editor) setFindWrapMessage(msg string) {
+	e.findWrapMessage = msg
+	e.statusTime = time.Now()
+}
+
+// findWrapNote returns the wrap note to put before the match count, or ""
+// once it has expired.
+func (e *Editor) findWrapNote() string {
+	if e.findWrapMessage == "" || time.Since(e.statusTime) >= 5*time.Second {
+		return ""
+	}
+	return e.findWrapMessage + " "
+}
+
+// findHistoryLimit is how many queries findHistory keeps.
+const findHistoryLimit = 50
+
+// addFindHistory records query as the newest search, moving it there if it
+// was searched for before, and forgets the oldest past findHistoryLimit.
+func (e *Editor) addFindHistory(query string) {
+	if query == "" {
+		return
+	}
+	e.findHistory = slices.DeleteFunc(e.findHistory, func(q string) bool { return q == query })
+	e.findHistory = append(e.findHistory, query)
+	if n := len(e.findHistory) - findHistoryLimit; n > 0 {
+		e.findHistory = slices.Delete(e.findHistory, 0, n)
+	}
+	e.findHistoryPos = len(e.findHistory)
+}
+
+// recallFindHistory (Up/Down in the find field) puts the next older (step
+// -1) or newer (step 1) query from findHistory in the prompt, skipping one
+// that is already there, and searches for it. Going newer than the newest
+// brings back what was being typed. It reports false when there is no
+// query that way.
+func (e *Editor) recallFindHistory(step int) bool {
+	pos := e.findHistoryPos
+	for {
+		pos += step
+		if pos < 0 || pos > len(e.findHistory) {
+			return false
+		}
+		if pos == len(e.findHistory) || e.findHistory[pos] != e.promptBuffer {
+			break
+		}
+	}
+	if e.findHistoryPos == len(e.findHistory) {
+		e.findDraft = e.promptBuffer
+	}
+	e.findHistoryPos = pos
+	query := e.findDraft
+	if pos < len(e.findHistory) {
+		query = e.findHistory[pos]
+	}
+	e.promptBuffer = query
+	e.promptCursorX = len([]rune(query))
+	e.lastSearchQuery = query
+	if query == "" {
+		e.findMatches = nil
+		e.findCurrentMatch = -1
+		e.searchErr = nil
+		e.selectionActive = false
+	} else {
+		e.findInitial()
+	}
+	return true
+}
+
+// clearSearch drops the current matches and the match selection without
+// moving the cursor. lastSearchQuery is kept so Ctrl+F offers it again.
+func (e *Editor) clearSearch() {
+	e.clearHighlights()
+	e.selectionActive = false
+	e.setStatusMessage("Search cleared.")
+}
+
 func (e *Editor) jumpToMatch(index int) {
 	if index < 0 || index >= len(e.findMatches) {
 		e.selectionActive = false
@@ -231,7 +688,10 @@ func (e *Editor) jumpToMatch(index int) {
 	e.selectionActive = true
 	e.selectionAnchorY = match.y
 	e.selectionAnchorX = match.x
-	e.cursorX += len([]rune(e.promptBuffer))
+	e.cursorX += match.length
+	if e.config.CenterFindMatch {
+		e.centerCursorIfOffScreen()
+	}
 }
 
 func (e *Editor) handleGotoLineInput(r rune) error {
@@ -241,8 +701,12 @@ func (e *Editor) handleGotoLineInput(r rune) error {
 
 	case '\r': // Enter
 		e.isGotoLine = false
-		lineNum, err := strconv.Atoi(e.promptBuffer)
-		if err != nil || lineNum <= 0 || lineNum > e.buffer.LineCount() {
+		lineNum, col, ok := parseGotoPosition(e.promptBuffer)
+		if !ok {
+			e.setStatusMessage("Invalid position: %s", e.promptBuffer)
+		} else if e.pager != nil {
+			e.pagerGotoLine(lineNum, col)
+		} else if lineNum > e.buffer.LineCount() {
 			if e.buffer.LineCount() == 0 && lineNum == 1 {
 				e.cursorY = 0
 				e.cursorX = 0
@@ -251,25 +715,56 @@ func (e *Editor) handleGotoLineInput(r rune) error {
 			}
 		} else {
 			e.cursorY = lineNum - 1
-			e.cursorX = 0
-			e.clampCursorX()
-			e.setStatusMessage("Moved to line %d", lineNum)
+			e.moveToGotoColumn(lineNum, col)
 		}
 		e.promptBuffer = ""
 		e.promptCursorX = 0
 		return nil
 
+	case '\x16': // Ctrl+V (Paste)
+		e.pasteIntoPrompt()
+
 	case '\x7f', '\b': // Backspace
 		e.backspacePromptRune()
 
 	default:
-		if r >= '0' && r <= '9' {
+		if r >= '0' && r <= '9' || r == ':' {
 			e.insertPromptRune(r)
 		}
 	}
 	return nil
 }
 
+// parseGotoPosition parses the Go to Line prompt: a 1-based line number, or
+// line:column with a 1-based column. col is 0 when no column was given.
+func parseGotoPosition(s string) (lineNum, col int, ok bool) {
+	lineStr, colStr, hasCol := strings.Cut(s, ":")
+	lineNum, err := strconv.Atoi(lineStr)
+	if err != nil || lineNum <= 0 {
+		return 0, 0, false
+	}
+	if !hasCol {
+		return lineNum, 0, true
+	}
+	col, err = strconv.Atoi(colStr)
+	if err != nil || col <= 0 {
+		return 0, 0, false
+	}
+	return lineNum, col, true
+}
+
+// moveToGotoColumn puts the cursor, already on line lineNum, at 1-based
+// column col, clamped to the line, or at its start when col is 0.
+func (e *Editor) moveToGotoColumn(lineNum, col int) {
+	e.cursorX = max(col-1, 0)
+	e.clampCursorX()
+	if col == 0 {
+		e.setStatusMessage("Moved to line %d", lineNum)
+	} else {
+		e.setStatusMessage("Moved to line %d, column %d", lineNum, e.cursorX+1)
+	}
+}
+
 func (e *Editor) handleSaveAsInput(r rune) error {
 	switch r {
 	case '\x1b': // Escape
@@ -282,12 +777,24 @@ func (e *Editor) handleSaveAsInput(r rune) error {
 			e.setStatusMessage("Save As cancelled (empty filename).")
 			e.promptBuffer = ""
 			e.promptCursorX = 0
+			e.resumeQuit(false)
 			return nil
 		}
+		if filename != e.filename {
+			// Whatever is at the new name is being overwritten on purpose.
+			e.diskModTime, e.diskSize = time.Time{}, 0
+		}
 		e.filename = filename
 		e.promptBuffer = ""
 		e.promptCursorX = 0
-		return e.save()
+		err := e.save()
+		if !e.isConfirmingOverwrite {
+			e.resumeQuit(err == nil)
+		}
+		return err
+
+	case '\x16': // Ctrl+V (Paste)
+		e.pasteIntoPrompt()
 
 	case '\x7f', '\b': // Backspace
 		e.backspacePromptRune()
@@ -303,13 +810,19 @@ func (e *Editor) handleSaveAsInput(r rune) error {
 func (e *Editor) handleQuitPrompt(r rune) error {
 	switch r {
 	case 'y', 'Y':
+		e.isQuitting = false
 		if err := e.save(); err != nil {
-			e.isQuitting = false
 			return nil
 		}
-		e.quit = true
+		if e.isSaveAs || e.isConfirmingOverwrite {
+			// The save asks first; the quit goes on once it is done
+			e.quitAfterSave = true
+			return nil
+		}
+		e.quitOrAsk()
 	case 'n', 'N':
-		e.quit = true
+		e.isQuitting = false
+		e.quitOrAsk()
 	default:
 		e.setStatusMessage("Quit cancelled.")
 		e.isQuitting = false
@@ -317,6 +830,46 @@ func (e *Editor) handleQuitPrompt(r rune) error {
 	return nil
 }
 
+func (e *Editor) handleOverwritePrompt(r rune) error {
+	e.isConfirmingOverwrite = false
+	switch r {
+	case 'y', 'Y':
+		err := e.writeFile()
+		e.resumeQuit(err == nil)
+		return err
+	default:
+		e.setStatusMessage("Save cancelled.")
+		e.resumeQuit(false)
+	}
+	return nil
+}
+
+func (e *Editor) handleReloadPrompt(r rune) error {
+	e.isConfirmingReload = false
+	switch r {
+	case 'y', 'Y':
+		e.reloadFromDisk()
+	default:
+		e.setStatusMessage("Reload cancelled.")
+	}
+	return nil
+}
+
+func (e *Editor) handleLineEndingPrompt(r rune) error {
+	e.isChoosingLineEnding = false
+	switch r {
+	case 'l', 'L':
+		n := e.convertLineEndings(false)
+		e.setStatusMessage("Converted %d line(s) to LF", n)
+	case 'c', 'C':
+		n := e.convertLineEndings(true)
+		e.setStatusMessage("Converted %d line(s) to CRLF", n)
+	default:
+		e.setStatusMessage("Line ending conversion cancelled.")
+	}
+	return nil
+}
+
 func (e *Editor) handleDeleteKey() {
 	e.flushEditGroups()
 	if e.selectionActive {
@@ -353,17 +906,17 @@ func (e *Editor) handleDeleteKey() {
 		// Delete the newline by deleting "before" (cursorY+1, 0)
 		e.buffer.Delete(e.cursorY+1, 0)
 	} else {
-		// In middle of line, delete rune at (cursorY, cursorX)
-		char := lineRunes[e.cursorX]
-
-		// Record the rune at (cursorY, cursorX)
-		e.deleteEntries = append(e.deleteEntries, opEntry{
-			insertLine: e.cursorY,
-			insertCol:  e.cursorX,
-			r:          char,
-		})
-		// Delete the rune by deleting "before" (cursorY, cursorX + 1)
-		e.buffer.Delete(e.cursorY, e.cursorX+1)
+		// In middle of line, delete the character at (cursorY, cursorX),
+		// along with any combining marks on it
+		end := nextClusterBoundary(lineRunes, e.cursorX)
+		for x := e.cursorX; x < end; x++ {
+			e.deleteEntries = append(e.deleteEntries, opEntry{
+				insertLine: e.cursorY,
+				insertCol:  x,
+				r:          lineRunes[x],
+			})
+		}
+		e.buffer.DeleteRange(e.cursorY, e.cursorX, e.cursorY, end)
 	}
 
 	e.dirty = true
@@ -420,6 +973,44 @@ func (e *Editor) handleDeleteWordRight() {
 	e.endUndoGroup()
 }
 
+// handleKillToLineEnd (Alt+K) deletes from the cursor to the end of the
+// line. At the end of the line it deletes the line break instead, joining
+// the next line on.
+func (e *Editor) handleKillToLineEnd() {
+	e.flushEditGroups()
+	endY, endX := e.cursorY, len([]rune(e.buffer.GetLine(e.cursorY)))
+	if e.cursorX >= endX {
+		if endY >= e.buffer.LineCount()-1 {
+			return
+		}
+		endY, endX = endY+1, 0
+	}
+	e.deleteSpan(e.cursorY, e.cursorX, endY, endX)
+}
+
+// handleKillToLineStart (Alt+Shift+K) deletes from the start of the line to
+// the cursor.
+func (e *Editor) handleKillToLineStart() {
+	e.flushEditGroups()
+	if e.cursorX == 0 {
+		return
+	}
+	e.deleteSpan(e.cursorY, 0, e.cursorY, e.cursorX)
+}
+
+// deleteSpan deletes the text between two positions as one undo group by
+// selecting it and deleting the selection, leaving the cursor at the start.
+func (e *Editor) deleteSpan(startY, startX, endY, endX int) {
+	e.selectionAnchorY = startY
+	e.selectionAnchorX = startX
+	e.cursorY = endY
+	e.cursorX = endX
+	e.selectionActive = true
+	e.beginUndoGroup()
+	e.deleteSelectedText()
+	e.endUndoGroup()
+}
+
 // Helper to get range of lines for multi-cursor
 func (e *Editor) getMultiCursorRange() (int, int) {
 	if e.extraCursorHeight == 0 {
@@ -432,25 +1023,34 @@ func (e *Editor) getMultiCursorRange() (int, int) {
 }
 
 func (e *Editor) handleKey(r rune) error {
+	if e.blockActive && e.handleBlockKey(r) {
+		return nil
+	}
+	// Only typing and Backspace act at the cursors Alt+D added
+	if r < ' ' && r != '\t' {
+		e.extraCursors = nil
+	}
+
 	// Common: if key is not selection-related, we stop selection mode
 	switch r {
-	case '\x1b': // Escape key (arrows, handled by handleEscape)
-	case '\x03': // Ctrl+C (Copy)
+	case '\x1b': // Escape key (arrows, handled by feedEscape)
 	case '\x18': // Ctrl+X (Cut)
 	case '\x01': // Ctrl+A (Select All)
+	case '\x12': // Ctrl+R (Run command, which may act on the selection)
+	case '\x10': // Ctrl+P (Command palette, whose command may act on the selection)
+	case '\x0e': // Ctrl+N (Document statistics, which may cover the selection)
+	case '\x1f': // Ctrl+/ (Toggle comment on the selected lines)
+	case '\x04': // Ctrl+D (Duplicate the selection)
 	case '\x7f': // Backspace
 		// Do nothing
+	case '\t': // Tab (indents the lines of a multi-line selection)
+		if _, _, ok := e.selectedLines(); !ok {
+			e.selectionActive = false
+		}
 	default:
 		e.selectionActive = false
 	}
 
-	// For most actions (except undo/redo/escape/copy/cut/select), new edits clear redo stack
-	switch r {
-	case '\x15', '\x19', '\x1b', '\x03', '\x18', '\x01': // Ctrl+U, Ctrl+Y, ESC, Ctrl+C, Ctrl+X, Ctrl+A
-	default:
-		e.redoStack = nil
-	}
-
 	switch r {
 	case '\x01': // Ctrl+A - Select All
 		e.flushEditGroups()
@@ -458,16 +1058,8 @@ func (e *Editor) handleKey(r rune) error {
 		return e.selectAll()
 	case '\x11': // Ctrl+Q
 		e.flushEditGroups()
-		if !e.dirty {
-			e.quit = true
-			return nil
-		}
-		if e.isContentUnchanged() {
-			e.quit = true
-			return nil
-		}
-		e.isQuitting = true
-		e.setStatusMessage("Save modified buffer (Y/N)?")
+		e.quitNext = 0
+		e.quitOrAsk()
 	case '\x13': // Ctrl+S
 		e.flushEditGroups()
 		return e.save()
@@ -484,9 +1076,6 @@ func (e *Editor) handleKey(r rune) error {
 	case '\x19': // Ctrl+Y (Redo)
 		e.flushEditGroups()
 		e.redo()
-	case '\x03': // Ctrl+C - Copy
-		e.flushEditGroups()
-		return e.copyToClipboard()
 	case '\x18': // Ctrl+X - Cut
 		e.flushEditGroups()
 		return e.cutToClipboard()
@@ -513,9 +1102,11 @@ func (e *Editor) handleKey(r rune) error {
 			e.findMatches = nil
 		}
 		e.promptCursorX = len([]rune(e.promptBuffer))
+		e.findHistoryPos = len(e.findHistory)
 		e.isFinding = true
+		e.findAccepted = false
 		e.findCurrentMatch = -1
-		e.statusMessage = "Find (ESC:Cancel | Enter/Ctrl+N:Next | Ctrl+P:Prev): "
+		e.statusMessage = "Find (ESC:Cancel | Enter/Ctrl+N:Next | Ctrl+P:Prev | Ctrl+E:Regex): "
 	case '\x08': // Ctrl+H
 		e.flushEditGroups()
 		e.findOrigCursorX = e.cursorX
@@ -525,6 +1116,7 @@ func (e *Editor) handleKey(r rune) error {
 		e.promptFocus = 0
 		e.promptBuffer = e.lastSearchQuery
 		e.promptCursorX = len([]rune(e.promptBuffer))
+		e.findHistoryPos = len(e.findHistory)
 		e.replaceBuffer = ""
 		e.replaceCursorX = 0
 		if e.promptBuffer != "" {
@@ -538,17 +1130,49 @@ func (e *Editor) handleKey(r rune) error {
 		if e.showNonPrintable {
 			status = "Show non-printable: ON"
 		}
-		e.setStatusMessage(status)
+		e.setStatusMessage("%s", status)
 	case '\x04': // Ctrl+D
 		e.flushEditGroups()
 		e.extraCursorHeight = 0
-		e.duplicateLine()
+		if e.selectionActive {
+			e.duplicateSelection()
+		} else {
+			e.duplicateLine()
+		}
+
+	case '\x02': // Ctrl+B (Convert line endings)
+		e.flushEditGroups()
+		e.isChoosingLineEnding = true
+		e.setStatusMessage("Convert line endings to (L)F or (C)RLF?")
 
 	case '\x0b': // Ctrl+K
 		e.flushEditGroups()
 		e.extraCursorHeight = 0
 		e.toggleCaseAtCursor()
 
+	case '\x07': // Ctrl+G (Clear search)
+		e.flushEditGroups()
+		e.clearSearch()
+
+	case '\x12': // Ctrl+R (Run user command)
+		e.flushEditGroups()
+		e.openRunCommandPrompt()
+
+	case '\x10': // Ctrl+P (Command palette)
+		e.flushEditGroups()
+		e.openCommandPalette()
+
+	case '\x0e': // Ctrl+N (Document statistics)
+		e.flushEditGroups()
+		e.showDocStats()
+
+	case '\x1f': // Ctrl+/ (Toggle comment)
+		e.toggleComment()
+
+	case '\x1d': // Ctrl+] (Jump to matching bracket)
+		e.flushEditGroups()
+		e.jumpToMatchingBracket()
+
 	case '\x17': // Ctrl+W
 		e.handleDeleteWordLeft()
 	case '\r': // Enter
@@ -560,13 +1184,9 @@ func (e *Editor) handleKey(r rune) error {
 		now := time.Now()
 
 		currentLine := e.buffer.GetLine(e.cursorY)
-		indent := ""
-		for _, char := range currentLine {
-			if char == ' ' || char == '\t' {
-				indent += string(char)
-			} else {
-				break
-			}
+		indent := leadingIndent(currentLine)
+		if e.opensBracketBeforeCursor(currentLine) {
+			indent += e.indentUnit()
 		}
 
 		textToInsert := "\n" + indent
@@ -616,6 +1236,30 @@ func (e *Editor) handleKey(r rune) error {
 		e.beginUndoGroup()
 		defer e.endUndoGroup()
 
+		if len(e.extraCursors) > 0 {
+			e.backspaceAtCursors()
+			return nil
+		}
+
+		// A soft tab in the indentation goes in one press
+		if n := e.softTabBackspaceWidth(); n > 1 {
+			for ; n > 0; n-- {
+				e.pushUndoDeleteIfExternalGrouping(e.cursorY, e.cursorX-1, ' ')
+				e.buffer.Delete(e.cursorY, e.cursorX)
+				e.cursorX--
+			}
+			e.dirty = true
+			return nil
+		}
+
+		// A single cursor deletes the whole character before it, combining
+		// marks and all. A column block goes one rune at a time to stay
+		// aligned.
+		back := 1
+		if e.extraCursorHeight == 0 && e.cursorX > 0 {
+			back = e.cursorX - prevClusterBoundary([]rune(e.buffer.GetLine(e.cursorY)), e.cursorX)
+		}
+
 		startLine, endLine := e.getMultiCursorRange()
 
 		// Process from bottom to top
@@ -636,31 +1280,26 @@ func (e *Editor) handleKey(r rune) error {
 				continue
 			} else {
 				if targetX > 0 {
-					delIndex := targetX - 1
-					char := e.getRuneAt(i, delIndex)
-					e.pushUndoDeleteIfExternalGrouping(i, delIndex, char)
-					e.buffer.Delete(i, targetX)
+					for x := targetX; x > targetX-back; x-- {
+						e.pushUndoDeleteIfExternalGrouping(i, x-1, lineRunes[x-1])
+						e.buffer.Delete(i, x)
+					}
 				} else {
 					// Handle join lines only if single cursor, or explicit decision.
 					// For column block, joining lines shifts everything below up, breaking the block structure.
 					// Let's DISABLE line joining in multi-cursor mode unless height is 0.
 					if e.extraCursorHeight == 0 {
-						prevLineIdx := i - 1
-						prevLineContent := e.buffer.GetLine(prevLineIdx)
-						expectedCursorX := len([]rune(prevLineContent))
-						e.pushUndoDeleteIfExternalGrouping(prevLineIdx, expectedCursorX, '\n')
-						e.cursorY = prevLineIdx
-						e.buffer.Delete(i, 0) // Delete newline of prev line? No, buffer delete logic is (y+1, 0)
-						// Actually logic is Delete(cursorY, cursorX).
-						// If cursorX==0, we delete the previous newline.
-						// Buffer.Delete(i, 0) -> deletes char BEFORE (i,0).
-						// Which is the newline at end of i-1.
-
-						// We only update main cursor if it's the primary line
-						if i == e.cursorY {
-							mergedLineContent := e.buffer.GetLine(e.cursorY)
-							e.cursorX = len([]rune(mergedLineContent))
-						}
+						// The newline ends line i-1, at the column where the
+						// two lines join. Recorded as a backspace so undo puts
+						// the cursor back at the start of line i.
+						joinX := len([]rune(e.buffer.GetLine(i - 1)))
+						e.pushUndoDeleteBlock([]opEntry{{insertLine: i - 1, insertCol: joinX, r: '\n'}}, true)
+						// Delete(i, 0) removes the rune before (i, 0): that newline
+						e.buffer.Delete(i, 0)
+						e.cursorY = i - 1
+						e.cursorX = joinX
+						e.dirty = true
+						return nil
 					}
 				}
 				e.dirty = true
@@ -668,8 +1307,16 @@ func (e *Editor) handleKey(r rune) error {
 		}
 		// For normal typing backspace, we update cursorX *after* the loop if we didn't change lines
 		if e.cursorX > 0 {
-			e.cursorX--
+			e.cursorX -= back
+		}
+
+	case '\t': // Tab
+		if e.selectionActive {
+			e.flushEditGroups()
+			e.indentSelection()
+			return nil
 		}
+		fallthrough
 
 	default: // Typing
 		e.flushBackspaceGroup()
@@ -680,6 +1327,21 @@ func (e *Editor) handleKey(r rune) error {
 		e.beginUndoGroup()
 		defer e.endUndoGroup()
 
+		// A soft tab is the spaces up to the next tab stop
+		count := 1
+		if r == '\t' && e.config.UseSoftTabs {
+			r, count = ' ', e.softTabWidth()
+		}
+
+		if len(e.extraCursors) > 0 {
+			for ; count > 0; count-- {
+				e.typeAtCursors(r)
+			}
+			e.lastTypeTime = time.Now()
+			return nil
+		}
+		e.dedentForClosingBracket(r)
+
 		startLine, endLine := e.getMultiCursorRange()
 
 		for i := startLine; i <= endLine; i++ {
@@ -693,27 +1355,51 @@ func (e *Editor) handleKey(r rune) error {
 				targetX = len(lineRunes)
 			}
 
-			if err := e.buffer.Insert(i, targetX, r); err != nil {
-				continue
-			}
+			for k := 0; k < count; k++ {
+				if err := e.buffer.Insert(i, targetX+k, r); err != nil {
+					break
+				}
 
-			// Push undo op
-			// Note: Undo logic uses 'delLine/Col' to know where to delete.
-			// insertLine/Col is mostly for redo.
-			e.pushUndoInsertBlock([]opEntry{{
-				insertLine: i, insertCol: targetX,
-				delLine: i, delCol: targetX,
-				r: r,
-			}})
+				// Push undo op
+				// Note: Undo logic uses 'delLine/Col' to know where to delete.
+				// insertLine/Col is mostly for redo.
+				e.pushUndoInsertBlock([]opEntry{{
+					insertLine: i, insertCol: targetX + k,
+					delLine: i, delCol: targetX + k + 1,
+					r: r,
+				}})
+			}
 		}
 
-		e.cursorX++
+		e.cursorX += count
+		if e.extraCursorHeight == 0 && r != ' ' && r != '\t' {
+			e.autoWrapLine()
+		}
 		e.lastTypeTime = time.Now()
 		e.dirty = true
 	}
 	return nil
 }
 
+// inPrompt reports whether a prompt or question in the bars below the text
+// has the keyboard.
+func (e *Editor) inPrompt() bool {
+	return e.isConfirmingReplace || e.isQuitting || e.isConfirmingReload || e.isConfirmingOverwrite || e.isChoosingLineEnding || e.isGotoLine || e.isSaveAs || e.isRunCommand || e.isCommandMode || e.isReplacing || e.isFinding
+}
+
+// handleCtrlC copies the selection or block selection when there is one.
+// Without one it never copies: depending on config.CtrlCAction it either does
+// nothing or cancels the current prompt/mode the same way Esc does.
+func (e *Editor) handleCtrlC() error {
+	if (e.selectionActive || e.blockActive) && !e.inPrompt() {
+		return e.copyToClipboard()
+	}
+	if e.config.CtrlCAction == config.CtrlCActionCancel {
+		return e.cancelMode()
+	}
+	return nil
+}
+
 func (e *Editor) handleReplaceInput(r rune) error {
 	switch r {
 	case '\x1b': // Escape
@@ -724,6 +1410,9 @@ func (e *Editor) handleReplaceInput(r rune) error {
 		return nil
 
 	case '\r', '\x0e': // Enter or Ctrl+N (Find Next)
+		if r == '\r' {
+			e.addFindHistory(e.promptBuffer)
+		}
 		e.findNext()
 		return nil
 
@@ -735,6 +1424,22 @@ func (e *Editor) handleReplaceInput(r rune) error {
 		e.replaceNext()
 		return nil
 
+	case '\x05': // Ctrl+E (Toggle regex)
+		e.toggleSearchRegex()
+		return nil
+
+	case '\x16': // Ctrl+V (Paste)
+		e.pasteIntoPrompt()
+		return nil
+
+	case '\x15': // Ctrl+U (Undo)
+		e.undoInFind(false)
+		return nil
+
+	case '\x19': // Ctrl+Y (Redo)
+		e.undoInFind(true)
+		return nil
+
 	case '\x01': // Ctrl+A (Replace All)
 		if len(e.findMatches) > 0 {
 			e.isConfirmingReplace = true
@@ -808,6 +1513,28 @@ func (e *Editor) insertPromptRune(r rune) {
 	}
 }
 
+// insertPromptText inserts pasted text into the focused prompt buffer at its
+// cursor. Prompts are single-line, so only the first line is used and control
+// characters are dropped. Find prompts re-run the search afterwards.
+func (e *Editor) insertPromptText(text string) {
+	if i := strings.IndexAny(text, "\r\n"); i != -1 {
+		text = text[:i]
+	}
+	for _, r := range text {
+		if r < 32 || r == '\x7f' {
+			continue
+		}
+		if e.isGotoLine && (r < '0' || r > '9') && r != ':' {
+			continue
+		}
+		e.insertPromptRune(r)
+	}
+	if e.isFinding && e.promptFocus == 0 {
+		e.lastSearchQuery = e.promptBuffer
+		e.findInitial()
+	}
+}
+
 func (e *Editor) backspacePromptRune() {
 	if e.promptFocus == 0 { // Find buffer
 		if e.promptCursorX > 0 {
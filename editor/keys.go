@@ -0,0 +1,295 @@
+package editor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// keyActions names the main-editor commands a [keybindings] table can move,
+// with the control key each is on by default. handleKey dispatches on these
+// default keys; see buildKeymap.
+var keyActions = map[string]rune{
+	"save":                 '\x13',
+	"save_as":              '\x05',
+	"quit":                 '\x11',
+	"undo":                 '\x15',
+	"redo":                 '\x19',
+	"cut":                  '\x18',
+	"paste":                '\x16',
+	"select_all":           '\x01',
+	"find":                 '\x06',
+	"replace":              '\x08',
+	"goto_line":            '\x14',
+	"toggle_line_numbers":  '\x0c',
+	"toggle_non_printable": '\x0f',
+	"duplicate_line":       '\x04',
+	"line_endings":         '\x02',
+	"toggle_case":          '\x0b',
+	"clear_search":         '\x07',
+	"run_command":          '\x12',
+	"doc_stats":            '\x0e',
+	"toggle_comment":       '\x1f',
+	"matching_bracket":     '\x1d',
+	"delete_word_left":     '\x17',
+	"command_palette":      '\x10',
+}
+
+// ctrlKeyNames names the control keys a binding can use besides Ctrl+A to
+// Ctrl+Z.
+var ctrlKeyNames = map[rune]string{'\x1c': "ctrl+\\", '\x1d': "ctrl+]", '\x1f': "ctrl+/"}
+
+// reservedCtrlKeys are the control keys that cannot be bound, because they
+// are always Copy or arrive as Tab or Enter.
+var reservedCtrlKeys = map[rune]string{'\x03': "Copy", '\t': "Tab", '\r': "Enter"}
+
+// parseKeySpec parses a key spec such as "ctrl+s", "Ctrl+/", "F5" or
+// "shift+insert" into its canonical form: lower case, with any modifiers of
+// a function key in the order ctrl, alt, shift.
+func parseKeySpec(spec string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(spec))
+	if key, ok := functionKeySpec(name); ok {
+		return key, nil
+	}
+	var key rune
+	for r, n := range ctrlKeyNames {
+		if n == name {
+			key = r
+		}
+	}
+	if letter, ok := strings.CutPrefix(name, "ctrl+"); ok && len(letter) == 1 && letter[0] >= 'a' && letter[0] <= 'z' {
+		key = rune(letter[0]-'a') + 1
+	}
+	if key == 0 {
+		return "", fmt.Errorf("unknown key %q (use ctrl+ and a letter, /, ] or \\, or f1-f12 or insert with any of ctrl+, alt+ and shift+)", spec)
+	}
+	if what, ok := reservedCtrlKeys[key]; ok {
+		return "", fmt.Errorf("%s is reserved for %s", keySpecName(key), what)
+	}
+	return keySpecName(key), nil
+}
+
+// functionKeySpec puts name in canonical form if it is a function or editing
+// key that decodeFunctionKey reports: F1-F12 or Insert with any modifiers,
+// or Delete with Shift alone, since Delete and Ctrl+Delete are editing keys.
+func functionKeySpec(name string) (string, bool) {
+	parts := strings.Split(name, "+")
+	base := parts[len(parts)-1]
+	mods := make(map[string]bool)
+	for _, mod := range parts[:len(parts)-1] {
+		if mod != "ctrl" && mod != "alt" && mod != "shift" || mods[mod] {
+			return "", false
+		}
+		mods[mod] = true
+	}
+	known := base == "insert"
+	for n := 1; n <= 12 && !known; n++ {
+		known = base == "f"+strconv.Itoa(n)
+	}
+	if base == "delete" {
+		known = len(mods) == 1 && mods["shift"]
+	}
+	if !known {
+		return "", false
+	}
+	key := ""
+	for _, mod := range []string{"ctrl", "alt", "shift"} {
+		if mods[mod] {
+			key += mod + "+"
+		}
+	}
+	return key + base, true
+}
+
+// keySpecName is the key spec of the control character key.
+func keySpecName(key rune) string {
+	if name, ok := ctrlKeyNames[key]; ok {
+		return name
+	}
+	return "ctrl+" + string('a'+key-1)
+}
+
+// buildKeymap works out, from the [keybindings] table, which action each
+// control or function key runs. The map takes the key spec of a typed key to
+// the default control key of its action; the keys an action had by default,
+// function keys included, have no entry once it is moved elsewhere. Bad
+// bindings are reported and skipped, leaving their action where it was.
+func buildKeymap(bindings map[string]string) (map[string]rune, []error) {
+	keymap := make(map[string]rune, len(keyActions)+len(functionKeyDefaults))
+	for _, key := range keyActions {
+		keymap[keySpecName(key)] = key
+	}
+	for name, key := range functionKeyDefaults {
+		keymap[name] = key
+	}
+
+	var errs []error
+	moved := make(map[string]string, len(bindings))
+	for _, action := range sortedKeys(bindings) {
+		if _, ok := keyActions[action]; !ok {
+			errs = append(errs, fmt.Errorf("keybindings: unknown action %q", action))
+			continue
+		}
+		key, err := parseKeySpec(bindings[action])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("keybindings: %s: %w", action, err))
+			continue
+		}
+		moved[action] = key
+	}
+	for action := range moved {
+		for _, key := range defaultKeys(keyActions[action]) {
+			delete(keymap, key)
+		}
+	}
+	for _, action := range sortedKeys(moved) {
+		key, def := moved[action], keyActions[action]
+		if other, taken := keymap[key]; taken {
+			errs = append(errs, fmt.Errorf("keybindings: %s is bound to both %s and %s", key, keyActionName(other), action))
+			for _, key := range defaultKeys(def) {
+				if _, taken := keymap[key]; !taken {
+					keymap[key] = def
+				}
+			}
+			continue
+		}
+		keymap[key] = def
+	}
+	return keymap, errs
+}
+
+// defaultKeys returns the specs of the keys the action on control key def
+// has by default, in order.
+func defaultKeys(def rune) []string {
+	keys := []string{keySpecName(def)}
+	for _, name := range sortedKeys(functionKeyDefaults) {
+		if functionKeyDefaults[name] == def {
+			keys = append(keys, name)
+		}
+	}
+	return keys
+}
+
+// keyActionName is the name of the action on the default key def.
+func keyActionName(def rune) string {
+	for name, key := range keyActions {
+		if key == def {
+			return name
+		}
+	}
+	if what, ok := reservedCtrlKeys[def]; ok {
+		return strings.ToLower(what)
+	}
+	return keySpecName(def)
+}
+
+// sortedKeys returns the keys of m in order, so bindings are applied and
+// reported the same way every run.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// boundKey turns a control key typed in the main editor into the default key
+// of the action bound to it, which is what handleKey dispatches on. It
+// reports false for a default key whose action was moved elsewhere. Prompts
+// keep their own keys.
+func (e *Editor) boundKey(r rune) (rune, bool) {
+	if r >= ' ' || e.escState != escNone || e.inPrompt() {
+		return r, true
+	}
+	if def, ok := e.keymap[keySpecName(r)]; ok {
+		return def, true
+	}
+	for _, def := range keyActions {
+		if def == r {
+			return 0, false // Its action was moved to another key
+		}
+	}
+	return r, true
+}
+
+// functionKeyDefaults maps the key specs of the function and editing keys
+// bound by default to the control key whose action they run. A
+// [keybindings] table can bind others; see buildKeymap.
+var functionKeyDefaults = map[string]rune{
+	"f2":           '\x13', // Save
+	"f3":           '\x06', // Find
+	"shift+insert": '\x16', // Paste
+	"ctrl+insert":  '\x03', // Copy
+	"shift+delete": '\x18', // Cut
+}
+
+// functionKeyAction returns the control key whose action the decoded
+// function key runs: the one bound to it in the main editor, or its default
+// in a prompt, which keeps its own keys. Keys without an action are
+// recognized but do nothing.
+func (e *Editor) functionKeyAction(key string) (rune, bool) {
+	key = strings.ToLower(key)
+	if e.inPrompt() {
+		r, ok := functionKeyDefaults[key]
+		return r, ok
+	}
+	r, ok := e.keymap[key]
+	return r, ok
+}
+
+// csiTildeKeys names the keys sent as CSI n ~.
+var csiTildeKeys = map[string]string{
+	"2":  "Insert",
+	"3":  "Delete",
+	"11": "F1", "12": "F2", "13": "F3", "14": "F4", "15": "F5",
+	"17": "F6", "18": "F7", "19": "F8", "20": "F9", "21": "F10",
+	"23": "F11", "24": "F12",
+}
+
+// ss3Keys names F1-F4, which arrive as ESC O P..S, or as CSI 1;m P..S when
+// a modifier is held.
+var ss3Keys = map[byte]string{'P': "F1", 'Q': "F2", 'R': "F3", 'S': "F4"}
+
+// decodeFunctionKey names the function or editing key a CSI (or SS3, with
+// empty params) sequence stands for, such as "F5" or "Ctrl+Shift+Insert". It
+// only reports keys that handleCSI does not already handle itself.
+func decodeFunctionKey(cmd byte, params string) (string, bool) {
+	code, mod, _ := strings.Cut(params, ";")
+	var name string
+	switch {
+	case cmd == '~':
+		name = csiTildeKeys[code]
+		if name == "Delete" && mod != "2" {
+			return "", false // Delete and Ctrl+Delete are editing keys handled directly
+		}
+	case ss3Keys[cmd] != "" && (code == "" || code == "1"):
+		name = ss3Keys[cmd]
+	}
+	if name == "" {
+		return "", false
+	}
+	return modifierPrefix(mod) + name, true
+}
+
+// modifierPrefix turns an xterm modifier parameter (1 + Shift|Alt<<1|Ctrl<<2)
+// into a prefix like "Ctrl+Shift+".
+func modifierPrefix(mod string) string {
+	m, err := strconv.Atoi(mod)
+	if err != nil || m < 2 {
+		return ""
+	}
+	m--
+	prefix := ""
+	if m&4 != 0 {
+		prefix += "Ctrl+"
+	}
+	if m&2 != 0 {
+		prefix += "Alt+"
+	}
+	if m&1 != 0 {
+		prefix += "Shift+"
+	}
+	return prefix
+}
@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bulga138/panka/buffer"
 	"github.com/bulga138/panka/config"
@@ -18,46 +22,92 @@ import (
 const (
 	ansiHideCursor     = "\x1b[?25l"
 	ansiShowCursor     = "\x1b[?25h"
-	ansiClearScreen    = "\x1b[2J"
-	ansiMoveToHome     = "\x1b[H"
+	ansiClearToEnd     = "\x1b[J"
 	ansiClearLine      = "\x1b[K"
 	ansiReset          = "\x1b[m"
 	ansiInvert         = "\x1b[7m"
 	ansiDim            = "\x1b[2m" // Added Dim for non-printables
+	ansiTodo           = "\x1b[1;33m"
+	ansiBracket        = "\x1b[1;4m"
+	ansiMatch          = "\x1b[30;43m"
+	ansiTrailing       = "\x1b[2;31m" // Trailing whitespace when non-printables are shown
 	ansiEnterAltScreen = "\x1b[?1049h"
 	ansiExitAltScreen  = "\x1b[?1049l"
+
+	ansiEnableBracketedPaste  = "\x1b[?2004h"
+	ansiDisableBracketedPaste = "\x1b[?2004l"
+	bracketedPasteEnd         = "\x1b[201~"
+
+	// Button-event mouse tracking (press, release and drag) in SGR encoding
+	ansiEnableMouse  = "\x1b[?1002h\x1b[?1006h"
+	ansiDisableMouse = "\x1b[?1006l\x1b[?1002l"
+)
+
+// Smallest terminal the editor will lay itself out in. Anything smaller
+// shows a single "terminal too small" line instead of the editor.
+const (
+	minTermWidth  = 20
+	minTermHeight = 4 // status bar + command bar + message bar + one text row
 )
 
 type findResult struct {
-	y int
-	x int
+	y      int
+	x      int
+	length int // In runes; a regex match's length varies
 }
 
 type Editor struct {
 	term       terminal.Terminal
 	buffer     buffer.Buffer
 	config     config.Config
+	clipboard  clipboard
 	filename   string
 	termWidth  int
 	termHeight int
 	cursorX    int
 	cursorY    int
 
+	// The visual column Up, Down and Page Up/Down aim for, so passing through
+	// a short line doesn't lose it. It holds while the cursor stays where the
+	// last vertical move left it, in an unchanged buffer; see desiredColumn.
+	desiredCursorX int
+	desiredFor     cursorPos
+	desiredVersion int
+
+	// Key spec of a typed control or function key to the default key of the
+	// action bound to it, from the [keybindings] config table; see boundKey
+	keymap map[string]rune
+
 	// Multi-cursor state
 	// 0 = single cursor.
 	// > 0 = extends downwards (e.g., 2 means current line + 2 lines below).
 	// < 0 = extends upwards (e.g., -2 means current line + 2 lines above).
 	extraCursorHeight int
 
+	// Cursors Alt+D added at other occurrences of a word, besides the main
+	// one. Typing and Backspace act at all of them; see multicursor.go
+	extraCursors []cursorPos
+
+	// Block selection (Alt+Shift+arrows): the rectangle from the anchor to
+	// the cursor, in screen columns; see blockselect.go
+	blockActive     bool
+	blockAnchorY    int
+	blockAnchorVisX int
+	blockCursorVisX int
+
 	viewportWrapOffset int
 	viewportY          int
 	viewportCol        int
 	lineNumWidth       int
 	dirty              bool
 	initialHash        string
+	initialLength      int       // Rune count that goes with initialHash
+	diskModTime        time.Time // The file's mtime when loaded or last saved; zero if it was not on disk
+	diskSize           int64
 	statusMessage      string
 	statusTime         time.Time
 	quit               bool
+	input              inputSource // Terminal input that reads can time out on
 	inputReader        *bufio.Reader
 	undoStack          []undoAction
 	redoStack          []undoAction
@@ -104,6 +154,37 @@ type Editor struct {
 	findOrigCursorY  int
 	findMatches      []findResult
 	findCurrentMatch int
+	findWrapMessage  string         // Set when Find Next or Previous wraps around; shown while statusTime is recent
+	searchRegex      bool           // Ctrl+E in find mode: the query is a regular expression
+	searchRe         *regexp.Regexp // The compiled query while searchRegex is on
+	searchErr        error          // Why the regex query did not compile
+
+	// Set while findMatches are shown outside the find prompt, as of buffer
+	// version highlightVersion; see highlight.go
+	highlightMatches       bool
+	highlightFollowsCursor bool // Alt+W: cleared once the cursor leaves the matches
+	highlightVersion       int
+	findAccepted           bool // Enter was pressed in the open find prompt
+
+	// The last literal search, kept so a query that only grows can filter
+	// these matches instead of rescanning the buffer.
+	findCache        []findCacheEntry
+	findCacheQuery   string
+	findCacheBuffer  buffer.Buffer
+	findCacheVersion int
+
+	// Queries searched for with Enter, oldest first, and where Up/Down in the
+	// find field is among them. findHistoryPos == len(findHistory) is the
+	// query being typed, kept in findDraft while older ones are shown.
+	findHistory    []string
+	findHistoryPos int
+	findDraft      string
+
+	// Auto-save: when the last key came in, and the buffer version last
+	// tried, so a save that failed is not retried until the next edit
+	lastInputTime   time.Time
+	autoSaveBuffer  buffer.Buffer
+	autoSaveVersion int
 
 	// Delete
 	deleteEntries   []opEntry
@@ -117,6 +198,57 @@ type Editor struct {
 
 	// Save
 	isSaveAs bool
+
+	// Alt+R on a modified buffer asks before the changes are thrown away
+	isConfirmingReload bool
+
+	// Saving over a file that changed on disk since it was read asks first
+	isConfirmingOverwrite bool
+
+	// Ctrl+R prompt for a user command
+	isRunCommand bool
+
+	// Ctrl+P command palette; see palette.go
+	isCommandMode bool
+
+	// Line endings
+	lineEnding           string // "\n" or "\r\n", detected on load; "" writes the buffer as-is
+	hasBOM               bool   // The file started with a byte order mark
+	isChoosingLineEnding bool
+
+	// How the file is stored on disk, detected on load; the buffer is UTF-8
+	encoding textEncoding
+
+	// Set when the terminal is below minTermWidth x minTermHeight
+	tooSmall bool
+
+	// Rows above the editor that hold the shell's output when it renders
+	// inline; 0 on the alternate screen
+	screenTop int
+
+	// Non-nil when the file is larger than config.MaxFileSize and is shown read-only
+	pager *pager
+
+	// Every open file; the fields above hold the current one. See buffers.go
+	buffers       []bufferState
+	currentBuffer int
+	quitNext      int  // Next buffer Ctrl+Q asks about
+	quitAfterSave bool // The quit waits on the save its prompt started; see resumeQuit
+
+	// Escape sequence parser, see feedEscape
+	escState  int
+	escParams []byte
+	pasting   bool // Inside a bracketed paste, see readBracketedPaste
+
+	// Set by --readonly: every edit is refused; see readonly.go
+	readOnly bool
+
+	// The file is not valid UTF-8, so its buffer is read-only: the invalid
+	// bytes are shown as U+FFFD and saving would not write them back
+	invalidUTF8 bool
+
+	// A left click in the text starts a drag that selects; see mouse.go
+	mouseDragging bool
 }
 
 type opEntry struct {
@@ -132,14 +264,20 @@ type undoAction struct {
 	ops         []opEntry
 	groupID     int
 	isBackspace bool
+
+	// A contiguous insert such as a paste is kept as its text and where it
+	// starts rather than as one opEntry per rune; ops is then empty.
+	text      string
+	line, col int
 }
 
-func NewEditor(term terminal.Terminal, cfg config.Config, file string) (*Editor, error) {
+// NewEditor opens each of files in its own buffer and shows the first. With
+// no files, or an empty name, the buffer starts out empty and unnamed.
+func NewEditor(term terminal.Terminal, cfg config.Config, files ...string) (*Editor, error) {
 	e := &Editor{
 		term:                term,
 		config:              cfg,
-		filename:            file,
-		inputReader:         bufio.NewReader(term.Stdin()),
+		clipboard:           systemClipboard(),
 		lineNumWidth:        5,
 		showLineNumbers:     cfg.ShowLineNumbers,
 		showNonPrintable:    cfg.ShowNonPrintable,
@@ -162,16 +300,35 @@ func NewEditor(term terminal.Terminal, cfg config.Config, file string) (*Editor,
 		initialHash:         "",
 		extraCursorHeight:   0,
 	}
-	var content string
-	if file != "" {
-		var err error
-		content, err = e.loadFileContent(file)
-		if err != nil && !os.IsNotExist(err) {
-			return nil, fmt.Errorf("failed to load file %s: %w", file, err)
+	e.input = newInputSource(term.Stdin())
+	e.inputReader = bufio.NewReader(e.input)
+	var errs []error
+	e.keymap, errs = buildKeymap(cfg.Keybindings)
+	for _, err := range errs {
+		log.Printf("config: %v", err)
+	}
+	if len(files) == 0 {
+		files = []string{""}
+	}
+	for i, file := range files {
+		if err := e.openFile(file); err != nil {
+			e.closeBuffers()
+			return nil, err
 		}
+		e.buffers = append(e.buffers, bufferState{})
+		e.storeBufferState(i)
+	}
+	if len(e.buffers) > 1 {
+		e.restoreBufferState(0)
+	}
+	// The log is off by default, so a broken key binding also shows up front
+	switch len(errs) {
+	case 0:
+	case 1:
+		e.setStatusMessage("Config error: %v", errs[0])
+	default:
+		e.setStatusMessage("Config error: %v (and %d more)", errs[0], len(errs)-1)
 	}
-	e.buffer = buffer.NewRope(content)
-	e.initialHash = e.calculateBufferHash()
 
 	e.refreshSize()
 	e.updateLineNumWidth()
@@ -183,40 +340,194 @@ func NewEditor(term terminal.Terminal, cfg config.Config, file string) (*Editor,
 	return e, nil
 }
 
+// openFile loads file into a fresh buffer, replacing the current one, and
+// resets the state that belongs to it. A file that does not exist yet opens
+// as an empty buffer under that name. If the file cannot be read, the
+// current buffer is left as it was.
+func (e *Editor) openFile(file string) error {
+	var content string
+	var p *pager
+	hasBOM := false
+	invalidUTF8 := false
+	enc := encodingUTF8
+	if info, err := os.Stat(file); err == nil && e.config.MaxFileSize > 0 && info.Size() > e.config.MaxFileSize {
+		if p, err = openPager(file, info.Size()); err != nil {
+			return fmt.Errorf("failed to open file %s: %w", file, err)
+		}
+		if err := p.load(pagerWindow{}); err != nil {
+			p.close()
+			return fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		content = p.bufferText()
+		e.setStatusMessage("File is larger than maxFileSize: opened read-only in pager mode")
+	} else if file != "" {
+		var err error
+		content, enc, hasBOM, err = e.readFileText(file)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to load file %s: %w", file, err)
+		}
+		if !utf8.ValidString(content) {
+			invalidUTF8 = true
+			e.setStatusMessage("File is not valid UTF-8: opened read-only so saving cannot corrupt it")
+		}
+	}
+	e.filename = file
+	e.pager = p
+	e.hasBOM = hasBOM
+	e.encoding = enc
+	e.invalidUTF8 = invalidUTF8
+	e.dirty = false
+	e.undoStack = make([]undoAction, 0)
+	e.redoStack = make([]undoAction, 0)
+	e.buffer = buffer.NewRope(content)
+	e.recordDiskState()
+	e.lineEnding = detectLineEnding(content)
+	e.initialHash = e.calculateBufferHash()
+	e.initialLength = e.buffer.Length()
+	return nil
+}
+
 func (e *Editor) refreshSize() {
 	w, h, err := e.term.GetWindowSize()
 	if err != nil {
-		e.termWidth = 80
-		e.termHeight = 24
-	} else {
-		e.termWidth = w
-		e.termHeight = h
-	}
-	if e.termHeight < 3 {
-		e.termHeight = 3
+		w = 80
+		h = 24
 	}
-	e.termHeight -= 3
+	e.setWindowSize(w, h)
+}
+
+// setWindowSize derives the text area from the terminal size. The text area
+// is never smaller than one cell, so layout math cannot go negative even when
+// the terminal is too small to be usable.
+//
+// An inline editor keeps the rows above it; when the terminal shrinks it
+// gives up the rows it needs to keep at least half the screen.
+func (e *Editor) setWindowSize(w, h int) {
+	e.screenTop = min(e.screenTop, h/2)
+	h -= e.screenTop
+	e.tooSmall = w < minTermWidth || h < minTermHeight
+	e.termWidth = max(w, 1)
+	e.termHeight = max(h-3, 1)
 }
 
 func (e *Editor) Run() error {
 	if err := e.term.EnableRawMode(); err != nil {
 		return err
 	}
-	os.Stdout.WriteString(ansiEnterAltScreen)
+	if e.config.UseAltScreen {
+		os.Stdout.WriteString(ansiEnterAltScreen)
+	} else {
+		e.reserveInlineRegion()
+	}
+	os.Stdout.WriteString(ansiEnableBracketedPaste)
+	if e.config.EnableMouse {
+		os.Stdout.WriteString(ansiEnableMouse)
+	}
 	defer func() {
 		e.term.DisableRawMode()
-		os.Stdout.WriteString(ansiExitAltScreen)
+		os.Stdout.WriteString(ansiDisableBracketedPaste)
+		if e.config.EnableMouse {
+			os.Stdout.WriteString(ansiDisableMouse)
+		}
+		if e.config.UseAltScreen {
+			os.Stdout.WriteString(ansiExitAltScreen)
+		} else {
+			// Leave the last frame in the scrollback and put the shell prompt below it.
+			fmt.Fprintf(os.Stdout, "%s%s\x1b[%d;1H\r\n", ansiReset, ansiShowCursor, e.screenTop+e.termHeight+3)
+		}
 	}()
+	defer e.closeBuffers()
 	for !e.quit {
 		e.checkResize()
 		e.render()
 		if err := e.processInput(); err != nil {
 			break
 		}
+		e.pagerFollowCursor()
 	}
 	return nil
 }
 
+// cursorReportTimeout is how long reserveInlineRegion waits for the terminal
+// to say where the cursor is.
+const cursorReportTimeout = 200 * time.Millisecond
+
+// reserveInlineRegion sets aside the rows from the cursor down for an inline
+// editor, so the shell output above it stays on screen. Where that leaves
+// less than half the screen, the output scrolls up just far enough to free
+// half of it. A terminal that does not report the cursor row gets the whole
+// screen, with what was on it scrolled into the scrollback.
+func (e *Editor) reserveInlineRegion() {
+	w, h, err := e.term.GetWindowSize()
+	if err != nil {
+		w, h = e.termWidth, e.termHeight+3
+	}
+	row, ok := e.queryCursorRow()
+	if !ok {
+		os.Stdout.WriteString(strings.Repeat("\r\n", h))
+		return
+	}
+	row = min(row, h)
+	top := inlineRegionTop(row, h)
+	if scroll := row - 1 - top; scroll > 0 {
+		fmt.Fprintf(os.Stdout, "\x1b[%d;1H%s", h, strings.Repeat("\n", scroll))
+	}
+	e.screenTop = top
+	e.setWindowSize(w, h)
+}
+
+// inlineRegionTop is how many rows of a terminal h rows high stay above an
+// inline editor started with the cursor on 1-based row.
+func inlineRegionTop(row, h int) int {
+	return max(min(row-1, h/2), 0)
+}
+
+// queryCursorRow asks the terminal for the cursor position and reads its
+// ESC [ row ; column R reply.
+func (e *Editor) queryCursorRow() (int, bool) {
+	os.Stdout.WriteString("\x1b[6n")
+	if e.input.SetReadDeadline(time.Now().Add(cursorReportTimeout)) != nil {
+		return 0, false
+	}
+	defer e.input.SetReadDeadline(time.Time{})
+	var reply []byte
+	for len(reply) < 32 {
+		b, err := e.inputReader.ReadByte()
+		if err != nil {
+			return 0, false
+		}
+		reply = append(reply, b)
+		if b == 'R' {
+			return parseCursorReport(string(reply))
+		}
+	}
+	return 0, false
+}
+
+// parseCursorReport returns the row of a cursor position report.
+func parseCursorReport(s string) (int, bool) {
+	s, ok := strings.CutPrefix(s, "\x1b[")
+	if !ok {
+		return 0, false
+	}
+	s, ok = strings.CutSuffix(s, "R")
+	if !ok {
+		return 0, false
+	}
+	rowText, colText, ok := strings.Cut(s, ";")
+	if !ok {
+		return 0, false
+	}
+	row, err := strconv.Atoi(rowText)
+	if err != nil || row < 1 {
+		return 0, false
+	}
+	if _, err := strconv.Atoi(colText); err != nil {
+		return 0, false
+	}
+	return row, true
+}
+
 func (e *Editor) getVisualX(lineY int, runeX int) int {
 	if lineY >= e.buffer.LineCount() {
 		return 0
@@ -231,14 +542,42 @@ func (e *Editor) getVisualX(lineY int, runeX int) int {
 	for i := 0; i < runeX && i < len(runes); i++ {
 		r := runes[i]
 		if r == '\t' {
-			visX += e.config.TabSize - (visX % e.config.TabSize)
+			visX += e.config.TabWidth - (visX % e.config.TabWidth)
 		} else {
-			visX += runewidth.RuneWidth(r)
+			visX += runeWidthAt(runes, i)
 		}
 	}
 	return visX
 }
 
+// runeWidthAt is the display width of runes[i], which can depend on the rune
+// after it.
+func runeWidthAt(runes []rune, i int) int {
+	var next rune
+	if i+1 < len(runes) {
+		next = runes[i+1]
+	}
+	return runewidth.RuneWidthFollowedBy(runes[i], next)
+}
+
+// runeXForVisualX is the inverse of getVisualX: it returns the rune index on
+// lineY whose cell range contains visX, or the line length past its end.
+func (e *Editor) runeXForVisualX(lineY int, visX int) int {
+	runes := []rune(e.buffer.GetLine(lineY))
+	x := 0
+	for i, r := range runes {
+		w := runeWidthAt(runes, i)
+		if r == '\t' {
+			w = e.config.TabWidth - (x % e.config.TabWidth)
+		}
+		if x+w > visX {
+			return i
+		}
+		x += w
+	}
+	return len(runes)
+}
+
 func (e *Editor) checkResize() {
 	w, h, err := e.term.GetWindowSize()
 	if err != nil {
@@ -249,12 +588,7 @@ func (e *Editor) checkResize() {
 	}
 	e.lastTermWidth = w
 	e.lastTermHeight = h
-	e.termWidth = w
-	e.termHeight = h
-	if e.termHeight < 3 {
-		e.termHeight = 3
-	}
-	e.termHeight -= 3
+	e.setWindowSize(w, h)
 	e.updateLineNumWidth()
 	e.setStatusMessage("Window resized to %d x %d", e.termWidth, e.termHeight)
 }
@@ -268,7 +602,7 @@ func (e *Editor) updateLineNumWidth() {
 }
 
 func (e *Editor) getTextWidth() int {
-	textWidth := e.termWidth - e.lineNumWidth
+	textWidth := e.termWidth - e.lineNumWidth - e.scrollbarWidth()
 	if textWidth < 1 {
 		return 1
 	}
@@ -294,46 +628,79 @@ func (e *Editor) countVisualRows(fileLine int, textWidth int) int {
 	return numVisualRows
 }
 
-func (e *Editor) loadFileContent(filename string) (string, error) {
+// readFileText reads filename as it goes into a buffer. The BOM is kept out
+// of the buffer, where it would be an invisible first rune, and written back
+// on save; hasBOM reports whether the file had one.
+func (e *Editor) readFileText(filename string) (text string, enc textEncoding, hasBOM bool, err error) {
+	text, enc, err = e.loadFileContent(filename)
+	text, hasBOM = strings.CutPrefix(text, utf8BOM)
+	return text, enc, hasBOM, err
+}
+
+// loadFileContent reads filename as UTF-8 text along with the encoding it
+// was stored in. A UTF-16 file, recognised by its byte order mark, is decoded
+// on the way in; its BOM comes back as a leading U+FEFF.
+func (e *Editor) loadFileContent(filename string) (string, textEncoding, error) {
 	const streamingThreshold = 1024 * 1024
 
 	info, err := os.Stat(filename)
 	if err != nil {
-		return "", err
+		return "", encodingUTF8, err
 	}
 
 	if info.Size() < streamingThreshold {
 		b, err := os.ReadFile(filename)
 		if err != nil {
-			return "", err
+			return "", encodingUTF8, err
 		}
-		return string(b), nil
+		enc := detectEncoding(b)
+		if enc != encodingUTF8 {
+			d := utf16Decoder{bigEndian: enc == encodingUTF16BE}
+			b = d.flush(d.decode(make([]byte, 0, len(b)), b))
+		}
+		return string(b), enc, nil
 	}
 
 	file, err := os.Open(filename)
 	if err != nil {
-		return "", err
+		return "", encodingUTF8, err
 	}
 	defer file.Close()
 
 	var result strings.Builder
 	result.Grow(int(info.Size()))
 
+	enc := encodingUTF8
+	var d *utf16Decoder
+	var decoded []byte
 	buf := make([]byte, 64*1024)
-	for {
-		n, err := file.Read(buf)
+	for first := true; ; first = false {
+		n, err := io.ReadFull(file, buf)
+		if first {
+			if enc = detectEncoding(buf[:n]); enc != encodingUTF8 {
+				d = &utf16Decoder{bigEndian: enc == encodingUTF16BE}
+			}
+		}
 		if n > 0 {
-			result.Write(buf[:n])
+			if d != nil {
+				decoded = d.decode(decoded[:0], buf[:n])
+				result.Write(decoded)
+			} else {
+				result.Write(buf[:n])
+			}
 		}
-		if err == io.EOF {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
 		}
 		if err != nil {
-			return "", fmt.Errorf("error reading file: %w", err)
+			return "", encodingUTF8, fmt.Errorf("error reading file: %w", err)
 		}
 	}
+	if d != nil {
+		result.Write(d.flush(decoded[:0]))
+	}
 
-	return result.String(), nil
+	return result.String(), enc, nil
 }
 
 func (e *Editor) getVisualCursorPos() (int, int) {
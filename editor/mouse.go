@@ -0,0 +1,154 @@
+package editor
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Bits of the button number in an SGR mouse report. The low two bits are the
+// button itself: 0 left, 1 middle, 2 right, and for the wheel 0 up, 1 down.
+const (
+	mouseShift  = 4
+	mouseMotion = 32
+	mouseWheel  = 64
+)
+
+// mouseWheelLines is how many visual rows one wheel step scrolls.
+const mouseWheelLines = 3
+
+// handleMouse acts on an SGR mouse report, ESC [ < button ; column ; row
+// ending in M for a press or motion and m for a release. A left click moves
+// the cursor, Shift+click and dragging select, and the wheel scrolls.
+func (e *Editor) handleMouse(params string, release bool) {
+	fields := strings.Split(strings.TrimPrefix(params, "<"), ";")
+	if len(fields) != 3 {
+		return
+	}
+	button, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+	col, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	row, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return
+	}
+	row -= e.screenTop
+	if e.tooSmall || e.inPrompt() {
+		e.mouseDragging = false
+		return
+	}
+
+	switch {
+	case button&mouseWheel != 0:
+		if release {
+			return
+		}
+		if button&3 == 0 {
+			e.scrollLines(-mouseWheelLines)
+		} else {
+			e.scrollLines(mouseWheelLines)
+		}
+	case release:
+		e.mouseDragging = false
+	case button&mouseMotion != 0:
+		if e.mouseDragging && button&3 == 0 {
+			e.dragTo(row, col)
+		}
+	case button&3 == 0:
+		e.clickAt(row, col, button&mouseShift != 0)
+	}
+}
+
+// clickAt moves the cursor to the text drawn at the screen position. With
+// extend, the selection runs from where the cursor was; otherwise the click
+// drops the selection and starts a possible drag from there.
+func (e *Editor) clickAt(row, col int, extend bool) {
+	if row < 1 || row > e.termHeight {
+		return // The status, command and message bars
+	}
+	e.flushEditGroups()
+	e.extraCursorHeight = 0
+	e.extraCursors = nil
+	e.blockActive = false
+	y, x := e.screenToBuffer(row, col)
+	if extend {
+		if !e.selectionActive {
+			e.selectionActive = true
+			e.selectionAnchorX = e.cursorX
+			e.selectionAnchorY = e.cursorY
+		}
+	} else {
+		e.selectionActive = false
+		e.selectionAnchorX = x
+		e.selectionAnchorY = y
+	}
+	e.cursorX = x
+	e.cursorY = y
+	e.mouseDragging = true
+}
+
+// dragTo extends the selection from the click that started the drag to the
+// screen position. Dragging onto the bars below the text scrolls down.
+func (e *Editor) dragTo(row, col int) {
+	if row > e.termHeight {
+		e.scrollLines(1)
+		row = e.termHeight
+	}
+	y, x := e.screenToBuffer(row, col)
+	e.selectionActive = true
+	e.cursorX = x
+	e.cursorY = y
+}
+
+// scrollLines moves the viewport n visual rows down, or up when n is
+// negative. The cursor stays where it is unless that is now off screen, or
+// inside the scrollOff margin; then it moves to the nearest row it may have,
+// in the same screen column.
+func (e *Editor) scrollLines(n int) {
+	textWidth := e.getTextWidth()
+	for ; n > 0; n-- {
+		e.advanceViewport(textWidth)
+	}
+	for ; n < 0; n++ {
+		e.retreatViewport(textWidth)
+	}
+
+	margin := e.scrollOffMargin()
+	top, bottom := 1+margin, e.termHeight-margin
+	if e.viewportY == 0 && e.viewportWrapOffset == 0 {
+		top = 1
+	}
+	row, col := e.calculateCursorScreenPosition()
+	cursorWrapRow := e.getVisualX(e.cursorY, e.cursorX) / textWidth
+	if e.cursorY < e.viewportY || e.cursorY == e.viewportY && cursorWrapRow < e.viewportWrapOffset || row < top {
+		e.cursorY, e.cursorX = e.screenToBuffer(top, col)
+	} else if row > bottom {
+		e.cursorY, e.cursorX = e.screenToBuffer(bottom, col)
+	}
+}
+
+// screenToBuffer is the inverse of calculateCursorScreenPosition: it returns
+// the line and rune drawn at a 1-based screen row and column. A column in the
+// gutter is the start of the row's text, one past the end of a line is its
+// end, and a row below the last line is the end of the buffer.
+func (e *Editor) screenToBuffer(row, col int) (int, int) {
+	textWidth := e.getTextWidth()
+	y := e.viewportY
+	wrapRow := e.viewportWrapOffset
+	for i := 1; i < row; i++ {
+		if wrapRow+1 < e.countVisualRows(y, textWidth) {
+			wrapRow++
+		} else if y+1 < e.buffer.LineCount() {
+			y++
+			wrapRow = 0
+		} else {
+			return y, len([]rune(e.buffer.GetLine(y)))
+		}
+	}
+	visCol := min(max(col-e.lineNumWidth-1, 0), textWidth-1)
+	return y, e.runeXForVisualX(y, wrapRow*textWidth+visCol)
+}
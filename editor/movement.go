@@ -1,10 +1,10 @@
 package editor
 
 import (
-	"os"
 	"strings"
 	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 func (e *Editor) clampCursorX() {
@@ -18,24 +18,75 @@ func (e *Editor) clampCursorX() {
 }
 
 func (e *Editor) movePageUp() {
-	e.cursorY -= e.termHeight
-	if e.cursorY < 0 {
-		e.cursorY = 0
-	}
-	e.extraCursorHeight = 0
-	e.clampCursorX()
+	e.movePage(-1)
 }
 
 func (e *Editor) movePageDown() {
-	lineCount := e.buffer.LineCount()
-	e.cursorY += e.termHeight
-	if e.cursorY >= lineCount {
-		e.cursorY = max(lineCount-1, 0)
-	}
+	e.movePage(1)
+}
+
+// movePage moves the cursor a screenful of visual rows up (dir < 0) or down,
+// so wrapped lines count once per row they occupy. The viewport moves with the
+// cursor, keeping it on the same screen row and visual column.
+func (e *Editor) movePage(dir int) {
 	e.extraCursorHeight = 0
-	e.clampCursorX()
+	textWidth := e.getTextWidth()
+	screenRow, _ := e.calculateCursorScreenPosition()
+
+	visX := e.getVisualX(e.cursorY, e.cursorX)
+	desired := e.desiredColumn()
+	y := e.cursorY
+	wrapRow := visX / textWidth
+	colInRow := desired % textWidth
+
+	for i := 0; i < e.termHeight; i++ {
+		if dir > 0 {
+			if wrapRow+1 < e.countVisualRows(y, textWidth) {
+				wrapRow++
+			} else if y+1 < e.buffer.LineCount() {
+				y++
+				wrapRow = 0
+			} else {
+				break
+			}
+		} else {
+			if wrapRow > 0 {
+				wrapRow--
+			} else if y > 0 {
+				y--
+				wrapRow = e.countVisualRows(y, textWidth) - 1
+			} else {
+				break
+			}
+		}
+	}
+
+	e.cursorY = y
+	e.cursorX = e.runeXForVisualX(y, wrapRow*textWidth+colInRow)
+	e.keepDesiredColumn(desired)
+	e.anchorViewportAt(screenRow)
+}
+
+// desiredColumn returns the visual column for a vertical move to aim for:
+// the one kept by the last vertical move if the cursor hasn't moved and the
+// buffer hasn't changed since, and otherwise the cursor's own.
+func (e *Editor) desiredColumn() int {
+	if e.desiredFor == (cursorPos{e.cursorY, e.cursorX}) && e.desiredVersion == e.buffer.Version() {
+		return e.desiredCursorX
+	}
+	return e.getVisualX(e.cursorY, e.cursorX)
+}
+
+// keepDesiredColumn remembers visX after a vertical move, for as long as the
+// cursor stays where the move put it.
+func (e *Editor) keepDesiredColumn(visX int) {
+	e.desiredCursorX = visX
+	e.desiredFor = cursorPos{e.cursorY, e.cursorX}
+	e.desiredVersion = e.buffer.Version()
 }
 
+// moveLineStart (Home) goes to the first character after the line's
+// indentation, or to column 0 when the cursor is already there.
 func (e *Editor) moveLineStart(isSelecting bool) {
 	if isSelecting && !e.selectionActive {
 		e.selectionActive = true
@@ -44,7 +95,12 @@ func (e *Editor) moveLineStart(isSelecting bool) {
 	} else if !isSelecting {
 		e.selectionActive = false
 	}
-	e.cursorX = 0
+	indent := utf8.RuneCountInString(leadingIndent(e.buffer.GetLine(e.cursorY)))
+	if e.cursorX == indent {
+		e.cursorX = 0
+	} else {
+		e.cursorX = indent
+	}
 }
 
 func (e *Editor) moveLineEnd(isSelecting bool) {
@@ -78,8 +134,12 @@ func (e *Editor) moveDocEnd() {
 }
 
 func (e *Editor) toggleLineNumbers() {
+	// The gutter changes the text width, which reflows wrapped lines.
+	// Remember where the cursor was on screen so it can stay there.
+	screenRow, _ := e.calculateCursorScreenPosition()
 	e.showLineNumbers = !e.showLineNumbers
 	e.updateLineNumWidth()
+	e.anchorViewportAt(screenRow)
 	if e.showLineNumbers {
 		e.lineNumWidth = 5 // Restore width
 		e.setStatusMessage("Line numbers ON")
@@ -89,242 +149,427 @@ func (e *Editor) toggleLineNumbers() {
 	}
 }
 
-func (e *Editor) handleEscape() error {
-	var b byte
-	var err error
-
-	if f, ok := e.term.Stdin().(*os.File); ok {
-		f.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
-		b, err = e.inputReader.ReadByte()
-		f.SetReadDeadline(time.Time{})
-	} else {
-		return nil
+// anchorViewportAt moves the viewport so the cursor is drawn on the given
+// 1-based screen row, or as close to it as the top of the document allows.
+func (e *Editor) anchorViewportAt(screenRow int) {
+	textWidth := e.getTextWidth()
+	screenRow = min(max(screenRow, 1), e.termHeight)
+	y := e.cursorY
+	wrapOffset := e.getVisualX(e.cursorY, e.cursorX) / textWidth
+	for i := 1; i < screenRow; i++ {
+		if wrapOffset > 0 {
+			wrapOffset--
+		} else if y > 0 {
+			y--
+			wrapOffset = e.countVisualRows(y, textWidth) - 1
+		} else {
+			break
+		}
 	}
+	e.viewportY = y
+	e.viewportWrapOffset = wrapOffset
+}
 
-	if err != nil {
-		goto CANCEL_MODE
-	}
+// Escape sequence parser states. Input arrives one rune at a time and a
+// sequence may be split across reads, so the parser keeps its state on the
+// Editor between processInput calls instead of reading ahead.
+const (
+	escNone  = iota // Not inside an escape sequence
+	escStart        // Got ESC
+	escCSI          // Got ESC [, collecting parameter bytes until the final byte
+	escSS3          // Got ESC O, waiting for the final byte
+	escDrop         // Inside an overlong CSI sequence, discarding up to its final byte
+)
+
+// escTimeout is how long a pending ESC waits for the rest of a sequence
+// before it is taken as a lone Esc key press.
+const escTimeout = 50 * time.Millisecond
 
-	{
-		seq := make([]byte, 0, 8)
-		paramBuf := make([]byte, 0, 8)
+// maxEscParams bounds the parameter bytes of a CSI sequence; anything longer
+// is not a key and is dropped.
+const maxEscParams = 32
+
+// feedEscape advances the escape sequence parser by one rune. A complete
+// sequence is dispatched to handleCSI; a rune that cannot continue the
+// sequence ends it and is then handled as ordinary input.
+func (e *Editor) feedEscape(r rune) error {
+	switch e.escState {
+	case escNone:
+		e.flushEditGroups()
+		e.escState = escStart
+		e.escParams = e.escParams[:0]
+		return nil
 
-		if b == '\x7f' || b == '\b' {
-			if !e.isSaveAs && !e.isGotoLine && !e.isFinding && !e.isReplacing {
+	case escStart:
+		switch r {
+		case '[':
+			e.escState = escCSI
+			return nil
+		case 'O':
+			e.escState = escSS3
+			return nil
+		case '\x7f', '\b': // Alt+Backspace
+			e.escState = escNone
+			if !e.isSaveAs && !e.isGotoLine && !e.isRunCommand && !e.isCommandMode && !e.isFinding && !e.isReplacing && !e.readOnlyBlocked() {
 				e.handleDeleteWordLeft()
 			}
 			return nil
+		case 't', 's': // Alt+T (tabs to spaces), Alt+S (spaces to tabs)
+			e.escState = escNone
+			if !e.isSaveAs && !e.isGotoLine && !e.isRunCommand && !e.isCommandMode && !e.isFinding && !e.isReplacing && !e.readOnlyBlocked() {
+				e.handleConvertIndentation(r == 's')
+			}
+			return nil
+		case 'k', 'K': // Alt+K (delete to the end of the line), Alt+Shift+K (to its start)
+			e.escState = escNone
+			if !e.inPrompt() && !e.readOnlyBlocked() {
+				if r == 'k' {
+					e.handleKillToLineEnd()
+				} else {
+					e.handleKillToLineStart()
+				}
+			}
+			return nil
+		case 'd': // Alt+D (add a cursor at the next occurrence of the word)
+			e.escState = escNone
+			if !e.inPrompt() {
+				e.addCursorAtNextOccurrence()
+			}
+			return nil
+		case 'w': // Alt+W (highlight every occurrence of the word)
+			e.escState = escNone
+			if !e.inPrompt() {
+				e.highlightWordOccurrences()
+			}
+			return nil
+		case 'n', 'p': // Alt+N, Alt+P (next or previous highlighted match)
+			if e.highlightMatches && !e.inPrompt() {
+				e.escState = escNone
+				e.stepHighlight(r == 'n')
+				return nil
+			}
+		case 'r': // Alt+R (reload the file from disk)
+			e.escState = escNone
+			if !e.inPrompt() {
+				e.reloadFile()
+			}
+			return nil
+		case '\x1b':
+			// The previous ESC was a lone Esc press; this one starts over.
+			return e.cancelMode()
 		}
-
-		if b != '[' {
-			e.inputReader.UnreadByte()
-			goto CANCEL_MODE
+		e.escState = escNone
+		if err := e.cancelMode(); err != nil {
+			return err
 		}
+		return e.handleRune(r)
 
-		readTimeout := time.After(10 * time.Millisecond)
-		for {
-			select {
-			case <-readTimeout:
+	case escCSI:
+		switch {
+		case r >= 0x20 && r <= 0x3f: // Parameter and intermediate bytes
+			if len(e.escParams) == maxEscParams {
+				e.escState = escDrop
 				return nil
-			default:
-				if e.inputReader.Buffered() == 0 {
-					time.Sleep(1 * time.Millisecond)
-					if e.inputReader.Buffered() == 0 {
-						goto PARSE
-					}
-				}
-
-				b, err := e.inputReader.ReadByte()
-				if err != nil {
-					goto PARSE
-				}
-
-				if b >= '0' && b <= '9' || b == ';' {
-					paramBuf = append(paramBuf, b)
-				} else {
-					seq = append(seq, paramBuf...)
-					seq = append(seq, b)
-					goto PARSE
-				}
 			}
+			e.escParams = append(e.escParams, byte(r))
+			return nil
+		case r >= 0x40 && r <= 0x7e: // Final byte
+			e.escState = escNone
+			return e.handleCSI(byte(r), string(e.escParams))
 		}
+		// Not part of a CSI sequence: drop what we have and handle r normally.
+		e.escState = escNone
+		return e.handleRune(r)
 
-	PARSE:
-		if len(seq) == 0 {
-			return nil
+	case escDrop:
+		if r >= 0x40 && r <= 0x7e || r < 0x20 {
+			e.escState = escNone
+		}
+		if r < 0x20 {
+			return e.handleRune(r)
 		}
-		cmd := seq[len(seq)-1]
-		params := string(paramBuf)
+		return nil
 
-		// --- PROMPT NAVIGATION ---
-		if e.isSaveAs || e.isGotoLine || e.isFinding || e.isReplacing {
-			var curCursor *int
-			var maxLen int
+	case escSS3:
+		e.escState = escNone
+		if r >= 0x40 && r <= 0x7e {
+			return e.handleCSI(byte(r), "")
+		}
+		return e.handleRune(r)
+	}
+	return nil
+}
 
-			if e.isReplacing && e.promptFocus == 1 {
-				curCursor = &e.replaceCursorX
-				maxLen = len([]rune(e.replaceBuffer))
-			} else {
-				curCursor = &e.promptCursorX
-				maxLen = len([]rune(e.promptBuffer))
-			}
+// escapeTimedOut ends a sequence that stopped arriving. A bare ESC is the Esc
+// key; a partial CSI or SS3 sequence is discarded.
+func (e *Editor) escapeTimedOut() error {
+	state := e.escState
+	e.escState = escNone
+	if state == escStart {
+		return e.cancelMode()
+	}
+	return nil
+}
 
-			switch cmd {
-			case 'Z': // Shift+Tab
-				if e.isReplacing {
-					e.promptFocus = (e.promptFocus + 1) % 2
-				}
-			case 'D': // Left
-				e.movePromptCursor(-1)
-			case 'C': // Right
-				e.movePromptCursor(1)
-			case 'H', '1', 'A': // Home / Up
-				if cmd == 'A' && e.isReplacing {
-					e.promptFocus = 0 // Up arrow goes to Find input
-				} else {
-					*curCursor = 0
-				}
-			case 'F', '4', 'B': // End / Down
-				if cmd == 'B' && e.isReplacing {
-					e.promptFocus = 1 // Down arrow goes to Replace input
-				} else {
-					*curCursor = maxLen
-				}
-			case '~': // Delete
-				if params == "3" {
-					e.deletePromptRune()
-				}
-			}
-			return nil
+// handleCSI runs the key bound to a complete CSI sequence ESC [ params cmd.
+func (e *Editor) handleCSI(cmd byte, params string) error {
+	// --- BRACKETED PASTE ---
+	if cmd == '~' && params == "200" {
+		e.handlePaste(e.readBracketedPaste())
+		return nil
+	}
+
+	// --- MOUSE ---
+	if (cmd == 'M' || cmd == 'm') && strings.HasPrefix(params, "<") {
+		e.handleMouse(params, cmd == 'm')
+		return nil
+	}
+
+	// --- FUNCTION KEYS ---
+	if key, ok := decodeFunctionKey(cmd, params); ok {
+		if r, bound := e.functionKeyAction(key); bound {
+			return e.handleRune(r)
 		}
+		return nil
+	}
 
-		// --- MAIN EDITOR NAVIGATION ---
-		switch cmd {
-		case 'Z': // Shift+Tab (Back Tab)
-			e.flushEditGroups()
-			e.unindentLine()
-			return nil
+	// --- PROMPT NAVIGATION ---
+	if e.isSaveAs || e.isGotoLine || e.isRunCommand || e.isCommandMode || e.isFinding || e.isReplacing {
+		var curCursor *int
+		var maxLen int
 
-		case 'A', 'B', 'C', 'D': // Arrow keys
-			isShift := false
-			isCtrl := false
-			isCtrlShift := false
-			isAlt := false
+		if e.isReplacing && e.promptFocus == 1 {
+			curCursor = &e.replaceCursorX
+			maxLen = len([]rune(e.replaceBuffer))
+		} else {
+			curCursor = &e.promptCursorX
+			maxLen = len([]rune(e.promptBuffer))
+		}
+		// Up and Down in the find field go through the search history
+		inFindField := e.isFinding && !(e.isReplacing && e.promptFocus == 1)
 
-			if strings.Contains(params, ";2") {
-				isShift = true
+		switch cmd {
+		case 'Z': // Shift+Tab
+			if e.isReplacing {
+				e.promptFocus = (e.promptFocus + 1) % 2
 			}
-			if strings.Contains(params, ";5") {
-				isCtrl = true
+		case 'D': // Left
+			e.movePromptCursor(-1)
+		case 'C': // Right
+			e.movePromptCursor(1)
+		case 'H', '1', 'A': // Home / Up
+			switch {
+			case cmd == 'A' && inFindField && e.recallFindHistory(-1):
+			case cmd == 'A' && e.isReplacing:
+				e.promptFocus = 0 // Up arrow goes to Find input
+			default:
+				*curCursor = 0
 			}
-			if strings.Contains(params, ";6") {
-				isCtrl = true
-				isShift = true
-				isCtrlShift = true
+		case 'F', '4', 'B': // End / Down
+			switch {
+			case cmd == 'B' && inFindField && e.recallFindHistory(1):
+			case cmd == 'B' && e.isReplacing:
+				e.promptFocus = 1 // Down arrow goes to Replace input
+			default:
+				*curCursor = maxLen
 			}
-			// --- Detect Ctrl+Alt (1;7) or Ctrl+Alt+Shift (1;8) ---
-			if strings.Contains(params, ";7") {
-				isCtrl = true
-				isAlt = true
+		case '~': // Delete
+			if params == "3" {
+				e.deletePromptRune()
 			}
-			if strings.Contains(params, ";8") {
-				isCtrl = true
-				isAlt = true
-				isShift = true
+		}
+		return nil
+	}
+
+	// --- MAIN EDITOR NAVIGATION ---
+	e.extraCursors = nil
+	if cmd >= 'A' && cmd <= 'D' && strings.Contains(params, ";4") { // Alt+Shift+arrows
+		e.extendBlockSelection(cmd)
+		return nil
+	}
+	if e.blockActive {
+		if cmd == '~' && params == "3" { // Delete
+			if !e.readOnlyBlocked() {
+				e.deleteBlock()
 			}
+			return nil
+		}
+		e.blockActive = false
+	}
+	switch cmd {
+	case 'Z': // Shift+Tab (Back Tab)
+		if e.readOnlyBlocked() {
+			return nil
+		}
+		e.flushEditGroups()
+		if _, _, ok := e.selectedLines(); ok {
+			e.unindentSelection()
+		} else {
+			e.unindentLine()
+		}
+		return nil
 
-			// --- Handle Ctrl+Alt+Up/Down/Left/Right ---
-			if isCtrl && isAlt {
-				switch cmd {
-				case 'A': // Up -> Move line up
-					e.moveLineUp()
-					return nil
-				case 'B': // Down -> Move line down
-					e.moveLineDown()
+	case 'A', 'B', 'C', 'D': // Arrow keys
+		isShift := false
+		isCtrl := false
+		isCtrlShift := false
+		isAlt := false
+
+		if strings.Contains(params, ";2") {
+			isShift = true
+		}
+		if strings.Contains(params, ";5") {
+			isCtrl = true
+		}
+		if strings.Contains(params, ";6") {
+			isCtrl = true
+			isShift = true
+			isCtrlShift = true
+		}
+		// --- Detect Ctrl+Alt (1;7) or Ctrl+Alt+Shift (1;8) ---
+		if strings.Contains(params, ";7") {
+			isCtrl = true
+			isAlt = true
+		}
+		if strings.Contains(params, ";8") {
+			isCtrl = true
+			isAlt = true
+			isShift = true
+		}
+
+		// --- Handle Ctrl+Alt+Up/Down/Left/Right ---
+		if isCtrl && isAlt {
+			switch cmd {
+			case 'A', 'B':
+				if e.readOnlyBlocked() {
 					return nil
-				case 'C': // Right -> Increase height downwards (or shrink upwards)
-					if e.extraCursorHeight < 0 {
-						e.extraCursorHeight++ // Shrink upwards extension
-					} else {
-						if e.cursorY+e.extraCursorHeight+1 < e.buffer.LineCount() {
-							e.extraCursorHeight++ // Grow downwards extension
-						}
+				}
+			}
+			switch cmd {
+			case 'A': // Up -> Move line up
+				e.moveLineUp()
+				return nil
+			case 'B': // Down -> Move line down
+				e.moveLineDown()
+				return nil
+			case 'C': // Right -> Increase height downwards (or shrink upwards)
+				if e.extraCursorHeight < 0 {
+					e.extraCursorHeight++ // Shrink upwards extension
+				} else {
+					if e.cursorY+e.extraCursorHeight+1 < e.buffer.LineCount() {
+						e.extraCursorHeight++ // Grow downwards extension
 					}
-					return nil
-				case 'D': // Left -> Increase height upwards (or shrink downwards)
-					if e.extraCursorHeight > 0 {
-						e.extraCursorHeight-- // Shrink downwards extension
-					} else {
-						if e.cursorY+e.extraCursorHeight-1 >= 0 {
-							e.extraCursorHeight-- // Grow upwards extension
-						}
+				}
+				return nil
+			case 'D': // Left -> Increase height upwards (or shrink downwards)
+				if e.extraCursorHeight > 0 {
+					e.extraCursorHeight-- // Shrink downwards extension
+				} else {
+					if e.cursorY+e.extraCursorHeight-1 >= 0 {
+						e.extraCursorHeight-- // Grow upwards extension
 					}
-					return nil
 				}
+				return nil
 			}
+		}
 
-			if isCtrl {
-				switch cmd {
-				case 'C': // Ctrl+Right
-					e.moveWordRight(isShift || isCtrlShift)
-				case 'D': // Ctrl+Left
-					e.moveWordLeft(isShift || isCtrlShift)
-				default:
-					e.handleArrowKey(cmd, isShift || isCtrlShift)
-				}
-			} else {
-				e.handleArrowKey(cmd, isShift)
+		if isCtrl {
+			switch cmd {
+			case 'A': // Ctrl+Up
+				e.moveParagraphUp(isShift || isCtrlShift)
+			case 'B': // Ctrl+Down
+				e.moveParagraphDown(isShift || isCtrlShift)
+			case 'C': // Ctrl+Right
+				e.moveWordRight(isShift || isCtrlShift)
+			case 'D': // Ctrl+Left
+				e.moveWordLeft(isShift || isCtrlShift)
+			default:
+				e.handleArrowKey(cmd, isShift || isCtrlShift)
 			}
+		} else {
+			e.handleArrowKey(cmd, isShift)
+		}
 
-		case 'H': // Home
-			isCtrl := strings.Contains(params, "5")
-			isShift := strings.Contains(params, "2")
-			if isCtrl {
-				e.moveDocStart()
-			} else {
-				e.moveLineStart(isShift)
-			}
+	case 'H': // Home
+		isCtrl := strings.Contains(params, "5")
+		isShift := strings.Contains(params, "2")
+		if isCtrl {
+			e.moveDocStart()
+		} else {
+			e.moveLineStart(isShift)
+		}
 
-		case 'F': // End
-			isCtrl := strings.Contains(params, "5")
-			isShift := strings.Contains(params, "2")
-			if isCtrl {
-				e.moveDocEnd()
-			} else {
-				e.moveLineEnd(isShift)
-			}
+	case 'F': // End
+		isCtrl := strings.Contains(params, "5")
+		isShift := strings.Contains(params, "2")
+		if isCtrl {
+			e.moveDocEnd()
+		} else {
+			e.moveLineEnd(isShift)
+		}
 
-		case '~': // PageUp, PageDown, Delete, etc.
-			switch params {
-			case "1": // Home
-				e.moveLineStart(false)
-			case "1;2": // Shift+Home
-				e.moveLineStart(true)
-			case "4": // End
-				e.moveLineEnd(false)
-			case "4;2": // Shift+End
-				e.moveLineEnd(true)
-			case "5": // Page Up
-				e.movePageUp()
-			case "6": // Page Down
-				e.movePageDown()
-			case "3": // Delete key
+	case '~': // PageUp, PageDown, Delete, etc.
+		switch params {
+		case "1": // Home
+			e.moveLineStart(false)
+		case "1;2": // Shift+Home
+			e.moveLineStart(true)
+		case "4": // End
+			e.moveLineEnd(false)
+		case "4;2": // Shift+End
+			e.moveLineEnd(true)
+		case "5": // Page Up
+			e.movePageUp()
+		case "6": // Page Down
+			e.movePageDown()
+		case "5;5": // Ctrl+Page Up
+			if !e.isQuitting && !e.isConfirmingReplace && !e.isConfirmingReload && !e.isConfirmingOverwrite && !e.isChoosingLineEnding {
+				e.cycleBuffer(-1)
+			}
+		case "6;5": // Ctrl+Page Down
+			if !e.isQuitting && !e.isConfirmingReplace && !e.isConfirmingReload && !e.isConfirmingOverwrite && !e.isChoosingLineEnding {
+				e.cycleBuffer(1)
+			}
+		case "3": // Delete key
+			if !e.readOnlyBlocked() {
 				e.handleDeleteKey()
-			case "3;5": // Ctrl+Delete
+			}
+		case "3;5": // Ctrl+Delete
+			if !e.readOnlyBlocked() {
 				e.handleDeleteWordRight()
 			}
 		}
-		return nil
 	}
+	return nil
+}
 
-CANCEL_MODE:
+// cancelMode leaves whatever prompt or mode is active, innermost first.
+// It backs a lone Esc press and, when configured, Ctrl+C.
+func (e *Editor) cancelMode() error {
 	// 1. Handle Confirm Prompt
 	if e.isConfirmingReplace {
 		e.isConfirmingReplace = false
 		e.setStatusMessage("Replace All cancelled.")
 		return nil
 	}
-	// 2. Handle Replace Mode
+	// 2. Handle Line Ending, Reload and Overwrite Prompts
+	if e.isChoosingLineEnding {
+		e.isChoosingLineEnding = false
+		e.setStatusMessage("Line ending conversion cancelled.")
+		return nil
+	}
+	if e.isConfirmingReload {
+		e.isConfirmingReload = false
+		e.setStatusMessage("Reload cancelled.")
+		return nil
+	}
+	if e.isConfirmingOverwrite {
+		e.isConfirmingOverwrite = false
+		e.setStatusMessage("Save cancelled.")
+		e.resumeQuit(false)
+		return nil
+	}
+	// 3. Handle Replace Mode
 	if e.isReplacing {
 		e.isReplacing = false
 		e.isFinding = false
@@ -333,21 +578,38 @@ CANCEL_MODE:
 		e.setStatusMessage("Replace cancelled.")
 		return nil
 	}
-	// 3. Handle Save As
+	// 4. Handle Save As
 	if e.isSaveAs {
 		e.isSaveAs = false
 		e.promptBuffer = ""
 		e.setStatusMessage("Save As cancelled.")
+		e.resumeQuit(false)
+		return nil
+	}
+	// 5. Handle Goto, Run Command and the command palette
+	if e.isRunCommand {
+		e.isRunCommand = false
+		e.promptBuffer = ""
+		e.setStatusMessage("Run command cancelled.")
+		return nil
+	}
+	if e.isCommandMode {
+		e.isCommandMode = false
+		e.promptBuffer = ""
+		e.setStatusMessage("Command cancelled.")
 		return nil
 	}
-	// 4. Handle Goto
 	if e.isGotoLine {
 		e.isGotoLine = false
 		e.promptBuffer = ""
 		e.setStatusMessage("Go to line cancelled.")
 		return nil
 	}
-	// 5. Handle Find
+	// 6. Handle Find
+	if e.isFinding && e.findAccepted && e.config.KeepHighlights && e.pager == nil && e.findCurrentMatch >= 0 {
+		e.keepFindHighlights()
+		return nil
+	}
 	if e.isFinding {
 		e.isFinding = false
 		e.promptBuffer = ""
@@ -360,9 +622,20 @@ CANCEL_MODE:
 		return nil
 	}
 
-	// 6. Handle Multi-Cursor Cancellation
-	if e.extraCursorHeight != 0 {
+	// 7. Handle Highlights, Block Selection and Multi-Cursor Cancellation
+	if e.highlightMatches {
+		e.clearHighlights()
+		e.selectionActive = false
+		e.setStatusMessage("Highlights cleared.")
+		return nil
+	}
+	if e.blockActive {
+		e.blockActive = false
+		return nil
+	}
+	if e.extraCursorHeight != 0 || len(e.extraCursors) > 0 {
 		e.extraCursorHeight = 0
+		e.extraCursors = nil
 		// e.setStatusMessage("Multi-cursor cancelled.") // Optional feedback
 		return nil
 	}
@@ -370,6 +643,46 @@ CANCEL_MODE:
 	return nil
 }
 
+// readBracketedPaste collects everything the terminal sends between the
+// bracketed paste start and end markers. Escape sequences other than the end
+// marker are part of the pasted text. If the input stops before the end
+// marker, the paste ends with what has arrived.
+func (e *Editor) readBracketedPaste() string {
+	e.pasting = true
+	defer func() { e.pasting = false }()
+	var sb strings.Builder
+	for {
+		r, err := e.readInputRune()
+		if err != nil {
+			break
+		}
+		sb.WriteRune(r)
+		if strings.HasSuffix(sb.String(), bracketedPasteEnd) {
+			return strings.TrimSuffix(sb.String(), bracketedPasteEnd)
+		}
+	}
+	return sb.String()
+}
+
+// handlePaste inserts text pasted through the terminal into the active prompt,
+// or into the buffer the same way Ctrl+V does.
+func (e *Editor) handlePaste(text string) {
+	if e.isConfirmingReplace || e.isQuitting || e.isConfirmingReload || e.isConfirmingOverwrite {
+		return
+	}
+	if e.isSaveAs || e.isGotoLine || e.isRunCommand || e.isCommandMode || e.isFinding || e.isReplacing {
+		e.insertPromptText(text)
+		return
+	}
+	if text == "" || e.readOnlyBlocked() {
+		return
+	}
+	e.selectionActive = false
+	e.extraCursors = nil
+	e.blockActive = false
+	e.pasteText(e.reindentPaste(text))
+}
+
 func (e *Editor) handleArrowKey(direction byte, modified bool) {
 	// NOTE: We deliberately do NOT reset e.extraCursorHeight here anymore,
 	// allowing the arrow keys to move the block of cursors.
@@ -433,6 +746,7 @@ func (e *Editor) moveCursor(dx, dy int, isSelecting bool) {
 		}
 	}
 	if dy != 0 {
+		desired := e.desiredColumn()
 		e.cursorY += dy
 		if e.cursorY < 0 {
 			e.cursorY = 0
@@ -440,7 +754,8 @@ func (e *Editor) moveCursor(dx, dy int, isSelecting bool) {
 		if e.cursorY >= e.buffer.LineCount() {
 			e.cursorY = max(e.buffer.LineCount()-1, 0)
 		}
-		e.clampCursorX()
+		e.cursorX = e.runeXForVisualX(e.cursorY, desired)
+		e.keepDesiredColumn(desired)
 		return
 	}
 	if dx == -1 && e.cursorX == 0 && e.cursorY > 0 {
@@ -448,22 +763,69 @@ func (e *Editor) moveCursor(dx, dy int, isSelecting bool) {
 		e.cursorX = len([]rune(e.buffer.GetLine(e.cursorY)))
 		return
 	}
-	currentLineLen := 0
+	var lineRunes []rune
 	if e.cursorY < e.buffer.LineCount() {
-		currentLineLen = len([]rune(e.buffer.GetLine(e.cursorY)))
+		lineRunes = []rune(e.buffer.GetLine(e.cursorY))
 	}
-	if dx == 1 && e.cursorX == currentLineLen && e.cursorY < e.buffer.LineCount()-1 {
+	if dx == 1 && e.cursorX == len(lineRunes) && e.cursorY < e.buffer.LineCount()-1 {
 		e.cursorY++
 		e.cursorX = 0
 		return
 	}
-	e.cursorX += dx
+	// Left and Right step over a whole character, accents and all
+	switch {
+	case dx == 1 && e.cursorX < len(lineRunes):
+		e.cursorX = nextClusterBoundary(lineRunes, e.cursorX)
+	case dx == -1 && e.cursorX <= len(lineRunes):
+		e.cursorX = prevClusterBoundary(lineRunes, e.cursorX)
+	default:
+		e.cursorX += dx
+	}
 	if e.cursorX < 0 {
 		e.cursorX = 0
 	}
 	e.clampCursorX()
 }
 
+// zeroWidthJoiner joins the characters on either side of it into one glyph,
+// as in family emoji.
+const zeroWidthJoiner = '\u200D'
+
+// extendsCluster reports whether r belongs to the character before it rather
+// than starting one of its own: a combining mark, a variation selector, a
+// zero width joiner or an emoji skin tone.
+func extendsCluster(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me) || r == zeroWidthJoiner || r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+// nextClusterBoundary returns the index just past the character that starts
+// at runes[i], taking in the marks that extend it and whatever a zero width
+// joiner joins to it. This is a simplified take on grapheme clusters; it
+// doesn't pair up regional indicators, for one.
+func nextClusterBoundary(runes []rune, i int) int {
+	if i >= len(runes) {
+		return len(runes)
+	}
+	j := i + 1
+	for j < len(runes) && (extendsCluster(runes[j]) || runes[j-1] == zeroWidthJoiner) {
+		j++
+	}
+	return j
+}
+
+// prevClusterBoundary returns the index where the character that ends at
+// runes[i-1] starts; see nextClusterBoundary.
+func prevClusterBoundary(runes []rune, i int) int {
+	if i <= 0 {
+		return 0
+	}
+	j := i - 1
+	for j > 0 && (extendsCluster(runes[j]) || runes[j-1] == zeroWidthJoiner) {
+		j--
+	}
+	return j
+}
+
 func isWordChar(r rune) bool {
 	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
 }
@@ -558,3 +920,131 @@ func (e *Editor) moveWordLeft(isSelecting bool) {
 	e.cursorY = y
 	e.cursorX = x + 1
 }
+
+// moveParagraphDown (Ctrl+Down) moves to the blank line after the paragraph
+// at or below the cursor, or to the end of the buffer after the last one. A
+// paragraph is a run of lines that are not blank; a line of only spaces and
+// tabs counts as blank.
+func (e *Editor) moveParagraphDown(isSelecting bool) {
+	if isSelecting && !e.selectionActive {
+		e.selectionActive = true
+		e.selectionAnchorX = e.cursorX
+		e.selectionAnchorY = e.cursorY
+	} else if !isSelecting {
+		e.selectionActive = false
+	}
+	lineCount := e.buffer.LineCount()
+	y := e.cursorY
+	for y < lineCount && isBlankLine(e.buffer.GetLine(y)) {
+		y++
+	}
+	for y < lineCount && !isBlankLine(e.buffer.GetLine(y)) {
+		y++
+	}
+	if y >= lineCount {
+		e.cursorY = lineCount - 1
+		e.cursorX = len([]rune(e.buffer.GetLine(e.cursorY)))
+		return
+	}
+	e.cursorY, e.cursorX = y, 0
+}
+
+// moveParagraphUp (Ctrl+Up) moves to the blank line before the paragraph at
+// or above the cursor, or to the start of the buffer before the first one.
+func (e *Editor) moveParagraphUp(isSelecting bool) {
+	if isSelecting && !e.selectionActive {
+		e.selectionActive = true
+		e.selectionAnchorX = e.cursorX
+		e.selectionAnchorY = e.cursorY
+	} else if !isSelecting {
+		e.selectionActive = false
+	}
+	y := e.cursorY
+	for y >= 0 && isBlankLine(e.buffer.GetLine(y)) {
+		y--
+	}
+	for y >= 0 && !isBlankLine(e.buffer.GetLine(y)) {
+		y--
+	}
+	e.cursorY, e.cursorX = max(y, 0), 0
+}
+
+// isBlankLine reports whether line holds nothing but spaces and tabs.
+func isBlankLine(line string) bool {
+	return strings.Trim(line, " \t") == ""
+}
+
+// maxBracketScanLines bounds how far findMatchingBracket looks, so an
+// unbalanced bracket does not scan the rest of a huge file.
+const maxBracketScanLines = 10000
+
+// bracketPairs maps each bracket to its partner.
+var bracketPairs = map[rune]rune{'(': ')', '[': ']', '{': '}', ')': '(', ']': '[', '}': '{'}
+
+// jumpToMatchingBracket moves the cursor to the partner of the bracket under
+// it, or just before it.
+func (e *Editor) jumpToMatchingBracket() {
+	x, bracket := e.bracketAtCursor()
+	if x < 0 {
+		e.setStatusMessage("No bracket at the cursor")
+		return
+	}
+	y, mx, ok := e.findMatchingBracket(e.cursorY, x)
+	if !ok {
+		e.setStatusMessage("No matching %c found", bracketPairs[bracket])
+		return
+	}
+	e.cursorY, e.cursorX = y, mx
+}
+
+// bracketAtCursor returns the column and rune of the bracket under the
+// cursor, or just before it, or -1 if there is none.
+func (e *Editor) bracketAtCursor() (int, rune) {
+	line := []rune(e.buffer.GetLine(e.cursorY))
+	x := e.cursorX
+	if x >= len(line) || bracketPairs[line[x]] == 0 {
+		x--
+	}
+	if x < 0 || x >= len(line) || bracketPairs[line[x]] == 0 {
+		return -1, 0
+	}
+	return x, line[x]
+}
+
+// findMatchingBracket returns the position of the partner of the bracket at
+// line y, column x, counting nested pairs of the same kind. Opening brackets
+// search forward and closing ones backward.
+func (e *Editor) findMatchingBracket(y, x int) (int, int, bool) {
+	line := []rune(e.buffer.GetLine(y))
+	open := line[x]
+	partner := bracketPairs[open]
+	step := 1
+	if open == ')' || open == ']' || open == '}' {
+		step = -1
+	}
+
+	depth := 0
+	for scanned := 0; scanned <= maxBracketScanLines; scanned++ {
+		for ; x >= 0 && x < len(line); x += step {
+			switch line[x] {
+			case open:
+				depth++
+			case partner:
+				depth--
+				if depth == 0 {
+					return y, x, true
+				}
+			}
+		}
+		y += step
+		if y < 0 || y >= e.buffer.LineCount() {
+			break
+		}
+		line = []rune(e.buffer.GetLine(y))
+		x = 0
+		if step < 0 {
+			x = len(line) - 1
+		}
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,192 @@
+package editor
+
+import (
+	"slices"
+	"sort"
+)
+
+// cursorPos is a cursor's place in the buffer, as a line and a rune index.
+type cursorPos struct {
+	y, x int
+}
+
+// addCursorAtNextOccurrence (Alt+D) finds the word the main cursor is in and
+// adds a cursor at the same place in the next whole-word occurrence of it,
+// after the cursor added last and wrapping around at the end of the buffer.
+// Typing and Backspace then act at every cursor.
+func (e *Editor) addCursorAtNextOccurrence() {
+	e.flushEditGroups()
+	e.extraCursorHeight = 0
+	e.selectionActive = false
+	line := []rune(e.buffer.GetLine(e.cursorY))
+	start, end := e.cursorX, e.cursorX
+	for start > 0 && isWordChar(line[start-1]) {
+		start--
+	}
+	for end < len(line) && isWordChar(line[end]) {
+		end++
+	}
+	if start == end {
+		e.setStatusMessage("No word at the cursor")
+		return
+	}
+	word := line[start:end]
+	offset := e.cursorX - start
+
+	from := cursorPos{e.cursorY, start}
+	if n := len(e.extraCursors); n > 0 {
+		from = cursorPos{e.extraCursors[n-1].y, e.extraCursors[n-1].x - offset}
+	}
+	next, ok := e.nextWordOccurrence(word, from)
+	pos := cursorPos{next.y, next.x + offset}
+	if !ok || pos == (cursorPos{e.cursorY, e.cursorX}) || slices.Contains(e.extraCursors, pos) {
+		e.setStatusMessage("No more occurrences of %q", string(word))
+		return
+	}
+	e.extraCursors = append(e.extraCursors, pos)
+	e.setStatusMessage("%d cursors", len(e.extraCursors)+1)
+}
+
+// nextWordOccurrence returns the start of the first whole-word occurrence of
+// word after from, searching to the end of the buffer and then from the top.
+func (e *Editor) nextWordOccurrence(word []rune, from cursorPos) (cursorPos, bool) {
+	lineCount := e.buffer.LineCount()
+	for i := 0; i <= lineCount; i++ {
+		y := (from.y + i) % lineCount
+		line := []rune(e.buffer.GetLine(y))
+		x := 0
+		if i == 0 {
+			x = from.x + 1
+		}
+		for ; x+len(word) <= len(line); x++ {
+			if i == lineCount && x > from.x {
+				break // Back where the search started
+			}
+			if isWholeWordAt(line, x, word) {
+				return cursorPos{y, x}, true
+			}
+		}
+	}
+	return cursorPos{}, false
+}
+
+// runesEqualAt reports whether line holds word starting at x.
+func runesEqualAt(line []rune, x int, word []rune) bool {
+	for i, r := range word {
+		if line[x+i] != r {
+			return false
+		}
+	}
+	return true
+}
+
+// isWholeWordAt reports whether line holds word starting at x, with no word
+// characters directly before or after it.
+func isWholeWordAt(line []rune, x int, word []rune) bool {
+	return runesEqualAt(line, x, word) &&
+		(x == 0 || !isWordChar(line[x-1])) &&
+		(x+len(word) == len(line) || !isWordChar(line[x+len(word)]))
+}
+
+// allCursors returns the main cursor and the extra cursors in buffer order,
+// with the index of the main one.
+func (e *Editor) allCursors() ([]cursorPos, int) {
+	mainPos := cursorPos{e.cursorY, e.cursorX}
+	cursors := append([]cursorPos{mainPos}, e.extraCursors...)
+	sort.Slice(cursors, func(i, j int) bool {
+		if cursors[i].y != cursors[j].y {
+			return cursors[i].y < cursors[j].y
+		}
+		return cursors[i].x < cursors[j].x
+	})
+	mainIndex := 0
+	for i, c := range cursors {
+		if c == mainPos {
+			mainIndex = i
+			break
+		}
+	}
+	return cursors, mainIndex
+}
+
+// setCursors stores cursors, as returned by allCursors and then moved, back
+// as the main and extra cursors. Cursors that edits brought together merge.
+func (e *Editor) setCursors(cursors []cursorPos, mainIndex int) {
+	mainPos := cursors[mainIndex]
+	e.cursorY = mainPos.y
+	e.cursorX = mainPos.x
+	e.extraCursors = e.extraCursors[:0]
+	for i, c := range cursors {
+		if c == mainPos || i > 0 && c == cursors[i-1] {
+			continue
+		}
+		e.extraCursors = append(e.extraCursors, c)
+	}
+}
+
+// typeAtCursors inserts r at every cursor. The cursors are visited in buffer
+// order, and each insert moves the cursors after it on its line one rune
+// further along.
+func (e *Editor) typeAtCursors(r rune) {
+	cursors, mainIndex := e.allCursors()
+	line, shift := -1, 0
+	for i := range cursors {
+		c := &cursors[i]
+		if c.y != line {
+			line, shift = c.y, 0
+		}
+		c.x += shift
+		if err := e.buffer.Insert(c.y, c.x, r); err != nil {
+			continue
+		}
+		e.pushUndoInsertBlock([]opEntry{{
+			insertLine: c.y, insertCol: c.x,
+			delLine: c.y, delCol: c.x + 1,
+			r: r,
+		}})
+		c.x++
+		shift++
+	}
+	e.setCursors(cursors, mainIndex)
+	e.dirty = true
+}
+
+// backspaceAtCursors deletes the rune before every cursor, keeping the later
+// cursors on a line in step the same way typeAtCursors does. A cursor at the
+// start of a line stays put: joining lines would move the cursors below it.
+func (e *Editor) backspaceAtCursors() {
+	cursors, mainIndex := e.allCursors()
+	line, shift := -1, 0
+	for i := range cursors {
+		c := &cursors[i]
+		if c.y != line {
+			line, shift = c.y, 0
+		}
+		c.x -= shift
+		if c.x == 0 {
+			continue
+		}
+		deleted := e.getRuneAt(c.y, c.x-1)
+		if err := e.buffer.Delete(c.y, c.x); err != nil {
+			continue
+		}
+		e.pushUndoDeleteIfExternalGrouping(c.y, c.x-1, deleted)
+		c.x--
+		shift++
+	}
+	e.setCursors(cursors, mainIndex)
+	e.dirty = true
+}
+
+// extraCursorCells returns the positions, as {line, column}, of the extra
+// cursors for drawRows to show, or nil when there are none.
+func (e *Editor) extraCursorCells() map[[2]int]bool {
+	if len(e.extraCursors) == 0 {
+		return nil
+	}
+	cells := make(map[[2]int]bool, len(e.extraCursors))
+	for _, c := range e.extraCursors {
+		cells[[2]int{c.y, c.x}] = true
+	}
+	return cells
+}
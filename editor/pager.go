@@ -0,0 +1,377 @@
+package editor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bulga138/panka/buffer"
+)
+
+// pagerWindowSize is how many bytes of a huge file are held in the buffer at once.
+const pagerWindowSize = 1 << 20
+
+// pagerWindow locates a loaded slice of the file.
+type pagerWindow struct {
+	start     int64 // byte offset of the window's first line
+	firstLine int   // 0-based file line number of the window's first line
+	midLine   bool  // the window starts inside a line too long to fit in one
+}
+
+// pager serves a file that is too large to edit by keeping only a window of
+// it in the buffer and sliding that window as the cursor moves.
+type pager struct {
+	file   *os.File
+	size   int64
+	window pagerWindow
+	text   string // raw bytes of the loaded window
+}
+
+func openPager(filename string, size int64) (*pager, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &pager{file: f, size: size}, nil
+}
+
+func (p *pager) close() {
+	if p.file != nil {
+		p.file.Close()
+		p.file = nil
+	}
+}
+
+// load reads the window at w. Unless it reaches the end of the file, the
+// window is cut after its last newline so it never ends mid-line; a window
+// inside a line longer than itself is cut at the last whole character.
+func (p *pager) load(w pagerWindow) error {
+	buf := make([]byte, pagerWindowSize)
+	n, err := p.file.ReadAt(buf, w.start)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	text := string(buf[:n])
+	if w.start+int64(n) < p.size {
+		if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+			text = text[:i+1]
+		} else {
+			text = text[:runeBoundary(text)]
+		}
+	}
+	p.window = w
+	p.text = text
+	return nil
+}
+
+// bufferText is the loaded window as shown in the buffer. A window that
+// stops short of the end of the file drops its final line break, so the
+// buffer does not end in an empty line that is not really there. The first
+// window also drops a byte order mark.
+func (p *pager) bufferText() string {
+	text := p.text
+	if p.window.start == 0 {
+		text = strings.TrimPrefix(text, utf8BOM)
+	}
+	if p.atEOF() {
+		return text
+	}
+	text = strings.TrimSuffix(text, "\n")
+	return strings.TrimSuffix(text, "\r")
+}
+
+// end is the byte offset just past the loaded window.
+func (p *pager) end() int64 {
+	return p.window.start + int64(len(p.text))
+}
+
+func (p *pager) atEOF() bool {
+	return p.end() >= p.size
+}
+
+// runeBoundary returns the length of s without a UTF-8 character cut off at
+// its end.
+func runeBoundary(s string) int {
+	for i := len(s) - 1; i >= 0 && i >= len(s)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(s[i]) {
+			if !utf8.FullRuneInString(s[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(s)
+}
+
+// lineByteOffset returns the offset of line n of the loaded window within p.text.
+func (p *pager) lineByteOffset(n int) int {
+	off := 0
+	for ; n > 0; n-- {
+		i := strings.IndexByte(p.text[off:], '\n')
+		if i < 0 {
+			return len(p.text)
+		}
+		off += i + 1
+	}
+	return off
+}
+
+// previous returns a window that ends where the loaded one starts and holds
+// up to half a window of the lines before it. When no line starts in that
+// half window, it starts inside the line instead.
+func (p *pager) previous() (pagerWindow, error) {
+	from := p.window.start - pagerWindowSize/2
+	if from < 0 {
+		from = 0
+	}
+	buf := make([]byte, p.window.start-from)
+	if _, err := p.file.ReadAt(buf, from); err != nil && err != io.EOF {
+		return pagerWindow{}, err
+	}
+	chunk := string(buf)
+	midLine := false
+	if from > 0 {
+		if i := strings.IndexByte(chunk, '\n'); i >= 0 && i < len(chunk)-1 {
+			// Skip the partial line the chunk starts in.
+			from += int64(i + 1)
+			chunk = chunk[i+1:]
+		} else {
+			// Skip to the first whole character.
+			for chunk != "" && !utf8.RuneStart(chunk[0]) {
+				from++
+				chunk = chunk[1:]
+			}
+			midLine = true
+		}
+	}
+	return pagerWindow{
+		start:     from,
+		firstLine: p.window.firstLine - strings.Count(chunk, "\n"),
+		midLine:   midLine,
+	}, nil
+}
+
+// scan reads the file line by line from the start of window w and calls fn
+// with each line's number and byte offset until fn returns true. It reports
+// whether fn stopped the scan.
+func (p *pager) scan(from pagerWindow, fn func(line int, offset int64, text string) bool) (bool, error) {
+	r := bufio.NewReader(io.NewSectionReader(p.file, from.start, p.size-from.start))
+	line, offset := from.firstLine, from.start
+	for {
+		text, err := r.ReadString('\n')
+		if text != "" && fn(line, offset, text) {
+			return true, nil
+		}
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		line++
+		offset += int64(len(text))
+	}
+}
+
+// ---------- Editor integration ----------
+
+// lineBase is the file line number of buffer line 0; it is only non-zero in pager mode.
+func (e *Editor) lineBase() int {
+	if e.pager == nil {
+		return 0
+	}
+	return e.pager.window.firstLine
+}
+
+// showPagerWindow loads w into the buffer. The cursor and viewport keep
+// pointing at the same file lines where the new window covers them.
+func (e *Editor) showPagerWindow(w pagerWindow) error {
+	shift := w.firstLine - e.pager.window.firstLine
+	if err := e.pager.load(w); err != nil {
+		return err
+	}
+	e.buffer = buffer.NewRope(e.pager.bufferText())
+	e.cursorY = max(e.cursorY-shift, 0)
+	e.viewportY = max(e.viewportY-shift, 0)
+	e.selectionAnchorY = max(e.selectionAnchorY-shift, 0)
+	e.viewportWrapOffset = 0
+	if lines := e.buffer.LineCount(); e.cursorY >= lines {
+		e.cursorY = max(lines-1, 0)
+	}
+	e.clampCursorX()
+	return nil
+}
+
+// pagerFollowCursor slides the window when the cursor reaches either edge of
+// it, so the cursor line ends up in the middle of the loaded text. A window
+// that holds a single line, or part of one, slides when the cursor reaches
+// either end of that line instead. It runs after every key in pager mode,
+// and waits for an escape sequence to finish.
+func (e *Editor) pagerFollowCursor() {
+	if e.pager == nil || e.escState != escNone {
+		return
+	}
+	lines := e.buffer.LineCount()
+	switch {
+	case lines == 1 && !e.pager.atEOF() && e.cursorX >= len([]rune(e.buffer.GetLine(0))):
+		if err := e.pagerSlideLine(); err != nil {
+			e.setStatusMessage("Pager error: %v", err)
+			return
+		}
+	case e.cursorY >= lines-1 && !e.pager.atEOF() && lines > 1:
+		shift := lines / 2
+		w := pagerWindow{
+			start:     e.pager.window.start + int64(e.pager.lineByteOffset(shift)),
+			firstLine: e.pager.window.firstLine + shift,
+		}
+		if err := e.showPagerWindow(w); err != nil {
+			e.setStatusMessage("Pager error: %v", err)
+			return
+		}
+	case e.cursorY == 0 && e.pager.window.start > 0 &&
+		(e.cursorX == 0 || lines > 1 && !e.pager.window.midLine):
+		old := e.pager.window
+		w, err := e.pager.previous()
+		if err == nil {
+			err = e.showPagerWindow(w)
+		}
+		if err != nil {
+			e.setStatusMessage("Pager error: %v", err)
+			return
+		}
+		// The old first line may have started before the old window; keep
+		// the cursor on the same character of it.
+		if n := int(old.start - w.start); n <= len(e.pager.text) {
+			before := e.pager.text[:n]
+			before = before[strings.LastIndexByte(before, '\n')+1:]
+			if w.start == 0 {
+				before = strings.TrimPrefix(before, utf8BOM)
+			}
+			e.cursorX += utf8.RuneCountInString(before)
+			e.clampCursorX()
+		}
+	default:
+		return
+	}
+	if e.isFinding {
+		// Matches are window-relative; find them again in the new window.
+		e.findAllMatches(e.promptBuffer)
+		e.findCurrentMatch = -1
+		for i, m := range e.findMatches {
+			if m.y == e.selectionAnchorY && m.x == e.selectionAnchorX {
+				e.findCurrentMatch = i
+			}
+		}
+	}
+}
+
+// pagerSlideLine moves a window that holds a single line on to the start of
+// the next line or, when the line goes on past the window, half a window
+// along it, keeping the cursor on the same character.
+func (e *Editor) pagerSlideLine() error {
+	p := e.pager
+	w := pagerWindow{start: p.end(), firstLine: p.window.firstLine + 1}
+	x := 0
+	if !strings.HasSuffix(p.text, "\n") {
+		half := runeBoundary(p.text[:len(p.text)/2])
+		skipped := p.text[:half]
+		if p.window.start == 0 {
+			skipped = strings.TrimPrefix(skipped, utf8BOM)
+		}
+		w = pagerWindow{start: p.window.start + int64(half), firstLine: p.window.firstLine, midLine: true}
+		x = e.cursorX - utf8.RuneCountInString(skipped)
+	}
+	if err := e.showPagerWindow(w); err != nil {
+		return err
+	}
+	e.cursorY = 0
+	e.cursorX = x
+	e.clampCursorX()
+	return nil
+}
+
+// pagerGotoLine moves to 1-based file line lineNum, and column col as for
+// moveToGotoColumn, loading a new window if it is outside the current one.
+func (e *Editor) pagerGotoLine(lineNum, col int) {
+	target := lineNum - 1
+	base := e.pager.window.firstLine
+	if target >= base && target < base+e.buffer.LineCount() {
+		e.cursorY = target - base
+		e.moveToGotoColumn(lineNum, col)
+		return
+	}
+	from := pagerWindow{}
+	if target > base {
+		from = e.pager.window
+	}
+	var found pagerWindow
+	ok, err := e.pager.scan(from, func(line int, offset int64, _ string) bool {
+		found = pagerWindow{start: offset, firstLine: line}
+		return line == target
+	})
+	if err != nil {
+		e.setStatusMessage("Pager error: %v", err)
+		return
+	}
+	if !ok {
+		e.setStatusMessage("Invalid line number: %d", lineNum)
+		return
+	}
+	if err := e.showPagerWindow(found); err != nil {
+		e.setStatusMessage("Pager error: %v", err)
+		return
+	}
+	e.cursorY = 0
+	e.viewportY = 0
+	e.moveToGotoColumn(lineNum, col)
+}
+
+// pagerFindForward searches the rest of the file, past the loaded window, for
+// the current query and loads the window starting at the first matching line.
+// Search in pager mode only goes forward.
+func (e *Editor) pagerFindForward() bool {
+	if e.pager.atEOF() || !e.compileSearch(e.promptBuffer) {
+		return false
+	}
+	from := pagerWindow{
+		start:     e.pager.end(),
+		firstLine: e.pager.window.firstLine + strings.Count(e.pager.text, "\n"),
+	}
+	var found pagerWindow
+	ok, err := e.pager.scan(from, func(line int, offset int64, text string) bool {
+		found = pagerWindow{start: offset, firstLine: line}
+		return len(e.matchLine(line, text, e.promptBuffer)) > 0
+	})
+	if err != nil {
+		e.setStatusMessage("Pager error: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	if err := e.showPagerWindow(found); err != nil {
+		e.setStatusMessage("Pager error: %v", err)
+		return false
+	}
+	e.viewportY = 0
+	e.findAllMatches(e.promptBuffer)
+	e.findCurrentMatch = 0
+	e.jumpToMatch(0)
+	return true
+}
+
+// pagerStatus is the status bar marker for pager mode.
+func (e *Editor) pagerStatus() string {
+	if e.pager == nil {
+		return ""
+	}
+	percent := int64(100)
+	if e.pager.size > 0 {
+		percent = e.pager.end() * 100 / e.pager.size
+	}
+	return fmt.Sprintf(" [PAGER read-only %d%%]", percent)
+}
@@ -0,0 +1,208 @@
+package editor
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/bulga138/panka/runewidth"
+)
+
+// The command palette (Ctrl+P) runs editor commands by name, including the
+// ones that have no key of their own. Every action in keyActions is there
+// under its [keybindings] name, next to paletteActions and the user commands
+// from the config; a user command named like an editor command is left out.
+// A name may be cut short as long as only one command starts with it, and
+// "-" may stand for "_". goto_line takes the line, or line:column, after the
+// name.
+
+// paletteActions are the commands only the palette runs.
+var paletteActions = []string{"diff", "reload", "sort_lines", "to_spaces", "to_tabs", "trim_whitespace"}
+
+// paletteCommandNames lists every command the palette runs, sorted.
+func (e *Editor) paletteCommandNames() []string {
+	names := slices.Clone(paletteActions)
+	for name := range keyActions {
+		if name != "command_palette" {
+			names = append(names, name)
+		}
+	}
+	for name := range e.config.Commands {
+		name = normalizeCommandName(name)
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// paletteUserCommand returns the user command the palette lists as name.
+func (e *Editor) paletteUserCommand(name string) (string, bool) {
+	if _, builtin := keyActions[name]; builtin || slices.Contains(paletteActions, name) {
+		return "", false
+	}
+	for cmd := range e.config.Commands {
+		if normalizeCommandName(cmd) == name {
+			return cmd, true
+		}
+	}
+	return "", false
+}
+
+// paletteMatches lists the commands whose names start with prefix.
+func (e *Editor) paletteMatches(prefix string) []string {
+	prefix = normalizeCommandName(prefix)
+	var matches []string
+	for _, name := range e.paletteCommandNames() {
+		if strings.HasPrefix(name, prefix) {
+			matches = append(matches, name)
+		}
+	}
+	return matches
+}
+
+func normalizeCommandName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "-", "_")
+}
+
+// openCommandPalette starts the Ctrl+P prompt for a command name.
+func (e *Editor) openCommandPalette() {
+	e.isCommandMode = true
+	e.promptBuffer = ""
+	e.promptCursorX = 0
+	e.statusMessage = "Command: "
+}
+
+func (e *Editor) handleCommandInput(r rune) error {
+	switch r {
+	case '\r': // Enter
+		e.isCommandMode = false
+		line := strings.TrimSpace(e.promptBuffer)
+		e.promptBuffer = ""
+		e.promptCursorX = 0
+		if line == "" {
+			e.setStatusMessage("Command cancelled.")
+			return nil
+		}
+		e.runPaletteLine(line)
+
+	case '\t': // Complete the command name as far as the matches agree
+		if strings.Contains(e.promptBuffer, " ") {
+			return nil
+		}
+		matches := e.paletteMatches(e.promptBuffer)
+		if len(matches) == 0 {
+			return nil
+		}
+		common := matches[0]
+		for _, name := range matches[1:] {
+			for !strings.HasPrefix(name, common) {
+				common = common[:len(common)-1]
+			}
+		}
+		if len(matches) == 1 {
+			common += " "
+		}
+		if len(common) >= len(e.promptBuffer) {
+			e.promptBuffer = common
+			e.promptCursorX = len([]rune(common))
+		}
+
+	case '\x16': // Ctrl+V (Paste)
+		e.pasteIntoPrompt()
+
+	case '\x7f', '\b': // Backspace
+		e.backspacePromptRune()
+
+	default:
+		if r >= 32 {
+			e.insertPromptRune(r)
+		}
+	}
+	return nil
+}
+
+// runPaletteLine runs the command named by the first word of line, passing
+// it the rest. The name must be a command or the start of exactly one.
+func (e *Editor) runPaletteLine(line string) {
+	name, arg, _ := strings.Cut(line, " ")
+	name = normalizeCommandName(name)
+	arg = strings.TrimSpace(arg)
+	matches := e.paletteMatches(name)
+	if !slices.Contains(matches, name) {
+		switch len(matches) {
+		case 0:
+			e.setStatusMessage("Unknown command: %s", name)
+			return
+		case 1:
+			name = matches[0]
+		default:
+			e.setStatusMessage("Ambiguous command %s: %s", name, strings.Join(matches, ", "))
+			return
+		}
+	}
+	if arg != "" && name != "goto_line" {
+		e.setStatusMessage("%s takes no argument", name)
+		return
+	}
+	e.runPaletteCommand(name, arg)
+}
+
+// runPaletteCommand runs one palette command. The actions that have a key
+// run as if their default key had been pressed, so read-only mode and the
+// selection are handled as they are for the key.
+func (e *Editor) runPaletteCommand(name, arg string) {
+	switch name {
+	case "goto_line":
+		e.handleRune(keyActions[name])
+		if arg != "" && e.isGotoLine {
+			e.promptBuffer = arg
+			e.handleGotoLineInput('\r')
+		}
+	case "diff":
+		e.showDiffSummary()
+	case "reload":
+		e.reloadFile()
+	case "sort_lines":
+		if !e.readOnlyBlocked() {
+			e.sortLines()
+		}
+	case "trim_whitespace":
+		if !e.readOnlyBlocked() {
+			e.trimTrailingWhitespace()
+		}
+	case "to_spaces", "to_tabs":
+		if !e.readOnlyBlocked() {
+			e.handleConvertIndentation(name == "to_tabs")
+		}
+	default:
+		if cmd, ok := e.paletteUserCommand(name); ok {
+			e.runUserCommand(cmd)
+			return
+		}
+		e.handleRune(keyActions[name])
+	}
+}
+
+// paletteHint lists, dimmed, the commands that start with the name typed so
+// far, cut to the width left after the prompt. It is empty once the name is
+// followed by an argument.
+func (e *Editor) paletteHint() string {
+	if strings.Contains(e.promptBuffer, " ") {
+		return ""
+	}
+	matches := e.paletteMatches(e.promptBuffer)
+	if len(matches) == 0 {
+		return ""
+	}
+	room := e.termWidth - runewidth.StringWidth(e.statusMessage+e.promptBuffer) - 2
+	hint := strings.Join(matches, " ")
+	if len(hint) > room {
+		if room < 4 {
+			return ""
+		}
+		hint = hint[:room-3] + "..."
+	}
+	return "  " + ansiDim + hint + ansiReset
+}
@@ -0,0 +1,32 @@
+package editor
+
+// SetReadOnly turns read-only mode on or off for every buffer. While it is
+// on, keys and pastes that would change the text are refused, and moving
+// around, finding, copying and selecting work as usual.
+func (e *Editor) SetReadOnly(readOnly bool) {
+	e.readOnly = readOnly
+}
+
+// readOnlyBlocked reports whether edits are refused, telling the user why.
+func (e *Editor) readOnlyBlocked() bool {
+	switch {
+	case e.pager != nil:
+		e.setStatusMessage("Read-only: file exceeds maxFileSize and is open in pager mode")
+	case e.invalidUTF8:
+		e.setStatusMessage("Read-only: file is not valid UTF-8 and saving would corrupt it")
+	case e.readOnly:
+		e.setStatusMessage("Buffer is read-only")
+	default:
+		return false
+	}
+	return true
+}
+
+// readOnlyStatus is the status bar marker for read-only mode, including a
+// file that is not valid UTF-8. Pager mode has its own marker.
+func (e *Editor) readOnlyStatus() string {
+	if !e.readOnly && !e.invalidUTF8 || e.pager != nil {
+		return ""
+	}
+	return " [RO]"
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,15 +35,20 @@ func (e *Editor) clampViewport() {
 func (e *Editor) render() {
 	e.clampViewport()
 	var ab bytes.Buffer
+	if e.tooSmall {
+		e.drawTooSmall(&ab)
+		os.Stdout.Write(ab.Bytes())
+		return
+	}
 	ab.WriteString(ansiHideCursor)
-	ab.WriteString(ansiMoveToHome)
+	fmt.Fprintf(&ab, "\x1b[%d;1H", e.screenTop+1)
 	e.scroll()
 	e.drawRows(&ab)
 	e.drawStatusBar(&ab)
 	e.drawCommandBar(&ab)
 	e.drawMessageBar(&ab)
 
-	if e.isGotoLine || e.isSaveAs || e.isFinding {
+	if e.isGotoLine || e.isSaveAs || e.isRunCommand || e.isCommandMode || e.isFinding {
 		var visualCursorOffset int
 		var promptMsgLen int
 		var cursorCol int
@@ -94,7 +100,7 @@ func (e *Editor) render() {
 			}
 			cursorRow = e.termHeight + 3
 		}
-		ab.WriteString(fmt.Sprintf("\x1b[%d;%dH", cursorRow, cursorCol))
+		ab.WriteString(fmt.Sprintf("\x1b[%d;%dH", e.screenTop+cursorRow, cursorCol))
 		ab.WriteString(ansiShowCursor)
 	} else {
 		visRow, visCol := e.calculateCursorScreenPosition()
@@ -111,7 +117,7 @@ func (e *Editor) render() {
 			visCol = e.termWidth
 		}
 
-		ab.WriteString(fmt.Sprintf("\x1b[%d;%dH", visRow, visCol))
+		ab.WriteString(fmt.Sprintf("\x1b[%d;%dH", e.screenTop+visRow, visCol))
 		ab.WriteString(ansiShowCursor)
 	}
 
@@ -126,15 +132,26 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 	selStartL, selStartC, selEndL, selEndC := e.getSelectionCoordsSafe()
 
 	mcStart, mcEnd := e.getMultiCursorRange()
+	brackets := e.bracketHighlights()
+	matchCells := e.matchHighlights()
+	block := e.blockRect()
+	cursorCells := e.extraCursorCells()
+	thumbStart, thumbEnd := scrollbarThumb(e.buffer.LineCount(), e.viewportY, e.linesInView(textWidth), e.termHeight)
+	// TODO keywords are found once per line, not once per wrapped row of it
+	var todos []bool
+	todosLine := -1
 
 	for screenRow := 0; screenRow < e.termHeight; screenRow++ {
+		bar := e.scrollbarCell(screenRow >= thumbStart && screenRow < thumbEnd)
 		if fileLine >= e.buffer.LineCount() {
-			ab.WriteString(e.drawTildeRow())
+			ab.WriteString(strings.TrimSuffix(e.drawTildeRow(), "\r\n"))
+			ab.WriteString(bar)
+			ab.WriteString("\r\n")
 		} else {
 			if e.showLineNumbers {
 				lineNumStr := ""
 				if lineWrapOffset == 0 {
-					lineNumStr = fmt.Sprintf("%d", fileLine+1)
+					lineNumStr = fmt.Sprintf("%d", e.lineBase()+fileLine+1)
 				}
 				fmt.Fprintf(ab, "%s %*s %s", ansiInvert, e.lineNumWidth-2, lineNumStr, ansiReset)
 			}
@@ -143,12 +160,12 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 			lineVisWidth := 0
 			visCharPositions := make([]int, 0, len(runes)+1)
 			visCharPositions = append(visCharPositions, 0)
-			for _, r := range runes {
+			for i, r := range runes {
 				var rWidth int
 				if r == '\t' {
-					rWidth = e.config.TabSize - (lineVisWidth % e.config.TabSize)
+					rWidth = e.config.TabWidth - (lineVisWidth % e.config.TabWidth)
 				} else {
-					rWidth = runewidth.RuneWidth(r)
+					rWidth = runeWidthAt(runes, i)
 				}
 				lineVisWidth += rWidth
 				visCharPositions = append(visCharPositions, lineVisWidth)
@@ -181,6 +198,12 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 					}
 				}
 
+				if todosLine != fileLine {
+					todos, todosLine = e.todoHighlights(runes), fileLine
+				}
+				// Whitespace from here to the end of the line is trailing
+				trailingStart := len([]rune(strings.TrimRight(lineContent, " \t")))
+
 				hasMultiCursor := false
 				if fileLine != e.cursorY && fileLine >= mcStart && fileLine <= mcEnd {
 					hasMultiCursor = true
@@ -195,13 +218,29 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 					charStartVisPos := visCharPositions[i]
 					visibleStart := max(charStartVisPos, rowStartVisPos)
 
-					isUnderCursor := hasMultiCursor && i == e.cursorX
-					isSelected := e.isRuneSelected(fileLine, i, selStartL, selStartC, selEndL, selEndC)
+					isUnderCursor := hasMultiCursor && i == e.cursorX || cursorCells[[2]int{fileLine, i}]
+					isSelected := e.isRuneSelected(fileLine, i, selStartL, selStartC, selEndL, selEndC) ||
+						e.blockActive && block.contains(fileLine, charStartVisPos)
+
+					isTodo := todos != nil && todos[i]
+					isBracket := brackets[[2]int{fileLine, i}]
+					isMatch := matchCells[[2]int{fileLine, i}]
 
 					if isUnderCursor {
 						lineBuffer.WriteString(ansiInvert)
 					} else if isSelected {
 						lineBuffer.WriteString(ansiInvert)
+					} else if isBracket {
+						lineBuffer.WriteString(ansiBracket)
+					} else if isMatch {
+						lineBuffer.WriteString(ansiMatch)
+					} else if isTodo {
+						lineBuffer.WriteString(ansiTodo)
+					}
+
+					whitespaceStyle := ansiDim
+					if i >= trailingStart {
+						whitespaceStyle = ansiTrailing
 					}
 
 					if r == '\t' {
@@ -210,7 +249,7 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 						if e.showNonPrintable && spacesToRender > 0 {
 							// Draw arrow for first char of tab
 							if visibleStart == charStartVisPos {
-								lineBuffer.WriteString(ansiDim)
+								lineBuffer.WriteString(whitespaceStyle)
 								lineBuffer.WriteRune('→') // U+2192
 								lineBuffer.WriteString(ansiReset)
 								if isUnderCursor || isSelected {
@@ -232,7 +271,7 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 						}
 						renderedWidth += spacesToRender
 					} else if r == ' ' && e.showNonPrintable {
-						lineBuffer.WriteString(ansiDim)
+						lineBuffer.WriteString(whitespaceStyle)
 						lineBuffer.WriteRune('·') // U+00B7 Middle Dot
 						lineBuffer.WriteString(ansiReset)
 						if isUnderCursor || isSelected {
@@ -241,15 +280,17 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 						renderedWidth += 1
 					} else {
 						lineBuffer.WriteRune(r)
-						renderedWidth += 1
+						// Count columns, not runes: a zero-width mark must not
+						// take room from a tab that straddles the row's end.
+						renderedWidth += visCharPositions[i+1] - charStartVisPos
 					}
 
-					if isUnderCursor || isSelected {
+					if isUnderCursor || isSelected || isBracket || isMatch || isTodo {
 						lineBuffer.WriteString(ansiReset)
 					}
 				}
 
-				isEOLUnderCursor := hasMultiCursor && e.cursorX >= len(runes)
+				isEOLUnderCursor := hasMultiCursor && e.cursorX >= len(runes) || cursorCells[[2]int{fileLine, len(runes)}]
 				isEOLSelected := e.isRuneSelected(fileLine, len(runes), selStartL, selStartC, selEndL, selEndC)
 
 				if endChar == len(runes) && renderedWidth < textWidth {
@@ -277,9 +318,16 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 					}
 				}
 
+				used := renderedWidth
+				if endChar == len(runes) && renderedWidth < textWidth && (isEOLUnderCursor || isEOLSelected || e.showNonPrintable) {
+					used++ // The end-of-line cell drawn above
+				}
+				lineBuffer.WriteString(e.rulerGuide(used, rowStartVisPos, textWidth))
+
 				ab.Write(lineBuffer.Bytes())
 			}
 			ab.WriteString(ansiClearLine)
+			ab.WriteString(bar)
 			ab.WriteString("\r\n")
 		}
 		if fileLine < e.buffer.LineCount() {
@@ -297,6 +345,143 @@ func (e *Editor) drawRows(ab *bytes.Buffer) {
 	}
 }
 
+// scrollbarWidth is the number of columns the scrollbar takes from the text.
+func (e *Editor) scrollbarWidth() int {
+	if e.config.ShowScrollbar {
+		return 1
+	}
+	return 0
+}
+
+// scrollbarCell returns what draws one row of the scrollbar in the rightmost
+// column: a block for the thumb, a dim line for the track. It is empty when
+// the scrollbar is off.
+func (e *Editor) scrollbarCell(thumb bool) string {
+	if !e.config.ShowScrollbar {
+		return ""
+	}
+	if thumb {
+		return fmt.Sprintf("\x1b[%dG█", e.termWidth)
+	}
+	return fmt.Sprintf("\x1b[%dG%s│%s", e.termWidth, ansiDim, ansiReset)
+}
+
+// linesInView counts the lines from viewportY on that are at least partly
+// on screen.
+func (e *Editor) linesInView(textWidth int) int {
+	rows := e.termHeight + e.viewportWrapOffset
+	n := 0
+	for y := e.viewportY; y < e.buffer.LineCount() && rows > 0; y++ {
+		rows -= e.countVisualRows(y, textWidth)
+		n++
+	}
+	return n
+}
+
+// scrollbarThumb returns the rows, from start up to but not including end,
+// that the thumb covers on a scrollbar height rows tall, for a file of
+// lineCount lines with visible lines in view from line top. The thumb's size
+// is the share of the file in view, at least one row. Only the first and
+// last screens of the file put it against the ends of the track, so it is
+// clear whether there is more to scroll.
+func scrollbarThumb(lineCount, top, visible, height int) (start, end int) {
+	if height <= 0 || lineCount <= visible {
+		return 0, max(height, 0)
+	}
+	size := min(max(height*visible/lineCount, 1), height)
+	switch {
+	case top <= 0:
+		return 0, size
+	case top+visible >= lineCount:
+		return height - size, height
+	}
+	start = max(min(top*height/lineCount, height-size-1), 1)
+	start = min(start, height-size)
+	return start, start + size
+}
+
+// rulerGuide returns the padding and dimmed guide that draw the ruler on a
+// row showing the line from column rowStart, whose cells from used on are
+// empty. It is empty when the ruler is off, falls on another row of a wrapped
+// line, or would cover text.
+func (e *Editor) rulerGuide(used, rowStart, textWidth int) string {
+	col := e.config.RulerColumn - rowStart
+	if e.config.RulerColumn == 0 || col < used || col >= textWidth {
+		return ""
+	}
+	return strings.Repeat(" ", col-used) + ansiDim + "│" + ansiReset
+}
+
+// bracketHighlights returns the positions, as {line, column}, of the bracket
+// at the cursor and its partner, or nil when there is no pair to show. It is
+// worked out once per frame; a selection, which includes a find match, hides it.
+func (e *Editor) bracketHighlights() map[[2]int]bool {
+	if e.selectionActive {
+		return nil
+	}
+	x, _ := e.bracketAtCursor()
+	if x < 0 {
+		return nil
+	}
+	y, mx, ok := e.findMatchingBracket(e.cursorY, x)
+	if !ok {
+		return nil
+	}
+	return map[[2]int]bool{{e.cursorY, x}: true, {y, mx}: true}
+}
+
+// matchHighlights returns the positions, as {line, column}, of the runes of
+// the matches highlighted outside the find prompt on the lines that can be
+// on screen, or nil when there are none.
+func (e *Editor) matchHighlights() map[[2]int]bool {
+	if !e.highlightMatches {
+		return nil
+	}
+	cells := make(map[[2]int]bool)
+	for _, m := range e.findMatches {
+		if m.y < e.viewportY || m.y >= e.viewportY+e.termHeight {
+			continue
+		}
+		for x := m.x; x < m.x+m.length; x++ {
+			cells[[2]int{m.y, x}] = true
+		}
+	}
+	return cells
+}
+
+// todoHighlights marks the runes of a line that belong to a TODO keyword
+// matched as a whole word. It returns nil when the feature is off or the line
+// has no keywords.
+func (e *Editor) todoHighlights(runes []rune) []bool {
+	if !e.config.HighlightTodos {
+		return nil
+	}
+	var marks []bool
+	for i := 0; i < len(runes); i++ {
+		if !isWordChar(runes[i]) || (i > 0 && isWordChar(runes[i-1])) {
+			continue
+		}
+		end := i
+		for end < len(runes) && isWordChar(runes[end]) {
+			end++
+		}
+		word := string(runes[i:end])
+		for _, k := range e.config.TodoKeywords {
+			if word == k {
+				if marks == nil {
+					marks = make([]bool, len(runes))
+				}
+				for j := i; j < end; j++ {
+					marks[j] = true
+				}
+				break
+			}
+		}
+		i = end - 1
+	}
+	return marks
+}
+
 // Helper to calculate visible width of a char/tab split across rows
 func visibleWidth(start, end, rowStart, rowEnd int) int {
 	vStart := max(start, rowStart)
@@ -331,23 +516,103 @@ func (e *Editor) getSelectionCoords() (startY, startX, endY, endX int) {
 
 func (e *Editor) drawStatusBar(ab *bytes.Buffer) {
 	ab.WriteString(ansiInvert)
+	tokens := e.statusTokens()
+	leftFormat, rightFormat, _ := strings.Cut(e.config.StatusFormat, "{=}")
+	right := truncateToWidth(formatStatus(rightFormat, tokens), e.termWidth)
+	rightWidth := runewidth.StringWidth(right)
+	left := truncateToWidth(formatStatus(leftFormat, tokens), e.termWidth-rightWidth)
+	padding := max(e.termWidth-runewidth.StringWidth(left)-rightWidth, 0)
+	ab.WriteString(left)
+	ab.WriteString(strings.Repeat(" ", padding))
+	ab.WriteString(right)
+	ab.WriteString(ansiReset)
+	ab.WriteString("\r\n")
+}
+
+// statusTokens holds what each statusFormat token stands for right now.
+func (e *Editor) statusTokens() map[string]string {
 	name := e.filename
 	if name == "" {
 		name = "[No Name]"
 	}
-	left := fmt.Sprintf(" %.20s", name)
+	dirty := ""
 	if e.dirty {
-		left += " (modified)"
+		dirty = " (modified)"
 	}
-	versionInfo := " v" + version.GetVersion()
-	right := fmt.Sprintf("Ln %d, Col %d %s", e.cursorY+1, e.cursorX+1, versionInfo)
-	totalLen := len(left) + len(right)
-	padding := max(e.termWidth-totalLen, 0)
-	ab.WriteString(left)
-	ab.WriteString(strings.Repeat(" ", padding))
-	ab.WriteString(right)
-	ab.WriteString(ansiReset)
-	ab.WriteString("\r\n")
+	return map[string]string{
+		"filename": fmt.Sprintf("%.20s", name),
+		"buffers":  e.bufferListStatus(),
+		"dirty":    dirty,
+		"mode":     e.pagerStatus() + e.readOnlyStatus() + e.searchStatus(),
+		"line":     strconv.Itoa(e.lineBase() + e.cursorY + 1),
+		"col":      strconv.Itoa(e.cursorX + 1),
+		"lines":    e.lineCountStatus(),
+		"eol":      e.lineEndingName(),
+		"encoding": e.encodingStatus(),
+		"version":  version.GetVersion(),
+	}
+}
+
+// lineCountStatus is the {lines} token. The pager does not know how many
+// lines the file has until it reaches the end, so before that it shows how
+// far the loaded window goes with a "+" after it.
+func (e *Editor) lineCountStatus() string {
+	lines := strconv.Itoa(e.lineBase() + e.buffer.LineCount())
+	if e.pager != nil && !e.pager.atEOF() {
+		lines += "+"
+	}
+	return lines
+}
+
+// formatStatus replaces each {name} in format with tokens[name]. A name
+// that is not in tokens, or a brace that is never closed, is left as written.
+func formatStatus(format string, tokens map[string]string) string {
+	var sb strings.Builder
+	for {
+		open := strings.IndexByte(format, '{')
+		if open < 0 {
+			break
+		}
+		sb.WriteString(format[:open])
+		format = format[open:]
+		end := strings.IndexByte(format, '}')
+		if end < 0 {
+			break
+		}
+		if value, ok := tokens[format[1:end]]; ok {
+			sb.WriteString(value)
+			format = format[end+1:]
+		} else {
+			sb.WriteByte('{')
+			format = format[1:]
+		}
+	}
+	sb.WriteString(format)
+	return sb.String()
+}
+
+// truncateToWidth cuts s to at most width screen columns.
+func truncateToWidth(s string, width int) string {
+	used := 0
+	for i, r := range s {
+		used += runewidth.RuneWidth(r)
+		if used > width {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// searchStatus is the status bar marker for regex search, including why the
+// query does not compile.
+func (e *Editor) searchStatus() string {
+	if !e.isFinding || !e.searchRegex {
+		return ""
+	}
+	if e.searchErr != nil {
+		return fmt.Sprintf(" [regex: %v]", e.searchErr)
+	}
+	return " [regex]"
 }
 
 func (e *Editor) drawCommandBar(ab *bytes.Buffer) {
@@ -357,7 +622,7 @@ func (e *Editor) drawCommandBar(ab *bytes.Buffer) {
 		if e.promptFocus == 0 {
 			findLabel = ansiInvert + findLabel + ansiReset
 		}
-		hints := " [TAB Switch | ^R Repl | ^A All | ESC Cancel]"
+		hints := " [TAB Switch | ^R Repl | ^A All | ^E Regex | ESC Cancel]"
 		countStr := ""
 		if e.promptBuffer != "" {
 			if len(e.findMatches) == 0 {
@@ -365,7 +630,7 @@ func (e *Editor) drawCommandBar(ab *bytes.Buffer) {
 			} else if e.findCurrentMatch == -1 {
 				countStr = fmt.Sprintf(" (%d)", len(e.findMatches))
 			} else {
-				countStr = fmt.Sprintf(" (%d/%d)", e.findCurrentMatch+1, len(e.findMatches))
+				countStr = fmt.Sprintf(" %s(%d/%d)", e.findWrapNote(), e.findCurrentMatch+1, len(e.findMatches))
 			}
 		}
 		prefixLen := runewidth.StringWidth("Find: ") + runewidth.StringWidth(e.promptBuffer) + runewidth.StringWidth(countStr)
@@ -378,6 +643,9 @@ func (e *Editor) drawCommandBar(ab *bytes.Buffer) {
 		ab.WriteString(hints) // Draw hints aligned to right
 	} else {
 		cmdStr := " ^S Save | ^Q Quit | ^U Undo | ^Y Redo | ^X Cut | ^C Copy | ^V Paste | ^T Go to | ^F Find | ^H Replace | ^K Toggle case | ^O Non-printable"
+		if e.isFinding {
+			cmdStr = " ^N Next | ^P Prev | ^E Regex | TAB/^H Replace | ESC Cancel"
+		}
 		if len(cmdStr) > e.termWidth {
 			cmdStr = cmdStr[:e.termWidth]
 		}
@@ -410,25 +678,48 @@ func (e *Editor) drawMessageBar(ab *bytes.Buffer) {
 			} else if e.findCurrentMatch == -1 {
 				countStr = fmt.Sprintf("(%d matches)", len(e.findMatches))
 			} else {
-				countStr = fmt.Sprintf("(%d of %d)", e.findCurrentMatch+1, len(e.findMatches))
+				countStr = fmt.Sprintf("%s(%d of %d)", e.findWrapNote(), e.findCurrentMatch+1, len(e.findMatches))
 			}
 		}
 		padding := max(0, e.termWidth-runewidth.StringWidth(prompt)-runewidth.StringWidth(countStr))
 		ab.WriteString(prompt + strings.Repeat(" ", padding) + countStr)
-	} else if e.isQuitting || e.isSaveAs || e.isGotoLine {
+	} else if e.isQuitting || e.isConfirmingReload || e.isConfirmingOverwrite || e.isChoosingLineEnding || e.isSaveAs || e.isGotoLine || e.isRunCommand || e.isCommandMode {
 		ab.WriteString(e.statusMessage)
-		if e.isSaveAs || e.isGotoLine {
+		if e.isSaveAs || e.isGotoLine || e.isRunCommand || e.isCommandMode {
 			ab.WriteString(e.promptBuffer)
 		}
+		if e.isCommandMode {
+			ab.WriteString(e.paletteHint())
+		}
 	} else if time.Since(e.statusTime) < 5*time.Second {
 		ab.WriteString(e.statusMessage)
 	}
 }
 
+// drawTooSmall replaces the editor's part of the screen with a single notice,
+// cut to the terminal width, when the terminal is too small to lay out the
+// editor.
+func (e *Editor) drawTooSmall(ab *bytes.Buffer) {
+	ab.WriteString(ansiHideCursor)
+	fmt.Fprintf(ab, "\x1b[%d;1H%s", e.screenTop+1, ansiClearToEnd)
+	msg := []rune("terminal too small")
+	if len(msg) > e.termWidth {
+		msg = msg[:e.termWidth]
+	}
+	ab.WriteString(string(msg))
+}
+
 func (e *Editor) drawTildeRow() string {
 	var sb strings.Builder
 	if e.showLineNumbers {
-		fmt.Fprintf(&sb, "%s %*s %s", ansiInvert, e.lineNumWidth-2, "~", ansiReset)
+		// The gutter is drawn even without a marker so its width stays aligned.
+		marker := ""
+		if e.config.ShowEndOfBuffer {
+			marker = e.config.EndOfBufferChar
+		}
+		// Pad by display width rather than bytes, which %*s would count.
+		pad := max(e.lineNumWidth-2-runewidth.StringWidth(marker), 0)
+		fmt.Fprintf(&sb, "%s %s%s %s", ansiInvert, strings.Repeat(" ", pad), marker, ansiReset)
 	}
 	sb.WriteString(ansiClearLine)
 	sb.WriteString("\r\n")
@@ -487,6 +778,9 @@ func (e *Editor) calculateCursorScreenPosition() (int, int) {
 	} else {
 		screenRow = 1
 	}
+	if screenRow < 1 {
+		screenRow = 1
+	}
 	visColOnLine := cursorVisX % textWidth
 	visCol := visColOnLine + e.lineNumWidth + 1
 	return screenRow, visCol
@@ -1,44 +1,31 @@
 package editor
 
 func (e *Editor) insertString(s string) {
-	runes := []rune(s)
-	if len(runes) == 0 {
+	if s == "" {
 		return
 	}
-	entries := make([]opEntry, 0, len(runes))
 	if !e.undoGrouping {
 		e.beginUndoGroup()
 		defer e.endUndoGroup()
 	}
-	for _, r := range runes {
-		insertLine := e.cursorY
-		insertCol := e.cursorX
-		if r == '\n' {
-			if err := e.buffer.Insert(e.cursorY, e.cursorX, '\n'); err != nil {
-				e.setStatusMessage("Replace error: %v", err)
-				return
-			}
-			e.cursorY++
-			e.cursorX = 0
-		} else {
-			if err := e.buffer.Insert(e.cursorY, e.cursorX, r); err != nil {
-				e.setStatusMessage("Replace error: %v", err)
-				return
-			}
-			e.cursorX++
-		}
-		delLine := e.cursorY
-		delCol := e.cursorX
-		entries = append(entries, opEntry{
-			insertLine: insertLine, insertCol: insertCol,
-			delLine: delLine, delCol: delCol,
-			r: r,
-		})
+	if err := e.insertTextAtCursor(s); err != nil {
+		e.setStatusMessage("Replace error: %v", err)
+		return
 	}
-	e.pushUndoInsertBlock(entries)
 	e.dirty = true
 }
 
+// insertTextAtCursor inserts text at the cursor with a single buffer call,
+// records it as one undo action and leaves the cursor after it.
+func (e *Editor) insertTextAtCursor(text string) error {
+	if err := e.buffer.InsertString(e.cursorY, e.cursorX, text); err != nil {
+		return err
+	}
+	e.pushUndoInsertText(e.cursorY, e.cursorX, text)
+	e.cursorY, e.cursorX = textEnd(e.cursorY, e.cursorX, text)
+	return nil
+}
+
 func (e *Editor) replaceNext() {
 	if e.findCurrentMatch == -1 || len(e.findMatches) == 0 {
 		e.findNext()
@@ -46,36 +33,61 @@ func (e *Editor) replaceNext() {
 	}
 	e.beginUndoGroup()
 	match := e.findMatches[e.findCurrentMatch]
-	matchLen := len([]rune(e.promptBuffer))
+	replacement := e.replacementFor(match)
 	e.selectionActive = true
 	e.selectionAnchorY = match.y
 	e.selectionAnchorX = match.x
 	e.cursorY = match.y
-	e.cursorX = match.x + matchLen
+	e.cursorX = match.x + match.length
 	e.deleteSelectedText()
-	e.insertString(e.replaceBuffer)
+	e.insertString(replacement)
 	e.endUndoGroup()
 	e.findInitial()
 }
 
+// replacementFor returns the text that replaces match. In regex mode, $1 or
+// ${name} in the replace prompt expand to the match's capture groups.
+func (e *Editor) replacementFor(match findResult) string {
+	if e.searchRe == nil {
+		return e.replaceBuffer
+	}
+	line := e.buffer.GetLine(match.y)
+	start := len(string([]rune(line)[:match.x]))
+	for _, loc := range e.searchRe.FindAllStringSubmatchIndex(line, -1) {
+		if loc[0] == start {
+			return string(e.searchRe.ExpandString(nil, e.replaceBuffer, line, loc))
+		}
+	}
+	return e.replaceBuffer
+}
+
+// replaceAll replaces every match that does not overlap an earlier one, like
+// strings.ReplaceAll: "aa" in "aaa" is replaced once. The replacements are
+// worked out before the buffer changes, then applied from the last match back
+// so the positions of the ones still to do stay valid.
 func (e *Editor) replaceAll() {
 	e.findAllMatches(e.promptBuffer)
-	if len(e.findMatches) == 0 {
+	matches := nonOverlapping(e.findMatches)
+	if len(matches) == 0 {
 		e.setStatusMessage("No matches found to replace.")
 		return
 	}
-	numReplaced := len(e.findMatches)
+	numReplaced := len(matches)
+	replacements := make([]string, len(matches))
+	for i, match := range matches {
+		replacements[i] = e.replacementFor(match)
+	}
 	e.beginUndoGroup()
-	for i := len(e.findMatches) - 1; i >= 0; i-- {
-		match := e.findMatches[i]
-		matchLen := len([]rune(e.promptBuffer))
+	for i := len(matches) - 1; i >= 0; i-- {
+		match := matches[i]
+		replacement := replacements[i]
 		e.selectionActive = true
 		e.selectionAnchorY = match.y
 		e.selectionAnchorX = match.x
 		e.cursorY = match.y
-		e.cursorX = match.x + matchLen
+		e.cursorX = match.x + match.length
 		e.deleteSelectedText()
-		e.insertString(e.replaceBuffer)
+		e.insertString(replacement)
 	}
 	e.endUndoGroup()
 	e.isReplacing = false
@@ -87,3 +99,16 @@ func (e *Editor) replaceAll() {
 	e.lastSearchQuery = e.promptBuffer
 	e.setStatusMessage("Replaced %d instance(s).", numReplaced)
 }
+
+// nonOverlapping drops the matches that start inside the match before them.
+// Matches come sorted by position, and literal search reports every start.
+func nonOverlapping(matches []findResult) []findResult {
+	var kept []findResult
+	for _, m := range matches {
+		if n := len(kept); n > 0 && kept[n-1].y == m.y && m.x < kept[n-1].x+kept[n-1].length {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
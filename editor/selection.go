@@ -13,33 +13,20 @@ func (e *Editor) deleteSelectedText() {
 	e.flushTypingAndBackspaceIfNeeded()
 	entries := make([]opEntry, 0)
 	if startY == endY {
-		line := e.buffer.GetLine(startY)
-		runes := []rune(line)
-		actualEndX := min(endX, len(runes))
-		for i := startX; i < actualEndX; i++ {
-			entries = append(entries, opEntry{
-				insertLine: startY,
-				insertCol:  i,
-				r:          runes[i],
-			})
-		}
-		for i := actualEndX - 1; i >= startX; i-- {
-			if err := e.buffer.Delete(startY, i+1); err != nil {
-				e.setStatusMessage("Delete error: %v", err)
-				return
-			}
+		runes := []rune(e.buffer.GetLine(startY))
+		endX = min(endX, len(runes))
+		for i := startX; i < endX; i++ {
+			entries = append(entries, opEntry{insertLine: startY, insertCol: i, r: runes[i]})
 		}
 	} else {
-		firstLine := e.buffer.GetLine(startY)
-		firstRunes := []rune(firstLine)
+		firstRunes := []rune(e.buffer.GetLine(startY))
 		for i := startX; i < len(firstRunes); i++ {
 			entries = append(entries, opEntry{insertLine: startY, insertCol: i, r: firstRunes[i]})
 		}
 		entries = append(entries, opEntry{insertLine: startY, insertCol: len(firstRunes), r: '\n'})
 		lineOffset := 1
 		for y := startY + 1; y < endY; y++ {
-			lineContent := e.buffer.GetLine(y)
-			runes := []rune(lineContent)
+			runes := []rune(e.buffer.GetLine(y))
 			actualInsertLine := startY + lineOffset
 			for i := 0; i < len(runes); i++ {
 				entries = append(entries, opEntry{insertLine: actualInsertLine, insertCol: i, r: runes[i]})
@@ -47,48 +34,19 @@ func (e *Editor) deleteSelectedText() {
 			entries = append(entries, opEntry{insertLine: actualInsertLine, insertCol: len(runes), r: '\n'})
 			lineOffset++
 		}
-		lastLine := e.buffer.GetLine(endY)
-		lastRunes := []rune(lastLine)
-		actualEndX := min(endX, len(lastRunes))
+		lastRunes := []rune(e.buffer.GetLine(endY))
+		endX = min(endX, len(lastRunes))
 		actualInsertLine := startY + lineOffset
-		for i := 0; i < actualEndX; i++ {
+		for i := 0; i < endX; i++ {
 			entries = append(entries, opEntry{insertLine: actualInsertLine, insertCol: i, r: lastRunes[i]})
 		}
-		for i := actualEndX - 1; i >= 0; i-- {
-			if err := e.buffer.Delete(endY, i+1); err != nil {
-				e.setStatusMessage("Delete error: %v", err)
-				return
-			}
-		}
-		for y := endY - 1; y > startY; y-- {
-			// --- FIX: Delete content FIRST, then delete the newline ---
-			// Previously, deleting the newline first merged the next line (which we want to keep)
-			// into the current line, and then we deleted the content, effectively erasing the next line.
+	}
 
-			lineRunes := []rune(e.buffer.GetLine(y))
-			for i := len(lineRunes) - 1; i >= 0; i-- {
-				if err := e.buffer.Delete(y, i+1); err != nil {
-					e.setStatusMessage("Delete error: %v", err)
-					return
-				}
-			}
-			// Now delete the newline connecting this (now empty) line to the next
-			if err := e.buffer.Delete(y+1, 0); err != nil {
-				e.setStatusMessage("Delete error: %v", err)
-				return
-			}
-			// --- END FIX ---
-		}
-		if err := e.buffer.Delete(startY+1, 0); err != nil {
-			e.setStatusMessage("Delete error: %v", err)
-			return
-		}
-		for i := len(firstRunes) - 1; i >= startX; i-- {
-			if err := e.buffer.Delete(startY, i+1); err != nil {
-				e.setStatusMessage("Delete error: %v", err)
-				return
-			}
-		}
+	// The entries above only describe the text for undo; the buffer drops
+	// the whole span in one call.
+	if err := e.buffer.DeleteRange(startY, startX, endY, endX); err != nil {
+		e.setStatusMessage("Delete error: %v", err)
+		return
 	}
 
 	e.pushUndoDeleteBlock(entries, false)
@@ -99,16 +57,12 @@ func (e *Editor) deleteSelectedText() {
 }
 
 func (e *Editor) pushUndoDeleteIfExternalGrouping(line, col int, r rune) {
-	action := undoAction{
+	e.recordUndo(undoAction{
 		isInsert: false,
 		ops: []opEntry{
 			{insertLine: line, insertCol: col, r: r},
 		},
-	}
-	if e.undoGrouping {
-		action.groupID = e.currentGroupID
-	}
-	e.undoStack = append(e.undoStack, action)
+	})
 }
 
 func (e *Editor) getSelectedText() string {
@@ -0,0 +1,75 @@
+package editor
+
+import "unicode/utf8"
+
+// docStats counts lines, runes and words in text written to it, so the whole
+// buffer can be measured through Buffer.WriteTo without building one string.
+// Words are counted the way word movement sees them: a run of isWordChar runes.
+// A line break counts as one character, CRLF included.
+type docStats struct {
+	lines, chars, words int
+	inWord, afterCR     bool
+	pending             []byte // A rune split across two writes
+}
+
+func newDocStats() *docStats {
+	return &docStats{lines: 1}
+}
+
+func (s *docStats) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(s.pending) > 0 {
+		p = append(s.pending, p...)
+		s.pending = nil
+	}
+	for len(p) > 0 {
+		if !utf8.FullRune(p) {
+			s.pending = append([]byte(nil), p...)
+			break
+		}
+		r, size := utf8.DecodeRune(p)
+		p = p[size:]
+		s.add(r)
+	}
+	return n, nil
+}
+
+// WriteString counts the runes in text, for a selection already in hand.
+func (s *docStats) WriteString(text string) {
+	for _, r := range text {
+		s.add(r)
+	}
+}
+
+func (s *docStats) add(r rune) {
+	s.chars++
+	if r == '\n' {
+		s.lines++
+		if s.afterCR {
+			s.chars--
+		}
+	}
+	s.afterCR = r == '\r'
+	word := isWordChar(r)
+	if word && !s.inWord {
+		s.words++
+	}
+	s.inWord = word
+}
+
+// showDocStats reports the line, word and character counts of the selection,
+// or of the whole buffer when nothing is selected, in the status bar.
+func (e *Editor) showDocStats() {
+	stats := newDocStats()
+	scope := "Document"
+	if e.pager != nil {
+		scope = "Loaded window" // The rest of the file is not in memory
+	}
+	if e.selectionActive {
+		scope = "Selection"
+		stats.WriteString(e.getSelectedText())
+	} else {
+		e.buffer.WriteTo(stats)
+	}
+	e.setStatusMessage("%s: %d lines, %d words, %d characters", scope, stats.lines, stats.words, stats.chars)
+}
@@ -1,6 +1,7 @@
 package editor
 
 import (
+	"slices"
 	"strings"
 	"unicode"
 )
@@ -16,6 +17,14 @@ const (
 // unindentLine removes indentation from the start of the line(s).
 // It handles multi-cursor ranges.
 func (e *Editor) unindentLine() {
+	// Handle potential multi-cursor range
+	startLine, endLine := e.getMultiCursorRange()
+	e.unindentLines(startLine, endLine)
+}
+
+// unindentLines takes one indent level, a tab or up to IndentSize spaces, off
+// the start of each line from startLine to endLine, as one undo group.
+func (e *Editor) unindentLines(startLine, endLine int) {
 	if e.buffer.LineCount() == 0 {
 		return
 	}
@@ -23,9 +32,6 @@ func (e *Editor) unindentLine() {
 	e.beginUndoGroup()
 	defer e.endUndoGroup()
 
-	// Handle potential multi-cursor range
-	startLine, endLine := e.getMultiCursorRange()
-
 	// Keep track if we actually changed anything
 	changed := false
 
@@ -46,8 +52,8 @@ func (e *Editor) unindentLine() {
 		if runes[0] == '\t' {
 			removeCount = 1
 		} else if runes[0] == ' ' {
-			// Count spaces up to TabSize
-			for j := 0; j < e.config.TabSize && j < len(runes); j++ {
+			// Count spaces up to IndentSize
+			for j := 0; j < e.config.IndentSize && j < len(runes); j++ {
 				if runes[j] == ' ' {
 					removeCount++
 				} else {
@@ -72,12 +78,7 @@ func (e *Editor) unindentLine() {
 			}
 
 			// Adjust cursor if this is the main cursor line
-			if i == e.cursorY {
-				e.cursorX -= removeCount
-				if e.cursorX < 0 {
-					e.cursorX = 0
-				}
-			}
+			e.shiftColumns(i, -removeCount)
 		}
 	}
 
@@ -86,6 +87,455 @@ func (e *Editor) unindentLine() {
 	}
 }
 
+// selectedLines returns the lines a selection spanning more than one line
+// covers. A selection ending at the start of a line leaves that line out, as
+// it does when whole lines are selected with Shift+Down. ok is false without
+// such a selection.
+func (e *Editor) selectedLines() (startLine, endLine int, ok bool) {
+	if !e.selectionActive {
+		return 0, 0, false
+	}
+	startY, _, endY, endX := e.getSelectionCoords()
+	if startY == endY {
+		return 0, 0, false
+	}
+	if endX == 0 {
+		endY--
+	}
+	return startY, endY, true
+}
+
+// indentSelection (Tab with a multi-line selection) adds one indent unit to
+// the start of every selected line that is not empty, as one undo group. The
+// selection stays, so Tab can be pressed again.
+func (e *Editor) indentSelection() {
+	startLine, endLine, ok := e.selectedLines()
+	if !ok {
+		return
+	}
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+
+	unit := []rune(e.indentUnit())
+	for y := startLine; y <= endLine; y++ {
+		if e.buffer.GetLine(y) == "" {
+			continue
+		}
+		entries := make([]opEntry, 0, len(unit))
+		for i, r := range unit {
+			if err := e.buffer.Insert(y, i, r); err != nil {
+				e.setStatusMessage("Indent error: %v", err)
+				return
+			}
+			entries = append(entries, opEntry{insertLine: y, insertCol: i, delLine: y, delCol: i + 1, r: r})
+		}
+		e.pushUndoInsertBlock(entries)
+		e.shiftColumns(y, len(unit))
+		e.dirty = true
+	}
+}
+
+// unindentSelection (Shift+Tab with a multi-line selection) takes one indent
+// level off every selected line, keeping the selection.
+func (e *Editor) unindentSelection() {
+	if startLine, endLine, ok := e.selectedLines(); ok {
+		e.unindentLines(startLine, endLine)
+	}
+}
+
+// shiftColumns moves the cursor, and the selection anchor while there is a
+// selection, n runes along line y after text was added to (n > 0) or removed
+// from (n < 0) its start. A position at the start of the line stays there, so
+// a selection of whole lines still takes in their new indentation.
+func (e *Editor) shiftColumns(y, n int) {
+	shift := func(x int) int {
+		if x == 0 {
+			return 0
+		}
+		return max(x+n, 0)
+	}
+	if e.cursorY == y {
+		e.cursorX = shift(e.cursorX)
+	}
+	if e.selectionActive && e.selectionAnchorY == y {
+		e.selectionAnchorX = shift(e.selectionAnchorX)
+	}
+}
+
+// convertLineEndings rewrites every line terminator in the buffer to CRLF (crlf)
+// or LF as one undo group, and makes that the ending used on save.
+// It returns the number of lines whose ending changed.
+func (e *Editor) convertLineEndings(crlf bool) int {
+	e.flushEditGroups()
+
+	// GetLine hides the '\r' of a CRLF pair, so look at the raw content.
+	var raw strings.Builder
+	e.buffer.WriteTo(&raw)
+	lines := strings.Split(raw.String(), "\n")
+
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+
+	changed := 0
+	// The last element is never followed by '\n', so it has no ending to convert.
+	for i := 0; i < len(lines)-1; i++ {
+		hasCR := strings.HasSuffix(lines[i], "\r")
+		if hasCR == crlf {
+			continue
+		}
+		// Column lineLen sits right before the '\r' (if any) that ends the line.
+		lineLen := len([]rune(e.buffer.GetLine(i)))
+		if crlf {
+			if err := e.buffer.Insert(i, lineLen, '\r'); err != nil {
+				e.setStatusMessage("Convert error: %v", err)
+				return changed
+			}
+			e.pushUndoInsertBlock([]opEntry{{
+				insertLine: i, insertCol: lineLen,
+				delLine: i, delCol: lineLen + 1,
+				r: '\r',
+			}})
+		} else {
+			e.pushUndoDeleteIfExternalGrouping(i, lineLen, '\r')
+			if err := e.buffer.Delete(i, lineLen+1); err != nil {
+				e.setStatusMessage("Convert error: %v", err)
+				return changed
+			}
+		}
+		changed++
+	}
+
+	if crlf {
+		e.lineEnding = "\r\n"
+	} else {
+		e.lineEnding = "\n"
+	}
+	if changed > 0 {
+		e.dirty = true
+	}
+	return changed
+}
+
+// handleConvertIndentation runs convertIndentation and reports the result.
+func (e *Editor) handleConvertIndentation(toTabs bool) {
+	what := "Tabs to spaces"
+	if toTabs {
+		what = "Spaces to tabs"
+	}
+	n := e.convertIndentation(toTabs)
+	e.setStatusMessage("%s: %d line(s) changed", what, n)
+}
+
+// convertIndentation rewrites the leading indentation of the selected lines,
+// or of every line without a selection, as one undo group. toTabs collapses
+// each run of TabWidth spaces into a tab; otherwise each tab becomes TabWidth
+// spaces. Tabs and spaces after the first other character are left alone.
+// It returns the number of lines changed.
+func (e *Editor) convertIndentation(toTabs bool) int {
+	e.flushEditGroups()
+
+	startY, endY := 0, e.buffer.LineCount()-1
+	if e.selectionActive {
+		startY, _, endY, _ = e.getSelectionCoords()
+	}
+
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+
+	changed := 0
+	for y := startY; y <= endY; y++ {
+		runes := []rune(e.buffer.GetLine(y))
+		indentLen := 0
+		for indentLen < len(runes) && (runes[indentLen] == ' ' || runes[indentLen] == '\t') {
+			indentLen++
+		}
+		oldIndent := runes[:indentLen]
+		newIndent := e.convertIndent(oldIndent, toTabs)
+		if string(newIndent) == string(oldIndent) {
+			continue
+		}
+
+		delOps := make([]opEntry, len(oldIndent))
+		for x, r := range oldIndent {
+			delOps[x] = opEntry{insertLine: y, insertCol: x, r: r}
+		}
+		if err := e.buffer.DeleteRange(y, 0, y, indentLen); err != nil {
+			e.setStatusMessage("Convert error: %v", err)
+			return changed
+		}
+		e.pushUndoDeleteBlock(delOps, false)
+
+		insOps := make([]opEntry, len(newIndent))
+		for x, r := range newIndent {
+			insOps[x] = opEntry{insertLine: y, insertCol: x, delLine: y, delCol: x + 1, r: r}
+		}
+		if err := e.buffer.InsertString(y, 0, string(newIndent)); err != nil {
+			e.setStatusMessage("Convert error: %v", err)
+			return changed
+		}
+		e.pushUndoInsertBlock(insOps)
+
+		// Keep the cursor and selection anchor on the same character.
+		if y == e.cursorY {
+			e.cursorX = e.convertedColumn(runes, e.cursorX, toTabs)
+		}
+		if y == e.selectionAnchorY {
+			e.selectionAnchorX = e.convertedColumn(runes, e.selectionAnchorX, toTabs)
+		}
+		changed++
+	}
+
+	if changed > 0 {
+		e.dirty = true
+	}
+	return changed
+}
+
+// convertIndent converts one line's leading whitespace for convertIndentation.
+func (e *Editor) convertIndent(indent []rune, toTabs bool) []rune {
+	width := max(e.config.TabWidth, 1)
+	out := make([]rune, 0, len(indent)*width)
+	if !toTabs {
+		for _, r := range indent {
+			if r == '\t' {
+				out = append(out, []rune(strings.Repeat(" ", width))...)
+			} else {
+				out = append(out, r)
+			}
+		}
+		return out
+	}
+	spaces := 0
+	for _, r := range indent {
+		if r == ' ' {
+			spaces++
+			if spaces == width {
+				out = append(out, '\t')
+				spaces = 0
+			}
+			continue
+		}
+		out = append(out, []rune(strings.Repeat(" ", spaces))...)
+		spaces = 0
+		out = append(out, r)
+	}
+	return append(out, []rune(strings.Repeat(" ", spaces))...)
+}
+
+// lineCommandRange is the lines sort_lines and trim_whitespace act on: those
+// of a selection spanning several lines, or the whole buffer. The empty line
+// after a final newline is left out, so sorting does not move it to the top.
+func (e *Editor) lineCommandRange() (startY, endY int) {
+	if startY, endY, ok := e.selectedLines(); ok {
+		return startY, endY
+	}
+	endY = e.buffer.LineCount() - 1
+	if endY > 0 && e.buffer.GetLine(endY) == "" {
+		endY--
+	}
+	return 0, endY
+}
+
+// sortLines sorts the selected lines, or every line, in byte order as one
+// undo group. Lines keep their endings; only their text moves.
+func (e *Editor) sortLines() {
+	e.flushEditGroups()
+	startY, endY := e.lineCommandRange()
+	lines := make([]string, 0, endY-startY+1)
+	for y := startY; y <= endY; y++ {
+		lines = append(lines, e.buffer.GetLine(y))
+	}
+	sorted := slices.Clone(lines)
+	slices.Sort(sorted)
+
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	for i, line := range sorted {
+		if line == lines[i] {
+			continue
+		}
+		if err := e.replaceLineText(startY+i, line); err != nil {
+			e.setStatusMessage("Sort error: %v", err)
+			return
+		}
+		e.dirty = true
+	}
+	e.clampCursorAndAnchor()
+	e.setStatusMessage("Sorted %d line(s)", len(lines))
+}
+
+// trimTrailingWhitespace removes the spaces and tabs at the end of the
+// selected lines, or of every line, as one undo group.
+func (e *Editor) trimTrailingWhitespace() {
+	e.flushEditGroups()
+	startY, endY := e.lineCommandRange()
+
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	changed := 0
+	for y := startY; y <= endY; y++ {
+		runes := []rune(e.buffer.GetLine(y))
+		keep := len([]rune(strings.TrimRight(string(runes), " \t")))
+		if keep == len(runes) {
+			continue
+		}
+		ops := make([]opEntry, 0, len(runes)-keep)
+		for x := keep; x < len(runes); x++ {
+			ops = append(ops, opEntry{insertLine: y, insertCol: x, r: runes[x]})
+		}
+		if err := e.buffer.DeleteRange(y, keep, y, len(runes)); err != nil {
+			e.setStatusMessage("Trim error: %v", err)
+			return
+		}
+		e.pushUndoDeleteBlock(ops, false)
+		e.dirty = true
+		changed++
+	}
+	e.clampCursorAndAnchor()
+	e.setStatusMessage("Trimmed trailing whitespace: %d line(s) changed", changed)
+}
+
+// replaceLineText replaces the text of line y with text, recording the
+// deletion and the insertion for undo.
+func (e *Editor) replaceLineText(y int, text string) error {
+	old := []rune(e.buffer.GetLine(y))
+	if len(old) > 0 {
+		ops := make([]opEntry, len(old))
+		for x, r := range old {
+			ops[x] = opEntry{insertLine: y, insertCol: x, r: r}
+		}
+		if err := e.buffer.DeleteRange(y, 0, y, len(old)); err != nil {
+			return err
+		}
+		e.pushUndoDeleteBlock(ops, false)
+	}
+	if text == "" {
+		return nil
+	}
+	runes := []rune(text)
+	ops := make([]opEntry, len(runes))
+	for x, r := range runes {
+		ops[x] = opEntry{insertLine: y, insertCol: x, delLine: y, delCol: x + 1, r: r}
+	}
+	if err := e.buffer.InsertString(y, 0, text); err != nil {
+		return err
+	}
+	e.pushUndoInsertBlock(ops)
+	return nil
+}
+
+// clampCursorAndAnchor keeps the cursor and the selection anchor inside
+// their lines after those lines got shorter.
+func (e *Editor) clampCursorAndAnchor() {
+	e.clampCursorX()
+	e.selectionAnchorX = min(e.selectionAnchorX, len([]rune(e.buffer.GetLine(e.selectionAnchorY))))
+}
+
+// convertedColumn maps column x of line, before its indentation was
+// converted, to the column of the same character afterwards. A column inside
+// the indentation maps to the converted width of the whitespace before it.
+func (e *Editor) convertedColumn(line []rune, x int, toTabs bool) int {
+	indentLen := 0
+	for indentLen < len(line) && (line[indentLen] == ' ' || line[indentLen] == '\t') {
+		indentLen++
+	}
+	if x >= indentLen {
+		return x - indentLen + len(e.convertIndent(line[:indentLen], toTabs))
+	}
+	return len(e.convertIndent(line[:x], toTabs))
+}
+
+// toggleComment comments out the current line, the selected lines or the
+// lines under a block cursor by inserting CommentPrefix after each line's
+// indentation. If every non-blank line is already commented, it removes the
+// prefix instead. The whole change is one undo step.
+func (e *Editor) toggleComment() {
+	e.flushEditGroups()
+	startY, endY := e.getMultiCursorRange()
+	if e.selectionActive {
+		var endX int
+		startY, _, endY, endX = e.getSelectionCoords()
+		if endX == 0 && endY > startY {
+			endY-- // A selection ending at column 0 does not include that line
+		}
+	}
+
+	prefix := []rune(e.config.CommentPrefix)
+	// "//x" counts as commented even though the prefix is "// ".
+	bare := []rune(strings.TrimRight(e.config.CommentPrefix, " \t"))
+
+	type commentLine struct {
+		y, indent int
+		runes     []rune
+	}
+	var lines []commentLine
+	allCommented := true
+	for y := startY; y <= endY && y < e.buffer.LineCount(); y++ {
+		runes := []rune(e.buffer.GetLine(y))
+		indent := 0
+		for indent < len(runes) && (runes[indent] == ' ' || runes[indent] == '\t') {
+			indent++
+		}
+		if indent == len(runes) {
+			continue // Blank lines are left alone
+		}
+		lines = append(lines, commentLine{y, indent, runes})
+		if !hasRunePrefix(runes[indent:], bare) {
+			allCommented = false
+		}
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	e.beginUndoGroup()
+	defer e.endUndoGroup()
+	for _, l := range lines {
+		var delta int
+		if allCommented {
+			remove := bare
+			if hasRunePrefix(l.runes[l.indent:], prefix) {
+				remove = prefix
+			}
+			ops := make([]opEntry, len(remove))
+			for i, r := range remove {
+				ops[i] = opEntry{insertLine: l.y, insertCol: l.indent + i, r: r}
+			}
+			if err := e.buffer.DeleteRange(l.y, l.indent, l.y, l.indent+len(remove)); err != nil {
+				e.setStatusMessage("Comment error: %v", err)
+				return
+			}
+			e.pushUndoDeleteBlock(ops, false)
+			delta = -len(remove)
+		} else {
+			ops := make([]opEntry, len(prefix))
+			for i, r := range prefix {
+				ops[i] = opEntry{insertLine: l.y, insertCol: l.indent + i, delLine: l.y, delCol: l.indent + i + 1, r: r}
+			}
+			if err := e.buffer.InsertString(l.y, l.indent, string(prefix)); err != nil {
+				e.setStatusMessage("Comment error: %v", err)
+				return
+			}
+			e.pushUndoInsertBlock(ops)
+			delta = len(prefix)
+		}
+		// Keep the cursor and selection anchor on the same character; one
+		// inside a removed prefix lands where the prefix was.
+		if l.y == e.cursorY && e.cursorX > l.indent {
+			e.cursorX = max(e.cursorX+delta, l.indent)
+		}
+		if l.y == e.selectionAnchorY && e.selectionAnchorX > l.indent {
+			e.selectionAnchorX = max(e.selectionAnchorX+delta, l.indent)
+		}
+	}
+	e.dirty = true
+}
+
+// hasRunePrefix reports whether runes starts with prefix.
+func hasRunePrefix(runes, prefix []rune) bool {
+	return len(runes) >= len(prefix) && string(runes[:len(prefix)]) == string(prefix)
+}
+
 // duplicateLine duplicates the current line content to the next line.
 func (e *Editor) duplicateLine() {
 	if e.buffer.LineCount() == 0 {
@@ -130,6 +580,35 @@ func (e *Editor) duplicateLine() {
 	e.dirty = true
 }
 
+// duplicateSelection (Ctrl+D with a selection) puts a copy of the selected
+// text just after it, as one undo group, and selects the copy so pressing
+// again stacks another. A selection of whole lines, from the start of a line
+// to the end of one or the start of a later one, is copied as lines below
+// it; any other selection is copied inline. An empty selection duplicates the
+// line instead.
+func (e *Editor) duplicateSelection() {
+	text := e.getSelectedText()
+	if text == "" {
+		e.selectionActive = false
+		e.duplicateLine()
+		return
+	}
+	_, startX, endY, endX := e.getSelectionCoords()
+	// A selection ending at the end of a line leaves its newline out, so the
+	// copy brings its own
+	lineWise := startX == 0 && endX > 0 && endX == len([]rune(e.buffer.GetLine(endY)))
+	if lineWise {
+		text = "\n" + text
+	}
+	e.cursorY, e.cursorX = endY, endX
+	e.insertString(text) // One undo group
+	e.selectionActive = true
+	e.selectionAnchorY, e.selectionAnchorX = endY, endX
+	if lineWise {
+		e.selectionAnchorY, e.selectionAnchorX = endY+1, 0
+	}
+}
+
 // moveLineUp moves the current line up by swapping it with the line above.
 func (e *Editor) moveLineUp() {
 	if e.cursorY == 0 {
@@ -217,50 +696,55 @@ func (e *Editor) moveLineDown() {
 	e.clampCursorX()
 }
 
-// toggleCaseAtCursor cycles the casing of the word under the cursor.
-// Cycle: Lower -> Title -> Upper -> Lower.
-// Mixed case words reset to Lower.
-func (e *Editor) toggleCaseAtCursor() {
-	if e.buffer.LineCount() == 0 {
-		return
-	}
-
-	lineContent := e.buffer.GetLine(e.cursorY)
-	runes := []rune(lineContent)
+// wordBoundsAt returns where the word under column x of runes starts and
+// ends. A cursor just past the end of a word counts as on it.
+func wordBoundsAt(runes []rune, x int) (start, end int, ok bool) {
 	if len(runes) == 0 {
-		return
-	}
-
-	originalCursorX := e.cursorX
-
-	idx := e.cursorX
-	if idx >= len(runes) {
-		idx = len(runes) - 1
+		return 0, 0, false
 	}
-
+	idx := min(x, len(runes)-1)
 	if !isWordChar(runes[idx]) {
 		if idx > 0 && isWordChar(runes[idx-1]) {
 			idx--
 		} else {
-			return
+			return 0, 0, false
 		}
 	}
 
-	start := idx
+	start = idx
 	for start > 0 && isWordChar(runes[start-1]) {
 		start--
 	}
 
-	end := idx
+	end = idx
 	for end < len(runes) && isWordChar(runes[end]) {
 		end++
 	}
+	return start, end, true
+}
 
-	word := string(runes[start:end])
-	if word == "" {
+// toggleCaseAtCursor cycles the casing of the word under the cursor.
+// Cycle: Lower -> Title -> Upper -> Lower.
+// Mixed case words reset to Lower.
+func (e *Editor) toggleCaseAtCursor() {
+	if e.buffer.LineCount() == 0 {
 		return
 	}
 
+	lineContent := e.buffer.GetLine(e.cursorY)
+	runes := []rune(lineContent)
+	if len(runes) == 0 {
+		return
+	}
+
+	originalCursorX := e.cursorX
+
+	start, end, ok := wordBoundsAt(runes, e.cursorX)
+	if !ok {
+		return
+	}
+	word := string(runes[start:end])
+
 	currentCase := detectCase(word)
 	var nextWord string
 
@@ -332,3 +816,149 @@ func toTitleCase(s string) string {
 	}
 	return string(runes)
 }
+
+// autoWrapLine breaks the current line at the last word boundary before
+// config.AutoWrapColumn once its visual width goes past that column.
+// The new line carries the indentation of the original one. It must be called
+// while the typing undo group is still open so the wrap undoes with the keystroke.
+func (e *Editor) autoWrapLine() {
+	column := e.config.AutoWrapColumn
+	if column <= 0 {
+		return
+	}
+
+	runes := []rune(e.buffer.GetLine(e.cursorY))
+	if e.getVisualX(e.cursorY, len(runes)) <= column {
+		return
+	}
+
+	indentLen := 0
+	for indentLen < len(runes) && (runes[indentLen] == ' ' || runes[indentLen] == '\t') {
+		indentLen++
+	}
+
+	// Find the last whitespace run whose start still fits within the column.
+	breakEnd := -1
+	for i := len(runes) - 1; i > indentLen; i-- {
+		if (runes[i] == ' ' || runes[i] == '\t') && e.getVisualX(e.cursorY, i) <= column {
+			breakEnd = i + 1
+			break
+		}
+	}
+	if breakEnd == -1 {
+		return // A single word longer than the column; nothing to break on
+	}
+	breakStart := breakEnd - 1
+	for breakStart > indentLen && (runes[breakStart-1] == ' ' || runes[breakStart-1] == '\t') {
+		breakStart--
+	}
+	if breakStart == indentLen {
+		return
+	}
+
+	origX := e.cursorX
+	origY := e.cursorY
+
+	// Remove the whitespace at the break point, then insert the line break.
+	for i := breakEnd - 1; i >= breakStart; i-- {
+		e.pushUndoDeleteIfExternalGrouping(origY, i, runes[i])
+		e.buffer.Delete(origY, i+1)
+	}
+	indent := string(runes[:indentLen])
+	e.cursorX = breakStart
+	e.insertString("\n" + indent)
+
+	// Follow the text the cursor was in.
+	if origX >= breakEnd {
+		e.cursorX = indentLen + origX - breakEnd
+	} else if origX > breakStart {
+		e.cursorX = indentLen
+	} else {
+		e.cursorY = origY
+		e.cursorX = origX
+	}
+}
+
+// leadingIndent returns the spaces and tabs line starts with.
+func leadingIndent(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// indentUnit is one level of indentation: a tab, or IndentSize spaces.
+func (e *Editor) indentUnit() string {
+	if e.config.IndentWithTabs {
+		return "\t"
+	}
+	return strings.Repeat(" ", e.config.IndentSize)
+}
+
+// softTabWidth is how many spaces Tab inserts with useSoftTabs: enough to
+// reach the next multiple of IndentSize from the cursor's visual column.
+func (e *Editor) softTabWidth() int {
+	return e.config.IndentSize - e.getVisualX(e.cursorY, e.cursorX)%e.config.IndentSize
+}
+
+// softTabBackspaceWidth is how many spaces Backspace removes with
+// useSoftTabs: back to the previous multiple of IndentSize, when the cursor is
+// a single cursor with only spaces before it on its line. Otherwise it is 0.
+func (e *Editor) softTabBackspaceWidth() int {
+	if !e.config.UseSoftTabs || e.extraCursorHeight != 0 || e.cursorX == 0 {
+		return 0
+	}
+	runes := []rune(e.buffer.GetLine(e.cursorY))
+	if e.cursorX > len(runes) {
+		return 0
+	}
+	for _, r := range runes[:e.cursorX] {
+		if r != ' ' {
+			return 0
+		}
+	}
+	return e.cursorX - (e.cursorX-1)/e.config.IndentSize*e.config.IndentSize
+}
+
+// opensBracketBeforeCursor reports whether auto-indent should add a level
+// after Enter: the rune just before the cursor on line is an opening bracket.
+func (e *Editor) opensBracketBeforeCursor(line string) bool {
+	if !e.config.AutoIndentBrackets || e.cursorX == 0 {
+		return false
+	}
+	runes := []rune(line)
+	if e.cursorX > len(runes) {
+		return false
+	}
+	switch runes[e.cursorX-1] {
+	case '{', '(', '[':
+		return true
+	}
+	return false
+}
+
+// dedentForClosingBracket takes one indent level off the cursor line when a
+// closing bracket is typed as its first non-blank rune, undoing the level
+// Enter added after the opening one. It runs inside the typing undo group.
+func (e *Editor) dedentForClosingBracket(r rune) {
+	if !e.config.AutoIndentBrackets || e.extraCursorHeight != 0 || (r != '}' && r != ')' && r != ']') {
+		return
+	}
+	runes := []rune(e.buffer.GetLine(e.cursorY))
+	if e.cursorX == 0 || e.cursorX > len(runes) || strings.TrimLeft(string(runes[:e.cursorX]), " \t") != "" {
+		return
+	}
+	n := 1
+	if runes[e.cursorX-1] == ' ' {
+		for n < e.config.IndentSize && n < e.cursorX && runes[e.cursorX-1-n] == ' ' {
+			n++
+		}
+	}
+	start := e.cursorX - n
+	entries := make([]opEntry, 0, n)
+	for x := start; x < e.cursorX; x++ {
+		entries = append(entries, opEntry{insertLine: e.cursorY, insertCol: x, r: runes[x]})
+	}
+	if err := e.buffer.DeleteRange(e.cursorY, start, e.cursorY, e.cursorX); err != nil {
+		return
+	}
+	e.pushUndoDeleteBlock(entries, false)
+	e.cursorX = start
+}
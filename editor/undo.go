@@ -1,39 +1,111 @@
 package editor
 
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
 // ---------- Undo/Redo push helpers ----------
 
+// recordUndo pushes action onto the undo stack, tagging it with the open
+// group, if any. Every edit is recorded through here, so this is also where a
+// new edit discards the redo history it diverged from. Inside a group the
+// stack is trimmed once, when the group ends.
+func (e *Editor) recordUndo(action undoAction) {
+	if e.undoGrouping {
+		action.groupID = e.currentGroupID
+	}
+	e.undoStack = append(e.undoStack, action)
+	e.redoStack = nil
+	if !e.undoGrouping {
+		e.trimUndoStack()
+	}
+}
+
+// trimUndoStack drops the oldest undo steps until at most UndoLimit are left.
+// A step is what one undo takes back: an action together with the ones that
+// share its group, so a group is never split. Steps are counted from the
+// newest, so only the ones kept are looked at.
+func (e *Editor) trimUndoStack() {
+	limit := e.config.UndoLimit
+	if limit <= 0 || len(e.undoStack) <= limit {
+		return
+	}
+	steps := 0
+	for i := len(e.undoStack) - 1; i > 0; i-- {
+		if sameUndoGroup(e.undoStack[i-1], e.undoStack[i]) {
+			continue
+		}
+		if steps++; steps == limit {
+			e.undoStack = slices.Delete(e.undoStack, 0, i)
+			return
+		}
+	}
+}
+
+// sameUndoGroup reports whether a and b, adjacent on a stack, are undone
+// together.
+func sameUndoGroup(a, b undoAction) bool {
+	return a.groupID > 0 && a.groupID == b.groupID
+}
+
 func (e *Editor) pushUndoInsertBlock(entries []opEntry) {
 	if len(entries) == 0 {
 		return
 	}
-	action := undoAction{
+	e.recordUndo(undoAction{
 		isInsert: true,
 		ops:      entries,
+	})
+}
+
+// pushUndoInsertText records text inserted in one piece at (line, col).
+func (e *Editor) pushUndoInsertText(line, col int, text string) {
+	if text == "" {
+		return
 	}
-	if e.undoGrouping {
-		action.groupID = e.currentGroupID
-	}
-	e.undoStack = append(e.undoStack, action)
+	e.recordUndo(undoAction{
+		isInsert: true,
+		text:     text,
+		line:     line,
+		col:      col,
+	})
 }
 
 func (e *Editor) pushUndoDeleteBlock(entries []opEntry, isBackspace bool) {
 	if len(entries) == 0 {
 		return
 	}
-	action := undoAction{
+	e.recordUndo(undoAction{
 		isInsert:    false,
 		isBackspace: isBackspace,
 		ops:         entries,
-	}
-	if e.undoGrouping {
-		action.groupID = e.currentGroupID
-	}
-	e.undoStack = append(e.undoStack, action)
+	})
 }
 
 // ---------- Undo/Redo execution ----------
 
+// textEnd returns the position just past text inserted at (line, col).
+func textEnd(line, col int, text string) (int, int) {
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		return line + strings.Count(text, "\n"), utf8.RuneCountInString(text[i+1:])
+	}
+	return line, col + utf8.RuneCountInString(text)
+}
+
 func (e *Editor) performUndo(action undoAction) {
+	if action.text != "" {
+		endLine, endCol := textEnd(action.line, action.col, action.text)
+		if err := e.buffer.DeleteRange(action.line, action.col, endLine, endCol); err != nil {
+			e.setStatusMessage("Undo error: %v", err)
+			return
+		}
+		e.cursorY = action.line
+		e.cursorX = action.col
+		e.dirty = true
+		return
+	}
 	// If action.isInsert == true, undo means: remove the inserted runes (reverse order)
 	// If action.isInsert == false, undo means: re-insert the deleted runes (forward order)
 	if action.isInsert {
@@ -83,6 +155,15 @@ func (e *Editor) performUndo(action undoAction) {
 }
 
 func (e *Editor) performRedo(action undoAction) {
+	if action.text != "" {
+		if err := e.buffer.InsertString(action.line, action.col, action.text); err != nil {
+			e.setStatusMessage("Redo error: %v", err)
+			return
+		}
+		e.cursorY, e.cursorX = textEnd(action.line, action.col, action.text)
+		e.dirty = true
+		return
+	}
 	// Redo an insert => re-insert the recorded runes (forward order)
 	// Redo a delete => delete the recorded runes again (reverse order)
 	if action.isInsert {
@@ -108,8 +189,13 @@ func (e *Editor) performRedo(action undoAction) {
 		// Delete the runes in reverse order using insert positions
 		for i := len(action.ops) - 1; i >= 0; i-- {
 			op := action.ops[i]
-			// Delete at position (insertLine, insertCol+1) deletes the rune originally at insertCol
-			if err := e.buffer.Delete(op.insertLine, op.insertCol+1); err != nil {
+			// Delete at position (insertLine, insertCol+1) deletes the rune originally at insertCol.
+			// A newline ends its line, so it is the rune before the start of the next one.
+			line, col := op.insertLine, op.insertCol+1
+			if op.r == '\n' {
+				line, col = op.insertLine+1, 0
+			}
+			if err := e.buffer.Delete(line, col); err != nil {
 				e.setStatusMessage("Redo error: %v", err)
 				return
 			}
@@ -137,9 +223,14 @@ func (e *Editor) undo() {
 	e.redoStack = append(e.redoStack, action)
 	e.performUndo(action)
 
-	// For grouped operations (groupID > 0), process all with same groupID
+	// For grouped operations (groupID > 0), process all with same groupID.
+	// Each one moves the cursor to its own edit; the group leaves it at the
+	// earliest of them in the text, whatever order they were made in. Undoing
+	// an edit only shifts the text after it, so the earliest position found
+	// so far is still right once the whole group is undone.
 	if action.groupID > 0 {
 		groupID := action.groupID
+		cursorY, cursorX := e.cursorY, e.cursorX
 		for len(e.undoStack) > 0 {
 			next := e.undoStack[len(e.undoStack)-1]
 			if next.groupID != groupID {
@@ -148,7 +239,11 @@ func (e *Editor) undo() {
 			e.undoStack = e.undoStack[:len(e.undoStack)-1]
 			e.redoStack = append(e.redoStack, next)
 			e.performUndo(next)
+			if e.cursorY < cursorY || e.cursorY == cursorY && e.cursorX < cursorX {
+				cursorY, cursorX = e.cursorY, e.cursorX
+			}
 		}
+		e.cursorY, e.cursorX = cursorY, cursorX
 	}
 
 	e.setStatusMessage("Undid last action")
@@ -17,6 +17,11 @@ import (
 var (
 	initConfig  = flag.Bool("init-config", false, "Create a default config file and exit.")
 	showVersion = flag.Bool("version", false, "Show version information and exit.")
+	noAltScreen = flag.Bool("no-alt-screen", false, "Render inline instead of on the alternate screen.")
+	configPath  = flag.String("config", "", "Load the config from this file instead of the default location.")
+	noConfig    = flag.Bool("no-config", false, "Do not load a config file; use the default settings.")
+	printConfig = flag.Bool("print-config", false, "Print the settings in effect as TOML and exit.")
+	readOnly    = flag.Bool("readonly", false, "Open the files read-only; edits are refused.")
 )
 
 func main() {
@@ -32,18 +37,49 @@ func main() {
 	// --- Handle --init-config flag ---
 	if *initConfig {
 		cfg := config.DefaultConfig()
-		if err := config.SaveConfig(cfg); err != nil {
+		save := config.SaveConfig
+		if *configPath != "" {
+			save = func(cfg config.Config) error { return config.SaveConfigFile(cfg, *configPath) }
+		}
+		if err := save(cfg); err != nil {
 			fmt.Fprintf(os.Stderr, "Error saving config: %v\n", err)
 			os.Exit(1)
 		}
 		os.Exit(0) // Exit cleanly after creating the file
 	}
 
-	// Force terminal reset at startup to ensure clean state
-	fmt.Print("\x1b[0m\x1b[2J\x1b[H\x1b[?25h")
-
 	// 1. Load Config
-	cfg := config.LoadConfig()
+	var cfg config.Config
+	switch {
+	case *noConfig:
+		cfg = config.DefaultConfig()
+	case *configPath != "":
+		// An explicitly requested config must load; don't silently fall back.
+		var err error
+		if cfg, err = config.LoadConfigFile(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		cfg = config.LoadConfig()
+	}
+	if *noAltScreen {
+		cfg.UseAltScreen = false
+	}
+
+	// --- Handle --print-config flag ---
+	if *printConfig {
+		fmt.Print(config.Encode(cfg))
+		os.Exit(0)
+	}
+
+	// Force terminal reset at startup to ensure clean state.
+	// Inline mode must not clear the screen the user is looking at.
+	if cfg.UseAltScreen {
+		fmt.Print("\x1b[0m\x1b[2J\x1b[H\x1b[?25h")
+	} else {
+		fmt.Print("\x1b[0m\x1b[?25h")
+	}
 
 	// 2. Set up logging based on config
 	if cfg.EnableLogger {
@@ -62,29 +98,24 @@ func main() {
 	log.Printf("Config loaded: %+v", cfg)
 
 	// 3. Parse Arguments
-	var filename string
-	// Use flag.Args() to get non-flag arguments
-	args := flag.Args()
-	if len(args) > 1 {
-		fmt.Println("Usage: panka [filename]")
-		os.Exit(1)
-	}
-	if len(args) == 1 {
-		filename = args[0]
-	}
-	log.Printf("File to open: %s", filename)
+	// Use flag.Args() to get non-flag arguments; each file opens in its own buffer
+	filenames := flag.Args()
+	log.Printf("Files to open: %q", filenames)
 
 	// 4. Initialize Terminal
 	term := terminal.New()
 	defer term.Close()
 
 	// 5. Initialize Editor
-	e, err := editor.NewEditor(term, cfg, filename)
+	e, err := editor.NewEditor(term, cfg, filenames...)
 	if err != nil {
 		fmt.Printf("Error initializing editor: %v\n", err)
 		log.Fatalf("Error initializing editor: %v", err)
 		os.Exit(1)
 	}
+	if *readOnly {
+		e.SetReadOnly(true)
+	}
 
 	// 6. Run the editor
 	if err := e.Run(); err != nil {
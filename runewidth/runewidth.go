@@ -30,14 +30,36 @@ func RuneWidth(r rune) int {
 	return 1
 }
 
+// RuneWidthFollowedBy is the width of r when next comes after it. A
+// variation selector 16 (U+FE0F) asks for the emoji presentation of the
+// symbol before it, which terminals draw two columns wide; pass 0 for next at
+// the end of the text.
+func RuneWidthFollowedBy(r, next rune) int {
+	w := RuneWidth(r)
+	if next == variationSelector16 && w == 1 {
+		return 2
+	}
+	return w
+}
+
 func StringWidth(s string) int {
 	width := 0
+	prev := rune(-1)
 	for _, r := range s {
-		width += RuneWidth(r)
+		if prev >= 0 {
+			width += RuneWidthFollowedBy(prev, r)
+		}
+		prev = r
+	}
+	if prev >= 0 {
+		width += RuneWidth(prev)
 	}
 	return width
 }
 
+// variationSelector16 selects the emoji presentation of the character before it.
+const variationSelector16 = '\uFE0F'
+
 func isExplicitZeroWidth(r rune) bool {
 	switch r {
 	case '\u202F', '\u200B', '\u200C', '\u200D', '\uFEFF',
@@ -56,5 +78,35 @@ func isWideCharacter(r rune) bool {
 		(r >= 0xF900 && r <= 0xFAFF) || // CJK Compatibility
 		(r >= 0xFE10 && r <= 0xFE19) || // Vertical forms
 		(r >= 0xFE30 && r <= 0xFE6F) || // CJK Compatibility Forms
-		(r >= 0xFF00 && r <= 0xFFEF) // Fullwidth forms
+		(r >= 0xFF00 && r <= 0xFFEF) || // Fullwidth forms
+		(r >= 0x1F1E6 && r <= 0x1F1FF) || // Regional indicators (flags)
+		(r >= 0x1F300 && r <= 0x1FAFF) || // Emoji and pictographs
+		isEmojiSymbol(r)
+}
+
+// emojiSymbols are the characters among the older symbol blocks that are
+// shown as emoji by default. The rest of those blocks, like ✓ or ★, are drawn
+// one column wide unless a U+FE0F follows them; see RuneWidthFollowedBy.
+var emojiSymbols = [][2]rune{
+	{0x231A, 0x231B}, {0x23E9, 0x23EC}, {0x23F0, 0x23F0}, {0x23F3, 0x23F3},
+	{0x25FD, 0x25FE}, {0x2614, 0x2615}, {0x2648, 0x2653}, {0x267F, 0x267F},
+	{0x2693, 0x2693}, {0x26A1, 0x26A1}, {0x26AA, 0x26AB}, {0x26BD, 0x26BE},
+	{0x26C4, 0x26C5}, {0x26CE, 0x26CE}, {0x26D4, 0x26D4}, {0x26EA, 0x26EA},
+	{0x26F2, 0x26F3}, {0x26F5, 0x26F5}, {0x26FA, 0x26FA}, {0x26FD, 0x26FD},
+	{0x2705, 0x2705}, {0x270A, 0x270B}, {0x2728, 0x2728}, {0x274C, 0x274C},
+	{0x274E, 0x274E}, {0x2753, 0x2755}, {0x2757, 0x2757}, {0x2795, 0x2797},
+	{0x27B0, 0x27B0}, {0x27BF, 0x27BF}, {0x2B1B, 0x2B1C}, {0x2B50, 0x2B50},
+	{0x2B55, 0x2B55},
+}
+
+func isEmojiSymbol(r rune) bool {
+	if r < 0x231A || r > 0x2B55 {
+		return false
+	}
+	for _, rng := range emojiSymbols {
+		if r >= rng[0] && r <= rng[1] {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,55 @@
+package runewidth
+
+import "testing"
+
+func TestRuneWidth(t *testing.T) {
+	tests := []struct {
+		r    rune
+		want int
+	}{
+		{'a', 1},
+		{'é', 1},
+		{'中', 2},
+		{'😀', 2},      // U+1F600
+		{'🚀', 2},      // U+1F680
+		{'🤖', 2},      // U+1F916
+		{'🥲', 2},      // U+1F972
+		{'🇫', 2},      // U+1F1EB, a regional indicator
+		{'⚡', 2},      // U+26A1, emoji by default
+		{'✅', 2},      // U+2705
+		{'⭐', 2},      // U+2B50
+		{'✓', 1},      // U+2713, text by default
+		{'★', 1},      // U+2605
+		{'☀', 1},      // U+2600
+		{'\u0301', 0}, // Combining acute accent
+		{'\u20E3', 0}, // Combining enclosing keycap
+		{'\uFE0F', 0}, // Variation selector 16
+		{'\u200D', 0}, // Zero width joiner
+	}
+	for _, tt := range tests {
+		if got := RuneWidth(tt.r); got != tt.want {
+			t.Errorf("RuneWidth(%U) = %d, want %d", tt.r, got, tt.want)
+		}
+	}
+}
+
+func TestStringWidth(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"hello", 5},
+		{"a😀b", 4},
+		{"☀\uFE0F", 2}, // U+FE0F asks for the emoji presentation
+		{"✓ done", 6},
+		{"✓\uFE0F done", 7},
+		{"😀\uFE0F", 2}, // Already wide
+		{"e\u0301", 1}, // e and a combining accent
+		{"中文 ok", 7},
+	}
+	for _, tt := range tests {
+		if got := StringWidth(tt.s); got != tt.want {
+			t.Errorf("StringWidth(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package terminal
+
+import "io"
+
+// Terminal is the platform layer the editor draws through: raw mode, the
+// window size and the input stream. New returns the implementation for the
+// current OS.
+type Terminal interface {
+	EnableRawMode() error
+	DisableRawMode() error
+	GetWindowSize() (width, height int, err error)
+	Stdin() io.Reader
+	Close() error
+}
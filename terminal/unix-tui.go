@@ -0,0 +1,117 @@
+//go:build !windows
+
+package terminal
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+type stdTerminal struct {
+	originalState *unix.Termios
+	stdinFile     *os.File
+}
+
+func New() Terminal {
+	// Opening the controlling terminal directly (rather than using fd 0)
+	// gives a file the runtime poller accepts, so read deadlines work as
+	// long as the fd stays non-blocking. Fd() would switch it to blocking
+	// mode for good, which is why the ioctls below go through control.
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return &stdTerminal{stdinFile: os.Stdin}
+	}
+	return &stdTerminal{stdinFile: tty}
+}
+
+func (t *stdTerminal) Close() error {
+	err := t.DisableRawMode()
+	if t.stdinFile != nil && t.stdinFile != os.Stdin {
+		if cerr := t.stdinFile.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (t *stdTerminal) Stdin() io.Reader {
+	return t.stdinFile
+}
+
+// control runs fn with f's file descriptor without taking it out of
+// non-blocking mode, as f.Fd() would.
+func control(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := rc.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func (t *stdTerminal) EnableRawMode() error {
+	var orig *unix.Termios
+	err := control(t.stdinFile, func(fd int) (err error) {
+		orig, err = unix.IoctlGetTermios(fd, ioctlGetTermios)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get terminal attributes: %w", err)
+	}
+
+	raw := *orig
+	// Without ISIG, Ctrl+C and Ctrl+Z arrive as plain 0x03 and 0x1a bytes
+	// instead of signals; without IXON, Ctrl+S and Ctrl+Q reach the editor
+	// instead of pausing output; without ICRNL, Enter arrives as '\r'.
+	raw.Iflag &^= unix.BRKINT | unix.ICRNL | unix.INPCK | unix.ISTRIP | unix.IXON
+	raw.Cflag |= unix.CS8
+	raw.Lflag &^= unix.ECHO | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+
+	err = control(t.stdinFile, func(fd int) error {
+		return unix.IoctlSetTermios(fd, ioctlSetTermios, &raw)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set terminal attributes: %w", err)
+	}
+	t.originalState = orig
+	return nil
+}
+
+func (t *stdTerminal) DisableRawMode() error {
+	if t.originalState == nil {
+		return nil
+	}
+	err := control(t.stdinFile, func(fd int) error {
+		return unix.IoctlSetTermios(fd, ioctlSetTermios, t.originalState)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore terminal attributes: %w", err)
+	}
+	t.originalState = nil
+	return nil
+}
+
+func (t *stdTerminal) GetWindowSize() (width, height int, err error) {
+	var ws *unix.Winsize
+	getWinsize := func(fd int) (err error) {
+		ws, err = unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+		return err
+	}
+	err = control(os.Stdout, getWinsize)
+	if err != nil || ws.Col == 0 {
+		// stdout may be redirected; ask the terminal we read from instead.
+		err = control(t.stdinFile, getWinsize)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get window size: %w", err)
+	}
+	return int(ws.Col), int(ws.Row), nil
+}
@@ -10,14 +10,6 @@ import (
 	"golang.org/x/sys/windows"
 )
 
-type Terminal interface {
-	EnableRawMode() error
-	DisableRawMode() error
-	GetWindowSize() (width, height int, err error)
-	Stdin() io.Reader
-	Close() error
-}
-
 type stdTerminal struct {
 	originalState *winState
 	stdinFile     *os.File
@@ -75,6 +67,8 @@ func (t *stdTerminal) EnableRawMode() error {
 
 	t.originalState = &winState{inMode, outMode}
 
+	// Disabling ENABLE_PROCESSED_INPUT delivers Ctrl+C as a plain 0x03 byte
+	// instead of raising a console control event that would kill the editor.
 	newInMode := inMode &^ (windows.ENABLE_ECHO_INPUT | windows.ENABLE_LINE_INPUT | windows.ENABLE_PROCESSED_INPUT)
 	newInMode |= windows.ENABLE_VIRTUAL_TERMINAL_INPUT
 
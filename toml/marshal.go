@@ -0,0 +1,236 @@
+// toml package - toml/marshal.go
+package toml
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Marshal converts native Go data structures to TOML. Values come first in
+// each table, then its subtables as [table] sections and its arrays of tables
+// as [[array]] sections, all in sorted key order so the output is stable.
+func Marshal(v map[string]any) ([]byte, error) {
+	var b strings.Builder
+	if err := writeTable(&b, nil, v); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
+
+// writeTable writes the body of the table at path, followed by the sections
+// of the tables nested in it.
+func writeTable(b *strings.Builder, path []string, table map[string]any) error {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var tables, arrays []string
+	for _, k := range keys {
+		switch v := table[k].(type) {
+		case map[string]any:
+			tables = append(tables, k)
+			continue
+		case []any:
+			if isArrayOfTables(v) {
+				arrays = append(arrays, k)
+				continue
+			}
+		case []map[string]any:
+			if len(v) > 0 {
+				arrays = append(arrays, k)
+				continue
+			}
+		}
+		value, err := encodeValue(table[k])
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(append(path, k), "."), err)
+		}
+		fmt.Fprintf(b, "%s = %s\n", EncodeKey(k), value)
+	}
+
+	for _, k := range tables {
+		sub := append(path[:len(path):len(path)], k)
+		writeHeader(b, "[%s]\n", sub)
+		if err := writeTable(b, sub, table[k].(map[string]any)); err != nil {
+			return err
+		}
+	}
+
+	for _, k := range arrays {
+		sub := append(path[:len(path):len(path)], k)
+		var elems []map[string]any
+		switch v := table[k].(type) {
+		case []any:
+			for _, elem := range v {
+				elems = append(elems, elem.(map[string]any))
+			}
+		case []map[string]any:
+			elems = v
+		}
+		for _, elem := range elems {
+			writeHeader(b, "[[%s]]\n", sub)
+			if err := writeTable(b, sub, elem); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeHeader writes a table header for path, set off from what came before
+// by a blank line.
+func writeHeader(b *strings.Builder, format string, path []string) {
+	if b.Len() > 0 {
+		b.WriteByte('\n')
+	}
+	keys := make([]string, len(path))
+	for i, k := range path {
+		keys[i] = EncodeKey(k)
+	}
+	fmt.Fprintf(b, format, strings.Join(keys, "."))
+}
+
+// isArrayOfTables reports whether a slice holds only tables, and so is
+// written as [[array]] sections rather than as an array value.
+func isArrayOfTables(v []any) bool {
+	if len(v) == 0 {
+		return false
+	}
+	for _, elem := range v {
+		if _, ok := elem.(map[string]any); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeValue renders a value as it appears after the = of a key, with
+// tables written inline.
+func encodeValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return QuoteString(v), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return encodeFloat(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []string:
+		elems := make([]any, len(v))
+		for i, s := range v {
+			elems[i] = s
+		}
+		return encodeValue(elems)
+	case []map[string]any:
+		elems := make([]any, len(v))
+		for i, m := range v {
+			elems[i] = m
+		}
+		return encodeValue(elems)
+	case []any:
+		parts := make([]string, len(v))
+		for i, elem := range v {
+			s, err := encodeValue(elem)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return "[" + strings.Join(parts, ", ") + "]", nil
+	case map[string]any:
+		if len(v) == 0 {
+			return "{}", nil
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		parts := make([]string, len(keys))
+		for i, k := range keys {
+			s, err := encodeValue(v[k])
+			if err != nil {
+				return "", err
+			}
+			parts[i] = EncodeKey(k) + " = " + s
+		}
+		return "{ " + strings.Join(parts, ", ") + " }", nil
+	}
+	return "", fmt.Errorf("unsupported value type %T", v)
+}
+
+// encodeFloat renders a float so that it reads back as a float, never as an
+// integer.
+func encodeFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
+// EncodeKey writes a key bare when TOML allows it and quoted otherwise, for
+// code that writes TOML by hand.
+func EncodeKey(k string) string {
+	if k == "" {
+		return `""`
+	}
+	for _, r := range k {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return QuoteString(k)
+		}
+	}
+	return k
+}
+
+// QuoteString writes s as a basic string, escaping what unescapeBasic
+// decodes. Unlike Go's %q, its escapes are all valid TOML.
+func QuoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
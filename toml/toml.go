@@ -3,6 +3,7 @@ package toml
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -64,6 +65,16 @@ func (p *Parser) parse(data string) error {
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		if strings.HasPrefix(line, "[") {
+			line = stripComment(line) // A table header may have a comment after it
+		}
+
+		if strings.HasPrefix(line, "[[") && strings.HasSuffix(line, "]]") {
+			if err := p.parseArrayTable(line); err != nil {
+				return err
+			}
+			continue
+		}
 
 		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
 			if err := p.parseTable(line); err != nil {
@@ -92,56 +103,388 @@ func (p *Parser) parseTable(line string) error {
 		return &ParseError{Line: p.lineNum + 1, Msg: "empty table name"}
 	}
 
-	p.tableKey = strings.Split(key, ".")
+	tableKey, err := splitDottedKey(key)
+	if err != nil {
+		return &ParseError{Line: p.lineNum + 1, Msg: err.Error()}
+	}
+	p.tableKey = tableKey
 	p.current = p.result
-	for _, k := range p.tableKey {
-		if next, exists := p.current[k]; !exists {
-			newTable := make(map[string]any)
-			p.current[k] = newTable
-			p.current = newTable
-		} else {
-			if nextMap, ok := next.(map[string]any); ok {
-				p.current = nextMap
-			} else {
-				return &ParseError{Line: p.lineNum + 1, Msg: "key already exists"}
+	for i, k := range p.tableKey {
+		if _, isArray := p.current[k].([]any); isArray && i == len(p.tableKey)-1 {
+			return &ParseError{Line: p.lineNum + 1, Msg: fmt.Sprintf("%s is already an array of tables", key)}
+		}
+		next, err := p.descend(k)
+		if err != nil {
+			return err
+		}
+		p.current = next
+	}
+	return nil
+}
+
+// parseArrayTable handles [[name]]: each occurrence appends a new table to
+// the array stored under name, and the lines after it fill that table.
+func (p *Parser) parseArrayTable(line string) error {
+	key := strings.TrimSpace(line[2 : len(line)-2])
+	if key == "" {
+		return &ParseError{Line: p.lineNum + 1, Msg: "empty table name"}
+	}
+
+	tableKey, err := splitDottedKey(key)
+	if err != nil {
+		return &ParseError{Line: p.lineNum + 1, Msg: err.Error()}
+	}
+	p.tableKey = tableKey
+	p.current = p.result
+	last := len(p.tableKey) - 1
+	for _, k := range p.tableKey[:last] {
+		next, err := p.descend(k)
+		if err != nil {
+			return err
+		}
+		p.current = next
+	}
+
+	name := p.tableKey[last]
+	var array []any
+	switch existing := p.current[name].(type) {
+	case nil:
+	case []any:
+		if len(existing) > 0 {
+			if _, ok := existing[0].(map[string]any); !ok {
+				return &ParseError{Line: p.lineNum + 1, Msg: fmt.Sprintf("%s is already an array of values", key)}
 			}
 		}
+		array = existing
+	case map[string]any:
+		return &ParseError{Line: p.lineNum + 1, Msg: fmt.Sprintf("%s is already a table", key)}
+	default:
+		return &ParseError{Line: p.lineNum + 1, Msg: "key already exists"}
 	}
+	table := make(map[string]any)
+	p.current[name] = append(array, table)
+	p.current = table
 	return nil
 }
 
+// descend returns the table under key k of the current table, creating it if
+// it is missing. Under an array of tables it is the array's last table, which
+// is where a dotted header like [a.b] after [[a]] belongs.
+func (p *Parser) descend(k string) (map[string]any, error) {
+	switch next := p.current[k].(type) {
+	case nil:
+		newTable := make(map[string]any)
+		p.current[k] = newTable
+		return newTable, nil
+	case map[string]any:
+		return next, nil
+	case []any:
+		if len(next) > 0 {
+			if last, ok := next[len(next)-1].(map[string]any); ok {
+				return last, nil
+			}
+		}
+	}
+	return nil, &ParseError{Line: p.lineNum + 1, Msg: "key already exists"}
+}
+
 // parseKeyValue handles key = value parsing
 func (p *Parser) parseKeyValue(line string) error {
-	parts := strings.SplitN(line, "=", 2)
-	if len(parts) != 2 {
+	rawKey, value, ok := cutKey(line)
+	if !ok {
 		return &ParseError{Line: p.lineNum + 1, Msg: "invalid key-value pair"}
 	}
+	key, err := parseKey(rawKey)
+	if err != nil {
+		return &ParseError{Line: p.lineNum + 1, Msg: err.Error()}
+	}
+	value = strings.TrimSpace(value)
 
-	key := strings.TrimSpace(parts[0])
-	value := strings.TrimSpace(parts[1])
+	if strings.HasPrefix(value, `"""`) || strings.HasPrefix(value, "'''") {
+		start := p.lineNum
+		s, err := p.parseMultilineString(value[:3])
+		if err != nil {
+			return &ParseError{Line: start + 1, Msg: err.Error()}
+		}
+		p.current[key] = s
+		return nil
+	}
+
+	value = stripComment(value)
+	start := p.lineNum
+	// An array may go on over the following lines until its brackets balance.
+	for strings.HasPrefix(value, "[") && bracketDepth(value) > 0 {
+		p.lineNum++
+		if p.lineNum == len(p.lines) {
+			return &ParseError{Line: start + 1, Msg: "unterminated array"}
+		}
+		value += " " + stripComment(strings.TrimSpace(p.lines[p.lineNum]))
+	}
 
 	parsedValue, err := p.parseValue(value)
 	if err != nil {
-		return &ParseError{Line: p.lineNum + 1, Msg: err.Error()}
+		return &ParseError{Line: start + 1, Msg: err.Error()}
 	}
 
 	p.current[key] = parsedValue
 	return nil
 }
 
+// cutKey splits a key = value line at the first = that is not inside a
+// quoted key.
+func cutKey(line string) (key, value string, ok bool) {
+	var quote byte // The quote of the string being scanned, or 0
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\' && quote == '"':
+			i++ // Only basic strings have escapes
+		case c == '"' || c == '\'':
+			quote = toggleQuote(quote, c)
+		case c == '=' && quote == 0:
+			return line[:i], line[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// parseKey decodes a quoted key, which may hold any character, including
+// dots, spaces and escapes. A bare key is returned as it is written.
+func parseKey(key string) (string, error) {
+	key = strings.TrimSpace(key)
+	if len(key) >= 2 && key[0] == '"' && key[len(key)-1] == '"' {
+		return unescapeBasic(key[1 : len(key)-1])
+	}
+	if len(key) >= 2 && key[0] == '\'' && key[len(key)-1] == '\'' {
+		return key[1 : len(key)-1], nil
+	}
+	return key, nil
+}
+
+// splitDottedKey splits the name of a table header at its dots, leaving the
+// dots inside quoted parts alone, and decodes each part as parseKey does.
+func splitDottedKey(key string) ([]string, error) {
+	var parts []string
+	var quote byte // The quote of the string being scanned, or 0
+	start := 0
+	for i := 0; i <= len(key); i++ {
+		if i == len(key) || key[i] == '.' && quote == 0 {
+			part, err := parseKey(key[start:i])
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+			start = i + 1
+			continue
+		}
+		switch c := key[i]; {
+		case c == '\\' && quote == '"':
+			i++
+		case c == '"' || c == '\'':
+			quote = toggleQuote(quote, c)
+		}
+	}
+	return parts, nil
+}
+
+// stripComment removes a trailing # comment from a value, leaving any #
+// inside a quoted string alone.
+func stripComment(value string) string {
+	var quote byte // The quote of the string being scanned, or 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if quote == '"' {
+				i++ // Only basic strings have escapes
+			}
+		case '"', '\'':
+			quote = toggleQuote(quote, value[i])
+		case '#':
+			if quote == 0 {
+				return strings.TrimSpace(value[:i])
+			}
+		}
+	}
+	return value
+}
+
+// toggleQuote tracks the string a scan is inside of: c opens a string when
+// quote is 0 and closes it when it matches the quote the string opened with.
+func toggleQuote(quote, c byte) byte {
+	switch quote {
+	case 0:
+		return c
+	case c:
+		return 0
+	}
+	return quote
+}
+
+// bracketDepth counts the array brackets in value still open at its end,
+// ignoring brackets inside quoted strings.
+func bracketDepth(value string) int {
+	depth := 0
+	var quote byte // The quote of the string being scanned, or 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			if quote == '"' {
+				i++ // Only basic strings have escapes
+			}
+		case '"', '\'':
+			quote = toggleQuote(quote, value[i])
+		case '[':
+			if quote == 0 {
+				depth++
+			}
+		case ']':
+			if quote == 0 {
+				depth--
+			}
+		}
+	}
+	return depth
+}
+
+// parseMultilineString reads a multi-line basic string (""") or literal
+// string (three single quotes) that opens on the current line, consuming
+// further lines up to the closing delimiter. A newline right after the opening
+// delimiter is dropped. In a basic string escapes are resolved and a backslash at the end of a line
+// joins it to the next non-blank text; a literal string is kept as written.
+func (p *Parser) parseMultilineString(delim string) (string, error) {
+	raw := strings.TrimRight(p.lines[p.lineNum], "\r")
+	text := raw[strings.Index(raw, delim)+3:]
+	if text == "" {
+		p.lineNum++ // The newline after the opening delimiter is trimmed
+		if p.lineNum == len(p.lines) {
+			return "", fmt.Errorf("unterminated multi-line string")
+		}
+		text = strings.TrimRight(p.lines[p.lineNum], "\r")
+	}
+
+	var body strings.Builder
+	for {
+		if end, ok := multilineStringEnd(text, delim); ok {
+			body.WriteString(text[:end])
+			rest := strings.TrimSpace(text[end+3:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected text after multi-line string: %s", rest)
+			}
+			if delim != `"""` {
+				return body.String(), nil
+			}
+			return unescapeBasic(body.String())
+		}
+		body.WriteString(text)
+		body.WriteByte('\n')
+		p.lineNum++
+		if p.lineNum == len(p.lines) {
+			return "", fmt.Errorf("unterminated multi-line string")
+		}
+		text = strings.TrimRight(p.lines[p.lineNum], "\r")
+	}
+}
+
+// multilineStringEnd finds the closing delimiter in a line of a multi-line
+// string, skipping escaped quotes in a basic string. Up to two quotes just
+// before the delimiter belong to the string, so """" ends with one quote in it.
+func multilineStringEnd(line, delim string) (int, bool) {
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && delim == `"""`:
+			i++
+		case strings.HasPrefix(line[i:], delim):
+			extra := 0
+			for extra < 2 && strings.HasPrefix(line[i+extra+1:], delim) {
+				extra++
+			}
+			return i + extra, true
+		}
+	}
+	return 0, false
+}
+
+// unescapeBasic resolves the escape sequences of a basic string, including a
+// line-ending backslash, which removes the newline and the whitespace after it.
+func unescapeBasic(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("trailing backslash in string")
+		}
+		switch s[i] {
+		case 'b':
+			b.WriteByte('\b')
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'f':
+			b.WriteByte('\f')
+		case 'r':
+			b.WriteByte('\r')
+		case '"':
+			b.WriteByte('"')
+		case '\\':
+			b.WriteByte('\\')
+		case 'u', 'U':
+			size := 4
+			if s[i] == 'U' {
+				size = 8
+			}
+			if i+size >= len(s) {
+				return "", fmt.Errorf("short unicode escape in string")
+			}
+			code, err := strconv.ParseUint(s[i+1:i+1+size], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid unicode escape in string: %s", s[i-1:i+1+size])
+			}
+			b.WriteRune(rune(code))
+			i += size
+		case ' ', '\t', '\n':
+			// Line continuation: only whitespace may follow the backslash on its line.
+			j := i
+			for j < len(s) && (s[j] == ' ' || s[j] == '\t') {
+				j++
+			}
+			if j == len(s) || s[j] != '\n' {
+				return "", fmt.Errorf("invalid escape in string: \\%c", s[i])
+			}
+			for j < len(s) && (s[j] == ' ' || s[j] == '\t' || s[j] == '\n') {
+				j++
+			}
+			i = j - 1
+		default:
+			return "", fmt.Errorf("invalid escape in string: \\%c", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
 // parseValue handles value parsing
 func (p *Parser) parseValue(value string) (any, error) {
 	// Handle strings
-	if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
-		return value[1 : len(value)-1], nil
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return unescapeBasic(value[1 : len(value)-1])
 	}
 
-	// Handle numbers
-	if num, err := strconv.Atoi(value); err == nil {
-		return num, nil
+	// Handle literal strings, which have no escapes and cannot contain '
+	if len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+		s := value[1 : len(value)-1]
+		if strings.Contains(s, "'") {
+			return nil, fmt.Errorf("unexpected ' in literal string: %s", value)
+		}
+		return s, nil
 	}
-	if num, err := strconv.ParseFloat(value, 64); err == nil {
-		return num, nil
+
+	// Handle numbers
+	if num, ok, err := parseNumber(value); ok {
+		return num, err
 	}
 
 	// Handle booleans
@@ -157,6 +500,11 @@ func (p *Parser) parseValue(value string) (any, error) {
 		return p.parseArray(value)
 	}
 
+	// Handle inline tables
+	if strings.HasPrefix(value, "{") && strings.HasSuffix(value, "}") {
+		return p.parseInlineTable(value)
+	}
+
 	// Handle datetime (basic format)
 	if strings.Contains(value, "T") && len(value) >= 19 {
 		if t, err := time.Parse(time.RFC3339, value); err == nil {
@@ -167,6 +515,80 @@ func (p *Parser) parseValue(value string) (any, error) {
 	return nil, fmt.Errorf("unrecognized value: %s", value)
 }
 
+// parseNumber handles integers and floats, which may have underscores
+// between digits, and 0x, 0o and 0b integers. ok is false when value is not
+// a number at all, so that other kinds of value can be tried.
+func parseNumber(value string) (num any, ok bool, err error) {
+	base := 10
+	if len(value) > 1 && value[0] == '0' {
+		switch value[1] {
+		case 'x':
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		}
+	}
+	if base != 10 {
+		digits := value[2:]
+		if !validDigits(digits, base) {
+			return nil, true, fmt.Errorf("invalid integer: %s", value)
+		}
+		n, err := strconv.ParseInt(strings.ReplaceAll(digits, "_", ""), base, 64)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid integer: %s", value)
+		}
+		return int(n), true, nil
+	}
+
+	plain := strings.ReplaceAll(value, "_", "")
+	if n, err := strconv.Atoi(plain); err == nil {
+		num = n
+	} else if errors.Is(err, strconv.ErrRange) {
+		// All digits, so a float would quietly lose precision.
+		return nil, true, fmt.Errorf("invalid integer: %s", value)
+	} else if f, err := strconv.ParseFloat(plain, 64); err == nil {
+		num = f
+	} else {
+		return nil, false, nil
+	}
+	if plain != value && !validDigits(value, base) {
+		return nil, true, fmt.Errorf("invalid underscore in number: %s", value)
+	}
+	return num, true, nil
+}
+
+// validDigits reports whether every underscore in s sits between two digits.
+// For bases other than 10, s must also be a non-empty run of digits in that
+// base, since there is no sign, point or exponent to allow for.
+func validDigits(s string, base int) bool {
+	isDigit := func(c byte) bool {
+		switch base {
+		case 16:
+			return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+		case 8:
+			return c >= '0' && c <= '7'
+		case 2:
+			return c == '0' || c == '1'
+		}
+		return c >= '0' && c <= '9'
+	}
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '_' {
+			if i == 0 || i == len(s)-1 || !isDigit(s[i-1]) || !isDigit(s[i+1]) {
+				return false
+			}
+		} else if base != 10 && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 // parseArray handles array parsing
 func (p *Parser) parseArray(value string) ([]any, error) {
 	content := strings.TrimSpace(value[1 : len(value)-1])
@@ -176,29 +598,40 @@ func (p *Parser) parseArray(value string) ([]any, error) {
 
 	var result []any
 	var current strings.Builder
-	inString := false
+	var quote byte // The quote of the string being scanned, or 0
 	escape := false
+	depth := 0 // Nesting of arrays and inline tables inside this array
 
 	for i, r := range content {
 		// Handle string literals
-		if r == '"' && !escape {
-			inString = !inString
+		if (r == '"' || r == '\'') && !escape {
+			quote = toggleQuote(quote, byte(r))
 		}
 
-		// Handle escape sequences
-		if r == '\\' && !escape && inString {
+		// Handle escape sequences, which only basic strings have
+		if r == '\\' && !escape && quote == '"' {
 			escape = true
 			continue
 		}
 
 		if escape {
 			escape = false
+			current.WriteByte('\\') // Kept for parseValue to decode
 			current.WriteRune(r)
 			continue
 		}
 
+		if quote == 0 {
+			switch r {
+			case '[', '{':
+				depth++
+			case ']', '}':
+				depth--
+			}
+		}
+
 		// Handle array separators
-		if r == ',' && !inString {
+		if r == ',' && quote == 0 && depth == 0 {
 			val := strings.TrimSpace(current.String())
 			if val == "" {
 				return nil, fmt.Errorf("empty array element at position %d", i)
@@ -232,3 +665,78 @@ func (p *Parser) parseArray(value string) ([]any, error) {
 
 	return result, nil
 }
+
+// parseInlineTable handles { key = value, ... } tables written on one line
+func (p *Parser) parseInlineTable(value string) (map[string]any, error) {
+	table := make(map[string]any)
+	content := strings.TrimSpace(value[1 : len(value)-1])
+	if content == "" {
+		return table, nil
+	}
+
+	entries := splitInline(content)
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			if i == len(entries)-1 {
+				return nil, fmt.Errorf("trailing comma in inline table")
+			}
+			return nil, fmt.Errorf("empty inline table entry")
+		}
+
+		rawKey, value, ok := cutKey(entry)
+		if !ok {
+			return nil, fmt.Errorf("invalid key-value pair in inline table: %s", entry)
+		}
+		if strings.TrimSpace(rawKey) == "" {
+			return nil, fmt.Errorf("empty key in inline table")
+		}
+		key, err := parseKey(rawKey)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := table[key]; exists {
+			return nil, fmt.Errorf("duplicate key in inline table: %s", key)
+		}
+
+		parsed, err := p.parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		table[key] = parsed
+	}
+	return table, nil
+}
+
+// splitInline splits the body of an inline table at the commas that are not
+// inside a quoted string, a nested array or a nested inline table.
+func splitInline(content string) []string {
+	var parts []string
+	var quote byte // The quote of the string being scanned, or 0
+	depth := 0
+	start := 0
+	for i := 0; i < len(content); i++ {
+		switch content[i] {
+		case '\\':
+			if quote == '"' {
+				i++ // Only basic strings have escapes
+			}
+		case '"', '\'':
+			quote = toggleQuote(quote, content[i])
+		case '[', '{':
+			if quote == 0 {
+				depth++
+			}
+		case ']', '}':
+			if quote == 0 {
+				depth--
+			}
+		case ',':
+			if quote == 0 && depth == 0 {
+				parts = append(parts, content[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, content[start:])
+}
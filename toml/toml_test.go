@@ -0,0 +1,524 @@
+package toml
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNative_MultilineStrings(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"empty", `s = """"""`, ""},
+		{"empty across lines", "s = \"\"\"\n\"\"\"", ""},
+		{"single line", `s = """one "two" three"""`, `one "two" three`},
+		{"several lines", "s = \"\"\"\nfirst\n  second\n\nfourth\"\"\"", "first\n  second\n\nfourth"},
+		{"text after the opener", "s = \"\"\"first\nsecond\n\"\"\"", "first\nsecond\n"},
+		{"line continuation", "s = \"\"\"\nThe quick \\\n\n    brown \\   \n  fox\"\"\"", "The quick brown fox"},
+		{"escapes", "s = \"\"\"tab\\there\\n\\\"q\\\" \\\\ \\u00e9\"\"\"", "tab\there\n\"q\" \\ é"},
+		{"quotes before the closer", `s = """say ""hi"""""`, `say ""hi""`},
+		{"crlf", "s = \"\"\"\r\na\r\nb\"\"\"\r\n", "a\nb"},
+		{"trailing comment", "s = \"\"\"a\nb\"\"\" # done", "a\nb"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ParseNative(tt.input + "\nafter = 1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := data["s"]; got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+			if data["after"] != 1 {
+				t.Errorf("expected parsing to go on after the string, got %v", data["after"])
+			}
+		})
+	}
+}
+
+func TestParseNative_MultilineStringErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		line  int
+	}{
+		{"unterminated", "a = 1\ns = \"\"\"\nnever closed", 2},
+		{"unterminated on the opening line", "s = \"\"\"", 1},
+		{"text after the closer", "s = \"\"\"a\"\"\" b", 1},
+		{"bad escape", "s = \"\"\"\n\\q\"\"\"", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseNative(tt.input)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a ParseError, got %v", err)
+			}
+			if perr.Line != tt.line {
+				t.Errorf("expected the error on line %d, got %d", tt.line, perr.Line)
+			}
+		})
+	}
+}
+
+func TestParse_ArrayOfTables(t *testing.T) {
+	input := `title = "fleet"
+
+[[servers]]
+name = "alpha"
+ports = [80, 443]
+
+[[servers]]
+name = "beta"
+
+[servers.owner]
+team = "ops"
+
+[[servers.disks]]
+size = 100
+
+[[servers.disks]]
+size = 200
+
+[[a.b]]
+c = true
+`
+	expected := map[string]any{
+		"title": "fleet",
+		"servers": []any{
+			map[string]any{"name": "alpha", "ports": []any{80, 443}},
+			map[string]any{
+				"name":  "beta",
+				"owner": map[string]any{"team": "ops"},
+				"disks": []any{map[string]any{"size": 100}, map[string]any{"size": 200}},
+			},
+		},
+		"a": map[string]any{"b": []any{map[string]any{"c": true}}},
+	}
+
+	got, err := Parse(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestParse_ArrayOfTablesErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		line  int
+	}{
+		{"table then array", "[a]\nx = 1\n[[a]]", 3},
+		{"array then table", "[[a]]\n[a]", 2},
+		{"value then array", "a = 1\n[[a]]", 2},
+		{"array of values then tables", "a = [1, 2]\n[[a]]", 2},
+		{"empty name", "[[ ]]", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseNative(tt.input)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a ParseError, got %v", err)
+			}
+			if perr.Line != tt.line {
+				t.Errorf("expected the error on line %d, got %d", tt.line, perr.Line)
+			}
+		})
+	}
+}
+
+func TestParseNative_InlineComments(t *testing.T) {
+	input := `port = 8080 # the http port
+ratio = 0.5# no space before it
+name = "issue #42" # a # inside the string stays
+quote = "say \"#hi\"" # escaped quotes do not end the string
+on = true  # boolean
+tags = ["a#b", "c"] # after an array
+ports = [ # a multi-line array
+  8001, # first
+  8002,
+  # a comment line
+  8003,
+] # closes here
+
+[server] # a table
+host = "localhost" #
+`
+	data, err := ParseNative(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"port":   8080,
+		"ratio":  0.5,
+		"name":   "issue #42",
+		"quote":  `say "#hi"`,
+		"on":     true,
+		"tags":   []any{"a#b", "c"},
+		"ports":  []any{8001, 8002, 8003},
+		"server": map[string]any{"host": "localhost"},
+	}
+	got, _ := json.Marshal(data)
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	_, err = ParseNative("a = 1\nports = [1, # never closed\n2")
+	var perr *ParseError
+	if !errors.As(err, &perr) || perr.Line != 2 {
+		t.Errorf("expected an unterminated array error on line 2, got %v", err)
+	}
+}
+
+func TestParse_InlineTables(t *testing.T) {
+	input := `point = { x = 1, y = 2 }
+empty = {}
+spaced = {   }
+name = { first = "Tom, \"T\"", last = "Preston-Werner" } # comment
+nested = { inner = { deep = { ok = true } }, list = [1, 2] }
+points = [ { x = 1, y = 2 }, { x = 3, y = 4 }, {} ]
+grid = [[1, 2], [3]]
+`
+	expected := map[string]any{
+		"point":  map[string]any{"x": 1, "y": 2},
+		"empty":  map[string]any{},
+		"spaced": map[string]any{},
+		"name":   map[string]any{"first": `Tom, "T"`, "last": "Preston-Werner"},
+		"nested": map[string]any{
+			"inner": map[string]any{"deep": map[string]any{"ok": true}},
+			"list":  []any{1, 2},
+		},
+		"points": []any{
+			map[string]any{"x": 1, "y": 2},
+			map[string]any{"x": 3, "y": 4},
+			map[string]any{},
+		},
+		"grid": []any{[]any{1, 2}, []any{3}},
+	}
+
+	got, err := Parse(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestParse_InlineTableErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		line  int
+	}{
+		{"trailing comma", "a = 1\np = { x = 1, }", 2},
+		{"trailing comma when nested", "p = { q = { x = 1, } }", 1},
+		{"empty entry", "p = { x = 1,, y = 2 }", 1},
+		{"missing equals", "p = { x }", 1},
+		{"empty key", "p = { = 1 }", 1},
+		{"duplicate key", "a = 1\nb = 2\np = { x = 1, x = 2 }", 3},
+		{"bad value", "p = { x = nope }", 1},
+		{"inside an array", "a = [{ x = 1, }]", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseNative(tt.input)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a ParseError, got %v", err)
+			}
+			if perr.Line != tt.line {
+				t.Errorf("expected the error on line %d, got %d", tt.line, perr.Line)
+			}
+		})
+	}
+}
+
+func TestParseNative_Numbers(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected any
+	}{
+		{"42", 42},
+		{"-17", -17},
+		{"1_000", 1000},
+		{"1_000_000", 1000000},
+		{"0xDEADBEEF", 0xDEADBEEF},
+		{"0xdead_beef", 0xDEADBEEF},
+		{"0o755", 0o755},
+		{"0b1010", 10},
+		{"0b1_0_1_0", 10},
+		{"0", 0},
+		{"3.25", 3.25},
+		{"3_000.5", 3000.5},
+		{"-1.5e3", -1500.0},
+		{"5e+2_2", 5e22},
+		{"6.626e-34", 6.626e-34},
+		{"9_223_372_036_854_775_807", 9223372036854775807},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			data, err := ParseNative("n = " + tt.value)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if data["n"] != tt.expected {
+				t.Errorf("expected %v (%T), got %v (%T)", tt.expected, tt.expected, data["n"], data["n"])
+			}
+		})
+	}
+}
+
+func TestParseNative_NumberErrors(t *testing.T) {
+	for _, value := range []string{
+		"_1000", "1000_", "1__0", "1_.5", "1._5",
+		"0x", "0o", "0b", "0x_1", "0xG", "0o8", "0b2", "0x-1", "0xFFFFFFFFFFFFFFFFF",
+		"9223372036854775808", "-9_223_372_036_854_775_809",
+	} {
+		t.Run(value, func(t *testing.T) {
+			_, err := ParseNative("a = 1\nn = " + value)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a ParseError, got %v", err)
+			}
+			if perr.Line != 2 {
+				t.Errorf("expected the error on line 2, got %d", perr.Line)
+			}
+		})
+	}
+}
+
+func TestParseNative_LiteralStrings(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"windows path", `s = 'C:\Users\foo'`, `C:\Users\foo`},
+		{"no escapes", `s = '\n\t\u00e9'`, `\n\t\u00e9`},
+		{"double quotes", `s = 'Tom "Dubs" Preston'`, `Tom "Dubs" Preston`},
+		{"empty", `s = ''`, ""},
+		{"hash and comment", `s = 'a # b' # c`, "a # b"},
+		{"trailing backslash", `s = 'C:\' # root`, `C:\`},
+		{"multi-line", "s = '''\nfirst \\\n  second\n'''", "first \\\n  second\n"},
+		{"multi-line on one line", `s = '''I [dw]on't need \d{2} apples'''`, `I [dw]on't need \d{2} apples`},
+		{"multi-line empty", `s = ''''''`, ""},
+		{"multi-line quotes before the closer", `s = '''say ''hi'''''`, `say ''hi''`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ParseNative(tt.input + "\nafter = 1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := data["s"]; got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+			if data["after"] != 1 {
+				t.Errorf("expected parsing to go on after the string, got %v", data["after"])
+			}
+		})
+	}
+
+	data, err := ParseNative(`paths = ['C:\a', 'b,c', "d"]` + "\n" + `t = { dir = 'C:\x\', n = 1 }`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, _ := json.Marshal(data)
+	want, _ := json.Marshal(map[string]any{
+		"paths": []any{`C:\a`, "b,c", "d"},
+		"t":     map[string]any{"dir": `C:\x\`, "n": 1},
+	})
+	if string(got) != string(want) {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestParseNative_LiteralStringErrors(t *testing.T) {
+	for _, input := range []string{
+		"a = 1\ns = 'it's'",
+		"a = 1\ns = '''\nnever closed",
+		"a = 1\ns = '''a''' b",
+	} {
+		_, err := ParseNative(input)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Line != 2 {
+			t.Errorf("%q: expected a ParseError on line 2, got %v", input, err)
+		}
+	}
+}
+
+func TestParseNative_BasicStringEscapes(t *testing.T) {
+	data, err := ParseNative(`plain = "no escapes"
+lines = "line1\nline2"
+all = "\b\t\n\f\r\"\\"
+unicode = "caf\u00e9 \U0001F600"
+path = "C:\\Users\\foo" # comment
+list = ["a\tb", "say \"hi, there\"", 'raw\n', "\\"]
+table = { s = "x\ny" }
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]any{
+		"plain":   "no escapes",
+		"lines":   "line1\nline2",
+		"all":     "\b\t\n\f\r\"\\",
+		"unicode": "café 😀",
+		"path":    `C:\Users\foo`,
+		"list":    []any{"a\tb", `say "hi, there"`, `raw\n`, `\`},
+		"table":   map[string]any{"s": "x\ny"},
+	}
+	got, _ := json.Marshal(data)
+	want, _ := json.Marshal(expected)
+	if string(got) != string(want) {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestParseNative_BasicStringEscapeErrors(t *testing.T) {
+	for _, value := range []string{
+		`"\q"`, `"\x41"`, `"\u00"`, `"\uZZZZ"`, `"\ "`, `["ok", "\q"]`, `{ s = "\q" }`,
+	} {
+		t.Run(value, func(t *testing.T) {
+			_, err := ParseNative("a = 1\ns = " + value)
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("expected a ParseError, got %v", err)
+			}
+			if perr.Line != 2 {
+				t.Errorf("expected the error on line 2, got %d", perr.Line)
+			}
+		})
+	}
+}
+
+func TestMarshal_RoundTrip(t *testing.T) {
+	input := map[string]any{
+		"title":   "say \"hi\"\n\tC:\\path # not a comment",
+		"unicode": "café \x01",
+		"count":   42,
+		"big":     int64(1) << 40,
+		"ratio":   0.5,
+		"whole":   3.0,
+		"tiny":    1e-30,
+		"on":      false,
+		"when":    time.Date(2023, 5, 29, 10, 0, 0, 0, time.UTC),
+		"tags":    []string{"a", "b,c"},
+		"mixed":   []any{1, "two", []any{3.5, true}, map[string]any{"x": 1}},
+		"empty":   []any{},
+		"point":   map[string]any{},
+		"server": map[string]any{
+			"host": "localhost",
+			"tls":  map[string]any{"enabled": true},
+			"backends": []any{
+				map[string]any{"name": "a", "ports": []any{80, 443}},
+				map[string]any{"name": "b", "owner": map[string]any{"team": "ops"}},
+			},
+		},
+		"users": []map[string]any{{"id": 1}, {"id": 2, "tags": map[string]any{}}},
+	}
+
+	out, err := Marshal(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := ParseNative(string(out))
+	if err != nil {
+		t.Fatalf("could not parse the output: %v\n%s", err, out)
+	}
+	got, _ := json.Marshal(data)
+	want, _ := json.Marshal(input)
+	if string(got) != string(want) {
+		t.Errorf("round trip changed the data\nexpected\n%s\ngot\n%s\nTOML:\n%s", want, got, out)
+	}
+
+	again, _ := Marshal(input)
+	if string(again) != string(out) {
+		t.Errorf("expected the same output every time")
+	}
+}
+
+func TestMarshal_QuotedKeysRoundTrip(t *testing.T) {
+	input := map[string]any{
+		"key with space": "v",
+		"a.b":            1,
+		`say "hi"`:       true,
+		"x=y":            "z",
+		"":               "empty key",
+		"my table": map[string]any{
+			"dotted.key": 2,
+			"café":       map[string]any{"inline key": map[string]any{"p.q": 1}},
+		},
+		"odd [key]": []any{map[string]any{"n.1": 1}, map[string]any{"n.1": 2}},
+		"inline":    []any{1, map[string]any{"in line": 1, "k=v": "a, b"}},
+	}
+	out, err := Marshal(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := ParseNative(string(out))
+	if err != nil {
+		t.Fatalf("could not parse the output: %v\n%s", err, out)
+	}
+	got, _ := json.Marshal(data)
+	want, _ := json.Marshal(input)
+	if string(got) != string(want) {
+		t.Errorf("round trip changed the data\nexpected\n%s\ngot\n%s\nTOML:\n%s", want, got, out)
+	}
+}
+
+func TestMarshal_Layout(t *testing.T) {
+	out, err := Marshal(map[string]any{
+		"b":              map[string]any{"y": 2, "x": 1},
+		"a":              1,
+		"list":           []any{map[string]any{"n": 1}, map[string]any{"n": 2}},
+		"key with space": "v",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := strings.Join([]string{
+		`a = 1`,
+		`"key with space" = "v"`,
+		``,
+		`[b]`,
+		`x = 1`,
+		`y = 2`,
+		``,
+		`[[list]]`,
+		`n = 1`,
+		``,
+		`[[list]]`,
+		`n = 2`,
+		``,
+	}, "\n")
+	if string(out) != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+func TestMarshal_UnsupportedType(t *testing.T) {
+	_, err := Marshal(map[string]any{"t": map[string]any{"c": make(chan int)}})
+	if err == nil || !strings.Contains(err.Error(), "t.c") {
+		t.Errorf("expected an error naming t.c, got %v", err)
+	}
+}